@@ -4,13 +4,17 @@ import (
 	"context"
 	"fmt"
 	"geekai/core/types"
+	"geekai/store/model"
 	"geekai/utils"
 	"geekai/utils/resp"
+	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis/v8"
 	"github.com/golang-jwt/jwt"
+	"gorm.io/gorm"
 )
 
 // 前端用户授权验证
@@ -107,3 +111,53 @@ func AdminAuthMiddleware(secretKey string, redis *redis.Client) gin.HandlerFunc
 		c.Set(types.AdminUserID, claims["user_id"])
 	}
 }
+
+// 开放接口访问令牌验证，错误信息采用 OpenAI 的格式返回
+func ApiTokenAuthMiddleware(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tokenString := strings.TrimSpace(strings.TrimPrefix(c.GetHeader(types.UserAuthHeader), "Bearer "))
+		if tokenString == "" {
+			tokenString = c.GetHeader("x-api-key")
+		}
+		if tokenString == "" {
+			apiTokenError(c, "缺少访问令牌，请在 Authorization 请求头中传入 Bearer Token")
+			return
+		}
+
+		var token model.ApiToken
+		if err := db.Where("token", utils.Sha256(tokenString)).First(&token).Error; err != nil {
+			apiTokenError(c, "无效的访问令牌")
+			return
+		}
+		if !token.Enabled {
+			apiTokenError(c, "访问令牌已被禁用")
+			return
+		}
+		if token.ExpiredAt > 0 && token.ExpiredAt < time.Now().Unix() {
+			apiTokenError(c, "访问令牌已过期")
+			return
+		}
+
+		var user model.User
+		if err := db.Where("id", token.UserId).First(&user).Error; err != nil || !user.Status {
+			apiTokenError(c, "用户不存在或者已被禁用")
+			return
+		}
+
+		db.Model(&token).UpdateColumn("last_used_at", time.Now().Unix())
+		c.Set(types.LoginUserID, token.UserId)
+		c.Set(types.LoginUserCache, user)
+		c.Set(types.ApiTokenCache, token)
+	}
+}
+
+func apiTokenError(c *gin.Context, message string) {
+	c.JSON(http.StatusUnauthorized, gin.H{
+		"error": gin.H{
+			"message": message,
+			"type":    "invalid_request_error",
+			"code":    "invalid_api_key",
+		},
+	})
+	c.Abort()
+}
@@ -9,20 +9,29 @@ package types
 
 // ApiRequest API 请求实体
 type ApiRequest struct {
-	Model               string  `json:"model,omitempty"`
-	Temperature         float32 `json:"temperature"`
-	MaxTokens           int     `json:"max_tokens,omitempty"`
-	MaxCompletionTokens int     `json:"max_completion_tokens,omitempty"` // 兼容GPT O1 模型
-	Stream              bool    `json:"stream,omitempty"`
-	Messages            []any   `json:"messages,omitempty"`
-	Tools               []Tool  `json:"tools,omitempty"`
-	Functions           []any   `json:"functions,omitempty"`       // 兼容中转平台
-	ResponseFormat      any     `json:"response_format,omitempty"` // 响应格式
+	Model               string         `json:"model,omitempty"`
+	Temperature         float32        `json:"temperature"`
+	TopP                float32        `json:"top_p,omitempty"`
+	MaxTokens           int            `json:"max_tokens,omitempty"`
+	MaxCompletionTokens int            `json:"max_completion_tokens,omitempty"` // 兼容GPT O1 模型
+	Stream              bool           `json:"stream,omitempty"`
+	StreamOptions       *StreamOptions `json:"stream_options,omitempty"`
+	Messages            []any          `json:"messages,omitempty"`
+	Tools               []Tool         `json:"tools,omitempty"`
+	Functions           []any          `json:"functions,omitempty"`       // 兼容中转平台
+	ResponseFormat      any            `json:"response_format,omitempty"` // 响应格式
 
 	ToolChoice string `json:"tool_choice,omitempty"`
 
 	Input      map[string]any `json:"input,omitempty"`      //兼容阿里通义千问
 	Parameters map[string]any `json:"parameters,omitempty"` //兼容阿里通义千问
+
+	ThinkingBudget int `json:"-"` // 思考过程的 token 预算，仅 Anthropic/Gemini 原生接口使用
+}
+
+// StreamOptions 流式输出选项，IncludeUsage 为 true 时最后一个数据块会返回 token 用量
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
 }
 
 type Message struct {
@@ -116,3 +125,23 @@ const (
 	PowerSub = PowerMark(0)
 	PowerAdd = PowerMark(1)
 )
+
+// AppReviewStatus 用户创建的应用的审核状态
+type AppReviewStatus int
+
+const (
+	AppReviewNone     = AppReviewStatus(0) // 私有应用，没有提交审核
+	AppReviewPending  = AppReviewStatus(1) // 等待审核
+	AppReviewApproved = AppReviewStatus(2) // 审核通过，公开给所有用户
+	AppReviewRejected = AppReviewStatus(3) // 审核未通过
+)
+
+// AppVariable 应用提示词里面的表单变量，用户在发送第一条消息之前填写，提示词中使用 {{name}} 引用
+type AppVariable struct {
+	Name     string   `json:"name"`     // 变量名
+	Label    string   `json:"label"`    // 表单标题
+	Type     string   `json:"type"`     // 表单类型：text, textarea, select
+	Options  []string `json:"options"`  // 下拉选项
+	Required bool     `json:"required"` // 是否必填
+	Default  string   `json:"default"`  // 默认值
+}
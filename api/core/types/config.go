@@ -17,17 +17,38 @@ type AppConfig struct {
 	Session         Session
 	AdminSession    Session
 	ProxyURL        string
-	MysqlDns        string       // mysql 连接地址
-	StaticDir       string       // 静态资源目录
-	StaticUrl       string       // 静态资源 URL
-	Redis           RedisConfig  // redis 连接信息
-	SMS             SMSConfig    // send mobile message config
-	OSS             OSSConfig    // OSS config
-	SmtpConfig      SmtpConfig   // 邮件发送配置
-	AlipayConfig    AlipayConfig // 支付宝支付渠道配置
-	GeekPayConfig   EpayConfig   // GEEK 支付配置
-	WechatPayConfig WxPayConfig  // 微信支付渠道配置
-	TikaHost        string       // TiKa 服务器地址
+	MysqlDns        string               // mysql 连接地址
+	StaticDir       string               // 静态资源目录
+	StaticUrl       string               // 静态资源 URL
+	Redis           RedisConfig          // redis 连接信息
+	SMS             SMSConfig            // send mobile message config
+	OSS             OSSConfig            // OSS config
+	SmtpConfig      SmtpConfig           // 邮件发送配置
+	AlipayConfig    AlipayConfig         // 支付宝支付渠道配置
+	GeekPayConfig   EpayConfig           // GEEK 支付配置
+	WechatPayConfig WxPayConfig          // 微信支付渠道配置
+	TikaHost        string               // TiKa 服务器地址，可选，本地不支持解析的文件格式（doc, ppt, xls 等）才会使用
+	VectorStore     VectorConfig         // 知识库向量存储配置
+	Jobs            map[string]JobConfig // 后台任务调度配置，key 为任务类型：mj, sd, dalle, suno, video, jimeng
+	Callback        CallbackConfig       // 生成任务的回调配置
+}
+
+// CallbackConfig 上游服务（MJ-Proxy，Suno，可灵）完成任务之后回调通知，开启之后查询进度只作为兜底
+type CallbackConfig struct {
+	Enabled      bool
+	BaseURL      string // 回调地址前缀，上游服务需要能访问到，如 https://ai.example.com
+	SecretKey    string // 回调地址的签名密钥
+	PollInterval int    // 兜底查询的间隔，单位：秒，默认 60
+}
+
+// JobConfig 后台任务的调度参数，不配置的使用各个服务的默认值
+type JobConfig struct {
+	Concurrency   int // 同时提交的任务数量
+	MaxRetries    int // 失败之后的最大重试次数
+	MaxDeliveries int // 队列消息的最大投递次数，超过之后转入死信队列
+	Timeout       int // 任务超时时间，单位：分钟
+	UserLimit     int // 每个用户同时进行中的任务数量上限，0 表示不限制
+	VipUserLimit  int // 会员和付费用户同时进行中的任务数量上限，不配置的使用 UserLimit
 }
 
 type RedisConfig struct {
@@ -84,6 +105,7 @@ type BaseConfig struct {
 
 	EnableContext bool `json:"enable_context,omitempty"`
 	ContextDeep   int  `json:"context_deep,omitempty"`
+	ToolMaxDepth  int  `json:"tool_max_depth,omitempty"` // 单次对话最多连续调用工具的轮数
 
 	SdNegPrompt string `json:"sd_neg_prompt"` // SD 默认反向提示词
 	MjMode      string `json:"mj_mode"`       // midjourney 默认的API模式，relax, fast, turbo
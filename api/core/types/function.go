@@ -8,6 +8,8 @@ package types
 // * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
 
 type ToolCall struct {
+	Index    int    `json:"index,omitempty"` // 流式输出时的工具调用序号
+	Id       string `json:"id,omitempty"`
 	Type     string `json:"type"`
 	Function struct {
 		Name      string `json:"name"`
@@ -25,3 +27,14 @@ type Function struct {
 	Description string                 `json:"description"`
 	Parameters  map[string]interface{} `json:"parameters"`
 }
+
+// ToolTrace 一次工具调用的记录，保存在回复消息中，作为后续对话的上下文
+type ToolTrace struct {
+	Round     int    `json:"round"` // 第几轮工具调用，从 1 开始
+	Id        string `json:"id"`
+	Name      string `json:"name"`
+	Label     string `json:"label"`
+	Arguments string `json:"arguments"`
+	Result    string `json:"result"`
+	Error     string `json:"error,omitempty"`
+}
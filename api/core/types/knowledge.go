@@ -0,0 +1,30 @@
+package types
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+// VectorConfig 知识库向量存储配置，默认使用本地存储（MySQL + 内存检索）
+type VectorConfig struct {
+	Active string       // local, qdrant
+	Qdrant QdrantConfig // Qdrant 向量数据库
+}
+
+type QdrantConfig struct {
+	URL    string // 如 http://localhost:6333
+	ApiKey string
+}
+
+// Citation 知识库检索命中的分段，作为回答的引用来源保存在回复消息中
+type Citation struct {
+	Index   int     `json:"index"` // 引用编号，从 1 开始，对应回答中的 [1]
+	KbId    uint    `json:"kb_id"`
+	DocId   uint    `json:"doc_id"`
+	DocName string  `json:"doc_name"`
+	ChunkId uint    `json:"chunk_id"`
+	Content string  `json:"content"`
+	Score   float64 `json:"score"`
+}
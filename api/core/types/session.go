@@ -10,6 +10,7 @@ package types
 const LoginUserID = "LOGIN_USER_ID"
 const AdminUserID = "ADMIN_USER_ID"
 const LoginUserCache = "LOGIN_USER_CACHE"
+const ApiTokenCache = "API_TOKEN_CACHE"
 
 const UserAuthHeader = "Authorization"
 const AdminAuthHeader = "Admin-Authorization"
@@ -38,6 +38,7 @@ type MjTask struct {
 	ChannelId        string   `json:"channel_id"`         // 渠道ID，用来区分是哪个渠道创建的任务，一个任务的 create 和 action 操作必须要再同一个渠道
 	Mode             string   `json:"mode"`               // 绘画模式，relax, fast, turbo
 	TranslateModelId int      `json:"translate_model_id"` // 提示词翻译模型ID
+	NotifyHook       string   `json:"-"`                  // 任务回调地址，提交的时候生成
 }
 
 type SdTask struct {
@@ -100,6 +101,7 @@ type SunoTask struct {
 	ExtendSecs   int    `json:"extend_secs,omitempty"` // 延长秒杀
 	SongId       string `json:"song_id,omitempty"`     // 合并歌曲ID
 	AudioURL     string `json:"audio_url"`             // 用户上传音频地址
+	NotifyHook   string `json:"-"`                     // 任务回调地址，提交的时候生成
 }
 
 const (
@@ -118,6 +120,7 @@ type VideoTask struct {
 	Prompt           string      `json:"prompt"` // 提示词
 	Params           interface{} `json:"params"`
 	TranslateModelId int         `json:"translate_model_id"` // 提示词翻译模型ID
+	NotifyHook       string      `json:"-"`                  // 任务回调地址，提交的时候生成
 }
 
 type LumaVideoParams struct {
@@ -28,12 +28,14 @@ require (
 	github.com/go-pay/gopay v1.5.101
 	github.com/golang-jwt/jwt v3.2.2+incompatible
 	github.com/google/go-tika v0.3.1
+	github.com/ledongthuc/pdf v0.0.0-20240201131950-da5b75280b06
 	github.com/microcosm-cc/bluemonday v1.0.26
 	github.com/sashabaranov/go-openai v1.38.1
 	github.com/shirou/gopsutil v3.21.11+incompatible
 	github.com/shopspring/decimal v1.3.1
 	github.com/syndtr/goleveldb v1.0.0
 	github.com/volcengine/volcengine-go-sdk v1.1.34
+	github.com/yuin/goldmark v1.7.4
 	golang.org/x/image v0.15.0
 )
 
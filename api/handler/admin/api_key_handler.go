@@ -13,6 +13,7 @@ import (
 	"geekai/core/middleware"
 	"geekai/core/types"
 	"geekai/handler"
+	"geekai/service"
 	"geekai/store/model"
 	"geekai/store/vo"
 	"geekai/utils"
@@ -25,10 +26,11 @@ import (
 
 type ApiKeyHandler struct {
 	handler.BaseHandler
+	apiKeyService *service.ApiKeyService
 }
 
-func NewApiKeyHandler(app *core.AppServer, db *gorm.DB) *ApiKeyHandler {
-	return &ApiKeyHandler{BaseHandler: handler.BaseHandler{DB: db, App: app}}
+func NewApiKeyHandler(app *core.AppServer, db *gorm.DB, apiKeyService *service.ApiKeyService) *ApiKeyHandler {
+	return &ApiKeyHandler{BaseHandler: handler.BaseHandler{DB: db, App: app}, apiKeyService: apiKeyService}
 }
 
 // RegisterRoutes 注册路由
@@ -50,10 +52,14 @@ func (h *ApiKeyHandler) Save(c *gin.Context) {
 		Id       uint   `json:"id"`
 		Name     string `json:"name"`
 		Type     string `json:"type"`
+		Provider string `json:"provider"`
 		Value    string `json:"value"`
 		ApiURL   string `json:"api_url"`
 		Enabled  bool   `json:"enabled"`
 		ProxyURL string `json:"proxy_url"`
+		Weight   int    `json:"weight"`
+		Rpm      int    `json:"rpm"`
+		Tpm      int    `json:"tpm"`
 	}
 	if err := c.ShouldBindJSON(&data); err != nil {
 		resp.ERROR(c, types.InvalidArgs)
@@ -66,10 +72,17 @@ func (h *ApiKeyHandler) Save(c *gin.Context) {
 	}
 	apiKey.Value = data.Value
 	apiKey.Type = data.Type
+	apiKey.Provider = data.Provider
 	apiKey.ApiURL = data.ApiURL
 	apiKey.Enabled = data.Enabled
 	apiKey.ProxyURL = data.ProxyURL
+	apiKey.Weight = max(data.Weight, 1)
+	apiKey.Rpm = max(data.Rpm, 0)
+	apiKey.Tpm = max(data.Tpm, 0)
 	apiKey.Name = data.Name
+	if apiKey.Enabled {
+		apiKey.DisabledReason = ""
+	}
 	err := h.DB.Save(&apiKey).Error
 	if err != nil {
 		resp.ERROR(c, err.Error())
@@ -82,6 +95,9 @@ func (h *ApiKeyHandler) Save(c *gin.Context) {
 		resp.ERROR(c, fmt.Sprintf("拷贝数据失败：%v", err))
 		return
 	}
+	if apiKey.Enabled {
+		h.apiKeyService.Reset(apiKey.Id)
+	}
 	keyVo.Id = apiKey.Id
 	keyVo.CreatedAt = apiKey.CreatedAt.Unix()
 	resp.SUCCESS(c, keyVo)
@@ -138,6 +154,11 @@ func (h *ApiKeyHandler) Set(c *gin.Context) {
 		resp.ERROR(c, err.Error())
 		return
 	}
+	// 手动启用 KEY 的时候清除自动禁用的原因和熔断状态
+	if data.Filed == "enabled" && utils.BoolValue(utils.InterfaceToString(data.Value)) {
+		h.DB.Model(&model.ApiKey{}).Where("id = ?", data.Id).UpdateColumn("disabled_reason", "")
+		h.apiKeyService.Reset(data.Id)
+	}
 	resp.SUCCESS(c)
 }
 
@@ -43,6 +43,7 @@ func (h *ChatAppHandler) RegisterRoutes() {
 		group.POST("sort", h.Sort)
 		group.POST("set", h.Set)
 		group.GET("remove", h.Remove)
+		group.POST("review", h.Review)
 	}
 }
 
@@ -53,6 +54,10 @@ func (h *ChatAppHandler) Save(c *gin.Context) {
 		resp.ERROR(c, types.InvalidArgs)
 		return
 	}
+	if err := handler.CheckAppParams(data.TopP, data.MaxTokens, data.ResponseFormat, data.Variables); err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
 	var role model.ChatApp
 	err := utils.CopyObject(data, &role)
 	if err != nil {
@@ -60,6 +65,11 @@ func (h *ChatAppHandler) Save(c *gin.Context) {
 		return
 	}
 	role.Id = data.Id
+	// CopyObject 不会转换整数数组
+	role.KnowledgeIds = utils.JsonEncode(data.KnowledgeIds)
+	role.Tools = utils.JsonEncode(data.Tools)
+	role.FunctionIds = utils.JsonEncode(data.FunctionIds)
+	role.Variables = utils.JsonEncode(data.Variables)
 	if data.CreatedAt > 0 {
 		role.CreatedAt = time.Unix(data.CreatedAt, 0)
 	} else {
@@ -83,7 +93,12 @@ func (h *ChatAppHandler) Save(c *gin.Context) {
 func (h *ChatAppHandler) List(c *gin.Context) {
 	var items []model.ChatApp
 	var roles = make([]vo.ChatApp, 0)
-	res := h.DB.Order("sort_num ASC").Find(&items)
+	// 用户的私有应用不在后台显示，提交过审核的才显示
+	session := h.DB.Where("user_id = 0 OR review_status <> ?", types.AppReviewNone)
+	if status := h.GetInt(c, "review_status", -1); status >= 0 {
+		session = session.Where("review_status", status)
+	}
+	res := session.Order("sort_num ASC").Find(&items)
 	if res.Error != nil {
 		resp.ERROR(c, "No data found")
 		return
@@ -195,3 +210,31 @@ func (h *ChatAppHandler) Remove(c *gin.Context) {
 	}
 	resp.SUCCESS(c)
 }
+
+// Review 审核用户提交的应用，审核通过之后公开给所有用户
+func (h *ChatAppHandler) Review(c *gin.Context) {
+	var data struct {
+		Id     uint   `json:"id"`
+		Pass   bool   `json:"pass"`
+		Remark string `json:"remark"`
+	}
+	if err := c.ShouldBindJSON(&data); err != nil {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+	var app model.ChatApp
+	if h.DB.Where("id", data.Id).Where("user_id > ?", 0).First(&app).Error != nil {
+		resp.ERROR(c, "应用不存在")
+		return
+	}
+	status := types.AppReviewRejected
+	if data.Pass {
+		status = types.AppReviewApproved
+	}
+	err := h.DB.Model(&app).UpdateColumns(map[string]any{"review_status": status, "review_remark": data.Remark}).Error
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c)
+}
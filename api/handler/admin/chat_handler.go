@@ -12,6 +12,7 @@ import (
 	"geekai/core/middleware"
 	"geekai/core/types"
 	"geekai/handler"
+	"geekai/service"
 	"geekai/store/model"
 	"geekai/store/vo"
 	"geekai/utils"
@@ -38,6 +39,7 @@ func (h *ChatHandler) RegisterRoutes() {
 	{
 		group.POST("list", h.List)
 		group.POST("message", h.Messages)
+		group.POST("search", h.Search)
 		group.GET("history", h.History)
 		group.GET("remove", h.RemoveChat)
 		group.GET("message/remove", h.RemoveMessage)
@@ -221,6 +223,55 @@ func (h *ChatHandler) Messages(c *gin.Context) {
 	resp.SUCCESS(c, vo.NewPage(total, data.Page, data.PageSize, list))
 }
 
+// Search 按关键词搜索所有用户的聊天记录
+func (h *ChatHandler) Search(c *gin.Context) {
+	var data struct {
+		Keywords string   `json:"keywords"`
+		UserId   uint     `json:"user_id"`
+		Type     string   `json:"type"`
+		RoleId   uint     `json:"role_id"`
+		Model    string   `json:"model"`
+		CreateAt []string `json:"created_time"`
+		Page     int      `json:"page"`
+		PageSize int      `json:"page_size"`
+	}
+	if err := c.ShouldBindJSON(&data); err != nil {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+
+	params := service.ChatSearchParams{
+		Keywords: data.Keywords,
+		UserId:   data.UserId,
+		Type:     data.Type,
+		RoleId:   data.RoleId,
+		Model:    data.Model,
+		Page:     data.Page,
+		PageSize: data.PageSize,
+	}
+	params.SetDateRange(data.CreateAt)
+	total, items, err := service.SearchChatMessages(h.DB, &params)
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+
+	userIds := make([]uint, 0, len(items))
+	for _, item := range items {
+		userIds = append(userIds, item.UserId)
+	}
+	var users []model.User
+	h.DB.Where("id IN ?", userIds).Find(&users)
+	userMap := make(map[uint]string)
+	for _, user := range users {
+		userMap[user.Id] = user.Username
+	}
+	for i := range items {
+		items[i].Username = userMap[items[i].UserId]
+	}
+	resp.SUCCESS(c, vo.NewPage(total, params.Page, params.PageSize, items))
+}
+
 // History 获取聊天历史记录
 func (h *ChatHandler) History(c *gin.Context) {
 	chatId := c.Query("chat_id") // 会话 ID
@@ -284,6 +335,13 @@ func (h *ChatHandler) RemoveChat(c *gin.Context) {
 // RemoveMessage 删除聊天记录
 func (h *ChatHandler) RemoveMessage(c *gin.Context) {
 	id := h.GetInt(c, "id", 0)
+	var message model.ChatMessage
+	if err := h.DB.Where("id", id).First(&message).Error; err != nil {
+		resp.ERROR(c, "消息不存在")
+		return
+	}
+	// 子消息挂到被删除消息的父消息下面，保持分支完整
+	h.DB.Model(&model.ChatMessage{}).Where("parent_id", message.Id).UpdateColumn("parent_id", message.ParentId)
 	err := h.DB.Unscoped().Where("id = ?", id).Delete(&model.ChatMessage{}).Error
 	if err != nil {
 		resp.ERROR(c, err.Error())
@@ -56,6 +56,9 @@ func (h *ChatModelHandler) Save(c *gin.Context) {
 		Open        bool              `json:"open"`
 		Platform    string            `json:"platform"`
 		Power       int               `json:"power"`
+		InputPower  float64           `json:"input_power"`
+		OutputPower float64           `json:"output_power"`
+		CachedPower float64           `json:"cached_power"`
 		MaxTokens   int               `json:"max_tokens"`  // 最大响应长度
 		MaxContext  int               `json:"max_context"` // 最大上下文长度
 		Desc        string            `json:"desc"`        //模型描述
@@ -82,6 +85,9 @@ func (h *ChatModelHandler) Save(c *gin.Context) {
 	item.Enabled = data.Enabled
 	item.Open = data.Open
 	item.Power = data.Power
+	item.InputPower = max(data.InputPower, 0)
+	item.OutputPower = max(data.OutputPower, 0)
+	item.CachedPower = max(data.CachedPower, 0)
 	item.MaxTokens = data.MaxTokens
 	item.MaxContext = data.MaxContext
 	item.Desc = data.Desc
@@ -95,7 +95,8 @@ func (h *FunctionHandler) Set(c *gin.Context) {
 
 func (h *FunctionHandler) List(c *gin.Context) {
 	var items []model.Function
-	res := h.DB.Find(&items)
+	// MCP 工具在 MCP 服务管理中维护
+	res := h.DB.Where("mcp_server_id", 0).Find(&items)
 	if res.Error != nil {
 		resp.ERROR(c, "No data found")
 		return
@@ -0,0 +1,90 @@
+package admin
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"geekai/core"
+	"geekai/core/middleware"
+	"geekai/core/types"
+	"geekai/handler"
+	"geekai/service/job"
+	"geekai/store/vo"
+	"geekai/utils/resp"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// JobHandler 后台任务队列管理
+type JobHandler struct {
+	handler.BaseHandler
+	engine *job.Engine
+}
+
+func NewJobHandler(app *core.AppServer, db *gorm.DB, engine *job.Engine) *JobHandler {
+	return &JobHandler{BaseHandler: handler.BaseHandler{App: app, DB: db}, engine: engine}
+}
+
+// RegisterRoutes 注册路由
+func (h *JobHandler) RegisterRoutes() {
+	group := h.App.Engine.Group("/api/admin/job/")
+	group.Use(middleware.AdminAuthMiddleware(h.App.Config.AdminSession.SecretKey, h.App.Redis))
+	group.GET("dead-letters", h.DeadLetters)
+	group.POST("dead-letters/requeue", h.Requeue)
+	group.POST("dead-letters/remove", h.Remove)
+}
+
+// DeadLetters 死信列表，type 为任务类型：mj, sd, dalle, suno, video, jimeng
+func (h *JobHandler) DeadLetters(c *gin.Context) {
+	page := h.GetInt(c, "page", 1)
+	pageSize := h.GetInt(c, "page_size", 20)
+	if page < 1 || pageSize < 1 {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+	items, total, err := h.engine.DeadLetters(c.Query("type"), page, pageSize)
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c, vo.NewPage(total, page, pageSize, items))
+}
+
+// Requeue 重新投递死信
+func (h *JobHandler) Requeue(c *gin.Context) {
+	var data struct {
+		Type string `json:"type"`
+		Id   string `json:"id"`
+	}
+	if err := c.ShouldBindJSON(&data); err != nil {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+	if err := h.engine.RequeueDeadLetter(data.Type, data.Id); err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c)
+}
+
+// Remove 删除死信
+func (h *JobHandler) Remove(c *gin.Context) {
+	var data struct {
+		Type string `json:"type"`
+		Id   string `json:"id"`
+	}
+	if err := c.ShouldBindJSON(&data); err != nil {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+	if err := h.engine.RemoveDeadLetter(data.Type, data.Id); err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c)
+}
@@ -0,0 +1,170 @@
+package admin
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"geekai/core"
+	"geekai/core/middleware"
+	"geekai/core/types"
+	"geekai/handler"
+	"geekai/service/oss"
+	"geekai/service/rag"
+	"geekai/store/model"
+	"geekai/store/vo"
+	"geekai/utils/resp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// KnowledgeHandler 管理员维护的知识库，可以绑定到应用
+type KnowledgeHandler struct {
+	handler.BaseHandler
+	ragService      *rag.Service
+	uploaderManager *oss.UploaderManager
+}
+
+func NewKnowledgeHandler(app *core.AppServer, db *gorm.DB, ragService *rag.Service, manager *oss.UploaderManager) *KnowledgeHandler {
+	return &KnowledgeHandler{BaseHandler: handler.BaseHandler{DB: db, App: app}, ragService: ragService, uploaderManager: manager}
+}
+
+// RegisterRoutes 注册路由
+func (h *KnowledgeHandler) RegisterRoutes() {
+	group := h.App.Engine.Group("/api/admin/knowledge/")
+
+	// 需要管理员授权的接口
+	group.Use(middleware.AdminAuthMiddleware(h.App.Config.AdminSession.SecretKey, h.App.Redis))
+	{
+		group.GET("list", h.List)
+		group.POST("save", h.Save)
+		group.GET("remove", h.Remove)
+		group.GET("docs", h.Docs)
+		group.POST("doc/upload", h.Upload)
+		group.GET("doc/remove", h.RemoveDoc)
+		group.GET("doc/retry", h.RetryDoc)
+	}
+}
+
+// List 知识库列表
+func (h *KnowledgeHandler) List(c *gin.Context) {
+	var items []model.KnowledgeBase
+	h.DB.Where("user_id", 0).Order("id DESC").Find(&items)
+	resp.SUCCESS(c, handler.KnowledgeBaseVos(h.DB, items))
+}
+
+// Save 新建或者修改知识库
+func (h *KnowledgeHandler) Save(c *gin.Context) {
+	var data vo.KnowledgeBase
+	if err := c.ShouldBindJSON(&data); err != nil {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+	data.Name = strings.TrimSpace(data.Name)
+	if data.Name == "" {
+		resp.ERROR(c, "知识库名称不能为空")
+		return
+	}
+
+	kb := model.KnowledgeBase{}
+	if data.Id > 0 {
+		if err := h.DB.Where("id", data.Id).Where("user_id", 0).First(&kb).Error; err != nil {
+			resp.ERROR(c, "知识库不存在")
+			return
+		}
+	}
+	// 已经有文档的知识库不能更换向量模型，不同模型的向量无法混用
+	if kb.Id == 0 || kb.DocNum == 0 {
+		var count int64
+		h.DB.Model(&model.ChatModel{}).Where("id", data.ModelId).Where("type", "embedding").Count(&count)
+		if count == 0 {
+			resp.ERROR(c, "请选择向量模型")
+			return
+		}
+		kb.ModelId = data.ModelId
+	}
+	if err := handler.FillKnowledgeBase(&kb, data); err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	if err := h.DB.Save(&kb).Error; err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c, handler.KnowledgeBaseVos(h.DB, []model.KnowledgeBase{kb})[0])
+}
+
+// Remove 删除知识库
+func (h *KnowledgeHandler) Remove(c *gin.Context) {
+	id := h.GetInt(c, "id", 0)
+	if id <= 0 {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+	if err := h.ragService.RemoveKb(uint(id)); err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c)
+}
+
+// Docs 知识库的文档列表
+func (h *KnowledgeHandler) Docs(c *gin.Context) {
+	var items []model.KnowledgeDoc
+	h.DB.Where("kb_id", h.GetInt(c, "kb_id", 0)).Order("id DESC").Find(&items)
+	resp.SUCCESS(c, handler.KnowledgeDocVos(items))
+}
+
+// Upload 上传文档到知识库
+func (h *KnowledgeHandler) Upload(c *gin.Context) {
+	var kb model.KnowledgeBase
+	if err := h.DB.Where("id", h.PostInt(c, "kb_id", 0)).First(&kb).Error; err != nil {
+		resp.ERROR(c, "知识库不存在")
+		return
+	}
+	file, err := h.uploaderManager.GetUploadHandler().PutFile(c, "file")
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	// 管理员上传的文档不扣减算力
+	doc, err := h.ragService.AddDoc(kb, 0, file)
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c, handler.KnowledgeDocVos([]model.KnowledgeDoc{doc})[0])
+}
+
+// RemoveDoc 删除文档
+func (h *KnowledgeHandler) RemoveDoc(c *gin.Context) {
+	var doc model.KnowledgeDoc
+	if err := h.DB.Where("id", h.GetInt(c, "id", 0)).First(&doc).Error; err != nil {
+		resp.ERROR(c, "文档不存在")
+		return
+	}
+	if err := h.ragService.RemoveDoc(doc); err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c)
+}
+
+// RetryDoc 重新处理失败的文档
+func (h *KnowledgeHandler) RetryDoc(c *gin.Context) {
+	var doc model.KnowledgeDoc
+	if err := h.DB.Where("id", h.GetInt(c, "id", 0)).First(&doc).Error; err != nil {
+		resp.ERROR(c, "文档不存在")
+		return
+	}
+	if err := h.ragService.Retry(doc); err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c)
+}
@@ -0,0 +1,178 @@
+package admin
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"geekai/core"
+	"geekai/core/middleware"
+	"geekai/core/types"
+	"geekai/handler"
+	"geekai/service/mcp"
+	"geekai/store/model"
+	"geekai/store/vo"
+	"geekai/utils"
+	"geekai/utils/resp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type McpServerHandler struct {
+	handler.BaseHandler
+	mcpService *mcp.Service
+}
+
+func NewMcpServerHandler(app *core.AppServer, db *gorm.DB, mcpService *mcp.Service) *McpServerHandler {
+	return &McpServerHandler{BaseHandler: handler.BaseHandler{DB: db, App: app}, mcpService: mcpService}
+}
+
+// RegisterRoutes 注册路由
+func (h *McpServerHandler) RegisterRoutes() {
+	group := h.App.Engine.Group("/api/admin/mcp/")
+
+	// 需要管理员授权的接口
+	group.Use(middleware.AdminAuthMiddleware(h.App.Config.AdminSession.SecretKey, h.App.Redis))
+	{
+		group.GET("list", h.List)
+		group.POST("save", h.Save)
+		group.POST("enable", h.Enable)
+		group.GET("sync", h.Sync)
+		group.GET("remove", h.Remove)
+	}
+}
+
+// List MCP 服务列表
+func (h *McpServerHandler) List(c *gin.Context) {
+	var items []model.McpServer
+	h.DB.Order("id ASC").Find(&items)
+	servers := make([]vo.McpServer, 0)
+	for _, item := range items {
+		var server vo.McpServer
+		if err := utils.CopyObject(item, &server); err != nil {
+			continue
+		}
+		server.Id = item.Id
+		server.CreatedAt = item.CreatedAt.Unix()
+		server.UpdatedAt = item.UpdatedAt.Unix()
+		servers = append(servers, server)
+	}
+	resp.SUCCESS(c, servers)
+}
+
+// Save 保存 MCP 服务配置，保存之后重新同步工具列表
+func (h *McpServerHandler) Save(c *gin.Context) {
+	var data vo.McpServer
+	if err := c.ShouldBindJSON(&data); err != nil {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+	data.Name = strings.TrimSpace(data.Name)
+	data.Command = strings.TrimSpace(data.Command)
+	data.URL = strings.TrimSpace(data.URL)
+	if data.Name == "" {
+		resp.ERROR(c, "服务名称不能为空")
+		return
+	}
+	switch data.Transport {
+	case mcp.TransportStdio:
+		if data.Command == "" {
+			resp.ERROR(c, "启动命令不能为空")
+			return
+		}
+	case mcp.TransportHttp, mcp.TransportSse:
+		if !strings.HasPrefix(data.URL, "http://") && !strings.HasPrefix(data.URL, "https://") {
+			resp.ERROR(c, "请输入正确的服务地址")
+			return
+		}
+	default:
+		resp.ERROR(c, "不支持的传输方式")
+		return
+	}
+
+	server := model.McpServer{}
+	if data.Id > 0 {
+		h.DB.Where("id", data.Id).First(&server)
+	}
+	server.Name = data.Name
+	server.Transport = data.Transport
+	server.Command = data.Command
+	server.Args = utils.JsonEncode(data.Args)
+	server.Env = utils.JsonEncode(data.Env)
+	server.URL = data.URL
+	server.Headers = utils.JsonEncode(data.Headers)
+	server.Enabled = data.Enabled
+	if err := h.DB.Save(&server).Error; err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+
+	if server.Enabled {
+		if err := h.mcpService.Sync(server.Id); err != nil {
+			logger.Errorf("同步 MCP 服务失败：%v", err)
+		}
+	} else {
+		_ = h.mcpService.SetEnabled(server.Id, false)
+	}
+	h.DB.Where("id", server.Id).First(&server)
+	_ = utils.CopyObject(server, &data)
+	data.Id = server.Id
+	data.CreatedAt = server.CreatedAt.Unix()
+	data.UpdatedAt = server.UpdatedAt.Unix()
+	resp.SUCCESS(c, data)
+}
+
+// Enable 启用或者禁用 MCP 服务
+func (h *McpServerHandler) Enable(c *gin.Context) {
+	var data struct {
+		Id      uint `json:"id"`
+		Enabled bool `json:"enabled"`
+	}
+	if err := c.ShouldBindJSON(&data); err != nil {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+
+	err := h.DB.Model(&model.McpServer{}).Where("id", data.Id).UpdateColumn("enabled", data.Enabled).Error
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	if err = h.mcpService.SetEnabled(data.Id, data.Enabled); err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c)
+}
+
+// Sync 重新拉取 MCP 服务的工具列表
+func (h *McpServerHandler) Sync(c *gin.Context) {
+	id := h.GetInt(c, "id", 0)
+	if id <= 0 {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+	if err := h.mcpService.Sync(uint(id)); err != nil {
+		resp.ERROR(c, "同步失败："+err.Error())
+		return
+	}
+	resp.SUCCESS(c)
+}
+
+func (h *McpServerHandler) Remove(c *gin.Context) {
+	id := h.GetInt(c, "id", 0)
+	if id <= 0 {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+	if err := h.mcpService.Remove(uint(id)); err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c)
+}
@@ -0,0 +1,165 @@
+package handler
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"fmt"
+	"geekai/core"
+	"geekai/core/middleware"
+	"geekai/core/types"
+	"geekai/store/model"
+	"geekai/store/vo"
+	"geekai/utils"
+	"geekai/utils/resp"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// 每个用户最多可以创建的访问令牌数量
+const maxApiTokensPerUser = 20
+
+// ApiTokenHandler 用户开放接口访问令牌管理
+type ApiTokenHandler struct {
+	BaseHandler
+}
+
+func NewApiTokenHandler(app *core.AppServer, db *gorm.DB) *ApiTokenHandler {
+	return &ApiTokenHandler{BaseHandler: BaseHandler{App: app, DB: db}}
+}
+
+// RegisterRoutes 注册路由
+func (h *ApiTokenHandler) RegisterRoutes() {
+	group := h.App.Engine.Group("/api/token/")
+
+	// 需要用户授权的接口
+	group.Use(middleware.UserAuthMiddleware(h.App.Config.Session.SecretKey, h.App.Redis))
+	{
+		group.GET("list", h.List)
+		group.POST("create", h.Create)
+		group.POST("update", h.Update)
+		group.GET("remove", h.Remove)
+	}
+}
+
+// List 访问令牌列表
+func (h *ApiTokenHandler) List(c *gin.Context) {
+	var items []model.ApiToken
+	var list = make([]vo.ApiToken, 0)
+	err := h.DB.Where("user_id", h.GetLoginUserId(c)).Order("id DESC").Find(&items).Error
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	for _, item := range items {
+		list = append(list, h.toVo(item))
+	}
+	resp.SUCCESS(c, list)
+}
+
+// Create 创建访问令牌，完整的令牌只在创建的时候返回一次
+func (h *ApiTokenHandler) Create(c *gin.Context) {
+	var data struct {
+		Name      string `json:"name"`
+		Models    []uint `json:"models"`
+		ExpiredAt int64  `json:"expired_at"`
+	}
+	if err := c.ShouldBindJSON(&data); err != nil || data.Name == "" {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+
+	userId := h.GetLoginUserId(c)
+	var count int64
+	h.DB.Model(&model.ApiToken{}).Where("user_id", userId).Count(&count)
+	if count >= maxApiTokensPerUser {
+		resp.ERROR(c, fmt.Sprintf("每个用户最多只能创建 %d 个访问令牌", maxApiTokensPerUser))
+		return
+	}
+
+	// 数据库只保存令牌的哈希值，明文令牌只在这里返回一次
+	token := "sk-" + utils.RandomHex(24)
+	item := model.ApiToken{
+		UserId:    userId,
+		Name:      data.Name,
+		Token:     utils.Sha256(token),
+		TokenMask: utils.MaskToken(token),
+		Models:    utils.JsonEncode(data.Models),
+		Enabled:   true,
+		ExpiredAt: data.ExpiredAt,
+	}
+	if err := h.DB.Create(&item).Error; err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	tokenVo := h.toVo(item)
+	tokenVo.Token = token
+	resp.SUCCESS(c, tokenVo)
+}
+
+// Update 更新访问令牌的名称、模型范围、过期时间和启用状态
+func (h *ApiTokenHandler) Update(c *gin.Context) {
+	var data struct {
+		Id        uint   `json:"id"`
+		Name      string `json:"name"`
+		Models    []uint `json:"models"`
+		Enabled   bool   `json:"enabled"`
+		ExpiredAt int64  `json:"expired_at"`
+	}
+	if err := c.ShouldBindJSON(&data); err != nil {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+
+	var item model.ApiToken
+	err := h.DB.Where("id", data.Id).Where("user_id", h.GetLoginUserId(c)).First(&item).Error
+	if err != nil {
+		resp.ERROR(c, "访问令牌不存在")
+		return
+	}
+	item.Name = data.Name
+	item.Models = utils.JsonEncode(data.Models)
+	item.Enabled = data.Enabled
+	item.ExpiredAt = data.ExpiredAt
+	if err = h.DB.Save(&item).Error; err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c)
+}
+
+// Remove 撤销访问令牌
+func (h *ApiTokenHandler) Remove(c *gin.Context) {
+	id := h.GetInt(c, "id", 0)
+	if id <= 0 {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+	err := h.DB.Where("id", id).Where("user_id", h.GetLoginUserId(c)).Delete(&model.ApiToken{}).Error
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c)
+}
+
+func (h *ApiTokenHandler) toVo(item model.ApiToken) vo.ApiToken {
+	var tokenVo vo.ApiToken
+	err := utils.CopyObject(item, &tokenVo)
+	if err != nil {
+		logger.Error(err)
+	}
+	tokenVo.Id = item.Id
+	tokenVo.Token = item.TokenMask
+	if tokenVo.Models == nil {
+		tokenVo.Models = make([]uint, 0)
+	}
+	tokenVo.CreatedAt = item.CreatedAt.Unix()
+	tokenVo.UpdatedAt = item.UpdatedAt.Unix()
+	return tokenVo
+}
@@ -0,0 +1,67 @@
+package handler
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"geekai/core"
+	"geekai/core/types"
+	"geekai/service/job"
+	"geekai/utils"
+	"geekai/utils/resp"
+	"io"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// 回调数据的最大长度
+const callbackMaxBody = 1 << 20
+
+// CallbackHandler 上游服务（MJ-Proxy，Suno，可灵）的任务回调
+type CallbackHandler struct {
+	BaseHandler
+	engine *job.Engine
+}
+
+func NewCallbackHandler(app *core.AppServer, db *gorm.DB, engine *job.Engine) *CallbackHandler {
+	return &CallbackHandler{
+		BaseHandler: BaseHandler{
+			App: app,
+			DB:  db,
+		},
+		engine: engine,
+	}
+}
+
+// RegisterRoutes 注册路由，回调地址通过签名校验，不需要登录
+func (h *CallbackHandler) RegisterRoutes() {
+	group := h.App.Engine.Group("/api/callback/")
+	group.POST(":type/:id", h.Notify)
+}
+
+// Notify 任务回调通知，地址由 job.Engine.CallbackURL 生成
+func (h *CallbackHandler) Notify(c *gin.Context) {
+	name := c.Param("type")
+	id := uint(utils.IntValue(c.Param("id"), 0))
+	if id == 0 || !h.engine.VerifyCallback(name, id, c.Query("sign")) {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, callbackMaxBody))
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	if err = h.engine.Callback(name, id, body); err != nil {
+		logger.Warnf("handle %s job %d callback with error: %v", name, id, err)
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c)
+}
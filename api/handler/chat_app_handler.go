@@ -8,6 +8,8 @@ package handler
 // * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
 
 import (
+	"errors"
+	"fmt"
 	"geekai/core"
 	"geekai/core/middleware"
 	"geekai/core/types"
@@ -15,6 +17,10 @@ import (
 	"geekai/store/vo"
 	"geekai/utils"
 	"geekai/utils/resp"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
@@ -38,14 +44,23 @@ func (h *ChatAppHandler) RegisterRoutes() {
 	{
 		group.GET("list/user", h.ListByUser)
 		group.POST("update", h.UpdateApp)
+		group.GET("mine", h.Mine)
+		group.POST("save", h.Save)
+		group.GET("remove", h.Remove)
+		group.POST("clone", h.Clone)
+		group.POST("submit", h.Submit)
 	}
 }
 
+// 公开的应用：系统应用和审核通过的用户应用
+const publicAppCondition = "user_id = 0 OR review_status = ?"
+
 // List 获取用户聊天应用列表
 func (h *ChatAppHandler) List(c *gin.Context) {
 	tid := h.GetInt(c, "tid", 0)
+	userId := h.GetLoginUserId(c)
 	var roles []model.ChatApp
-	session := h.DB.Where("enable", true)
+	session := h.DB.Where("enable", true).Where(publicAppCondition, types.AppReviewApproved)
 	if tid > 0 {
 		session = session.Where("tid", tid)
 	}
@@ -61,7 +76,7 @@ func (h *ChatAppHandler) List(c *gin.Context) {
 		err := utils.CopyObject(r, &v)
 		if err == nil {
 			v.Id = r.Id
-			roleVos = append(roleVos, v)
+			roleVos = append(roleVos, hideContext(v, userId))
 		}
 	}
 	resp.SUCCESS(c, roleVos)
@@ -72,7 +87,9 @@ func (h *ChatAppHandler) ListByUser(c *gin.Context) {
 	id := h.GetInt(c, "id", 0)
 	userId := h.GetLoginUserId(c)
 	var roles []model.ChatApp
-	session := h.DB.Where("enable", true)
+	// 用户自己创建的应用总是可用
+	visible := h.DB.Where(publicAppCondition, types.AppReviewApproved).Or("user_id", userId)
+	session := h.DB.Where("enable", true).Where(visible)
 	// 如果用户没登录，则获取所有角色
 	if userId > 0 {
 		var user model.User
@@ -87,12 +104,12 @@ func (h *ChatAppHandler) ListByUser(c *gin.Context) {
 		}
 		// 保证用户至少有一个角色可用
 		if len(roleKeys) > 0 {
-			session = session.Where("marker IN ?", roleKeys)
+			session = session.Where(h.DB.Where("marker IN ?", roleKeys).Or("user_id", userId))
 		}
 	}
 
 	if id > 0 {
-		session = session.Or("id", id)
+		session = session.Or(h.DB.Where("id", id).Where(visible))
 	}
 	res := session.Order("sort_num ASC").Find(&roles)
 	if res.Error != nil {
@@ -106,7 +123,7 @@ func (h *ChatAppHandler) ListByUser(c *gin.Context) {
 		err := utils.CopyObject(r, &v)
 		if err == nil {
 			v.Id = r.Id
-			roleVos = append(roleVos, v)
+			roleVos = append(roleVos, hideContext(v, userId))
 		}
 	}
 	resp.SUCCESS(c, roleVos)
@@ -136,3 +153,261 @@ func (h *ChatAppHandler) UpdateApp(c *gin.Context) {
 
 	resp.SUCCESS(c)
 }
+
+// 每个用户最多创建的应用数量
+const userAppMaxNum = 50
+
+// Mine 当前用户创建的应用
+func (h *ChatAppHandler) Mine(c *gin.Context) {
+	var items []model.ChatApp
+	err := h.DB.Where("user_id", h.GetLoginUserId(c)).Order("id DESC").Find(&items).Error
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	var appVos = make([]vo.ChatApp, 0)
+	for _, item := range items {
+		appVos = append(appVos, appVo(item))
+	}
+	resp.SUCCESS(c, appVos)
+}
+
+// Save 创建或者更新自己的应用，审核通过或者等待审核的应用修改之后需要重新提交审核
+func (h *ChatAppHandler) Save(c *gin.Context) {
+	var data struct {
+		Id          uint    `json:"id"`
+		Name        string  `json:"name"`
+		Prompt      string  `json:"prompt"` // 系统提示词
+		HelloMsg    string  `json:"hello_msg"`
+		Icon        string  `json:"icon"`
+		ModelId     uint    `json:"model_id"`
+		Tools       []uint  `json:"tools"`
+		Temperature float32 `json:"temperature"`
+		// 覆盖模型的请求参数
+		TopP           float32             `json:"top_p"`
+		MaxTokens      int                 `json:"max_tokens"`
+		ResponseFormat string              `json:"response_format"`
+		FunctionIds    []uint              `json:"function_ids"`
+		Variables      []types.AppVariable `json:"variables"`
+	}
+	if err := c.ShouldBindJSON(&data); err != nil {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+	data.Name = strings.TrimSpace(data.Name)
+	if data.Name == "" || utf8.RuneCountInString(data.Name) > 30 {
+		resp.ERROR(c, "应用名称不能为空，并且不能超过 30 个字符")
+		return
+	}
+	if utf8.RuneCountInString(data.HelloMsg) > 255 {
+		resp.ERROR(c, "打招呼信息不能超过 255 个字符")
+		return
+	}
+	if data.Temperature < 0 || data.Temperature > 2 {
+		resp.ERROR(c, "模型温度的取值范围为 0 ~ 2")
+		return
+	}
+	if err := CheckAppParams(data.TopP, data.MaxTokens, data.ResponseFormat, data.Variables); err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	if data.ModelId > 0 {
+		var chatModel model.ChatModel
+		if h.DB.Where("id", data.ModelId).Where("enabled", true).First(&chatModel).Error != nil {
+			resp.ERROR(c, "绑定的模型不存在或者未启用")
+			return
+		}
+	}
+
+	userId := h.GetLoginUserId(c)
+	var app model.ChatApp
+	if data.Id > 0 {
+		if h.DB.Where("id", data.Id).Where("user_id", userId).First(&app).Error != nil {
+			resp.ERROR(c, "应用不存在")
+			return
+		}
+	} else {
+		var total int64
+		h.DB.Model(&model.ChatApp{}).Where("user_id", userId).Count(&total)
+		if total >= userAppMaxNum {
+			resp.ERROR(c, fmt.Sprintf("最多只能创建 %d 个应用", userAppMaxNum))
+			return
+		}
+		app = model.ChatApp{UserId: userId, Key: "u_" + utils.RandomHex(8), Enable: true}
+	}
+
+	app.Name = data.Name
+	app.HelloMsg = data.HelloMsg
+	app.Icon = data.Icon
+	app.ModelId = data.ModelId
+	app.Temperature = data.Temperature
+	app.Tools = utils.JsonEncode(data.Tools)
+	app.TopP = data.TopP
+	app.MaxTokens = data.MaxTokens
+	app.ResponseFormat = data.ResponseFormat
+	app.FunctionIds = utils.JsonEncode(data.FunctionIds)
+	app.Variables = utils.JsonEncode(data.Variables)
+	app.Context = "[]"
+	if prompt := strings.TrimSpace(data.Prompt); prompt != "" {
+		app.Context = utils.JsonEncode([]types.Message{{Role: "system", Content: prompt}})
+	}
+	if app.Icon == "" {
+		app.Icon = "/images/avatar/gpt.png"
+	}
+	if app.ReviewStatus == types.AppReviewApproved || app.ReviewStatus == types.AppReviewPending {
+		app.ReviewStatus = types.AppReviewPending
+		app.ReviewRemark = ""
+	}
+	if err := h.DB.Save(&app).Error; err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c, appVo(app))
+}
+
+// Remove 删除自己的应用
+func (h *ChatAppHandler) Remove(c *gin.Context) {
+	id := h.GetInt(c, "id", 0)
+	if id <= 0 {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+	res := h.DB.Where("id", id).Where("user_id", h.GetLoginUserId(c)).Delete(&model.ChatApp{})
+	if res.Error != nil {
+		resp.ERROR(c, "删除失败！")
+		return
+	}
+	if res.RowsAffected == 0 {
+		resp.ERROR(c, "应用不存在")
+		return
+	}
+	resp.SUCCESS(c)
+}
+
+// Clone 复制一个公开的应用作为自己的私有应用
+func (h *ChatAppHandler) Clone(c *gin.Context) {
+	var data struct {
+		Id uint `json:"id"`
+	}
+	if err := c.ShouldBindJSON(&data); err != nil {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+	userId := h.GetLoginUserId(c)
+	var source model.ChatApp
+	err := h.DB.Where("id", data.Id).Where("enable", true).
+		Where(h.DB.Where(publicAppCondition, types.AppReviewApproved).Or("user_id", userId)).
+		First(&source).Error
+	if err != nil {
+		resp.ERROR(c, "应用不存在")
+		return
+	}
+	var total int64
+	h.DB.Model(&model.ChatApp{}).Where("user_id", userId).Count(&total)
+	if total >= userAppMaxNum {
+		resp.ERROR(c, fmt.Sprintf("最多只能创建 %d 个应用", userAppMaxNum))
+		return
+	}
+
+	// 提示词是私有的，只有复制自己的应用才带上提示词
+	context := "[]"
+	if source.UserId == userId {
+		context = source.Context
+	}
+	app := model.ChatApp{
+		Name:           string([]rune(source.Name)[:min(utf8.RuneCountInString(source.Name), 27)]) + "-副本",
+		Key:            "u_" + utils.RandomHex(8),
+		Context:        context,
+		HelloMsg:       source.HelloMsg,
+		Icon:           source.Icon,
+		Enable:         true,
+		ModelId:        source.ModelId,
+		ContextCompact: source.ContextCompact,
+		UserId:         userId,
+		Temperature:    source.Temperature,
+		Tools:          source.Tools,
+		TopP:           source.TopP,
+		MaxTokens:      source.MaxTokens,
+		ResponseFormat: source.ResponseFormat,
+		FunctionIds:    source.FunctionIds,
+		Variables:      source.Variables,
+	}
+	if err = h.DB.Create(&app).Error; err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c, appVo(app))
+}
+
+// Submit 提交审核，审核通过之后公开给所有用户
+func (h *ChatAppHandler) Submit(c *gin.Context) {
+	var data struct {
+		Id uint `json:"id"`
+	}
+	if err := c.ShouldBindJSON(&data); err != nil {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+	var app model.ChatApp
+	if h.DB.Where("id", data.Id).Where("user_id", h.GetLoginUserId(c)).First(&app).Error != nil {
+		resp.ERROR(c, "应用不存在")
+		return
+	}
+	if app.ReviewStatus == types.AppReviewPending || app.ReviewStatus == types.AppReviewApproved {
+		resp.ERROR(c, "应用已经提交过审核")
+		return
+	}
+	err := h.DB.Model(&app).UpdateColumns(map[string]any{"review_status": types.AppReviewPending, "review_remark": ""}).Error
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c)
+}
+
+func appVo(app model.ChatApp) vo.ChatApp {
+	var v vo.ChatApp
+	err := utils.CopyObject(app, &v)
+	if err != nil {
+		logger.Error(err)
+	}
+	v.Id = app.Id
+	v.CreatedAt = app.CreatedAt.Unix()
+	v.UpdatedAt = app.UpdatedAt.Unix()
+	return v
+}
+
+// 应用的提示词是私有的，不是当前用户创建的应用不返回提示词
+func hideContext(v vo.ChatApp, userId uint) vo.ChatApp {
+	if userId == 0 || v.UserId != userId {
+		v.Context = []types.Message{}
+	}
+	return v
+}
+
+// 提示词表单变量的名称，不能跟内置变量重名
+var appVariableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,29}$`)
+
+// CheckAppParams 校验应用的请求参数和表单变量，后台和用户创建应用共用
+func CheckAppParams(topP float32, maxTokens int, responseFormat string, variables []types.AppVariable) error {
+	if topP < 0 || topP > 1 {
+		return errors.New("top_p 的取值范围为 0 ~ 1")
+	}
+	if maxTokens < 0 {
+		return errors.New("最大响应长度不能小于 0")
+	}
+	if responseFormat != "" && responseFormat != "text" && responseFormat != "json_object" {
+		return errors.New("不支持的响应格式")
+	}
+	names := make(map[string]bool)
+	for _, v := range variables {
+		if !appVariableName.MatchString(v.Name) || slices.Contains([]string{"date", "time", "datetime", "weekday"}, v.Name) {
+			return fmt.Errorf("变量名 %s 无效，只能使用字母、数字和下划线，并且不能跟内置变量重名", v.Name)
+		}
+		if names[v.Name] {
+			return fmt.Errorf("变量 %s 重复", v.Name)
+		}
+		names[v.Name] = true
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package handler
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"encoding/json"
+	"fmt"
+	"geekai/service"
+	"geekai/utils/resp"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 导入文件的大小限制
+const maxImportFileSize = 100 * 1024 * 1024
+
+// Export 导出会话，chat_id 为空导出全部会话，format 支持 markdown, html 和 json
+func (h *ChatHandler) Export(c *gin.Context) {
+	chatId := h.GetTrim(c, "chat_id")
+	archive, err := service.ExportChats(h.DB, h.GetLoginUserId(c), chatId)
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+
+	filename := "chats-" + time.Now().Format("20060102150405")
+	if chatId != "" {
+		filename = "chat-" + chatId
+	}
+	switch h.GetTrim(c, "format") {
+	case "markdown", "md":
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s.md", filename))
+		c.Data(http.StatusOK, "text/markdown; charset=utf-8", []byte(archive.RenderMarkdown()))
+	case "html":
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s.html", filename))
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(archive.RenderHTML()))
+	case "json", "":
+		data, err := json.MarshalIndent(archive, "", "  ")
+		if err != nil {
+			resp.ERROR(c, err.Error())
+			return
+		}
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s.json", filename))
+		c.Data(http.StatusOK, "application/json; charset=utf-8", data)
+	default:
+		resp.ERROR(c, "不支持的导出格式")
+	}
+}
+
+// Import 导入会话，支持本系统导出的 JSON 文件和 ChatGPT 的导出文件
+func (h *ChatHandler) Import(c *gin.Context) {
+	file, err := c.FormFile("file")
+	if err != nil {
+		resp.ERROR(c, "请上传要导入的文件")
+		return
+	}
+	if file.Size > maxImportFileSize {
+		resp.ERROR(c, fmt.Sprintf("文件大小不能超过 %dMB", maxImportFileSize/1024/1024))
+		return
+	}
+	user, err := h.GetLoginUser(c)
+	if err != nil {
+		resp.NotAuth(c)
+		return
+	}
+
+	f, err := file.Open()
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	archive, err := service.ParseChatArchive(data)
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	count, err := service.ImportChats(h.DB, user, archive)
+	if err != nil {
+		logger.Errorf("导入会话失败：%v", err)
+		resp.ERROR(c, fmt.Sprintf("已导入 %d 个会话，剩下的会话导入失败：%v", count, err))
+		return
+	}
+	resp.SUCCESS(c, gin.H{"count": count})
+}
@@ -0,0 +1,285 @@
+package handler
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"geekai/core/types"
+	"geekai/service"
+	"geekai/store/model"
+	"geekai/store/vo"
+	"geekai/utils"
+	"geekai/utils/resp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// 单次对比最多同时请求的模型数量
+const compareMaxModels = 4
+
+// Compare 多模型对比，同一个提问（相同的上下文和附件）同时发给多个模型，
+// 所有模型的输出通过同一个 SSE 连接推送，每个事件带上 model_id 区分
+func (h *ChatHandler) Compare(c *gin.Context) {
+	setSSEHeaders(c)
+
+	var input struct {
+		ChatInput
+		ModelIds []uint `json:"model_ids"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		pushMessage(c, ChatEventError, types.InvalidArgs)
+		c.Abort()
+		return
+	}
+	input.UserId = h.GetLoginUserId(c)
+
+	modelIds := make([]uint, 0, len(input.ModelIds))
+	for _, id := range input.ModelIds {
+		if !slices.Contains(modelIds, id) {
+			modelIds = append(modelIds, id)
+		}
+	}
+	if len(modelIds) < 2 || len(modelIds) > compareMaxModels {
+		pushMessage(c, ChatEventError, fmt.Sprintf("请选择 2 到 %d 个模型进行对比！", compareMaxModels))
+		return
+	}
+
+	// 使用旧的聊天数据覆盖角色ID
+	var chat model.ChatItem
+	h.DB.Where("chat_id", input.ChatId).First(&chat)
+	if chat.Id > 0 {
+		if chat.UserId != input.UserId {
+			pushMessage(c, ChatEventError, "会话不存在")
+			return
+		}
+		input.RoleId = chat.RoleId
+	}
+
+	// 验证聊天角色
+	var chatRole model.ChatApp
+	err := h.DB.First(&chatRole, input.RoleId).Error
+	if err != nil || !chatRole.Enable || !canUseApp(chatRole, input.UserId) {
+		pushMessage(c, ChatEventError, "当前聊天角色不存在或者未启用，请更换角色之后再发起对话！")
+		return
+	}
+	input.ChatRole = chatRole
+
+	// 获取模型信息，按照用户选择的顺序排列
+	var items []model.ChatModel
+	h.DB.Where("id IN ?", modelIds).Where("enabled", true).Find(&items)
+	models := make([]model.ChatModel, 0, len(items))
+	for _, id := range modelIds {
+		for _, v := range items {
+			if v.Id == id {
+				models = append(models, v)
+			}
+		}
+	}
+	if len(models) != len(modelIds) {
+		pushMessage(c, ChatEventError, "部分 AI 模型暂未启用，请更换模型后再发起对比！")
+		return
+	}
+	input.ChatModel = models[0]
+	if chat.Id > 0 {
+		input.ModelId = chat.ModelId
+	} else {
+		input.ModelId = models[0].Id
+	}
+
+	h.startGeneration(c, input.ChatInput, func(ctx context.Context, out *chatOutput) error {
+		return h.sendCompareMessage(ctx, input.ChatInput, models, out)
+	})
+}
+
+// 并发请求多个模型，全部结束之后保存提问和每个模型的回复，每个模型分别扣减算力
+func (h *ChatHandler) sendCompareMessage(ctx context.Context, input ChatInput, models []model.ChatModel, out *chatOutput) error {
+	promptCreatedAt := time.Now() // 记录提问时间
+	// 按照上下文长度最小的模型组装上下文，保证每个模型都能完整接收
+	for _, m := range models {
+		if m.MaxContext < input.ChatModel.MaxContext {
+			input.ChatModel = m
+		}
+	}
+	userVo, baseReq, err := h.buildRequest(ctx, &input, out)
+	if err != nil {
+		return err
+	}
+
+	// 每个模型使用自己的请求参数，上下文和工具共用
+	inputs := make([]ChatInput, len(models))
+	requests := make([]types.ApiRequest, len(models))
+	toolTokens, _ := utils.CalcTokens(utils.JsonEncode(baseReq.Tools), baseReq.Model)
+	power := 0
+	for i, m := range models {
+		inputs[i] = input
+		inputs[i].ChatModel = m
+		req := newApiRequest(inputs[i])
+		// 工具调用会往消息里追加内容，每个模型使用单独的副本
+		req.Messages = slices.Clone(baseReq.Messages)
+		if !strings.HasPrefix(m.Value, "o1-") {
+			req.Tools = baseReq.Tools
+			req.ToolChoice = baseReq.ToolChoice
+		}
+		requests[i] = req
+		power += service.EstimateChatPower(m, getTotalTokens(req)+toolTokens)
+	}
+	if userVo.Power < power {
+		return fmt.Errorf("您的算力不足，请购买算力。")
+	}
+
+	modelVos := make([]gin.H, 0, len(models))
+	for _, m := range models {
+		modelVos = append(modelVos, gin.H{"id": m.Id, "name": m.Name, "value": m.Value})
+	}
+	out.push(ChatEventCompare, modelVos)
+
+	replies := make([]*chatReply, len(models))
+	var wg sync.WaitGroup
+	for i := range models {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			mo := out.withModel(models[i].Id)
+			// 单个模型出错不影响其他模型
+			defer func() {
+				if err := recover(); err != nil {
+					logger.Errorf("compare model %s error: %v", models[i].Value, err)
+					mo.push(ChatEventError, fmt.Sprint(err))
+				}
+			}()
+			reply, err := h.streamReply(ctx, requests[i], userVo, inputs[i], mo)
+			if err != nil {
+				mo.push(ChatEventError, err.Error())
+				return
+			}
+			replies[i] = reply
+		}(i)
+	}
+	wg.Wait()
+
+	// 审核通过的回复才保存
+	passed := make([]int, 0, len(replies))
+	billings := make([]service.TokenUsage, len(replies))
+	estimates := make([]bool, len(replies))
+	for i, reply := range replies {
+		if reply == nil {
+			continue
+		}
+		mo := out.withModel(models[i].Id)
+		billings[i], estimates[i] = fillUsage(reply.Request, &reply.Usage, reply.Usage.Content)
+		if h.moderateReply(mo, reply.Usage, inputs[i], userVo, billings[i]) {
+			continue
+		}
+		passed = append(passed, i)
+	}
+	if len(passed) == 0 {
+		if ctx.Err() != nil {
+			return errors.New("已停止生成，没有输出任何内容")
+		}
+		return errors.New("所有模型都没有返回有效的回复")
+	}
+
+	modelIds := make([]uint, 0, len(models))
+	for _, m := range models {
+		modelIds = append(modelIds, m.Id)
+	}
+	compare := model.ChatCompare{UserId: userVo.Id, ChatId: input.ChatId, ModelIds: utils.JsonEncode(modelIds)}
+	if err = h.DB.Create(&compare).Error; err != nil {
+		logger.Error("failed to save chat compare: ", err)
+	}
+	input.CompareId = compare.Id
+
+	first := replies[passed[0]]
+	promptMsg := h.savePrompt(input, userVo, first.Usage.Prompt, first.Usage.PromptTokens, models[passed[0]].Value, promptCreatedAt)
+	var activeMsgId uint
+	for _, i := range passed {
+		inputs[i].CompareId = compare.Id
+		reply := replies[i]
+		replyMsg := h.saveReply(out.withModel(models[i].Id), inputs[i], userVo, promptMsg.Id, reply.Request.Model, reply.Usage, estimates[i], reply.Usage.Content, reply.Traces, reply.CreatedAt)
+		h.subUserPower(userVo, inputs[i], billings[i])
+		// 在用户选出最佳回答之前，先使用第一个模型的回复
+		if activeMsgId == 0 {
+			activeMsgId = replyMsg.Id
+		}
+	}
+	h.DB.Model(&compare).UpdateColumn("prompt_id", promptMsg.Id)
+	h.saveChatItem(input, userVo, first.Usage.Prompt, models[passed[0]].Value, activeMsgId)
+	return nil
+}
+
+// CompareWinner 选出最佳回答，作为会话的正式回复，会话切换到这条回复所在的分支
+func (h *ChatHandler) CompareWinner(c *gin.Context) {
+	var data struct {
+		MsgId uint `json:"msg_id"`
+	}
+	if err := c.ShouldBindJSON(&data); err != nil {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+
+	userId := h.GetLoginUserId(c)
+	var msg model.ChatMessage
+	err := h.DB.Where("id", data.MsgId).Where("user_id", userId).First(&msg).Error
+	if err != nil || msg.CompareId == 0 || msg.Type != types.ReplyMsg {
+		resp.ERROR(c, "对比回复不存在")
+		return
+	}
+	tree, err := service.LoadChatTree(h.DB, msg.ChatId)
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+
+	// 选出最佳回答之后可能已经继续对话了，切换到这条回复下面最新的消息
+	leafId := tree.LatestLeaf(msg.Id)
+	err = h.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&model.ChatCompare{}).Where("id", msg.CompareId).UpdateColumn("winner_id", msg.Id).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&model.ChatItem{}).Where("chat_id", msg.ChatId).UpdateColumn("active_msg_id", leafId).Error
+	})
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c, h.branchMessages(tree, leafId))
+}
+
+// CompareDetail 对比详情，包括所有模型的回复
+func (h *ChatHandler) CompareDetail(c *gin.Context) {
+	var compare model.ChatCompare
+	err := h.DB.Where("id", h.GetInt(c, "id", 0)).Where("user_id", h.GetLoginUserId(c)).First(&compare).Error
+	if err != nil {
+		resp.ERROR(c, "对比记录不存在")
+		return
+	}
+
+	compareVo := vo.ChatCompare{
+		Id:        compare.Id,
+		ChatId:    compare.ChatId,
+		PromptId:  compare.PromptId,
+		WinnerId:  compare.WinnerId,
+		Replies:   make([]vo.ChatMessage, 0),
+		CreatedAt: compare.CreatedAt.Unix(),
+	}
+	_ = utils.JsonDecode(compare.ModelIds, &compareVo.ModelIds)
+	var items []model.ChatMessage
+	h.DB.Where("compare_id", compare.Id).Where("type", types.ReplyMsg).Order("id ASC").Find(&items)
+	for _, item := range items {
+		compareVo.Replies = append(compareVo.Replies, toMessageVo(item))
+	}
+	resp.SUCCESS(c, compareVo)
+}
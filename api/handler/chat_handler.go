@@ -8,26 +8,27 @@ package handler
 // * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"geekai/core"
 	"geekai/core/middleware"
 	"geekai/core/types"
 	"geekai/service"
+	"geekai/service/mcp"
 	"geekai/service/moderation"
 	"geekai/service/oss"
+	"geekai/service/provider"
+	"geekai/service/rag"
 	"geekai/store/model"
 	"geekai/store/vo"
 	"geekai/utils"
 	"geekai/utils/resp"
 	"io"
 	"net/http"
-	"net/url"
 	"os"
 	"path"
+	"slices"
 	"strings"
 	"time"
 	"unicode/utf8"
@@ -45,6 +46,22 @@ const (
 	ChatEventError        = "error"
 	ChatEventMessageDelta = "message_delta"
 	ChatEventTitle        = "title"
+	ChatEventToolCall     = "tool_call"   // 开始调用工具
+	ChatEventToolResult   = "tool_result" // 工具调用结果
+	ChatEventCitations    = "citations"   // 知识库检索结果
+	ChatEventGeneration   = "generation"  // 生成任务 ID，用于断线重连和停止生成
+	ChatEventCompare      = "compare"     // 多模型对比开始，参与对比的模型列表
+)
+
+const (
+	summaryMaxTokens = 1024  // 给上下文摘要预留的 token 数量
+	summaryMaxDialog = 30000 // 单次总结的对话内容最大字符数
+)
+
+const (
+	chatGenerateTimeout = 30 * time.Minute // 单次生成任务的最长时间
+	chatHeartbeatPeriod = 10 * time.Second // 生成任务和用户锁续期的间隔，需要小于租约的有效期
+	chatPingPeriod      = 15 * time.Second // 没有新事件的时候给客户端发送心跳，防止代理断开连接
 )
 
 type ChatInput struct {
@@ -58,7 +75,14 @@ type ChatInput struct {
 	Files     []vo.File       `json:"files"`
 	ChatModel model.ChatModel `json:"chat_model,omitempty"`
 	ChatRole  model.ChatApp   `json:"chat_role,omitempty"`
-	LastMsgId uint            `json:"last_msg_id,omitempty"` // 最后的消息ID，用于重新生成答案的时候过滤上下文
+	LastMsgId uint            `json:"last_msg_id,omitempty"` // 要重新生成的回复 ID，编辑提问时为提问的下一条回复 ID
+	ParentId  uint            `json:"-"`                     // 新的提问消息挂在哪条回复下面
+	CompareId uint            `json:"-"`                     // 多模型对比的 ID
+	// 应用提示词的表单变量，只在创建会话的时候提交
+	Variables map[string]string `json:"variables,omitempty"`
+	// 知识库检索
+	KnowledgeIds []uint           `json:"knowledge_ids,omitempty"` // 用户选择的自己的知识库
+	Citations    []types.Citation `json:"-"`                       // 检索到的知识库分段
 }
 
 type ChatHandler struct {
@@ -66,22 +90,30 @@ type ChatHandler struct {
 	redis             *redis.Client
 	uploadManager     *oss.UploaderManager
 	licenseService    *service.LicenseService
-	ReqCancelFunc     *types.LMap[string, context.CancelFunc] // HttpClient 请求取消 handle function
 	userService       *service.UserService
 	moderationManager *moderation.ServiceManager
-	userLocks         *types.UserLockManager
+	userLocks         *service.UserLockService
+	apiKeyService     *service.ApiKeyService
+	mcpService        *mcp.Service
+	assistantService  *service.AssistantService
+	ragService        *rag.Service
+	chatStream        *service.ChatStreamService
 }
 
-func NewChatHandler(app *core.AppServer, db *gorm.DB, redis *redis.Client, manager *oss.UploaderManager, licenseService *service.LicenseService, userService *service.UserService, moderationManager *moderation.ServiceManager) *ChatHandler {
+func NewChatHandler(app *core.AppServer, db *gorm.DB, redis *redis.Client, manager *oss.UploaderManager, licenseService *service.LicenseService, userService *service.UserService, moderationManager *moderation.ServiceManager, apiKeyService *service.ApiKeyService, mcpService *mcp.Service, assistantService *service.AssistantService, ragService *rag.Service, chatStream *service.ChatStreamService, userLocks *service.UserLockService) *ChatHandler {
 	return &ChatHandler{
 		BaseHandler:       BaseHandler{App: app, DB: db},
 		redis:             redis,
 		uploadManager:     manager,
 		licenseService:    licenseService,
-		ReqCancelFunc:     types.NewLMap[string, context.CancelFunc](),
 		userService:       userService,
 		moderationManager: moderationManager,
-		userLocks:         types.NewUserLockManager(),
+		userLocks:         userLocks,
+		apiKeyService:     apiKeyService,
+		mcpService:        mcpService,
+		assistantService:  assistantService,
+		ragService:        ragService,
+		chatStream:        chatStream,
 	}
 }
 
@@ -91,29 +123,41 @@ func (h *ChatHandler) RegisterRoutes() {
 
 	// 聊天接口不需要授权（已在authConfig中配置）
 	group.Any("message", h.Chat)
+	// 查看分享的对话不需要登录
+	group.GET("share/detail", h.ShareDetail)
 
 	// 其他接口需要用户授权
 	group.Use(middleware.UserAuthMiddleware(h.App.Config.Session.SecretKey, h.App.Redis))
 	{
 		group.GET("list", h.List)
+		group.POST("search", h.Search)
+		group.GET("export", h.Export)
+		group.POST("import", h.Import)
 		group.GET("detail", h.Detail)
 		group.POST("update", h.Update)
 		group.GET("remove", h.Remove)
 		group.GET("history", h.History)
+		group.GET("branches", h.Branches)
+		group.POST("branch", h.SwitchBranch)
 		group.GET("clear", h.Clear)
 		group.POST("tokens", h.Tokens)
 		group.GET("stop", h.StopGenerate)
+		group.GET("resume", h.Resume)
+		group.GET("generation", h.Generation)
+		group.POST("compare", h.Compare)
+		group.POST("compare/winner", h.CompareWinner)
+		group.GET("compare/detail", h.CompareDetail)
 		group.POST("tts", h.TextToSpeech)
+		group.POST("share/create", h.ShareCreate)
+		group.GET("share/list", h.ShareList)
+		group.GET("share/remove", h.ShareRemove)
+		group.POST("share/fork", h.ShareFork)
 	}
 }
 
-// Chat 处理聊天请求
+// Chat 处理聊天请求，生成任务在后台执行，这里只负责把生成的事件转发给客户端
 func (h *ChatHandler) Chat(c *gin.Context) {
-	// 设置SSE响应头
-	c.Header("Prompt-Type", "text/event-stream")
-	c.Header("Cache-Control", "no-cache")
-	c.Header("Connection", "keep-alive")
-	c.Header("X-Accel-Buffering", "no")
+	setSSEHeaders(c)
 
 	var input ChatInput
 	if err := c.ShouldBindJSON(&input); err != nil {
@@ -122,17 +166,6 @@ func (h *ChatHandler) Chat(c *gin.Context) {
 		return
 	}
 
-	// 用户级并发锁，确保同一用户同时只有一个对话请求
-	if !h.userLocks.TryLock(input.UserId) {
-		pushMessage(c, ChatEventError, "您有一个对话请求正在进行中，请稍后再试或先停止当前生成！")
-		c.Abort()
-		return
-	}
-	defer h.userLocks.Unlock(input.UserId)
-
-	ctx, cancel := context.WithCancel(c.Request.Context())
-	defer cancel()
-
 	// 这里做个全局的异常处理，防止整个请求异常，导致 SSE 连接断开
 	defer func() {
 		if err := recover(); err != nil {
@@ -153,7 +186,7 @@ func (h *ChatHandler) Chat(c *gin.Context) {
 	// 验证聊天角色
 	var chatRole model.ChatApp
 	err := h.DB.First(&chatRole, input.RoleId).Error
-	if err != nil || !chatRole.Enable {
+	if err != nil || !chatRole.Enable || !canUseApp(chatRole, input.UserId) {
 		pushMessage(c, ChatEventError, "当前聊天角色不存在或者未启用，请更换角色之后再发起对话！")
 		return
 	}
@@ -168,14 +201,163 @@ func (h *ChatHandler) Chat(c *gin.Context) {
 	}
 	input.ChatModel = chatModel
 
-	// 发送消息
-	err = h.sendMessage(ctx, input, c)
-	if err != nil {
-		pushMessage(c, ChatEventError, err.Error())
+	h.startGeneration(c, input, func(ctx context.Context, out *chatOutput) error {
+		return h.sendMessage(ctx, input, out)
+	})
+}
+
+// 私有应用只有创建者可以使用
+func canUseApp(app model.ChatApp, userId uint) bool {
+	return app.UserId == 0 || app.UserId == userId || app.ReviewStatus == types.AppReviewApproved
+}
+
+// 创建生成任务并在后台执行 run，当前连接负责转发生成的事件
+func (h *ChatHandler) startGeneration(c *gin.Context, input ChatInput, run func(ctx context.Context, out *chatOutput) error) {
+	// 用户级并发锁，确保同一用户同时只有一个对话请求，多个实例之间通过 Redis 租约互斥，锁在生成任务结束的时候释放
+	lease, ok := h.userLocks.TryLock(input.UserId)
+	if !ok {
+		pushMessage(c, ChatEventError, "您有一个对话请求正在进行中，请稍后再试或先停止当前生成！")
+		c.Abort()
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), chatGenerateTimeout)
+	gen := service.ChatGeneration{UserId: input.UserId, ChatId: input.ChatId, Prompt: input.Prompt, Files: input.Files}
+	if err := h.chatStream.Create(&gen, cancel); err != nil {
+		cancel()
+		lease.Release()
+		pushMessage(c, ChatEventError, "创建生成任务失败："+err.Error())
+		return
+	}
+
+	go h.generate(ctx, cancel, gen, lease, run)
+	h.relayStream(c, gen.Id, "")
+}
+
+// Resume 断线重连，从 Last-Event-ID 之后继续接收生成的内容，没有 Last-Event-ID 的从头开始接收
+func (h *ChatHandler) Resume(c *gin.Context) {
+	setSSEHeaders(c)
+
+	gen, err := h.chatStream.Get(h.GetTrim(c, "generation_id"))
+	if err != nil || gen.UserId != h.GetLoginUserId(c) {
+		pushMessage(c, ChatEventError, service.ErrChatGenerationNotFound.Error())
+		return
+	}
+	lastId := c.GetHeader("Last-Event-ID")
+	if lastId == "" {
+		lastId = h.GetTrim(c, "last_event_id")
+	}
+	h.relayStream(c, gen.Id, lastId)
+}
+
+// Generation 查询会话正在进行的生成任务，页面刷新之后用来恢复输出
+func (h *ChatHandler) Generation(c *gin.Context) {
+	gen, err := h.chatStream.Active(h.GetTrim(c, "chat_id"))
+	if err != nil || gen.UserId != h.GetLoginUserId(c) {
+		resp.SUCCESS(c, nil)
+		return
+	}
+	resp.SUCCESS(c, gen)
+}
+
+// 在后台执行生成任务，客户端断开连接不会中断生成，生成的内容照常保存
+func (h *ChatHandler) generate(ctx context.Context, cancel context.CancelFunc, gen service.ChatGeneration, lease *service.UserLease, run func(ctx context.Context, out *chatOutput) error) {
+	out := &chatOutput{stream: h.chatStream, generationId: gen.Id}
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Errorf("chat generate error: %v", err)
+			out.push(ChatEventError, fmt.Sprint(err))
+		}
+		cancel()
+		if err := h.chatStream.Finish(gen); err != nil {
+			logger.Errorf("结束生成任务失败：%v", err)
+		}
+		lease.Release()
+	}()
+
+	// 定时给生成任务和用户锁续期，同时检查停止标记
+	go func() {
+		ticker := time.NewTicker(chatHeartbeatPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := lease.Renew(); errors.Is(err, service.ErrUserLockLost) {
+					// 租约已经被其他实例占用，继续生成就不能保证同一用户只有一个对话请求
+					logger.Errorf("用户 %d 的对话锁已经失效，停止生成", lease.UserId)
+					cancel()
+					return
+				} else if err != nil {
+					logger.Errorf("用户 %d 的对话锁续期失败：%v", lease.UserId, err)
+				}
+				stopped, err := h.chatStream.Heartbeat(gen)
+				if err != nil {
+					logger.Errorf("生成任务续期失败：%v", err)
+				} else if stopped {
+					cancel()
+				}
+			}
+		}
+	}()
+
+	out.push(ChatEventGeneration, gen.Id)
+	if err := run(ctx, out); err != nil {
+		out.push(ChatEventError, err.Error())
 		return
 	}
+	out.push(ChatEventEnd, "对话完成")
+}
+
+// 把生成任务的事件转发给客户端，直到生成结束或者客户端断开
+func (h *ChatHandler) relayStream(c *gin.Context, generationId string, lastId string) {
+	events := make(chan []service.ChatStreamEvent)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(events)
+		for {
+			items, err := h.chatStream.Read(c.Request.Context(), generationId, lastId)
+			if err != nil {
+				errs <- err
+				return
+			}
+			events <- items
+			lastId = items[len(items)-1].Id
+			if items[len(items)-1].Type == service.ChatStreamEOF {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(chatPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case items, ok := <-events:
+			if !ok {
+				if err := <-errs; err != nil && c.Request.Context().Err() == nil {
+					pushMessage(c, ChatEventError, "接收生成内容失败："+err.Error())
+				}
+				return
+			}
+			for _, event := range items {
+				if event.Type == service.ChatStreamEOF {
+					return
+				}
+				pushEvent(c, event)
+			}
+		case <-ticker.C:
+			_, _ = c.Writer.WriteString(": ping\n\n")
+			c.Writer.Flush()
+		}
+	}
+}
 
-	pushMessage(c, ChatEventEnd, "对话完成")
+func setSSEHeaders(c *gin.Context) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
 }
 
 func pushMessage(c *gin.Context, msgType string, content interface{}) {
@@ -186,56 +368,136 @@ func pushMessage(c *gin.Context, msgType string, content interface{}) {
 	c.Writer.Flush()
 }
 
-func (h *ChatHandler) sendMessage(ctx context.Context, input ChatInput, c *gin.Context) error {
+// 推送带有事件 ID 的消息，客户端断线重连的时候通过 Last-Event-ID 告诉服务端从哪里继续
+func pushEvent(c *gin.Context, event service.ChatStreamEvent) {
+	_, _ = fmt.Fprintf(c.Writer, "id:%s\nevent:message\ndata:%s\n\n", event.Id, event.Data)
+	c.Writer.Flush()
+}
+
+// 生成任务的事件输出，事件先写到 Redis，再由 SSE 连接转发给客户端
+type chatOutput struct {
+	stream       *service.ChatStreamService
+	generationId string
+	modelId      uint // 多模型对比的时候标记事件属于哪个模型
+}
+
+// 多个模型的输出共用一个生成任务，事件带上模型 ID 让客户端区分
+func (o *chatOutput) withModel(modelId uint) *chatOutput {
+	return &chatOutput{stream: o.stream, generationId: o.generationId, modelId: modelId}
+}
+
+func (o *chatOutput) push(msgType string, content interface{}) {
+	message := map[string]interface{}{
+		"type": msgType,
+		"body": content,
+	}
+	if o.modelId > 0 {
+		message["model_id"] = o.modelId
+	}
+	if err := o.stream.Push(o.generationId, msgType, message); err != nil {
+		logger.Errorf("推送生成事件失败：%v", err)
+	}
+}
+
+func (h *ChatHandler) sendMessage(ctx context.Context, input ChatInput, out *chatOutput) error {
+	userVo, req, err := h.buildRequest(ctx, &input, out)
+	if err != nil {
+		return err
+	}
+
+	// 根据组装好的提示词预估需要消耗的算力
+	toolTokens, _ := utils.CalcTokens(utils.JsonEncode(req.Tools), req.Model)
+	if userVo.Power < service.EstimateChatPower(input.ChatModel, getTotalTokens(req)+toolTokens) {
+		return fmt.Errorf("您的算力不足，请购买算力。")
+	}
+
+	return h.sendOpenAiMessage(req, userVo, ctx, input, out)
+}
+
+// 按照模型的配置创建请求参数，应用设置了请求参数的优先使用应用的设置
+func newApiRequest(input ChatInput) types.ApiRequest {
+	chatModel := input.ChatModel
+	app := input.ChatRole
+	var req = types.ApiRequest{
+		Model:       chatModel.Value,
+		Stream:      input.Stream,
+		Temperature: chatModel.Temperature,
+		TopP:        app.TopP,
+	}
+	if app.Temperature > 0 {
+		req.Temperature = app.Temperature
+	}
+	if app.ResponseFormat == "json_object" {
+		req.ResponseFormat = map[string]any{"type": "json_object"}
+	}
+	// 应用的最大响应长度不能超过模型的设置
+	maxTokens := chatModel.MaxTokens
+	if app.MaxTokens > 0 && (maxTokens <= 0 || app.MaxTokens < maxTokens) {
+		maxTokens = app.MaxTokens
+	}
+	// 兼容 OpenAI 模型
+	if strings.HasPrefix(chatModel.Value, "o1-") ||
+		strings.HasPrefix(chatModel.Value, "o3-") ||
+		strings.HasPrefix(chatModel.Value, "gpt") {
+		req.MaxCompletionTokens = maxTokens
+	} else {
+		req.MaxTokens = maxTokens
+	}
+	// 原生 Anthropic/Gemini 接口的思考预算
+	var options map[string]string
+	if err := utils.JsonDecode(chatModel.Options, &options); err == nil {
+		req.ThinkingBudget = utils.IntValue(options["thinking_budget"], 0)
+	}
+	return req
+}
+
+// 校验用户并组装对话请求：工具、知识库检索、上下文和附件，请求参数按照 input.ChatModel 设置。
+// 新消息所在的分支和检索到的知识库分段会写回 input
+func (h *ChatHandler) buildRequest(ctx context.Context, input *ChatInput, out *chatOutput) (vo.User, types.ApiRequest, error) {
 	var user model.User
+	var req types.ApiRequest
 	res := h.DB.Model(&model.User{}).First(&user, input.UserId)
 	if res.Error != nil {
-		return errors.New("未授权用户，您正在进行非法操作！")
+		return vo.User{}, req, errors.New("未授权用户，您正在进行非法操作！")
 	}
 	var userVo vo.User
 	err := utils.CopyObject(user, &userVo)
 	userVo.Id = user.Id
 	if err != nil {
-		return errors.New("User 对象转换失败，" + err.Error())
+		return userVo, req, errors.New("User 对象转换失败，" + err.Error())
 	}
 
 	if !userVo.Status {
-		return errors.New("您的账号已经被禁用，如果疑问，请联系管理员！")
-	}
-
-	if userVo.Power < input.ChatModel.Power {
-		return fmt.Errorf("您的算力不足，请购买算力。")
+		return userVo, req, errors.New("您的账号已经被禁用，如果疑问，请联系管理员！")
 	}
 
 	if userVo.ExpiredTime > 0 && userVo.ExpiredTime <= time.Now().Unix() {
-		return errors.New("您的账号已经过期，请联系管理员！")
+		return userVo, req, errors.New("您的账号已经过期，请联系管理员！")
 	}
 
 	// 检查 prompt 长度是否超过了当前模型允许的最大上下文长度
 	promptTokens, _ := utils.CalcTokens(input.Prompt, input.ChatModel.Value)
 	if promptTokens > input.ChatModel.MaxContext {
 
-		return errors.New("对话内容超出了当前模型允许的最大上下文长度！")
+		return userVo, req, errors.New("对话内容超出了当前模型允许的最大上下文长度！")
 	}
 
-	var req = types.ApiRequest{
-		Model:       input.ChatModel.Value,
-		Stream:      input.Stream,
-		Temperature: input.ChatModel.Temperature,
-	}
-	// 兼容 OpenAI 模型
-	if strings.HasPrefix(input.ChatModel.Value, "o1-") ||
-		strings.HasPrefix(input.ChatModel.Value, "o3-") ||
-		strings.HasPrefix(input.ChatModel.Value, "gpt") {
-		req.MaxCompletionTokens = input.ChatModel.MaxTokens
-	} else {
-		req.MaxTokens = input.ChatModel.MaxTokens
-	}
+	req = newApiRequest(*input)
 
-	if len(input.Tools) > 0 && !strings.HasPrefix(input.ChatModel.Value, "o1-") {
+	// 应用绑定的工具总是启用
+	toolIds := slices.Clone(input.Tools)
+	var functionIds []uint
+	_ = utils.JsonDecode(input.ChatRole.FunctionIds, &functionIds)
+	for _, id := range functionIds {
+		if !slices.Contains(toolIds, id) {
+			toolIds = append(toolIds, id)
+		}
+	}
+	if len(toolIds) > 0 && !strings.HasPrefix(input.ChatModel.Value, "o1-") {
 		var items []model.Function
-		res = h.DB.Where("enabled", true).Where("id IN ?", input.Tools).Find(&items)
+		res = h.DB.Where("enabled", true).Where("id IN ?", toolIds).Find(&items)
 		if res.Error == nil {
+			items = h.mcpService.UserFunctions(userVo.Id, items)
 			var tools = make([]types.Tool, 0)
 			for _, v := range items {
 				var parameters map[string]interface{}
@@ -264,42 +526,94 @@ func (h *ChatHandler) sendMessage(ctx context.Context, input ChatInput, c *gin.C
 		}
 	}
 
+	// 检索知识库，检索到的分段作为参考资料放在提问的前面
+	if kbIds := h.knowledgeIds(*input, userVo.Id); len(kbIds) > 0 {
+		citations, err := h.ragService.Search(ctx, kbIds, input.Prompt)
+		if err != nil {
+			logger.Errorf("检索知识库失败：%v", err)
+		}
+		// 参考资料最多占用剩余上下文的一半
+		budget := (input.ChatModel.MaxContext - max(req.MaxTokens, req.MaxCompletionTokens) - promptTokens) / 2
+		for _, v := range citations {
+			tks, _ := utils.CalcTokens(v.Content, req.Model)
+			if tks > budget {
+				break
+			}
+			budget -= tks
+			promptTokens += tks
+			input.Citations = append(input.Citations, v)
+		}
+		if len(input.Citations) > 0 {
+			out.push(ChatEventCitations, input.Citations)
+		}
+	}
+
+	// 确定新消息所在的分支，重新生成和编辑提问都会新建一个分支，不会删除原来的消息
+	branch, err := service.LoadChatTree(h.DB, input.ChatId)
+	if err != nil {
+		return userVo, req, fmt.Errorf("加载聊天记录失败：%v", err)
+	}
+	var chatItem model.ChatItem
+	h.DB.Where("chat_id", input.ChatId).First(&chatItem)
+	if chatItem.Id > 0 && chatItem.UserId != userVo.Id {
+		return userVo, req, errors.New("会话不存在")
+	}
+	input.ParentId = branch.BranchParent(input.LastMsgId, chatItem.ActiveMsgId)
+
+	// 应用提示词中的变量，已经存在的会话使用创建会话时填写的表单变量
+	if chatItem.Id > 0 {
+		input.Variables = nil
+		_ = utils.JsonDecode(chatItem.Variables, &input.Variables)
+	}
+	promptValues, err := service.AppPromptValues(input.ChatRole, userVo, input.Variables)
+	if err != nil {
+		return userVo, req, err
+	}
+	input.Variables = service.AppVariableValues(input.ChatRole, input.Variables)
+
 	// 加载聊天上下文
 	chatCtx := make([]any, 0)
 	messages := make([]any, 0)
 	if h.App.SysConfig.Base.EnableContext {
 		_ = utils.JsonDecode(input.ChatRole.Context, &messages)
-		if h.App.SysConfig.Base.ContextDeep > 0 {
-			var historyMessages []model.ChatMessage
-			dbSession := h.DB.Session(&gorm.Session{}).Where("chat_id", input.ChatId)
-			if input.LastMsgId > 0 { // 重新生成和编辑逻辑
-				var lastMessage model.ChatMessage
-				err = dbSession.Where("id < ?", input.LastMsgId).Where("type", types.ReplyMsg).Order("id DESC").First(&lastMessage).Error
-				if err != nil {
-					input.LastMsgId = 0
-				} else {
-					input.LastMsgId = lastMessage.Id
+		for _, v := range messages {
+			if item, ok := v.(map[string]any); ok {
+				if content, ok := item["content"].(string); ok {
+					item["content"] = service.RenderAppPrompt(content, promptValues)
 				}
-				dbSession = dbSession.Where("id < ?", input.LastMsgId)
-				// 删除对应的聊天记录
-				h.DB.Debug().Where("chat_id", input.ChatId).Where("id > ?", input.LastMsgId).Delete(&model.ChatMessage{})
 			}
-			err = dbSession.Limit(h.App.SysConfig.Base.ContextDeep).Order("id DESC").Find(&historyMessages).Error
-			if err == nil {
-				for i := len(historyMessages) - 1; i >= 0; i-- {
-					msg := historyMessages[i]
-					ms := types.Message{Role: "user", Content: msg.Content}
-					if msg.Type == types.ReplyMsg {
-						ms.Role = "assistant"
-					}
-					chatCtx = append(chatCtx, ms)
+		}
+		if h.App.SysConfig.Base.ContextDeep > 0 {
+			// 只使用当前分支上的消息作为上下文
+			historyMessages := branch.Path(input.ParentId)
+			summary := ""
+			if h.compactEnabled(*input) {
+				// 给历史消息留出的 token 数量，扣除最大响应长度、工具、提问和摘要的长度
+				tks, _ := utils.CalcTokens(utils.JsonEncode(req.Tools), req.Model)
+				budget := input.ChatModel.MaxContext - max(req.MaxTokens, req.MaxCompletionTokens) - tks - promptTokens - summaryMaxTokens
+				summary, historyMessages = h.compactContext(&chatItem, historyMessages, budget, req.Model)
+			} else {
+				historyMessages = historyMessages[max(len(historyMessages)-h.App.SysConfig.Base.ContextDeep, 0):]
+			}
+			// chatCtx 最终会倒序加入请求，所以这里从最新的消息开始添加
+			for j := len(historyMessages) - 1; j >= 0; j-- {
+				items := historyToMessages(historyMessages[j])
+				for i := len(items) - 1; i >= 0; i-- {
+					chatCtx = append(chatCtx, items[i])
 				}
 			}
+			// 摘要放在历史消息的前面
+			if summary != "" {
+				chatCtx = append(chatCtx, types.Message{
+					Role:    "system",
+					Content: "以下是之前对话内容的摘要，回答时请参考：\n" + summary,
+				})
+			}
 		}
 
 		// 计算当前请求的 token 总长度，确保不会超出最大上下文长度
 		// MaxContextLength = Response + Tool + Prompt + Context
-		tokens := req.MaxTokens // 最大响应长度
+		tokens := max(req.MaxTokens, req.MaxCompletionTokens) // 最大响应长度
 		tks, _ := utils.CalcTokens(utils.JsonEncode(req.Tools), req.Model)
 		tokens += tks + promptTokens
 
@@ -333,6 +647,12 @@ func (h *ChatHandler) sendMessage(ctx context.Context, input ChatInput, c *gin.C
 	for i := len(chatCtx) - 1; i >= 0; i-- {
 		reqMgs = append(reqMgs, chatCtx[i])
 	}
+	if len(input.Citations) > 0 {
+		reqMgs = append(reqMgs, map[string]any{
+			"role":    "system",
+			"content": rag.BuildPrompt(input.Citations),
+		})
+	}
 
 	fileContents := make([]string, 0) // 文件内容
 	var finalPrompt = input.Prompt
@@ -349,10 +669,10 @@ func (h *ChatHandler) sendMessage(ctx context.Context, input ChatInput, c *gin.C
 			})
 		} else {
 			// 处理文件，提取文件内容
-			content, err := utils.ReadFileContent(file.URL, h.App.Config.TikaHost)
+			content, err := h.readFileContent(file.URL, input.UserId)
 			if err != nil {
 				logger.Error("error with read file: ", err)
-				continue
+				return userVo, req, fmt.Errorf("读取文件 %s 失败：%v", file.Name, err)
 			} else {
 				fileContents = append(fileContents, fmt.Sprintf("%s 文件内容：%s", file.Name, content))
 				logger.Debugf("fileContents: %s", fileContents)
@@ -361,10 +681,10 @@ func (h *ChatHandler) sendMessage(ctx context.Context, input ChatInput, c *gin.C
 	}
 
 	if len(fileContents) > 0 {
-		finalPrompt = fmt.Sprintf("请根据提供的文件内容信息回答问题(其中Excel 已转成 HTML)：\n\n %s\n\n 问题：%s", strings.Join(fileContents, "\n"), input.Prompt)
+		finalPrompt = fmt.Sprintf("请根据提供的文件内容信息回答问题(其中表格已转成 HTML)：\n\n %s\n\n 问题：%s", strings.Join(fileContents, "\n"), input.Prompt)
 		tokens, _ := utils.CalcTokens(finalPrompt, req.Model)
 		if tokens > input.ChatModel.MaxContext {
-			return fmt.Errorf("文件的长度超出模型允许的最大上下文长度，请减少文件内容数量或文件大小。")
+			return userVo, req, fmt.Errorf("文件的长度超出模型允许的最大上下文长度，请减少文件内容数量或文件大小。")
 		}
 	} else {
 		finalPrompt = input.Prompt
@@ -385,8 +705,154 @@ func (h *ChatHandler) sendMessage(ctx context.Context, input ChatInput, c *gin.C
 			"content": finalPrompt,
 		})
 	}
+	return userVo, req, nil
+}
+
+// 读取对话附件的文本内容，提取的内容缓存在文件记录上，同一个文件不用重复下载和解析
+func (h *ChatHandler) readFileContent(url string, userId uint) (string, error) {
+	var file model.File
+	h.DB.Where("user_id", userId).Where("url", url).First(&file)
+	if file.Content != "" {
+		return file.Content, nil
+	}
+
+	content, err := utils.ReadFileContent(url, h.App.Config.TikaHost)
+	if err != nil {
+		return "", err
+	}
+	if file.Id > 0 {
+		h.DB.Model(&file).UpdateColumn("content", content)
+	}
+	return content, nil
+}
+
+// 对话使用的知识库：应用绑定的知识库，以及用户选择的自己的知识库
+func (h *ChatHandler) knowledgeIds(input ChatInput, userId uint) []uint {
+	var ids []uint
+	_ = utils.JsonDecode(input.ChatRole.KnowledgeIds, &ids)
+	if len(input.KnowledgeIds) > 0 {
+		var userIds []uint
+		h.DB.Model(&model.KnowledgeBase{}).Where("id IN ?", input.KnowledgeIds).Where("user_id", userId).Pluck("id", &userIds)
+		ids = append(ids, userIds...)
+	}
+	return ids
+}
+
+// 是否开启上下文压缩，应用设置优先，应用没有设置的使用模型的设置
+func (h *ChatHandler) compactEnabled(input ChatInput) bool {
+	switch input.ChatRole.ContextCompact {
+	case 1:
+		return true
+	case 2:
+		return false
+	}
+	var options map[string]string
+	_ = utils.JsonDecode(input.ChatModel.Options, &options)
+	return options["context_compact"] == "1"
+}
+
+// 上下文压缩：超出上下文深度或者长度的历史消息交给助手模型总结成摘要，摘要保存在会话上。
+// 后续对话只把新移出上下文的消息合并到摘要里面，返回摘要和需要保留的历史消息。
+func (h *ChatHandler) compactContext(chatItem *model.ChatItem, history []model.ChatMessage, budget int, modelName string) (string, []model.ChatMessage) {
+	deep := h.App.SysConfig.Base.ContextDeep
+	// 摘要覆盖的消息在当前分支上才有效，切换到其他分支之后需要重新总结
+	summary := ""
+	start := 0
+	for i, msg := range history {
+		if chatItem.SummaryMsgId > 0 && msg.Id == chatItem.SummaryMsgId {
+			summary = chatItem.Summary
+			start = i + 1
+			break
+		}
+	}
+	pending := history[start:]
+	tokens := make([]int, len(pending))
+	total := 0
+	for i, msg := range pending {
+		tokens[i], _ = utils.CalcTokens(msg.Content, modelName)
+		total += tokens[i]
+	}
+	if len(pending) <= deep && total <= budget {
+		return summary, pending
+	}
+
+	// 只保留最近一半的消息，避免每一轮对话都要重新总结
+	keep := min(max(deep/2, 2), len(pending))
+	kept := 0
+	for i := len(pending) - keep; i < len(pending); i++ {
+		kept += tokens[i]
+	}
+	for keep > 0 && kept > budget/2 {
+		kept -= tokens[len(pending)-keep]
+		keep--
+	}
+	evicted := pending[:len(pending)-keep]
+	if len(evicted) == 0 {
+		return summary, pending
+	}
 
-	return h.sendOpenAiMessage(req, userVo, ctx, input, c)
+	var builder strings.Builder
+	for _, msg := range evicted {
+		if msg.Type == types.PromptMsg {
+			builder.WriteString("用户：")
+		} else {
+			builder.WriteString("助手：")
+		}
+		builder.WriteString(messageText(msg))
+		builder.WriteString("\n\n")
+	}
+	// 对话内容太长的只总结最近的部分
+	dialog := []rune(builder.String())
+	dialog = dialog[max(len(dialog)-summaryMaxDialog, 0):]
+	newSummary, err := h.assistantService.Summarize(summary, string(dialog), h.App.SysConfig.Base.AssistantModelId)
+	if err != nil {
+		// 总结失败的直接丢掉较早的消息
+		logger.Errorf("压缩对话上下文失败：%v", err)
+		return summary, pending[len(pending)-keep:]
+	}
+
+	chatItem.Summary = newSummary
+	chatItem.SummaryMsgId = evicted[len(evicted)-1].Id
+	if chatItem.Id > 0 {
+		h.DB.Model(chatItem).UpdateColumns(map[string]any{"summary": chatItem.Summary, "summary_msg_id": chatItem.SummaryMsgId})
+	}
+	return newSummary, pending[len(pending)-keep:]
+}
+
+// 把聊天记录转换成上下文消息，带有工具调用记录的回复会还原出 assistant 的 tool_calls 和 tool 消息
+func historyToMessages(msg model.ChatMessage) []any {
+	var content vo.MsgContent
+	if err := utils.JsonDecode(msg.Content, &content); err != nil {
+		content.Text = msg.Content
+	}
+	if msg.Type != types.ReplyMsg {
+		return []any{types.Message{Role: "user", Content: content.Text}}
+	}
+
+	items := make([]any, 0)
+	var traces []types.ToolTrace
+	_ = utils.JsonDecode(msg.ToolCalls, &traces)
+	for i := 0; i < len(traces); {
+		// 同一轮的工具调用放在同一条 assistant 消息中
+		j := i
+		calls := make([]types.ToolCall, 0)
+		for ; j < len(traces) && traces[j].Round == traces[i].Round; j++ {
+			call := types.ToolCall{Id: traces[j].Id, Type: "function"}
+			call.Function.Name = traces[j].Name
+			call.Function.Arguments = traces[j].Arguments
+			calls = append(calls, call)
+		}
+		items = append(items, map[string]any{"role": "assistant", "content": "", "tool_calls": calls})
+		for _, trace := range traces[i:j] {
+			result := trace.Result
+			if trace.Error != "" {
+				result = "调用工具出错：" + trace.Error
+			}
+			items = append(items, map[string]any{"role": "tool", "tool_call_id": trace.Id, "content": result})
+		}
+		i = j
+	}
+	return append(items, types.Message{Role: "assistant", Content: content.Text})
 }
 
 // 判断一个 URL 是否图片链接
@@ -481,85 +947,66 @@ func getTotalTokens(req types.ApiRequest) int {
 	return tokens
 }
 
-// StopGenerate 停止生成
+// StopGenerate 停止生成，已经生成的内容会保存下来，并且按照已经生成的内容扣减算力
 func (h *ChatHandler) StopGenerate(c *gin.Context) {
-	sessionId := c.Query("session_id")
-	if h.ReqCancelFunc.Has(sessionId) {
-		h.ReqCancelFunc.Get(sessionId)()
-		h.ReqCancelFunc.Delete(sessionId)
+	gen, err := h.chatStream.Get(h.GetTrim(c, "generation_id"))
+	if err != nil || gen.UserId != h.GetLoginUserId(c) {
+		resp.ERROR(c, service.ErrChatGenerationNotFound.Error())
+		return
+	}
+	if err = h.chatStream.Stop(gen.Id); err != nil {
+		resp.ERROR(c, err.Error())
+		return
 	}
 	resp.SUCCESS(c, types.OkMsg)
 }
 
-// 发送请求到 OpenAI 服务器
-// useOwnApiKey: 是否使用了用户自己的 API KEY
-func (h *ChatHandler) doRequest(ctx context.Context, req types.ApiRequest, input ChatInput, apiKey *model.ApiKey) (*http.Response, error) {
-	// if the chat model bind a KEY, use it directly
-	if input.ChatModel.KeyId > 0 {
-		h.DB.Where("id", input.ChatModel.KeyId).Where("enabled", true).Find(apiKey)
-	} else { // use the last unused key
-		h.DB.Where("type", "chat").Where("enabled", true).Order("last_used_at ASC").First(apiKey)
-	}
-
-	if apiKey.Id == 0 {
-		return nil, errors.New("no available key, please import key")
-	}
-
-	// ONLY allow apiURL in blank list
-	err := h.licenseService.IsValidApiURL(apiKey.ApiURL)
-	if err != nil {
-		return nil, err
-	}
+// 发送请求到大模型服务商
+func (h *ChatHandler) doRequest(ctx context.Context, req types.ApiRequest, input ChatInput, apiKey *model.ApiKey, callback func(delta provider.Delta)) (*provider.Response, error) {
 	logger.Debugf("对话请求消息体：%+v", req)
-	var apiURL string
-	p, _ := url.Parse(apiKey.ApiURL)
-	// 如果设置的是 BASE_URL 没有路径，则添加 /v1/chat/completions
-	if p.Path == "" {
-		apiURL = fmt.Sprintf("%s/v1/chat/completions", apiKey.ApiURL)
-	} else {
-		apiURL = apiKey.ApiURL
-	}
-	// 创建 HttpClient 请求对象
-	var client *http.Client
-	requestBody, err := json.Marshal(req)
-	if err != nil {
-		return nil, err
-	}
-	request, err := http.NewRequest(http.MethodPost, apiURL, bytes.NewBuffer(requestBody))
-	if err != nil {
-		return nil, err
-	}
+	// 预估本次请求消耗的 tokens，用于 KEY 的 TPM 限流
+	tokens, _ := utils.CalcTokens(utils.JsonEncode(req.Messages), req.Model)
+	var response *provider.Response
+	// if the chat model bind a KEY, use it only, otherwise let the scheduler pick one by weight and rate limits
+	key, err := h.apiKeyService.Invoke(ctx, "chat", input.ChatModel.KeyId, tokens+max(req.MaxTokens, req.MaxCompletionTokens), func(key model.ApiKey) (int, error) {
+		// ONLY allow apiURL in blank list
+		if err := h.licenseService.IsValidApiURL(key.ApiURL); err != nil {
+			return 0, service.Permanent(err)
+		}
 
-	request = request.WithContext(ctx)
-	request.Header.Set("Content-Type", "application/json")
-	if len(apiKey.ProxyURL) > 5 { // 使用代理
-		proxy, _ := url.Parse(apiKey.ProxyURL)
-		client = &http.Client{
-			Transport: &http.Transport{
-				Proxy: http.ProxyURL(proxy),
-			},
+		outputted := false
+		res, err := provider.Resolve(key, input.ChatModel).Chat(ctx, key, req, func(delta provider.Delta) {
+			outputted = true
+			callback(delta)
+		})
+		if err != nil {
+			// 已经向客户端输出了部分内容，不能再切换 KEY 重试
+			if outputted {
+				return 0, service.Permanent(err)
+			}
+			return 0, err
 		}
-	} else {
-		client = http.DefaultClient
+		response = res
+		return res.Usage.TotalTokens, nil
+	})
+	*apiKey = key
+	if err != nil {
+		return nil, err
 	}
-	logger.Infof("Sending %s request, API KEY:%s, PROXY: %s, Model: %s", apiKey.ApiURL, apiURL, apiKey.ProxyURL, req.Model)
-	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiKey.Value))
-	// 更新API KEY 最后使用时间
-	h.DB.Model(&model.ApiKey{}).Where("id", apiKey.Id).UpdateColumn("last_used_at", time.Now().Unix())
-	return client.Do(request)
+	return response, nil
 }
 
 // 扣减用户算力
-func (h *ChatHandler) subUserPower(userVo vo.User, input ChatInput, promptTokens int, replyTokens int) {
-	power := 1
-	if input.ChatModel.Power > 0 {
-		power = input.ChatModel.Power
+func (h *ChatHandler) subUserPower(userVo vo.User, input ChatInput, usage service.TokenUsage) {
+	power, detail := service.CalcChatPower(input.ChatModel, usage)
+	if power <= 0 {
+		return
 	}
 
 	err := h.userService.DecreasePower(userVo.Id, power, model.PowerLog{
 		Type:   types.PowerConsume,
 		Model:  input.ChatModel.Value,
-		Remark: fmt.Sprintf("模型名称：%s, 提问长度：%d，回复长度：%d", input.ChatModel.Name, promptTokens, replyTokens),
+		Remark: fmt.Sprintf("模型名称：%s，%s", input.ChatModel.Name, detail),
 	})
 	if err != nil {
 		logger.Error(err)
@@ -567,143 +1014,184 @@ func (h *ChatHandler) subUserPower(userVo vo.User, input ChatInput, promptTokens
 }
 
 func (h *ChatHandler) saveChatHistory(
-	c *gin.Context,
+	out *chatOutput,
 	req types.ApiRequest,
 	usage Usage,
 	message types.Message,
 	input ChatInput,
 	userVo vo.User,
 	promptCreatedAt time.Time,
-	replyCreatedAt time.Time) {
+	replyCreatedAt time.Time,
+	traces []types.ToolTrace) {
 
-	// 文本审核
-	if h.App.SysConfig.Moderation.Enable {
-		moderationResult, err := h.moderationManager.GetService().Moderate(usage.Content)
-		if err != nil {
-			logger.Error("failed to moderate content: ", err)
-		}
-		logger.Debugf("moderationResult: %+v", moderationResult)
-		if moderationResult.Flagged {
-			// 记录违规内容
-			moderation := model.Moderation{
-				UserId: userVo.Id,
-				Source: types.ModerationSourceChat,
-				Input:  usage.Prompt,
-				Output: usage.Content,
-				Result: utils.JsonEncode(moderationResult),
-			}
-			err = h.DB.Create(&moderation).Error
-			if err != nil {
-				logger.Error("failed to save moderation: ", err)
-			}
-			pushMessage(c, ChatEventError, "很抱歉，内容触发敏感词预警，AI 无法回答！！！")
-			// 更新用户算力
-			if input.ChatModel.Power > 0 {
-				h.subUserPower(userVo, input, 0, 0)
-			}
-			return
-		}
+	billing, estimated := fillUsage(req, &usage, message.Content)
+	if h.moderateReply(out, usage, input, userVo, billing) {
+		return
 	}
 	// 追加聊天记录
-	// for prompt
-	var promptTokens, replyTokens, totalTokens int
-	if usage.PromptTokens > 0 {
-		promptTokens = usage.PromptTokens
-	} else {
-		promptTokens, _ = utils.CalcTokens(usage.Content, req.Model)
+	promptMsg := h.savePrompt(input, userVo, usage.Prompt, usage.PromptTokens, req.Model, promptCreatedAt)
+	replyMsg := h.saveReply(out, input, userVo, promptMsg.Id, req.Model, usage, estimated, message.Content, traces, replyCreatedAt)
+	// 更新用户算力
+	h.subUserPower(userVo, input, billing)
+	// 保存当前会话
+	h.saveChatItem(input, userVo, usage.Prompt, req.Model, replyMsg.Id)
+}
+
+// 优先使用上游返回的真实用量，没有返回用量的按照请求内容估算，返回计费用量和是否为估算
+func fillUsage(req types.ApiRequest, usage *Usage, content string) (service.TokenUsage, bool) {
+	estimated := false
+	if usage.PromptTokens == 0 {
+		usage.PromptTokens = getTotalTokens(req)
+		estimated = true
+	}
+	if usage.CompletionTokens == 0 {
+		usage.CompletionTokens, _ = utils.CalcTokens(content, req.Model)
+		estimated = true
+	}
+	if usage.TotalTokens == 0 {
+		usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	}
+	return service.TokenUsage{
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		CachedTokens:     usage.CachedTokens,
+	}, estimated
+}
+
+// 文本审核，内容违规的记录下来并且照常扣减算力，返回是否违规
+func (h *ChatHandler) moderateReply(out *chatOutput, usage Usage, input ChatInput, userVo vo.User, billing service.TokenUsage) bool {
+	if !h.App.SysConfig.Moderation.Enable {
+		return false
 	}
+	moderationResult, err := h.moderationManager.GetService().Moderate(usage.Content)
+	if err != nil {
+		logger.Error("failed to moderate content: ", err)
+	}
+	logger.Debugf("moderationResult: %+v", moderationResult)
+	if !moderationResult.Flagged {
+		return false
+	}
+	// 记录违规内容
+	moderation := model.Moderation{
+		UserId: userVo.Id,
+		Source: types.ModerationSourceChat,
+		Input:  usage.Prompt,
+		Output: usage.Content,
+		Result: utils.JsonEncode(moderationResult),
+	}
+	err = h.DB.Create(&moderation).Error
+	if err != nil {
+		logger.Error("failed to save moderation: ", err)
+	}
+	out.push(ChatEventError, "很抱歉，内容触发敏感词预警，AI 无法回答！！！")
+	// 更新用户算力
+	h.subUserPower(userVo, input, billing)
+	return true
+}
 
+// 保存提问消息
+func (h *ChatHandler) savePrompt(input ChatInput, userVo vo.User, prompt string, tokens int, modelValue string, createdAt time.Time) model.ChatMessage {
 	historyUserMsg := model.ChatMessage{
-		UserId: userVo.Id,
-		ChatId: input.ChatId,
-		RoleId: input.RoleId,
-		Type:   types.PromptMsg,
-		Icon:   userVo.Avatar,
+		UserId:   userVo.Id,
+		ChatId:   input.ChatId,
+		ParentId: input.ParentId,
+		RoleId:   input.RoleId,
+		Type:     types.PromptMsg,
+		Icon:     userVo.Avatar,
 		Content: utils.JsonEncode(vo.MsgContent{
-			Text:  usage.Prompt,
+			Text:  prompt,
 			Files: input.Files,
 		}),
-		Tokens:      promptTokens,
-		TotalTokens: promptTokens,
+		SearchText:  prompt,
+		Tokens:      tokens,
+		TotalTokens: tokens,
 		UseContext:  true,
-		Model:       req.Model,
+		Model:       modelValue,
+		CompareId:   input.CompareId,
 	}
-	historyUserMsg.CreatedAt = promptCreatedAt
-	historyUserMsg.UpdatedAt = promptCreatedAt
+	historyUserMsg.CreatedAt = createdAt
+	historyUserMsg.UpdatedAt = createdAt
 	err := h.DB.Save(&historyUserMsg).Error
 	if err != nil {
 		logger.Error("failed to save prompt history message: ", err)
 	}
+	return historyUserMsg
+}
 
-	// for reply
-	// 计算本次对话消耗的总 token 数量
-	if usage.CompletionTokens > 0 {
-		replyTokens = usage.CompletionTokens
-		totalTokens = usage.TotalTokens
-	} else {
-		replyTokens, _ = utils.CalcTokens(message.Content, req.Model)
-		totalTokens = replyTokens + getTotalTokens(req)
-	}
+// 保存回复消息，并且把完整的消息推送给前端
+func (h *ChatHandler) saveReply(
+	out *chatOutput,
+	input ChatInput,
+	userVo vo.User,
+	parentId uint,
+	modelValue string,
+	usage Usage,
+	estimated bool,
+	content string,
+	traces []types.ToolTrace,
+	createdAt time.Time) model.ChatMessage {
 	historyReplyMsg := model.ChatMessage{
-		UserId: userVo.Id,
-		ChatId: input.ChatId,
-		RoleId: input.RoleId,
-		Type:   types.ReplyMsg,
-		Icon:   input.ChatRole.Icon,
+		UserId:   userVo.Id,
+		ChatId:   input.ChatId,
+		ParentId: parentId,
+		RoleId:   input.RoleId,
+		Type:     types.ReplyMsg,
+		Icon:     input.ChatRole.Icon,
 		Content: utils.JsonEncode(vo.MsgContent{
-			Text:  message.Content,
+			Text:  content,
 			Files: input.Files,
 		}),
-		Tokens:      replyTokens,
-		TotalTokens: totalTokens,
-		UseContext:  true,
-		Model:       req.Model,
-	}
-	historyReplyMsg.CreatedAt = replyCreatedAt
-	historyReplyMsg.UpdatedAt = replyCreatedAt
-	err = h.DB.Create(&historyReplyMsg).Error
+		Tokens:           usage.CompletionTokens,
+		TotalTokens:      usage.TotalTokens,
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		ReasoningTokens:  usage.ReasoningTokens,
+		CachedTokens:     usage.CachedTokens,
+		UsageEstimated:   estimated,
+		ToolCalls:        utils.JsonEncode(traces),
+		Citations:        utils.JsonEncode(input.Citations),
+		SearchText:       content,
+		UseContext:       true,
+		Model:            modelValue,
+		CompareId:        input.CompareId,
+	}
+	historyReplyMsg.CreatedAt = createdAt
+	historyReplyMsg.UpdatedAt = createdAt
+	err := h.DB.Create(&historyReplyMsg).Error
 	if err != nil {
 		logger.Error("failed to save reply history message: ", err)
 	}
 
 	// 发送完整聊天记录给前端
-	var messageVo vo.ChatMessage
-	err = utils.CopyObject(historyReplyMsg, &messageVo)
-	if err == nil {
-		// 解析内容
-		var content vo.MsgContent
-		err = utils.JsonDecode(historyReplyMsg.Content, &content)
-		if err != nil {
-			content.Text = historyReplyMsg.Content
-		}
-		messageVo.Content = content
-		messageVo.CreatedAt = historyReplyMsg.CreatedAt.Unix()
-		messageVo.UpdatedAt = historyReplyMsg.UpdatedAt.Unix()
-		pushMessage(c, ChatEventComplete, messageVo)
-	}
+	out.push(ChatEventComplete, toMessageVo(historyReplyMsg))
+	return historyReplyMsg
+}
 
-	// 更新用户算力
-	if input.ChatModel.Power > 0 {
-		h.subUserPower(userVo, input, promptTokens, replyTokens)
-	}
-	// 保存当前会话
+// 保存当前会话，已经存在的会话切换到新消息所在的分支
+func (h *ChatHandler) saveChatItem(input ChatInput, userVo vo.User, prompt string, modelValue string, activeMsgId uint) {
 	var chatItem model.ChatItem
-	err = h.DB.Where("chat_id = ?", input.ChatId).First(&chatItem).Error
+	err := h.DB.Where("chat_id = ?", input.ChatId).First(&chatItem).Error
 	if err != nil {
 		chatItem.ChatId = input.ChatId
 		chatItem.UserId = userVo.Id
 		chatItem.RoleId = input.RoleId
 		chatItem.ModelId = input.ModelId
-		if utf8.RuneCountInString(usage.Prompt) > 30 {
-			chatItem.Title = string([]rune(usage.Prompt)[:30]) + "..."
+		if utf8.RuneCountInString(prompt) > 30 {
+			chatItem.Title = string([]rune(prompt)[:30]) + "..."
 		} else {
-			chatItem.Title = usage.Prompt
+			chatItem.Title = prompt
+		}
+		chatItem.Model = modelValue
+		chatItem.ActiveMsgId = activeMsgId
+		if len(input.Variables) > 0 {
+			chatItem.Variables = utils.JsonEncode(input.Variables)
 		}
-		chatItem.Model = req.Model
 		err = h.DB.Create(&chatItem).Error
 		if err != nil {
 			logger.Error("failed to save chat item: ", err)
 		}
+	} else {
+		h.DB.Model(&chatItem).UpdateColumn("active_msg_id", activeMsgId)
 	}
 }
 
@@ -746,25 +1234,6 @@ func (h *ChatHandler) TextToSpeech(c *gin.Context) {
 		return
 	}
 
-	// 调用 DeepSeek 的 API 接口
-	var apiKey model.ApiKey
-	if chatModel.KeyId > 0 {
-		h.DB.Where("id", chatModel.KeyId).First(&apiKey)
-	}
-	if apiKey.Id == 0 {
-		h.DB.Where("type", "tts").Where("enabled", true).First(&apiKey)
-	}
-	if apiKey.Id == 0 {
-		resp.ERROR(c, "no TTS API key, please import key")
-		return
-	}
-
-	logger.Debugf("chatModel: %+v, apiKey: %+v", chatModel, apiKey)
-
-	// 调用 openai tts api
-	config := openai.DefaultConfig(apiKey.Value)
-	config.BaseURL = apiKey.ApiURL + "/v1"
-	client := openai.NewClientWithConfig(config)
 	voice := openai.VoiceAlloy
 	var options map[string]string
 	err = utils.JsonDecode(chatModel.Options, &options)
@@ -777,11 +1246,25 @@ func (h *ChatHandler) TextToSpeech(c *gin.Context) {
 		Voice: voice,
 	}
 
-	audioData, err := client.CreateSpeech(context.Background(), req)
+	// 调用 openai tts api，模型绑定了 KEY 的只使用绑定的 KEY
+	var audioData io.ReadCloser
+	_, err = h.apiKeyService.Invoke(c.Request.Context(), "tts", chatModel.KeyId, 0, func(apiKey model.ApiKey) (int, error) {
+		logger.Debugf("chatModel: %+v, apiKey: %+v", chatModel, apiKey)
+		config := openai.DefaultConfig(apiKey.Value)
+		config.BaseURL = apiKey.ApiURL + "/v1"
+		client := openai.NewClientWithConfig(config)
+		res, err := client.CreateSpeech(c.Request.Context(), req)
+		if err != nil {
+			return 0, speechError(err)
+		}
+		audioData = res
+		return 0, nil
+	})
 	if err != nil {
 		resp.ERROR(c, err.Error())
 		return
 	}
+	defer audioData.Close()
 
 	// 先将音频数据读取到内存
 	audioBytes, err := io.ReadAll(audioData)
@@ -806,3 +1289,16 @@ func (h *ChatHandler) TextToSpeech(c *gin.Context) {
 		logger.Error("写入音频数据到响应失败:", err)
 	}
 }
+
+// 把 go-openai 返回的错误转换成 provider.ApiError，KEY 调度器根据状态码和错误码判断是否需要切换或者禁用 KEY
+func speechError(err error) error {
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) && apiErr.HTTPStatusCode > 0 {
+		return &provider.ApiError{Provider: "TTS", StatusCode: apiErr.HTTPStatusCode, Body: utils.JsonEncode(openai.ErrorResponse{Error: apiErr})}
+	}
+	var reqErr *openai.RequestError
+	if errors.As(err, &reqErr) && reqErr.HTTPStatusCode > 0 {
+		return &provider.ApiError{Provider: "TTS", StatusCode: reqErr.HTTPStatusCode, Body: string(reqErr.Body)}
+	}
+	return err
+}
@@ -9,10 +9,12 @@ package handler
 
 import (
 	"geekai/core/types"
+	"geekai/service"
 	"geekai/store/model"
 	"geekai/store/vo"
 	"geekai/utils"
 	"geekai/utils/resp"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
@@ -67,6 +69,40 @@ func (h *ChatHandler) List(c *gin.Context) {
 	resp.SUCCESS(c, items)
 }
 
+// Search 按关键词搜索当前用户的聊天记录
+func (h *ChatHandler) Search(c *gin.Context) {
+	var data struct {
+		Keywords string   `json:"keywords"`
+		Type     string   `json:"type"`
+		RoleId   uint     `json:"role_id"`
+		Model    string   `json:"model"`
+		CreateAt []string `json:"created_time"`
+		Page     int      `json:"page"`
+		PageSize int      `json:"page_size"`
+	}
+	if err := c.ShouldBindJSON(&data); err != nil {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+
+	params := service.ChatSearchParams{
+		Keywords: data.Keywords,
+		UserId:   h.GetLoginUserId(c),
+		Type:     data.Type,
+		RoleId:   data.RoleId,
+		Model:    data.Model,
+		Page:     data.Page,
+		PageSize: data.PageSize,
+	}
+	params.SetDateRange(data.CreateAt)
+	total, items, err := service.SearchChatMessages(h.DB, &params)
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c, vo.NewPage(total, params.Page, params.PageSize, items))
+}
+
 // Update 更新会话标题
 func (h *ChatHandler) Update(c *gin.Context) {
 	var data struct {
@@ -128,36 +164,143 @@ func (h *ChatHandler) Clear(c *gin.Context) {
 	resp.SUCCESS(c, types.OkMsg)
 }
 
-// History 获取聊天历史记录
+// History 获取聊天历史记录，只返回当前激活分支上的消息
 func (h *ChatHandler) History(c *gin.Context) {
 	chatId := c.Query("chat_id") // 会话 ID
-	var items []model.ChatMessage
-	var messages = make([]vo.ChatMessage, 0)
-	res := h.DB.Where("chat_id = ?", chatId).Find(&items)
-	if res.Error != nil {
+	if !h.checkChatOwner(c, chatId) {
+		resp.ERROR(c, "会话不存在")
+		return
+	}
+	var chatItem model.ChatItem
+	h.DB.Where("chat_id", chatId).First(&chatItem)
+	tree, err := service.LoadChatTree(h.DB, chatId)
+	if err != nil {
 		resp.ERROR(c, "No history message")
 		return
-	} else {
-		for _, item := range items {
-			var v vo.ChatMessage
-			err := utils.CopyObject(item, &v)
-			if err != nil {
-				continue
-			}
-			// 解析内容
-			var content vo.MsgContent
-			err = utils.JsonDecode(item.Content, &content)
-			if err != nil {
-				content.Text = item.Content
+	}
+
+	resp.SUCCESS(c, h.branchMessages(tree, tree.ActiveLeaf(chatItem.ActiveMsgId)))
+}
+
+// 从根消息到叶子消息的分支消息列表，有多个分支的提问消息附带所有分支的 ID，用于切换分支
+func (h *ChatHandler) branchMessages(tree *service.ChatTree, leafId uint) []vo.ChatMessage {
+	var messages = make([]vo.ChatMessage, 0)
+	for _, item := range tree.Path(leafId) {
+		v := toMessageVo(item)
+		if siblings := tree.Siblings(item.Id); len(siblings) > 1 {
+			v.Branches = siblings
+		}
+		messages = append(messages, v)
+	}
+	return messages
+}
+
+// 转换成前端显示的消息
+func toMessageVo(item model.ChatMessage) vo.ChatMessage {
+	var v vo.ChatMessage
+	err := utils.CopyObject(item, &v)
+	if err != nil {
+		logger.Error(err)
+	}
+	// 解析内容
+	var content vo.MsgContent
+	err = utils.JsonDecode(item.Content, &content)
+	if err != nil {
+		content.Text = item.Content
+	}
+	v.Content = content
+	v.CreatedAt = item.CreatedAt.Unix()
+	v.UpdatedAt = item.UpdatedAt.Unix()
+	return v
+}
+
+// Branches 获取提问消息的所有分支
+func (h *ChatHandler) Branches(c *gin.Context) {
+	chatId := c.Query("chat_id")
+	msgId := h.GetInt(c, "msg_id", 0)
+	if !h.checkChatOwner(c, chatId) {
+		resp.ERROR(c, "会话不存在")
+		return
+	}
+	tree, err := service.LoadChatTree(h.DB, chatId)
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+
+	type branchVo struct {
+		Id        uint   `json:"id"`         // 分支提问消息 ID
+		Prompt    string `json:"prompt"`     // 提问内容
+		Reply     string `json:"reply"`      // 回复内容摘要
+		Rounds    int    `json:"rounds"`     // 分支上的对话轮数
+		CreatedAt int64  `json:"created_at"` // 创建时间
+	}
+	branches := make([]branchVo, 0)
+	for _, id := range tree.Siblings(uint(msgId)) {
+		msg, _ := tree.Get(id)
+		branch := branchVo{Id: id, CreatedAt: msg.CreatedAt.Unix(), Prompt: messageText(msg)}
+		if children := tree.Children(id); len(children) > 0 {
+			reply, _ := tree.Get(children[len(children)-1])
+			branch.Reply = messageText(reply)
+			if utf8.RuneCountInString(branch.Reply) > 100 {
+				branch.Reply = string([]rune(branch.Reply)[:100]) + "..."
 			}
-			v.Content = content
-			v.CreatedAt = item.CreatedAt.Unix()
-			v.UpdatedAt = item.UpdatedAt.Unix()
-			messages = append(messages, v)
 		}
+		// 分支上当前提问之后的对话轮数
+		leafPath := tree.Path(tree.LatestLeaf(id))
+		branch.Rounds = (len(leafPath) - len(tree.Path(id)) + 2) / 2
+		branches = append(branches, branch)
 	}
+	resp.SUCCESS(c, branches)
+}
 
-	resp.SUCCESS(c, messages)
+// SwitchBranch 切换到指定消息所在的分支，返回切换之后的聊天记录
+func (h *ChatHandler) SwitchBranch(c *gin.Context) {
+	var data struct {
+		ChatId string `json:"chat_id"`
+		MsgId  uint   `json:"msg_id"`
+	}
+	if err := c.ShouldBindJSON(&data); err != nil {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+	if !h.checkChatOwner(c, data.ChatId) {
+		resp.ERROR(c, "会话不存在")
+		return
+	}
+	tree, err := service.LoadChatTree(h.DB, data.ChatId)
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	if _, ok := tree.Get(data.MsgId); !ok {
+		resp.ERROR(c, "消息不存在")
+		return
+	}
+
+	leafId := tree.LatestLeaf(data.MsgId)
+	err = h.DB.Model(&model.ChatItem{}).Where("chat_id", data.ChatId).UpdateColumn("active_msg_id", leafId).Error
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c, h.branchMessages(tree, leafId))
+}
+
+// 检查会话是否属于当前登录用户
+func (h *ChatHandler) checkChatOwner(c *gin.Context, chatId string) bool {
+	var count int64
+	h.DB.Model(&model.ChatItem{}).Where("chat_id", chatId).Where("user_id", h.GetLoginUserId(c)).Count(&count)
+	return count > 0
+}
+
+// 消息的文本内容
+func messageText(msg model.ChatMessage) string {
+	var content vo.MsgContent
+	if err := utils.JsonDecode(msg.Content, &content); err != nil {
+		return msg.Content
+	}
+	return content.Text
 }
 
 // Remove 删除会话
@@ -198,7 +341,7 @@ func (h *ChatHandler) Detail(c *gin.Context) {
 	}
 
 	var chatItem model.ChatItem
-	res := h.DB.Where("chat_id = ?", chatId).First(&chatItem)
+	res := h.DB.Where("chat_id = ?", chatId).Where("user_id", h.GetLoginUserId(c)).First(&chatItem)
 	if res.Error != nil {
 		resp.ERROR(c, "No chat found")
 		return
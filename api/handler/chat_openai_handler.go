@@ -8,20 +8,21 @@ package handler
 // * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
 
 import (
-	"bufio"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"geekai/core/types"
+	"geekai/service"
+	"geekai/service/provider"
 	"geekai/store/model"
 	"geekai/store/vo"
 	"geekai/utils"
 	"io"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/gin-gonic/gin"
 	req2 "github.com/imroc/req/v3"
 )
 
@@ -31,219 +32,248 @@ type Usage struct {
 	PromptTokens     int    `json:"prompt_tokens"`
 	CompletionTokens int    `json:"completion_tokens"`
 	TotalTokens      int    `json:"total_tokens"`
+	ReasoningTokens  int    `json:"reasoning_tokens"`
+	CachedTokens     int    `json:"cached_tokens"`
 }
 
-type OpenAIResVo struct {
-	Id                string `json:"id"`
-	Object            string `json:"object"`
-	Created           int    `json:"created"`
-	Model             string `json:"model"`
-	SystemFingerprint string `json:"system_fingerprint"`
-	Choices           []struct {
-		Index   int `json:"index"`
-		Message struct {
-			Role    string `json:"role"`
-			Content string `json:"content"`
-		} `json:"message"`
-		Logprobs     interface{} `json:"logprobs"`
-		FinishReason string      `json:"finish_reason"`
-	} `json:"choices"`
-	Usage Usage `json:"usage"`
+// 单次对话默认最多连续调用工具的轮数
+const defaultToolMaxDepth = 5
+
+// 模型的一次完整回复
+type chatReply struct {
+	Request   types.ApiRequest // 最后一轮的请求，包含工具调用的上下文
+	Usage     Usage
+	Traces    []types.ToolTrace
+	CreatedAt time.Time
 }
 
-// OPenAI 消息发送实现
+// 发送对话消息，根据 API KEY 选择对应的服务商适配器，统一转换成 SSE 消息推送给前端。
+// 模型返回工具调用时执行工具，把结果以 tool 消息追加到上下文之后再次请求模型，直到模型不再调用工具
 func (h *ChatHandler) sendOpenAiMessage(
 	req types.ApiRequest,
 	userVo vo.User,
 	ctx context.Context,
 	input ChatInput,
-	c *gin.Context) error {
+	out *chatOutput) error {
 	promptCreatedAt := time.Now() // 记录提问时间
-	start := time.Now()
-	var apiKey = model.ApiKey{}
-	response, err := h.doRequest(ctx, req, input, &apiKey)
-	logger.Info("HTTP请求完成，耗时：", time.Since(start))
-	if err != nil {
-		if strings.Contains(err.Error(), "context canceled") {
-			return fmt.Errorf("用户取消了请求：%s", input.Prompt)
-		} else if strings.Contains(err.Error(), "no available key") {
-			return errors.New("抱歉😔😔😔，系统已经没有可用的 API KEY，请联系管理员！")
-		}
+	reply, err := h.streamReply(ctx, req, userVo, input, out)
+	if err != nil || reply == nil {
 		return err
-	} else {
-		defer response.Body.Close()
 	}
 
-	if response.StatusCode != 200 {
-		body, _ := io.ReadAll(response.Body)
-		return fmt.Errorf("请求 OpenAI API 失败：%d, %v", response.StatusCode, string(body))
+	// 消息发送成功
+	message := types.Message{Role: "assistant", Content: reply.Usage.Content}
+	h.saveChatHistory(out, reply.Request, reply.Usage, message, input, userVo, promptCreatedAt, reply.CreatedAt, reply.Traces)
+	return nil
+}
+
+// 请求模型并把输出推送给前端，返回完整的回复。模型没有输出任何内容的时候返回 nil
+func (h *ChatHandler) streamReply(ctx context.Context, req types.ApiRequest, userVo vo.User, input ChatInput, out *chatOutput) (*chatReply, error) {
+	var replyCreatedAt time.Time // 记录回复时间
+	var apiKey = model.ApiKey{}
+	var contents = make([]string, 0)
+	var traces = make([]types.ToolTrace, 0)
+	var usage = Usage{Prompt: input.Prompt}
+	maxDepth := h.App.SysConfig.Base.ToolMaxDepth
+	if maxDepth <= 0 {
+		maxDepth = defaultToolMaxDepth
+	}
+	// 模型只能调用这次请求提供的工具
+	offered := make(map[string]bool, len(req.Tools))
+	for _, tool := range req.Tools {
+		offered[tool.Function.Name] = true
 	}
 
-	contentType := response.Header.Get("Content-Type")
-	if strings.Contains(contentType, "text/event-stream") {
-		replyCreatedAt := time.Now() // 记录回复时间
-		// 循环读取 Chunk 消息
-		var message = types.Message{Role: "assistant"}
-		var contents = make([]string, 0)
-		var function model.Function
-		var toolCall = false
-		var arguments = make([]string, 0)
+	for round := 1; ; round++ {
+		// 达到最大轮数之后不再提供工具，要求模型直接作答
+		if round > maxDepth {
+			req.Tools = nil
+			req.ToolChoice = ""
+			clear(offered)
+		}
+		start := time.Now()
 		var reasoning = false
-
-		scanner := bufio.NewScanner(response.Body)
-		for scanner.Scan() {
-			line := scanner.Text()
-			if !strings.Contains(line, "data:") || len(line) < 30 {
-				continue
-			}
-			var responseBody = types.ApiResponse{}
-			err = json.Unmarshal([]byte(line[6:]), &responseBody)
-			if err != nil { // 数据解析出错
-				return errors.New(line)
-			}
-			if len(responseBody.Choices) == 0 { // Fixed: 兼容 Azure API 第一个输出空行
-				continue
-			}
-			if responseBody.Choices[0].Delta.Content == nil &&
-				responseBody.Choices[0].Delta.ToolCalls == nil &&
-				responseBody.Choices[0].Delta.ReasoningContent == "" {
-				continue
+		response, err := h.doRequest(ctx, req, input, &apiKey, func(delta provider.Delta) {
+			if replyCreatedAt.IsZero() {
+				replyCreatedAt = time.Now()
 			}
-
-			if responseBody.Choices[0].FinishReason == "stop" && len(contents) == 0 {
-				pushMessage(c, "text", "抱歉😔😔😔，AI助手由于未知原因已经停止输出内容。")
-				break
-			}
-
-			var tool types.ToolCall
-			if len(responseBody.Choices[0].Delta.ToolCalls) > 0 {
-				tool = responseBody.Choices[0].Delta.ToolCalls[0]
-				if toolCall && tool.Function.Name == "" {
-					arguments = append(arguments, tool.Function.Arguments)
-					continue
+			switch delta.Type {
+			case provider.DeltaReasoning: // 兼容思考过程
+				reasoningContent := delta.Content
+				if !reasoning {
+					reasoningContent = fmt.Sprintf("<think>%s", reasoningContent)
+					reasoning = true
+				}
+				out.push("text", reasoningContent)
+				contents = append(contents, reasoningContent)
+			case provider.DeltaContent:
+				finalContent := delta.Content
+				if reasoning {
+					finalContent = fmt.Sprintf("</think>%s", delta.Content)
+					reasoning = false
 				}
+				out.push("text", finalContent)
+				contents = append(contents, finalContent)
 			}
-
-			// 兼容 Function Call
-			fun := responseBody.Choices[0].Delta.FunctionCall
-			if fun.Name != "" {
-				tool = *new(types.ToolCall)
-				tool.Function.Name = fun.Name
-			} else if toolCall {
-				arguments = append(arguments, fun.Arguments)
-				continue
+		})
+		logger.Info("HTTP请求完成，耗时：", time.Since(start))
+		// 用户停止了生成或者生成超时，保存已经输出的内容
+		stopped := err != nil && ctx.Err() != nil
+		if err != nil && !stopped {
+			if errors.Is(err, service.ErrNoAvailableKey) {
+				return nil, errors.New("抱歉😔😔😔，系统已经没有可用的 API KEY，请联系管理员！")
+			} else if errors.Is(err, service.ErrKeyRateLimited) {
+				return nil, errors.New("当前请求过多，请稍后再试！")
 			}
+			return nil, err
+		}
+		if reasoning { // 只输出了思考过程
+			out.push("text", "</think>")
+			contents = append(contents, "</think>")
+		}
+		if stopped {
+			// 没有拿到上游返回的用量，按照已经输出的内容估算
+			usage = Usage{Prompt: input.Prompt}
+			break
+		}
 
-			if !utils.IsEmptyValue(tool) {
-				res := h.DB.Where("name = ?", tool.Function.Name).First(&function)
-				if res.Error == nil {
-					toolCall = true
-					callMsg := fmt.Sprintf("正在调用工具 `%s` 作答 ...\n\n", function.Label)
-					pushMessage(c, "text", callMsg)
-					contents = append(contents, callMsg)
-				}
-				continue
-			}
+		// 累计每一轮请求的 token 用量，任何一轮没有返回用量都改为估算
+		if response.Usage.TotalTokens > 0 && (round == 1 || usage.TotalTokens > 0) {
+			usage.PromptTokens += response.Usage.PromptTokens
+			usage.CompletionTokens += response.Usage.CompletionTokens
+			usage.TotalTokens += response.Usage.TotalTokens
+			usage.ReasoningTokens += response.Usage.ReasoningTokens
+			usage.CachedTokens += response.Usage.CachedTokens
+		} else {
+			usage = Usage{Prompt: input.Prompt}
+		}
 
-			if responseBody.Choices[0].FinishReason == "tool_calls" ||
-				responseBody.Choices[0].FinishReason == "function_call" { // 函数调用完毕
-				break
-			}
+		if len(response.ToolCalls) == 0 || round > maxDepth || ctx.Err() != nil {
+			break
+		}
 
-			// output stopped
-			if responseBody.Choices[0].FinishReason != "" {
-				break // 输出完成或者输出中断了
-			} else { // 正常输出结果
-				// 兼容思考过程
-				if responseBody.Choices[0].Delta.ReasoningContent != "" {
-					reasoningContent := responseBody.Choices[0].Delta.ReasoningContent
-					if !reasoning {
-						reasoningContent = fmt.Sprintf("<think>%s", reasoningContent)
-						reasoning = true
-					}
-
-					pushMessage(c, "text", reasoningContent)
-					contents = append(contents, reasoningContent)
-				} else if responseBody.Choices[0].Delta.Content != "" {
-					finalContent := responseBody.Choices[0].Delta.Content
-					if reasoning {
-						finalContent = fmt.Sprintf("</think>%s", responseBody.Choices[0].Delta.Content)
-						reasoning = false
-					}
-					contents = append(contents, utils.InterfaceToString(finalContent))
-					pushMessage(c, "text", finalContent)
-				}
+		// 把模型的工具调用和执行结果追加到上下文中，进入下一轮
+		calls := make([]types.ToolCall, 0, len(response.ToolCalls))
+		for _, call := range response.ToolCalls {
+			call.Index = 0
+			call.Type = "function"
+			if call.Id == "" {
+				call.Id = fmt.Sprintf("call_%s", utils.RandomHex(8))
 			}
-		} // end for
-
-		if err := scanner.Err(); err != nil {
-			if strings.Contains(err.Error(), "context canceled") {
-				logger.Info("用户取消了请求：", input.Prompt)
-			} else {
-				logger.Error("信息读取出错：", err)
+			calls = append(calls, call)
+		}
+		message := map[string]any{
+			"role":       "assistant",
+			"content":    response.Content,
+			"tool_calls": calls,
+		}
+		// Anthropic 开启思考模式时，下一轮请求需要带上签名过的思考内容
+		if len(response.ThinkingBlocks) > 0 {
+			message["thinking_blocks"] = response.ThinkingBlocks
+		}
+		req.Messages = append(req.Messages, message)
+		for _, trace := range h.callTools(ctx, out, calls, offered, round, userVo.Id) {
+			result := trace.Result
+			if trace.Error != "" {
+				result = "调用工具出错：" + trace.Error
 			}
+			req.Messages = append(req.Messages, map[string]any{
+				"role":         "tool",
+				"tool_call_id": trace.Id,
+				"content":      result,
+			})
+			traces = append(traces, trace)
 		}
+	}
 
-		if toolCall { // 调用函数完成任务
-			params := make(map[string]any)
-			_ = utils.JsonDecode(strings.Join(arguments, ""), &params)
-			logger.Debugf("函数名称: %s, 函数参数：%s", function.Name, params)
-			params["user_id"] = userVo.Id
-			var apiRes types.BizVo
-			r, err := req2.C().R().SetHeader("Body-Type", "application/json").
-				SetHeader("Authorization", function.Token).
-				SetBody(params).Post(function.Action)
-			errMsg := ""
-			if err != nil {
-				errMsg = err.Error()
-			} else {
-				all, _ := io.ReadAll(r.Body)
-				err = json.Unmarshal(all, &apiRes)
-				if err != nil {
-					errMsg = err.Error()
-				} else if apiRes.Code != types.Success {
-					errMsg = apiRes.Message
-				}
-			}
+	if ctx.Err() != nil {
+		logger.Info("用户取消了请求：", input.Prompt)
+	}
+	if replyCreatedAt.IsZero() {
+		replyCreatedAt = time.Now()
+	}
 
-			if errMsg != "" {
-				errMsg = "调用函数工具出错：" + errMsg
-				contents = append(contents, errMsg)
-			} else {
-				errMsg = utils.InterfaceToString(apiRes.Data)
-				contents = append(contents, errMsg)
-			}
-			pushMessage(c, "text", errMsg)
+	if len(contents) == 0 && len(traces) == 0 {
+		if ctx.Err() != nil {
+			return nil, errors.New("已停止生成，没有输出任何内容")
 		}
+		out.push("text", "抱歉😔😔😔，AI助手由于未知原因已经停止输出内容。")
+		return nil, nil
+	}
 
-		// 消息发送成功
-		if len(contents) > 0 {
-			usage := Usage{
-				Prompt:           input.Prompt,
-				Content:          strings.Join(contents, ""),
-				PromptTokens:     0,
-				CompletionTokens: 0,
-				TotalTokens:      0,
-			}
-			message.Content = usage.Content
-			h.saveChatHistory(c, req, usage, message, input, userVo, promptCreatedAt, replyCreatedAt)
+	usage.Content = strings.Join(contents, "")
+	return &chatReply{Request: req, Usage: usage, Traces: traces, CreatedAt: replyCreatedAt}, nil
+}
+
+// 并行执行一轮中的所有工具调用，每个调用的开始和结果都会推送给前端
+// offered 是这次请求提供给模型的工具，模型调用其他的工具一律拒绝
+func (h *ChatHandler) callTools(ctx context.Context, out *chatOutput, calls []types.ToolCall, offered map[string]bool, round int, userId uint) []types.ToolTrace {
+	traces := make([]types.ToolTrace, len(calls))
+	var wg sync.WaitGroup
+	for i, call := range calls {
+		trace := types.ToolTrace{Round: round, Id: call.Id, Name: call.Function.Name, Label: call.Function.Name, Arguments: call.Function.Arguments}
+		if !offered[call.Function.Name] {
+			trace.Error = fmt.Sprintf("工具 %s 不在当前对话可以使用的工具中", call.Function.Name)
+			traces[i] = trace
+			continue
 		}
-	} else { // 非流式输出
-		var respVo OpenAIResVo
-		body, err := io.ReadAll(response.Body)
-		if err != nil {
-			return fmt.Errorf("读取响应失败：%v", body)
+		var function model.Function
+		err := h.DB.Where("name", call.Function.Name).Where("enabled", true).First(&function).Error
+		if err == nil && len(h.mcpService.UserFunctions(userId, []model.Function{function})) == 0 {
+			err = errors.New("MCP 服务未启用")
 		}
-		err = json.Unmarshal(body, &respVo)
 		if err != nil {
-			return fmt.Errorf("解析响应失败：%v", body)
+			trace.Error = fmt.Sprintf("工具 %s 不存在或者未启用", call.Function.Name)
+			traces[i] = trace
+			continue
 		}
-		content := respVo.Choices[0].Message.Content
-		pushMessage(c, "text", content)
-		respVo.Usage.Prompt = input.Prompt
-		respVo.Usage.Content = content
-		h.saveChatHistory(c, req, respVo.Usage, respVo.Choices[0].Message, input, userVo, promptCreatedAt, time.Now())
+		trace.Label = function.Label
+		out.push(ChatEventToolCall, trace)
+
+		wg.Add(1)
+		go func(i int, trace types.ToolTrace) {
+			defer wg.Done()
+			result, err := h.callFunction(ctx, function, trace.Arguments, userId)
+			trace.Result = result
+			if err != nil {
+				trace.Error = err.Error()
+			}
+			traces[i] = trace
+		}(i, trace)
 	}
+	wg.Wait()
 
-	return nil
+	// 事件的顺序需要固定，等所有工具执行完之后再统一推送结果
+	for _, trace := range traces {
+		out.push(ChatEventToolResult, trace)
+	}
+	return traces
+}
+
+// 调用函数工具，返回执行结果
+func (h *ChatHandler) callFunction(ctx context.Context, function model.Function, arguments string, userId uint) (string, error) {
+	params := make(map[string]any)
+	_ = utils.JsonDecode(arguments, &params)
+	logger.Debugf("函数名称: %s, 函数参数：%s", function.Name, params)
+	// MCP 工具交给 MCP 服务执行
+	if function.McpServerId > 0 {
+		return h.mcpService.CallTool(ctx, function, params)
+	}
+	params["user_id"] = userId
+	var apiRes types.BizVo
+	r, err := req2.C().R().SetHeader("Body-Type", "application/json").
+		SetHeader("Authorization", function.Token).
+		SetBody(params).Post(function.Action)
+	if err != nil {
+		return "", err
+	}
+	all, _ := io.ReadAll(r.Body)
+	err = json.Unmarshal(all, &apiRes)
+	if err != nil {
+		return "", err
+	}
+	if apiRes.Code != types.Success {
+		return "", errors.New(apiRes.Message)
+	}
+	return utils.InterfaceToString(apiRes.Data), nil
 }
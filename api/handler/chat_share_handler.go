@@ -0,0 +1,253 @@
+package handler
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"errors"
+	"geekai/core/types"
+	"geekai/service"
+	"geekai/store/model"
+	"geekai/store/vo"
+	"geekai/utils"
+	"geekai/utils/resp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// ShareCreate 分享对话，保存当前分支（或者截止到指定消息）的消息快照
+func (h *ChatHandler) ShareCreate(c *gin.Context) {
+	var data struct {
+		ChatId    string `json:"chat_id"`
+		MsgId     uint   `json:"msg_id"`     // 分享到哪条消息为止，为空分享当前分支的全部消息
+		ExpiredAt int64  `json:"expired_at"` // 过期时间，0 为永不过期
+	}
+	if err := c.ShouldBindJSON(&data); err != nil {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+	if data.ExpiredAt > 0 && data.ExpiredAt < time.Now().Unix() {
+		resp.ERROR(c, "过期时间不能早于当前时间")
+		return
+	}
+
+	userId := h.GetLoginUserId(c)
+	var chatItem model.ChatItem
+	if err := h.DB.Where("chat_id", data.ChatId).Where("user_id", userId).First(&chatItem).Error; err != nil {
+		resp.ERROR(c, "会话不存在")
+		return
+	}
+	tree, err := service.LoadChatTree(h.DB, data.ChatId)
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	leafId := tree.ActiveLeaf(chatItem.ActiveMsgId)
+	if data.MsgId > 0 {
+		if _, ok := tree.Get(data.MsgId); !ok {
+			resp.ERROR(c, "消息不存在")
+			return
+		}
+		leafId = data.MsgId
+	}
+	messages := h.branchMessages(tree, leafId)
+	if len(messages) == 0 {
+		resp.ERROR(c, "会话还没有消息，不能分享")
+		return
+	}
+	// 快照里面不保留用户 ID 和其他分支
+	for i := range messages {
+		messages[i].UserId = 0
+		messages[i].Branches = nil
+	}
+
+	item := model.ChatShare{
+		ShareId:   utils.RandomHex(16),
+		UserId:    userId,
+		ChatId:    chatItem.ChatId,
+		MsgId:     leafId,
+		Title:     chatItem.Title,
+		RoleId:    chatItem.RoleId,
+		ModelId:   chatItem.ModelId,
+		Model:     chatItem.Model,
+		Messages:  utils.JsonEncode(messages),
+		MsgNum:    len(messages),
+		ExpiredAt: data.ExpiredAt,
+	}
+	if err = h.DB.Create(&item).Error; err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c, h.shareVo(item, false))
+}
+
+// ShareList 当前用户的分享列表，chat_id 不为空的时候只返回该会话的分享
+func (h *ChatHandler) ShareList(c *gin.Context) {
+	session := h.DB.Where("user_id", h.GetLoginUserId(c))
+	if chatId := h.GetTrim(c, "chat_id"); chatId != "" {
+		session = session.Where("chat_id", chatId)
+	}
+	var items []model.ChatShare
+	var list = make([]vo.ChatShare, 0)
+	if err := session.Omit("messages").Order("id DESC").Find(&items).Error; err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	for _, item := range items {
+		list = append(list, h.shareVo(item, false))
+	}
+	resp.SUCCESS(c, list)
+}
+
+// ShareRemove 取消分享，分享链接立即失效
+func (h *ChatHandler) ShareRemove(c *gin.Context) {
+	id := h.GetInt(c, "id", 0)
+	if id <= 0 {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+	err := h.DB.Where("id", id).Where("user_id", h.GetLoginUserId(c)).Delete(&model.ChatShare{}).Error
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c)
+}
+
+// ShareDetail 查看分享的对话，不需要登录
+func (h *ChatHandler) ShareDetail(c *gin.Context) {
+	item, err := h.getShare(h.GetTrim(c, "share_id"))
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	h.DB.Model(&item).UpdateColumn("views", gorm.Expr("views + ?", 1))
+	item.Views++
+
+	shareVo := h.shareVo(item, true)
+	// 公开访问不暴露原会话的信息
+	shareVo.ChatId = ""
+	shareVo.MsgId = 0
+	var user model.User
+	if h.DB.Select("nickname").Where("id", item.UserId).First(&user).Error == nil {
+		shareVo.Nickname = user.Nickname
+	}
+	resp.SUCCESS(c, shareVo)
+}
+
+// ShareFork 继续分享的对话，把消息快照复制成当前用户的一个新会话
+func (h *ChatHandler) ShareFork(c *gin.Context) {
+	var data struct {
+		ShareId string `json:"share_id"`
+	}
+	if err := c.ShouldBindJSON(&data); err != nil {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+	item, err := h.getShare(data.ShareId)
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	user, err := h.GetLoginUser(c)
+	if err != nil {
+		resp.NotAuth(c)
+		return
+	}
+
+	var messages []vo.ChatMessage
+	if err = utils.JsonDecode(item.Messages, &messages); err != nil {
+		resp.ERROR(c, "分享的消息已损坏")
+		return
+	}
+	// 分享者的私有应用当前用户不能使用，改用默认的公开应用
+	roleId := item.RoleId
+	var role model.ChatApp
+	if h.DB.Where("id", roleId).First(&role).Error != nil || !canUseApp(role, user.Id) {
+		role = model.ChatApp{}
+		h.DB.Select("id").Where("user_id", 0).Where("enable", true).Order("sort_num ASC").First(&role)
+		roleId = role.Id
+	}
+
+	chatId := utils.RandomHex(16)
+	err = h.DB.Transaction(func(tx *gorm.DB) error {
+		var parentId uint
+		for _, m := range messages {
+			msg := model.ChatMessage{
+				UserId:      user.Id,
+				ChatId:      chatId,
+				ParentId:    parentId,
+				Type:        m.Type,
+				Icon:        m.Icon,
+				RoleId:      roleId,
+				Model:       m.Model,
+				Content:     utils.JsonEncode(m.Content),
+				Tokens:      m.Tokens,
+				TotalTokens: m.TotalTokens,
+				ToolCalls:   utils.JsonEncode(m.ToolCalls),
+				Citations:   utils.JsonEncode(m.Citations),
+				SearchText:  m.Content.Text,
+				UseContext:  true,
+			}
+			if m.Type == types.PromptMsg {
+				msg.Icon = user.Avatar
+			}
+			if err := tx.Create(&msg).Error; err != nil {
+				return err
+			}
+			parentId = msg.Id
+		}
+		return tx.Create(&model.ChatItem{
+			ChatId:      chatId,
+			UserId:      user.Id,
+			RoleId:      roleId,
+			Title:       item.Title,
+			ModelId:     item.ModelId,
+			Model:       item.Model,
+			ActiveMsgId: parentId,
+		}).Error
+	})
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c, gin.H{"chat_id": chatId, "role_id": roleId, "model_id": item.ModelId})
+}
+
+// 获取有效的分享，已取消或者已过期的返回错误
+func (h *ChatHandler) getShare(shareId string) (model.ChatShare, error) {
+	var item model.ChatShare
+	if shareId == "" || h.DB.Where("share_id", shareId).First(&item).Error != nil {
+		return item, errors.New("分享不存在或者已经取消")
+	}
+	if item.ExpiredAt > 0 && item.ExpiredAt < time.Now().Unix() {
+		return item, errors.New("分享已经过期")
+	}
+	return item, nil
+}
+
+func (h *ChatHandler) shareVo(item model.ChatShare, withMessages bool) vo.ChatShare {
+	var shareVo vo.ChatShare
+	err := utils.CopyObject(item, &shareVo)
+	if err != nil {
+		logger.Error(err)
+	}
+	shareVo.Id = item.Id
+	shareVo.CreatedAt = item.CreatedAt.Unix()
+	shareVo.UpdatedAt = item.UpdatedAt.Unix()
+	if !withMessages {
+		shareVo.Messages = nil
+	}
+	var role model.ChatApp
+	if h.DB.Select("name", "icon").Where("id", item.RoleId).First(&role).Error == nil {
+		shareVo.RoleName = role.Name
+		shareVo.Icon = role.Icon
+	}
+	return shareVo
+}
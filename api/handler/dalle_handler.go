@@ -132,9 +132,15 @@ func (h *DallJobHandler) Image(c *gin.Context) {
 		Power:    chatModel.Power,
 		TaskInfo: utils.JsonEncode(task),
 	}
-	res := h.DB.Create(&job)
-	if res.Error != nil {
-		resp.ERROR(c, "error with save job: "+res.Error.Error())
+	// 检查同时进行中的任务数量和创建任务在同一把锁里完成
+	err = h.dallService.Admit(user.Id, func() error {
+		if err := h.DB.Create(&job).Error; err != nil {
+			return fmt.Errorf("error with save job: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		resp.ERROR(c, err.Error())
 		return
 	}
 
@@ -213,6 +219,11 @@ func (h *DallJobHandler) getData(finish bool, userId uint, page int, pageSize in
 		return res.Error, vo.Page{}
 	}
 
+	// 进行中的任务返回排队位置
+	var positions map[uint]int
+	if !finish {
+		positions = h.dallService.QueuePositions()
+	}
 	var jobs = make([]vo.DallJob, 0)
 	for _, item := range items {
 		var job vo.DallJob
@@ -220,6 +231,7 @@ func (h *DallJobHandler) getData(finish bool, userId uint, page int, pageSize in
 		if err != nil {
 			continue
 		}
+		job.QueuePosition = positions[job.Id]
 		jobs = append(jobs, job)
 	}
 
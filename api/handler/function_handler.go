@@ -14,6 +14,7 @@ import (
 	"geekai/core/types"
 	"geekai/service"
 	"geekai/service/dalle"
+	"geekai/service/mcp"
 	"geekai/service/oss"
 	"geekai/store/model"
 	"geekai/store/vo"
@@ -33,6 +34,7 @@ type FunctionHandler struct {
 	uploadManager *oss.UploaderManager
 	dallService   *dalle.Service
 	userService   *service.UserService
+	mcpService    *mcp.Service
 }
 
 func NewFunctionHandler(
@@ -41,7 +43,8 @@ func NewFunctionHandler(
 	config *types.AppConfig,
 	manager *oss.UploaderManager,
 	dallService *dalle.Service,
-	userService *service.UserService) *FunctionHandler {
+	userService *service.UserService,
+	mcpService *mcp.Service) *FunctionHandler {
 	return &FunctionHandler{
 		BaseHandler: BaseHandler{
 			App: server,
@@ -50,6 +53,7 @@ func NewFunctionHandler(
 		uploadManager: manager,
 		dallService:   dallService,
 		userService:   userService,
+		mcpService:    mcpService,
 	}
 }
 
@@ -82,6 +86,11 @@ type dataItem struct {
 
 // check authorization
 func (h *FunctionHandler) checkAuth(c *gin.Context) error {
+	_, err := h.parseToken(c)
+	return err
+}
+
+func (h *FunctionHandler) parseToken(c *gin.Context) (jwt.MapClaims, error) {
 	tokenString := c.GetHeader(types.UserAuthHeader)
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
@@ -92,20 +101,20 @@ func (h *FunctionHandler) checkAuth(c *gin.Context) error {
 	})
 
 	if err != nil {
-		return fmt.Errorf("error with parse auth token: %v", err)
+		return nil, fmt.Errorf("error with parse auth token: %v", err)
 	}
 
 	claims, ok := token.Claims.(jwt.MapClaims)
 	if !ok || !token.Valid {
-		return errors.New("token is invalid")
+		return nil, errors.New("token is invalid")
 	}
 
 	expr := utils.IntValue(utils.InterfaceToString(claims["expired"]), 0)
 	if expr > 0 && int64(expr) < time.Now().Unix() {
-		return errors.New("token is expired")
+		return nil, errors.New("token is expired")
 	}
 
-	return nil
+	return claims, nil
 }
 
 // WeiBo 微博热搜
@@ -238,6 +247,12 @@ func (h *FunctionHandler) Dall3(c *gin.Context) {
 	task.Id = job.Id
 	content, err := h.dallService.Image(task, true)
 	if err != nil {
+		// 同步任务失败的时候还没有扣减算力，不需要任务引擎退回
+		h.DB.Model(&job).UpdateColumns(map[string]interface{}{
+			"progress": service.FailTaskProgress,
+			"err_msg":  err.Error(),
+			"power":    0,
+		})
 		resp.ERROR(c, "任务执行失败："+err.Error())
 		return
 	}
@@ -264,6 +279,12 @@ func (h *FunctionHandler) List(c *gin.Context) {
 		resp.ERROR(c, err.Error())
 		return
 	}
+	// 只返回当前用户启用的 MCP 服务的工具，未登录用户不返回 MCP 工具
+	var userId uint
+	if claims, err := h.parseToken(c); err == nil {
+		userId = uint(utils.IntValue(utils.InterfaceToString(claims["user_id"]), 0))
+	}
+	items = h.mcpService.UserFunctions(userId, items)
 
 	tools := make([]vo.Function, 0)
 	for _, v := range items {
@@ -107,11 +107,20 @@ func (h *JimengHandler) CreateTask(c *gin.Context) {
 	}
 	req.Power = powerCost
 
-	job, err := h.jimengService.CreateTask(user.Id, &req)
-	if err != nil {
-		logger.Errorf("create jimeng task failed: %v", err)
+	// 检查同时进行中的任务数量和创建任务在同一把锁里完成
+	var job *model.JimengJob
+	var createErr error
+	err = h.jimengService.Admit(user.Id, func() error {
+		job, createErr = h.jimengService.CreateTask(user.Id, &req)
+		return createErr
+	})
+	if createErr != nil {
+		logger.Errorf("create jimeng task failed: %v", createErr)
 		resp.ERROR(c, "创建任务失败")
 		return
+	} else if err != nil {
+		resp.ERROR(c, err.Error())
+		return
 	}
 
 	h.userService.DecreasePower(user.Id, powerCost, model.PowerLog{
@@ -203,6 +212,7 @@ func (h *JimengHandler) Jobs(c *gin.Context) {
 	}
 
 	// 填充 VO
+	positions := h.jimengService.QueuePositions()
 	var jobVos []vo.JimengJob
 	for _, job := range jobs {
 		var jobVo vo.JimengJob
@@ -211,6 +221,7 @@ func (h *JimengHandler) Jobs(c *gin.Context) {
 			continue
 		}
 		jobVo.CreatedAt = job.CreatedAt.Unix()
+		jobVo.QueuePosition = positions[job.Id]
 		jobVos = append(jobVos, jobVo)
 	}
 	resp.SUCCESS(c, vo.NewPage(total, req.Page, req.PageSize, jobVos))
@@ -254,8 +265,8 @@ func (h *JimengHandler) Remove(c *gin.Context) {
 		return
 	}
 
-	// 失败任务删除后退回算力
-	if job.Status == types.JMTaskStatusFailed {
+	// 失败任务删除后退回算力，任务引擎已经退回的不再重复退回
+	if job.Status == types.JMTaskStatusFailed && job.Power > 0 {
 		logger.Infof("delete jimeng job failed, refund power: %d", job.Power)
 		err = h.userService.IncreasePower(user.Id, job.Power, model.PowerLog{
 			Type:   types.PowerRefund,
@@ -302,10 +313,57 @@ func (h *JimengHandler) Retry(c *gin.Context) {
 		return
 	}
 
-	// 重置任务状态
-	if err := h.jimengService.UpdateJobStatus(uint(jobId), types.JMTaskStatusInQueue, ""); err != nil {
-		logger.Errorf("reset job status failed: %v", err)
-		resp.ERROR(c, "重置任务状态失败")
+	// 失败的任务已经退回了算力，重试需要重新扣减
+	power := 0
+	if job.Power == 0 {
+		var req types.JimengTaskRequest
+		if err := utils.JsonDecode(job.Params, &req); err != nil {
+			resp.ERROR(c, "解析任务参数失败")
+			return
+		}
+		power, err = h.getTaskPower(req)
+		if err != nil {
+			resp.ERROR(c, "计算任务消耗积分失败: "+err.Error())
+			return
+		}
+		user, err := h.GetLoginUser(c)
+		if err != nil {
+			resp.NotAuth(c)
+			return
+		}
+		if user.Power < power {
+			resp.ERROR(c, fmt.Sprintf("算力不足，需要%d算力", power))
+			return
+		}
+	}
+
+	// 检查同时进行中的任务数量和重置任务状态在同一把锁里完成
+	err = h.jimengService.Admit(userId, func() error {
+		// 并发重试的请求在锁里依次执行，前面的请求已经重置了任务状态
+		if current, err := h.jimengService.GetJob(uint(jobId)); err != nil || current.Status != types.JMTaskStatusFailed {
+			return errors.New("只有失败的任务才能重试")
+		}
+		if power > 0 {
+			err := h.userService.DecreasePower(userId, power, model.PowerLog{
+				Type:   types.PowerConsume,
+				Model:  job.ReqKey,
+				Remark: fmt.Sprintf("重试任务，任务ID：%d", job.Id),
+			})
+			if err != nil {
+				return errors.New("扣减算力失败")
+			}
+			h.DB.Model(&model.JimengJob{}).Where("id", job.Id).UpdateColumn("power", power)
+		}
+
+		// 重置任务状态
+		if err := h.jimengService.UpdateJobStatus(uint(jobId), types.JMTaskStatusInQueue, ""); err != nil {
+			logger.Errorf("reset job status failed: %v", err)
+			return errors.New("重置任务状态失败")
+		}
+		return nil
+	})
+	if err != nil {
+		resp.ERROR(c, err.Error())
 		return
 	}
 
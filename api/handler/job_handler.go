@@ -0,0 +1,127 @@
+package handler
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"fmt"
+	"geekai/core"
+	"geekai/core/middleware"
+	"geekai/core/types"
+	"geekai/service/job"
+	"geekai/utils"
+	"geekai/utils/resp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// JobHandler 生成任务的通用操作
+type JobHandler struct {
+	BaseHandler
+	engine *job.Engine
+}
+
+func NewJobHandler(app *core.AppServer, db *gorm.DB, engine *job.Engine) *JobHandler {
+	return &JobHandler{
+		BaseHandler: BaseHandler{
+			App: app,
+			DB:  db,
+		},
+		engine: engine,
+	}
+}
+
+// RegisterRoutes 注册路由
+func (h *JobHandler) RegisterRoutes() {
+	group := h.App.Engine.Group("/api/job/")
+
+	// 需要用户授权的接口
+	group.Use(middleware.UserAuthMiddleware(h.App.Config.Session.SecretKey, h.App.Redis))
+	{
+		group.POST("cancel", h.Cancel)
+		group.GET("events", h.Events)
+	}
+}
+
+// Cancel 取消还没有完成的任务，退回算力
+func (h *JobHandler) Cancel(c *gin.Context) {
+	var data struct {
+		Type string `json:"type"` // 任务类型：mj, sd, dalle, suno, video, jimeng
+		Id   uint   `json:"id"`
+	}
+	if err := c.ShouldBindJSON(&data); err != nil || data.Id == 0 {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+
+	rec, err := h.engine.Load(data.Type, data.Id)
+	if err != nil || rec.UserId != h.GetLoginUserId(c) {
+		resp.ERROR(c, "任务不存在")
+		return
+	}
+	if err = h.engine.Cancel(data.Type, data.Id); err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c)
+}
+
+// Events 推送当前用户的任务事件（创建、进度、完成、失败、退款），代替轮询任务列表。
+// 断线重连的时候从 Last-Event-ID 之后继续接收，没有 Last-Event-ID 的只接收新事件
+func (h *JobHandler) Events(c *gin.Context) {
+	setSSEHeaders(c)
+
+	userId := h.GetLoginUserId(c)
+	lastId := c.GetHeader("Last-Event-ID")
+	if lastId == "" {
+		lastId = h.GetTrim(c, "last_event_id")
+	}
+	if lastId == "" {
+		lastId = h.engine.LatestEventId(userId)
+	}
+
+	events := make(chan []job.Event)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(events)
+		for {
+			items, err := h.engine.Events(c.Request.Context(), userId, lastId)
+			if err != nil {
+				errs <- err
+				return
+			}
+			events <- items
+			lastId = items[len(items)-1].Id
+		}
+	}()
+
+	// 先发送一条注释，客户端收到响应头之后确认连接建立
+	_, _ = c.Writer.WriteString(": connected\n\n")
+	c.Writer.Flush()
+	ticker := time.NewTicker(chatPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case items, ok := <-events:
+			if !ok {
+				if err := <-errs; err != nil && c.Request.Context().Err() == nil {
+					logger.Errorf("读取用户 %d 的任务事件失败：%v", userId, err)
+				}
+				return
+			}
+			for _, event := range items {
+				_, _ = fmt.Fprintf(c.Writer, "id:%s\nevent:message\ndata:%s\n\n", event.Id, utils.JsonEncode(event))
+			}
+			c.Writer.Flush()
+		case <-ticker.C:
+			_, _ = c.Writer.WriteString(": ping\n\n")
+			c.Writer.Flush()
+		}
+	}
+}
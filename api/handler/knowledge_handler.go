@@ -0,0 +1,266 @@
+package handler
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"errors"
+	"geekai/core"
+	"geekai/core/middleware"
+	"geekai/core/types"
+	"geekai/service/oss"
+	"geekai/service/rag"
+	"geekai/store/model"
+	"geekai/store/vo"
+	"geekai/utils"
+	"geekai/utils/resp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// KnowledgeHandler 用户自己的知识库
+type KnowledgeHandler struct {
+	BaseHandler
+	ragService      *rag.Service
+	uploaderManager *oss.UploaderManager
+}
+
+func NewKnowledgeHandler(app *core.AppServer, db *gorm.DB, ragService *rag.Service, manager *oss.UploaderManager) *KnowledgeHandler {
+	return &KnowledgeHandler{BaseHandler: BaseHandler{App: app, DB: db}, ragService: ragService, uploaderManager: manager}
+}
+
+// RegisterRoutes 注册路由
+func (h *KnowledgeHandler) RegisterRoutes() {
+	group := h.App.Engine.Group("/api/knowledge/")
+	group.Use(middleware.UserAuthMiddleware(h.App.Config.Session.SecretKey, h.App.Redis))
+	{
+		group.GET("list", h.List)
+		group.POST("save", h.Save)
+		group.GET("remove", h.Remove)
+		group.GET("docs", h.Docs)
+		group.POST("doc/upload", h.Upload)
+		group.GET("doc/remove", h.RemoveDoc)
+		group.GET("doc/retry", h.RetryDoc)
+	}
+}
+
+// List 知识库列表
+func (h *KnowledgeHandler) List(c *gin.Context) {
+	var items []model.KnowledgeBase
+	h.DB.Where("user_id", h.GetLoginUserId(c)).Order("id DESC").Find(&items)
+	resp.SUCCESS(c, KnowledgeBaseVos(h.DB, items))
+}
+
+// Save 新建或者修改知识库
+func (h *KnowledgeHandler) Save(c *gin.Context) {
+	var data vo.KnowledgeBase
+	if err := c.ShouldBindJSON(&data); err != nil {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+	data.Name = strings.TrimSpace(data.Name)
+	if data.Name == "" {
+		resp.ERROR(c, "知识库名称不能为空")
+		return
+	}
+
+	userId := h.GetLoginUserId(c)
+	kb := model.KnowledgeBase{UserId: userId}
+	if data.Id > 0 {
+		if err := h.DB.Where("id", data.Id).Where("user_id", userId).First(&kb).Error; err != nil {
+			resp.ERROR(c, "知识库不存在")
+			return
+		}
+	}
+	// 已经有文档的知识库不能更换向量模型，不同模型的向量无法混用
+	if kb.Id == 0 || kb.DocNum == 0 {
+		var count int64
+		h.DB.Model(&model.ChatModel{}).Where("id", data.ModelId).Where("type", "embedding").
+			Where("enabled", true).Where("open", true).Count(&count)
+		if count == 0 {
+			resp.ERROR(c, "请选择可用的向量模型")
+			return
+		}
+		kb.ModelId = data.ModelId
+	}
+	if err := FillKnowledgeBase(&kb, data); err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	if err := h.DB.Save(&kb).Error; err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c, KnowledgeBaseVos(h.DB, []model.KnowledgeBase{kb})[0])
+}
+
+// Remove 删除知识库
+func (h *KnowledgeHandler) Remove(c *gin.Context) {
+	kb, err := h.getKb(c, uint(h.GetInt(c, "id", 0)))
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	if err = h.ragService.RemoveKb(kb.Id); err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c)
+}
+
+// Docs 知识库的文档列表
+func (h *KnowledgeHandler) Docs(c *gin.Context) {
+	kb, err := h.getKb(c, uint(h.GetInt(c, "kb_id", 0)))
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	var items []model.KnowledgeDoc
+	h.DB.Where("kb_id", kb.Id).Order("id DESC").Find(&items)
+	resp.SUCCESS(c, KnowledgeDocVos(items))
+}
+
+// Upload 上传文档到知识库
+func (h *KnowledgeHandler) Upload(c *gin.Context) {
+	kb, err := h.getKb(c, uint(h.PostInt(c, "kb_id", 0)))
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	user, err := h.GetLoginUser(c)
+	if err != nil {
+		resp.NotAuth(c)
+		return
+	}
+	if user.Power <= 0 {
+		resp.ERROR(c, "您的算力不足，请购买算力。")
+		return
+	}
+
+	file, err := h.uploaderManager.GetUploadHandler().PutFile(c, "file")
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	doc, err := h.ragService.AddDoc(kb, user.Id, file)
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c, KnowledgeDocVos([]model.KnowledgeDoc{doc})[0])
+}
+
+// RemoveDoc 删除文档
+func (h *KnowledgeHandler) RemoveDoc(c *gin.Context) {
+	doc, err := h.getDoc(c)
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	if err = h.ragService.RemoveDoc(doc); err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c)
+}
+
+// RetryDoc 重新处理失败的文档
+func (h *KnowledgeHandler) RetryDoc(c *gin.Context) {
+	doc, err := h.getDoc(c)
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	if err = h.ragService.Retry(doc); err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c)
+}
+
+func (h *KnowledgeHandler) getKb(c *gin.Context, id uint) (model.KnowledgeBase, error) {
+	var kb model.KnowledgeBase
+	err := h.DB.Where("id", id).Where("user_id", h.GetLoginUserId(c)).First(&kb).Error
+	if err != nil {
+		return kb, errors.New("知识库不存在")
+	}
+	return kb, nil
+}
+
+func (h *KnowledgeHandler) getDoc(c *gin.Context) (model.KnowledgeDoc, error) {
+	var doc model.KnowledgeDoc
+	err := h.DB.Where("id", h.GetInt(c, "id", 0)).Where("user_id", h.GetLoginUserId(c)).First(&doc).Error
+	if err != nil {
+		return doc, errors.New("文档不存在")
+	}
+	return doc, nil
+}
+
+// FillKnowledgeBase 使用提交的数据更新知识库的设置
+func FillKnowledgeBase(kb *model.KnowledgeBase, data vo.KnowledgeBase) error {
+	if data.ChunkSize < 100 || data.ChunkSize > 4000 {
+		return errors.New("分段长度必须在 100 到 4000 之间")
+	}
+	if data.ChunkOverlap < 0 || data.ChunkOverlap >= data.ChunkSize/2 {
+		return errors.New("分段重叠长度不能超过分段长度的一半")
+	}
+	if data.TopK < 1 || data.TopK > 20 {
+		return errors.New("检索数量必须在 1 到 20 之间")
+	}
+	kb.Name = data.Name
+	kb.Description = data.Description
+	kb.ChunkSize = data.ChunkSize
+	kb.ChunkOverlap = data.ChunkOverlap
+	kb.TopK = data.TopK
+	return nil
+}
+
+// KnowledgeBaseVos 知识库转换成 VO，附带向量模型的名称
+func KnowledgeBaseVos(db *gorm.DB, items []model.KnowledgeBase) []vo.KnowledgeBase {
+	modelIds := make([]uint, 0, len(items))
+	for _, item := range items {
+		modelIds = append(modelIds, item.ModelId)
+	}
+	var models []model.ChatModel
+	db.Where("id IN ?", modelIds).Find(&models)
+	names := make(map[uint]string, len(models))
+	for _, m := range models {
+		names[m.Id] = m.Name
+	}
+
+	kbs := make([]vo.KnowledgeBase, 0, len(items))
+	for _, item := range items {
+		var kb vo.KnowledgeBase
+		if err := utils.CopyObject(item, &kb); err != nil {
+			continue
+		}
+		kb.Id = item.Id
+		kb.ModelName = names[item.ModelId]
+		kb.CreatedAt = item.CreatedAt.Unix()
+		kb.UpdatedAt = item.UpdatedAt.Unix()
+		kbs = append(kbs, kb)
+	}
+	return kbs
+}
+
+// KnowledgeDocVos 文档转换成 VO
+func KnowledgeDocVos(items []model.KnowledgeDoc) []vo.KnowledgeDoc {
+	docs := make([]vo.KnowledgeDoc, 0, len(items))
+	for _, item := range items {
+		var doc vo.KnowledgeDoc
+		if err := utils.CopyObject(item, &doc); err != nil {
+			continue
+		}
+		doc.Id = item.Id
+		doc.CreatedAt = item.CreatedAt.Unix()
+		doc.UpdatedAt = item.UpdatedAt.Unix()
+		docs = append(docs, doc)
+	}
+	return docs
+}
@@ -14,7 +14,6 @@ import (
 	"geekai/core/types"
 	"geekai/service"
 	"geekai/store/model"
-	"geekai/utils"
 	"geekai/utils/resp"
 
 	"github.com/gin-gonic/gin"
@@ -24,15 +23,17 @@ import (
 // MarkMapHandler 生成思维导图
 type MarkMapHandler struct {
 	BaseHandler
-	clients     *types.LMap[int, *types.WsClient]
-	userService *service.UserService
+	clients          *types.LMap[int, *types.WsClient]
+	userService      *service.UserService
+	assistantService *service.AssistantService
 }
 
-func NewMarkMapHandler(app *core.AppServer, db *gorm.DB, userService *service.UserService) *MarkMapHandler {
+func NewMarkMapHandler(app *core.AppServer, db *gorm.DB, userService *service.UserService, assistantService *service.AssistantService) *MarkMapHandler {
 	return &MarkMapHandler{
-		BaseHandler: BaseHandler{App: app, DB: db},
-		clients:     types.NewLMap[int, *types.WsClient](),
-		userService: userService,
+		BaseHandler:      BaseHandler{App: app, DB: db},
+		clients:          types.NewLMap[int, *types.WsClient](),
+		userService:      userService,
+		assistantService: assistantService,
 	}
 }
 
@@ -100,7 +101,7 @@ func (h *MarkMapHandler) Generate(c *gin.Context) {
 请直接生成结果，不要任何解释性语句。
 `})
 	messages = append(messages, types.Message{Role: "user", Content: fmt.Sprintf("请生成一份有关【%s】一份思维导图，要求结构清晰，有条理", data.Prompt)})
-	content, err := utils.SendOpenAIMessage(h.DB, messages, data.ModelId)
+	content, err := h.assistantService.SendMessage(messages, data.ModelId)
 	if err != nil {
 		resp.ERROR(c, fmt.Sprintf("请求 OpenAI API 失败: %s", err))
 		return
@@ -0,0 +1,99 @@
+package handler
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"geekai/core"
+	"geekai/core/middleware"
+	"geekai/core/types"
+	"geekai/service/mcp"
+	"geekai/store/model"
+	"geekai/utils/resp"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// McpHandler 用户启用或者关闭 MCP 服务
+type McpHandler struct {
+	BaseHandler
+	mcpService *mcp.Service
+}
+
+func NewMcpHandler(app *core.AppServer, db *gorm.DB, mcpService *mcp.Service) *McpHandler {
+	return &McpHandler{BaseHandler: BaseHandler{App: app, DB: db}, mcpService: mcpService}
+}
+
+// RegisterRoutes 注册路由
+func (h *McpHandler) RegisterRoutes() {
+	group := h.App.Engine.Group("/api/mcp/")
+	group.Use(middleware.UserAuthMiddleware(h.App.Config.Session.SecretKey, h.App.Redis))
+	{
+		group.GET("list", h.List)
+		group.POST("enable", h.Enable)
+	}
+}
+
+type mcpServerVo struct {
+	Id      uint   `json:"id"`
+	Name    string `json:"name"`
+	ToolNum int    `json:"tool_num"`
+	Enabled bool   `json:"enabled"` // 当前用户是否启用
+}
+
+// List 可用的 MCP 服务列表
+func (h *McpHandler) List(c *gin.Context) {
+	var items []model.McpServer
+	h.DB.Where("enabled", true).Order("id ASC").Find(&items)
+	ids := h.mcpService.UserServerIds(h.GetLoginUserId(c))
+	servers := make([]mcpServerVo, 0)
+	for _, item := range items {
+		servers = append(servers, mcpServerVo{
+			Id:      item.Id,
+			Name:    item.Name,
+			ToolNum: item.ToolNum,
+			Enabled: slices.Contains(ids, item.Id),
+		})
+	}
+	resp.SUCCESS(c, servers)
+}
+
+// Enable 启用或者关闭 MCP 服务，启用之后服务的工具才会出现在工具列表中
+func (h *McpHandler) Enable(c *gin.Context) {
+	var data struct {
+		Id      uint `json:"id"`
+		Enabled bool `json:"enabled"`
+	}
+	if err := c.ShouldBindJSON(&data); err != nil {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+
+	userId := h.GetLoginUserId(c)
+	if !data.Enabled {
+		h.DB.Where("user_id", userId).Where("server_id", data.Id).Delete(&model.UserMcpServer{})
+		resp.SUCCESS(c)
+		return
+	}
+
+	var server model.McpServer
+	if err := h.DB.Where("id", data.Id).Where("enabled", true).First(&server).Error; err != nil {
+		resp.ERROR(c, "MCP 服务不存在或者已经被禁用")
+		return
+	}
+	var count int64
+	h.DB.Model(&model.UserMcpServer{}).Where("user_id", userId).Where("server_id", server.Id).Count(&count)
+	if count == 0 {
+		if err := h.DB.Create(&model.UserMcpServer{UserId: userId, ServerId: server.Id}).Error; err != nil {
+			resp.ERROR(c, err.Error())
+			return
+		}
+	}
+	resp.SUCCESS(c)
+}
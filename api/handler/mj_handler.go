@@ -85,6 +85,16 @@ func (h *MidJourneyHandler) preCheck(c *gin.Context) bool {
 
 }
 
+// 创建任务，检查同时进行中的任务数量和创建任务在同一把锁里完成
+func (h *MidJourneyHandler) createJob(job *model.MidJourneyJob) error {
+	return h.mjService.Admit(job.UserId, func() error {
+		if err := h.DB.Create(job).Error; err != nil {
+			return fmt.Errorf("添加任务失败：%v", err)
+		}
+		return nil
+	})
+}
+
 // Image 创建一个绘画任务
 func (h *MidJourneyHandler) Image(c *gin.Context) {
 	var data struct {
@@ -227,8 +237,8 @@ func (h *MidJourneyHandler) Image(c *gin.Context) {
 		opt = "换脸"
 	}
 
-	if res := h.DB.Create(&job); res.Error != nil || res.RowsAffected == 0 {
-		resp.ERROR(c, "添加任务失败："+res.Error.Error())
+	if err := h.createJob(&job); err != nil {
+		resp.ERROR(c, err.Error())
 		return
 	}
 
@@ -289,8 +299,8 @@ func (h *MidJourneyHandler) Upscale(c *gin.Context) {
 		Power:     h.App.SysConfig.Base.MjActionPower,
 		CreatedAt: time.Now(),
 	}
-	if res := h.DB.Create(&job); res.Error != nil || res.RowsAffected == 0 {
-		resp.ERROR(c, "添加任务失败："+res.Error.Error())
+	if err := h.createJob(&job); err != nil {
+		resp.ERROR(c, err.Error())
 		return
 	}
 
@@ -345,8 +355,8 @@ func (h *MidJourneyHandler) Variation(c *gin.Context) {
 		Power:     h.App.SysConfig.Base.MjActionPower,
 		CreatedAt: time.Now(),
 	}
-	if res := h.DB.Create(&job); res.Error != nil || res.RowsAffected == 0 {
-		resp.ERROR(c, "添加任务失败："+res.Error.Error())
+	if err := h.createJob(&job); err != nil {
+		resp.ERROR(c, err.Error())
 		return
 	}
 
@@ -425,6 +435,11 @@ func (h *MidJourneyHandler) getData(finish bool, userId uint, page int, pageSize
 		return res.Error, vo.Page{}
 	}
 
+	// 进行中的任务返回排队位置
+	var positions map[uint]int
+	if !finish {
+		positions = h.mjService.QueuePositions()
+	}
 	var jobs = make([]vo.MidJourneyJob, 0)
 	for _, item := range items {
 		var job vo.MidJourneyJob
@@ -432,6 +447,7 @@ func (h *MidJourneyHandler) getData(finish bool, userId uint, page int, pageSize
 		if err != nil {
 			continue
 		}
+		job.QueuePosition = positions[job.Id]
 		jobs = append(jobs, job)
 	}
 	return nil, vo.NewPage(total, page, pageSize, jobs)
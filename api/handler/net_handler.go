@@ -107,7 +107,7 @@ func (h *NetHandler) List(c *gin.Context) {
 		offset := (data.Page - 1) * data.PageSize
 		session = session.Offset(offset).Limit(data.PageSize)
 	}
-	err := session.Order("id desc").Find(&items).Error
+	err := session.Omit("content").Order("id desc").Find(&items).Error
 	if err != nil {
 		resp.ERROR(c, err.Error())
 		return
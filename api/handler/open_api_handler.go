@@ -0,0 +1,413 @@
+package handler
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"errors"
+	"fmt"
+	"geekai/core"
+	"geekai/core/middleware"
+	"geekai/core/types"
+	"geekai/service"
+	"geekai/service/provider"
+	"geekai/store/model"
+	"geekai/utils"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// OpenApiHandler OpenAI 兼容的开放接口，使用用户创建的访问令牌鉴权，按算力计费
+type OpenApiHandler struct {
+	BaseHandler
+	chatHandler    *ChatHandler
+	userService    *service.UserService
+	licenseService *service.LicenseService
+}
+
+func NewOpenApiHandler(app *core.AppServer, db *gorm.DB, chatHandler *ChatHandler, userService *service.UserService, licenseService *service.LicenseService) *OpenApiHandler {
+	return &OpenApiHandler{
+		BaseHandler:    BaseHandler{App: app, DB: db},
+		chatHandler:    chatHandler,
+		userService:    userService,
+		licenseService: licenseService,
+	}
+}
+
+// RegisterRoutes 注册路由
+func (h *OpenApiHandler) RegisterRoutes() {
+	group := h.App.Engine.Group("/v1/")
+	group.Use(middleware.ApiTokenAuthMiddleware(h.DB))
+	{
+		group.POST("chat/completions", h.ChatCompletions)
+		group.GET("models", h.Models)
+		group.POST("embeddings", h.Embeddings)
+	}
+}
+
+type openApiChatRequest struct {
+	Model               string              `json:"model"`
+	Messages            []any               `json:"messages"`
+	Stream              bool                `json:"stream"`
+	Temperature         *float32            `json:"temperature"`
+	MaxTokens           int                 `json:"max_tokens"`
+	MaxCompletionTokens int                 `json:"max_completion_tokens"`
+	Tools               []types.Tool        `json:"tools"`
+	ToolChoice          any                 `json:"tool_choice"`
+	ResponseFormat      any                 `json:"response_format"`
+	StreamOptions       types.StreamOptions `json:"stream_options"`
+}
+
+// 流式输出的工具调用片段，index 字段不能省略
+type openApiToolCall struct {
+	Index    int    `json:"index"`
+	Id       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+// ChatCompletions 对话补全接口，兼容 OpenAI /v1/chat/completions
+func (h *OpenApiHandler) ChatCompletions(c *gin.Context) {
+	var data openApiChatRequest
+	if err := c.ShouldBindJSON(&data); err != nil || data.Model == "" || len(data.Messages) == 0 {
+		apiError(c, http.StatusBadRequest, "invalid_request_error", "请求参数错误，model 和 messages 不能为空")
+		return
+	}
+
+	chatModel, err := h.getModel(c, data.Model, "chat")
+	if err != nil {
+		apiError(c, http.StatusNotFound, "model_not_found", err.Error())
+		return
+	}
+	user, _ := h.GetLoginUser(c)
+	if user.ExpiredTime > 0 && user.ExpiredTime <= time.Now().Unix() {
+		apiError(c, http.StatusForbidden, "account_expired", "您的账号已经过期，请联系管理员！")
+		return
+	}
+
+	req := types.ApiRequest{
+		Model:          chatModel.Value,
+		Stream:         data.Stream,
+		Temperature:    chatModel.Temperature,
+		Messages:       data.Messages,
+		Tools:          data.Tools,
+		ResponseFormat: data.ResponseFormat,
+	}
+	if data.Temperature != nil {
+		req.Temperature = *data.Temperature
+	}
+	maxTokens := chatModel.MaxTokens
+	if data.MaxCompletionTokens > 0 {
+		maxTokens = data.MaxCompletionTokens
+	} else if data.MaxTokens > 0 {
+		maxTokens = data.MaxTokens
+	}
+	if strings.HasPrefix(chatModel.Value, "o1-") ||
+		strings.HasPrefix(chatModel.Value, "o3-") ||
+		strings.HasPrefix(chatModel.Value, "gpt") {
+		req.MaxCompletionTokens = maxTokens
+	} else {
+		req.MaxTokens = maxTokens
+	}
+	if choice, ok := data.ToolChoice.(string); ok {
+		req.ToolChoice = choice
+	} else if len(req.Tools) > 0 {
+		req.ToolChoice = "auto"
+	}
+	if user.Power < service.EstimateChatPower(chatModel, getTotalTokens(req)) {
+		apiError(c, http.StatusTooManyRequests, "insufficient_quota", "您的算力不足，请购买算力。")
+		return
+	}
+
+	chunkId := "chatcmpl-" + utils.RandomHex(12)
+	created := time.Now().Unix()
+	chunk := func(delta gin.H, finishReason any) gin.H {
+		return gin.H{
+			"id":      chunkId,
+			"object":  "chat.completion.chunk",
+			"created": created,
+			"model":   data.Model,
+			"choices": []gin.H{{"index": 0, "delta": delta, "finish_reason": finishReason}},
+		}
+	}
+	if data.Stream {
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Header("X-Accel-Buffering", "no")
+	}
+
+	var apiKey model.ApiKey
+	input := ChatInput{UserId: user.Id, ModelId: chatModel.Id, ChatModel: chatModel}
+	started := false
+	response, err := h.chatHandler.doRequest(c.Request.Context(), req, input, &apiKey, func(delta provider.Delta) {
+		if !data.Stream {
+			return
+		}
+		if !started {
+			writeChunk(c, chunk(gin.H{"role": "assistant", "content": ""}, nil))
+			started = true
+		}
+		switch delta.Type {
+		case provider.DeltaReasoning:
+			writeChunk(c, chunk(gin.H{"reasoning_content": delta.Content}, nil))
+		case provider.DeltaContent:
+			writeChunk(c, chunk(gin.H{"content": delta.Content}, nil))
+		}
+	})
+	if err != nil {
+		logger.Errorf("open api request failed: %v", err)
+		status, message := upstreamError(err)
+		if started { // 已经开始输出，只能通过 SSE 返回错误
+			writeChunk(c, gin.H{"error": gin.H{"message": message, "type": "upstream_error"}})
+			return
+		}
+		if errors.Is(err, service.ErrKeyRateLimited) {
+			apiError(c, http.StatusTooManyRequests, "rate_limit_exceeded", "当前请求过多，请稍后再试！")
+			return
+		}
+		apiError(c, status, "upstream_error", message)
+		return
+	}
+
+	usage := h.consumePower(user, chatModel, req, response)
+	finishReason := response.FinishReason
+	if finishReason == "" {
+		finishReason = "stop"
+	}
+	toolCalls := make([]openApiToolCall, 0, len(response.ToolCalls))
+	for i, call := range response.ToolCalls {
+		item := openApiToolCall{Index: i, Id: call.Id, Type: "function"}
+		if item.Id == "" {
+			item.Id = fmt.Sprintf("call_%s", utils.RandomHex(8))
+		}
+		item.Function.Name = call.Function.Name
+		item.Function.Arguments = call.Function.Arguments
+		toolCalls = append(toolCalls, item)
+	}
+
+	if !data.Stream {
+		message := gin.H{"role": "assistant", "content": response.Content}
+		if response.Reasoning != "" {
+			message["reasoning_content"] = response.Reasoning
+		}
+		if len(toolCalls) > 0 {
+			message["tool_calls"] = toolCalls
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"id":      chunkId,
+			"object":  "chat.completion",
+			"created": created,
+			"model":   data.Model,
+			"choices": []gin.H{{"index": 0, "message": message, "finish_reason": finishReason}},
+			"usage":   usage,
+		})
+		return
+	}
+
+	if !started {
+		writeChunk(c, chunk(gin.H{"role": "assistant", "content": ""}, nil))
+	}
+	if len(toolCalls) > 0 {
+		writeChunk(c, chunk(gin.H{"tool_calls": toolCalls}, nil))
+	}
+	writeChunk(c, chunk(gin.H{}, finishReason))
+	if data.StreamOptions.IncludeUsage {
+		writeChunk(c, gin.H{
+			"id":      chunkId,
+			"object":  "chat.completion.chunk",
+			"created": created,
+			"model":   data.Model,
+			"choices": []gin.H{},
+			"usage":   usage,
+		})
+	}
+	_, _ = c.Writer.WriteString("data: [DONE]\n\n")
+	c.Writer.Flush()
+}
+
+// Models 当前令牌可以访问的模型列表，兼容 OpenAI /v1/models
+func (h *OpenApiHandler) Models(c *gin.Context) {
+	var items []model.ChatModel
+	h.DB.Where("enabled", true).Where("type IN ?", []string{"chat", "embedding"}).Order("sort_num ASC").Find(&items)
+	user, _ := h.GetLoginUser(c)
+	token := h.getToken(c)
+	list := make([]gin.H, 0)
+	for _, item := range items {
+		if !h.canAccess(user, token, item) {
+			continue
+		}
+		list = append(list, gin.H{
+			"id":       item.Value,
+			"object":   "model",
+			"created":  item.CreatedAt.Unix(),
+			"owned_by": "geekai",
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": list})
+}
+
+// Embeddings 文本向量化接口，兼容 OpenAI /v1/embeddings
+func (h *OpenApiHandler) Embeddings(c *gin.Context) {
+	var data provider.EmbeddingRequest
+	if err := c.ShouldBindJSON(&data); err != nil || data.Model == "" || data.Input == nil {
+		apiError(c, http.StatusBadRequest, "invalid_request_error", "请求参数错误，model 和 input 不能为空")
+		return
+	}
+
+	chatModel, err := h.getModel(c, data.Model, "embedding")
+	if err != nil {
+		apiError(c, http.StatusNotFound, "model_not_found", err.Error())
+		return
+	}
+	user, _ := h.GetLoginUser(c)
+	tokens, _ := utils.CalcTokens(utils.JsonEncode(data.Input), chatModel.Value)
+	if user.Power < service.EstimateChatPower(chatModel, tokens) {
+		apiError(c, http.StatusTooManyRequests, "insufficient_quota", "您的算力不足，请购买算力。")
+		return
+	}
+
+	lease, err := h.chatHandler.apiKeyService.Acquire("embedding", chatModel.KeyId, tokens)
+	if errors.Is(err, service.ErrKeyRateLimited) {
+		apiError(c, http.StatusTooManyRequests, "rate_limit_exceeded", "当前请求过多，请稍后再试！")
+		return
+	} else if err != nil {
+		apiError(c, http.StatusServiceUnavailable, "no_available_key", "系统已经没有可用的 API KEY，请联系管理员！")
+		return
+	}
+	apiKey := lease.Key
+	if err = h.licenseService.IsValidApiURL(apiKey.ApiURL); err != nil {
+		logger.Errorf("open api invalid api url: %v", err)
+		apiError(c, http.StatusServiceUnavailable, "invalid_api_url", "系统配置错误，请联系管理员！")
+		return
+	}
+
+	data.Model = chatModel.Value
+	res, err := provider.CreateEmbeddings(c.Request.Context(), apiKey, data)
+	if err != nil {
+		h.chatHandler.apiKeyService.ReportFailure(apiKey, err)
+		logger.Errorf("open api embedding failed: %v", err)
+		status, message := upstreamError(err)
+		apiError(c, status, "upstream_error", message)
+		return
+	}
+	lease.Done(res.Usage.TotalTokens)
+
+	power, detail := service.CalcChatPower(chatModel, service.TokenUsage{PromptTokens: res.Usage.PromptTokens})
+	if power > 0 {
+		err = h.userService.DecreasePower(user.Id, power, model.PowerLog{
+			Type:   types.PowerConsume,
+			Model:  chatModel.Value,
+			Remark: fmt.Sprintf("开放接口调用，模型名称：%s，%s", chatModel.Name, detail),
+		})
+		if err != nil {
+			logger.Error(err)
+		}
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// 根据模型值查询模型，并且校验当前令牌是否有权限访问
+func (h *OpenApiHandler) getModel(c *gin.Context, value string, modelType string) (model.ChatModel, error) {
+	var chatModel model.ChatModel
+	err := h.DB.Where("value", value).Where("type", modelType).Where("enabled", true).First(&chatModel).Error
+	if err != nil {
+		return chatModel, fmt.Errorf("模型 %s 不存在或者未启用", value)
+	}
+	user, _ := h.GetLoginUser(c)
+	if !h.canAccess(user, h.getToken(c), chatModel) {
+		return chatModel, fmt.Errorf("当前访问令牌没有权限访问模型 %s", value)
+	}
+	return chatModel, nil
+}
+
+// 模型需要对用户开放，并且在令牌的授权范围内
+func (h *OpenApiHandler) canAccess(user model.User, token model.ApiToken, chatModel model.ChatModel) bool {
+	if !chatModel.Open {
+		var models []uint
+		_ = utils.JsonDecode(user.ChatModels, &models)
+		if !slices.Contains(models, chatModel.Id) {
+			return false
+		}
+	}
+	var scopes []uint
+	_ = utils.JsonDecode(token.Models, &scopes)
+	return len(scopes) == 0 || slices.Contains(scopes, chatModel.Id)
+}
+
+func (h *OpenApiHandler) getToken(c *gin.Context) model.ApiToken {
+	value, exists := c.Get(types.ApiTokenCache)
+	if exists {
+		return value.(model.ApiToken)
+	}
+	return model.ApiToken{}
+}
+
+// 扣减算力，上游没有返回用量的时候自己估算
+func (h *OpenApiHandler) consumePower(user model.User, chatModel model.ChatModel, req types.ApiRequest, response *provider.Response) provider.Usage {
+	usage := response.Usage
+	if usage.PromptTokens == 0 {
+		usage.PromptTokens = getTotalTokens(req)
+	}
+	if usage.CompletionTokens == 0 {
+		usage.CompletionTokens, _ = utils.CalcTokens(response.Reasoning+response.Content, req.Model)
+	}
+	if usage.TotalTokens == 0 {
+		usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	}
+
+	power, detail := service.CalcChatPower(chatModel, service.TokenUsage{
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		CachedTokens:     usage.CachedTokens,
+	})
+	if power > 0 {
+		err := h.userService.DecreasePower(user.Id, power, model.PowerLog{
+			Type:   types.PowerConsume,
+			Model:  chatModel.Value,
+			Remark: fmt.Sprintf("开放接口调用，模型名称：%s，%s", chatModel.Name, detail),
+		})
+		if err != nil {
+			logger.Error(err)
+		}
+	}
+	return usage
+}
+
+func writeChunk(c *gin.Context, data any) {
+	_, _ = c.Writer.WriteString(fmt.Sprintf("data: %s\n\n", utils.JsonEncode(data)))
+	c.Writer.Flush()
+}
+
+// 按照 OpenAI 的格式返回错误信息
+// 上游的错误信息里面有服务商名称和原始的响应内容，鉴权和限流等错误不能透传给调用方
+// 只有请求参数校验失败（400）的时候返回上游的错误内容，方便调用方修正请求
+func upstreamError(err error) (int, string) {
+	var apiErr *provider.ApiError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusBadRequest {
+		return http.StatusBadRequest, apiErr.Body
+	}
+	return http.StatusBadGateway, "上游服务请求失败，请稍后再试！"
+}
+
+func apiError(c *gin.Context, status int, code string, message string) {
+	c.JSON(status, gin.H{
+		"error": gin.H{
+			"message": message,
+			"type":    "invalid_request_error",
+			"code":    code,
+		},
+	})
+}
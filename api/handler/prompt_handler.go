@@ -14,7 +14,6 @@ import (
 	"geekai/core/types"
 	"geekai/service"
 	"geekai/store/model"
-	"geekai/utils"
 	"geekai/utils/resp"
 	"strings"
 	"time"
@@ -28,16 +27,18 @@ import (
 
 type PromptHandler struct {
 	BaseHandler
-	userService *service.UserService
+	userService      *service.UserService
+	assistantService *service.AssistantService
 }
 
-func NewPromptHandler(app *core.AppServer, db *gorm.DB, userService *service.UserService) *PromptHandler {
+func NewPromptHandler(app *core.AppServer, db *gorm.DB, userService *service.UserService, assistantService *service.AssistantService) *PromptHandler {
 	return &PromptHandler{
 		BaseHandler: BaseHandler{
 			App: app,
 			DB:  db,
 		},
-		userService: userService,
+		userService:      userService,
+		assistantService: assistantService,
 	}
 }
 
@@ -64,7 +65,7 @@ func (h *PromptHandler) Lyric(c *gin.Context) {
 		resp.ERROR(c, types.InvalidArgs)
 		return
 	}
-	content, err := utils.OpenAIRequest(h.DB, fmt.Sprintf(service.LyricPromptTemplate, data.Prompt), h.App.SysConfig.Base.AssistantModelId)
+	content, err := h.assistantService.Request(fmt.Sprintf(service.LyricPromptTemplate, data.Prompt), h.App.SysConfig.Base.AssistantModelId)
 	if err != nil {
 		resp.ERROR(c, err.Error())
 		return
@@ -82,7 +83,7 @@ func (h *PromptHandler) Image(c *gin.Context) {
 		resp.ERROR(c, types.InvalidArgs)
 		return
 	}
-	content, err := utils.OpenAIRequest(h.DB, fmt.Sprintf(service.ImagePromptOptimizeTemplate, data.Prompt), h.App.SysConfig.Base.AssistantModelId)
+	content, err := h.assistantService.Request(fmt.Sprintf(service.ImagePromptOptimizeTemplate, data.Prompt), h.App.SysConfig.Base.AssistantModelId)
 	if err != nil {
 		resp.ERROR(c, err.Error())
 		return
@@ -100,7 +101,7 @@ func (h *PromptHandler) Video(c *gin.Context) {
 		resp.ERROR(c, types.InvalidArgs)
 		return
 	}
-	content, err := utils.OpenAIRequest(h.DB, fmt.Sprintf(service.VideoPromptTemplate, data.Prompt), h.App.SysConfig.Base.AssistantModelId)
+	content, err := h.assistantService.Request(fmt.Sprintf(service.VideoPromptTemplate, data.Prompt), h.App.SysConfig.Base.AssistantModelId)
 	if err != nil {
 		resp.ERROR(c, err.Error())
 		return
@@ -127,7 +128,7 @@ func (h *PromptHandler) MetaPrompt(c *gin.Context) {
 		Role:    "user",
 		Content: "Task, Goal, or the Role to actor is:\n" + data.Prompt,
 	})
-	content, err := utils.SendOpenAIMessage(h.DB, messages, 0)
+	content, err := h.assistantService.SendMessage(messages, 0)
 	if err != nil {
 		resp.ERROR(c, err.Error())
 		return
@@ -2,6 +2,7 @@ package handler
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"geekai/core"
 	"geekai/core/middleware"
@@ -14,7 +15,6 @@ import (
 	"net/http"
 	"regexp"
 	"strings"
-	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
@@ -33,11 +33,12 @@ import (
 
 type RealtimeHandler struct {
 	BaseHandler
-	userService *service.UserService
+	userService   *service.UserService
+	apiKeyService *service.ApiKeyService
 }
 
-func NewRealtimeHandler(server *core.AppServer, db *gorm.DB, userService *service.UserService) *RealtimeHandler {
-	return &RealtimeHandler{BaseHandler: BaseHandler{App: server, DB: db}, userService: userService}
+func NewRealtimeHandler(server *core.AppServer, db *gorm.DB, userService *service.UserService, apiKeyService *service.ApiKeyService) *RealtimeHandler {
+	return &RealtimeHandler{BaseHandler: BaseHandler{App: server, DB: db}, userService: userService, apiKeyService: apiKeyService}
 }
 
 // RegisterRoutes 注册路由
@@ -84,13 +85,17 @@ func (h *RealtimeHandler) Connection(c *gin.Context) {
 		return
 	}
 
-	var apiKey model.ApiKey
-	h.DB.Where("type", "realtime").Where("enabled", true).Order("last_used_at ASC").First(&apiKey)
-	if apiKey.Id == 0 {
+	lease, err := h.apiKeyService.Acquire("realtime", 0, 0)
+	if errors.Is(err, service.ErrKeyRateLimited) {
+		sendError(ws, "当前请求过多，请稍后再试")
+		c.Abort()
+		return
+	} else if err != nil {
 		sendError(ws, "管理员未配置 Realtime API KEY")
 		c.Abort()
 		return
 	}
+	apiKey := lease.Key
 
 	apiURL := fmt.Sprintf("%s/v1/realtime?model=%s", apiKey.ApiURL, md)
 	// 连接到真实的后端服务器，传入相同的子协议
@@ -115,9 +120,6 @@ func (h *RealtimeHandler) Connection(c *gin.Context) {
 		return
 	}
 
-	// 更新API KEY 最后使用时间
-	h.DB.Model(&model.ApiKey{}).Where("id", apiKey.Id).UpdateColumn("last_used_at", time.Now().Unix())
-
 	// 开始双向转发
 	errorChan := make(chan error, 2)
 	go relay(ws, backendConn, errorChan)
@@ -152,12 +154,12 @@ func sendError(ws *websocket.Conn, message string) {
 
 // OpenAI 实时语音对话，一次性对话
 func (h *RealtimeHandler) VoiceChat(c *gin.Context) {
-	var apiKey model.ApiKey
-	err := h.DB.Session(&gorm.Session{}).Where("type", "realtime").Where("enabled", true).First(&apiKey).Error
+	lease, err := h.apiKeyService.Acquire("realtime", 0, 0)
 	if err != nil {
 		resp.ERROR(c, fmt.Sprintf("error with fetch OpenAI API KEY：%v", err))
 		return
 	}
+	apiKey := lease.Key
 
 	// 检查用户是否还有算力
 	userId := h.GetLoginUserId(c)
@@ -207,9 +209,6 @@ func (h *RealtimeHandler) VoiceChat(c *gin.Context) {
 		resp.ERROR(c, fmt.Sprintf("解析API数据失败：%v, %s", err, string(body)))
 	}
 
-	// 更新 API KEY 的最后使用时间
-	h.DB.Model(&apiKey).UpdateColumn("last_used_at", time.Now().Unix())
-
 	// 扣减算力
 	err = h.userService.DecreasePower(userId, h.App.SysConfig.Base.AdvanceVoicePower, model.PowerLog{
 		Type:   types.PowerConsume,
@@ -190,9 +190,15 @@ func (h *SdJobHandler) Image(c *gin.Context) {
 		Power:     h.App.SysConfig.Base.SdPower,
 		CreatedAt: time.Now(),
 	}
-	res := h.DB.Create(&job)
-	if res.Error != nil {
-		resp.ERROR(c, "error with save job: "+res.Error.Error())
+	// 检查同时进行中的任务数量和创建任务在同一把锁里完成
+	err = h.sdService.Admit(job.UserId, func() error {
+		if err := h.DB.Create(&job).Error; err != nil {
+			return fmt.Errorf("error with save job: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		resp.ERROR(c, err.Error())
 		return
 	}
 
@@ -273,6 +279,11 @@ func (h *SdJobHandler) getData(finish bool, userId uint, page int, pageSize int,
 		return res.Error, vo.Page{}
 	}
 
+	// 进行中的任务返回排队位置
+	var positions map[uint]int
+	if !finish {
+		positions = h.sdService.QueuePositions()
+	}
 	var jobs = make([]vo.SdJob, 0)
 	for _, item := range items {
 		var job vo.SdJob
@@ -280,6 +291,7 @@ func (h *SdJobHandler) getData(finish bool, userId uint, page int, pageSize int,
 		if err != nil {
 			continue
 		}
+		job.QueuePosition = positions[job.Id]
 		jobs = append(jobs, job)
 	}
 
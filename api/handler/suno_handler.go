@@ -170,9 +170,12 @@ func (h *SunoHandler) Create(c *gin.Context) {
 	if data.Lyrics != "" {
 		job.Prompt = data.Lyrics
 	}
-	tx := h.DB.Create(&job)
-	if tx.Error != nil {
-		resp.ERROR(c, tx.Error.Error())
+	// 检查同时进行中的任务数量和创建任务在同一把锁里完成
+	err = h.sunoService.Admit(user.Id, func() error {
+		return h.DB.Create(&job).Error
+	})
+	if err != nil {
+		resp.ERROR(c, err.Error())
 		return
 	}
 
@@ -229,6 +232,7 @@ func (h *SunoHandler) List(c *gin.Context) {
 		songMap[t.SongId] = t
 	}
 	// 转换为 VO
+	positions := h.sunoService.QueuePositions()
 	items := make([]vo.SunoJob, 0)
 	for _, v := range list {
 		var item vo.SunoJob
@@ -237,6 +241,7 @@ func (h *SunoHandler) List(c *gin.Context) {
 			continue
 		}
 		item.CreatedAt = v.CreatedAt.Unix()
+		item.QueuePosition = positions[v.Id]
 		if s, ok := songMap[v.RefSongId]; ok {
 			item.RefSong = map[string]interface{}{
 				"id":    s.Id,
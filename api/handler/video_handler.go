@@ -137,9 +137,12 @@ func (h *VideoHandler) LumaCreate(c *gin.Context) {
 		Power:    h.App.SysConfig.Base.LumaPower,
 		TaskInfo: utils.JsonEncode(task),
 	}
-	tx := h.DB.Create(&job)
-	if tx.Error != nil {
-		resp.ERROR(c, tx.Error.Error())
+	// 检查同时进行中的任务数量和创建任务在同一把锁里完成
+	err = h.videoService.Admit(job.UserId, func() error {
+		return h.DB.Create(&job).Error
+	})
+	if err != nil {
+		resp.ERROR(c, err.Error())
 		return
 	}
 
@@ -234,9 +237,12 @@ func (h *VideoHandler) KeLingCreate(c *gin.Context) {
 		Power:    power,
 		TaskInfo: utils.JsonEncode(task),
 	}
-	tx := h.DB.Create(&job)
-	if tx.Error != nil {
-		resp.ERROR(c, tx.Error.Error())
+	// 检查同时进行中的任务数量和创建任务在同一把锁里完成
+	err = h.videoService.Admit(job.UserId, func() error {
+		return h.DB.Create(&job).Error
+	})
+	if err != nil {
+		resp.ERROR(c, err.Error())
 		return
 	}
 
@@ -288,6 +294,7 @@ func (h *VideoHandler) List(c *gin.Context) {
 	}
 
 	// 转换为 VO
+	positions := h.videoService.QueuePositions()
 	items := make([]vo.VideoJob, 0)
 	for _, v := range list {
 		var item vo.VideoJob
@@ -296,6 +303,7 @@ func (h *VideoHandler) List(c *gin.Context) {
 			continue
 		}
 		item.CreatedAt = v.CreatedAt.Unix()
+		item.QueuePosition = positions[v.Id]
 		if item.VideoURL == "" {
 			item.VideoURL = v.WaterURL
 		}
@@ -18,10 +18,13 @@ import (
 	"geekai/service"
 	"geekai/service/dalle"
 	"geekai/service/jimeng"
+	"geekai/service/job"
+	"geekai/service/mcp"
 	"geekai/service/mj"
 	"geekai/service/moderation"
 	"geekai/service/oss"
 	"geekai/service/payment"
+	"geekai/service/rag"
 	"geekai/service/sd"
 	"geekai/service/sms"
 	"geekai/service/suno"
@@ -163,6 +166,7 @@ func main() {
 		fx.Provide(admin.NewOrderHandler),
 		fx.Provide(admin.NewPowerLogHandler),
 		fx.Provide(admin.NewAdminJimengHandler),
+		fx.Provide(admin.NewJobHandler),
 
 		// 邮件服务
 		fx.Provide(service.NewSmtpService),
@@ -172,12 +176,16 @@ func main() {
 			licenseService.SyncLicense()
 		}),
 
+		// 后台任务引擎
+		fx.Provide(job.NewEngine),
+		fx.Invoke(func(e *job.Engine) {
+			e.Run()
+		}),
+
 		// Dalle 服务
 		fx.Provide(dalle.NewService),
 		fx.Invoke(func(s *dalle.Service) {
 			s.Run()
-			s.DownloadImages()
-			s.CheckTaskStatus()
 		}),
 
 		// MidJourney service pool
@@ -185,28 +193,21 @@ func main() {
 		fx.Provide(mj.NewClient),
 		fx.Invoke(func(s *mj.Service) {
 			s.Run()
-			s.SyncTaskProgress()
-			s.DownloadImages()
 		}),
 
 		// Stable Diffusion 机器人
 		fx.Provide(sd.NewService),
-		fx.Invoke(func(s *sd.Service, config *types.AppConfig) {
+		fx.Invoke(func(s *sd.Service) {
 			s.Run()
-			s.CheckTaskStatus()
 		}),
 
 		fx.Provide(suno.NewService),
 		fx.Invoke(func(s *suno.Service) {
 			s.Run()
-			s.SyncTaskProgress()
-			s.DownloadFiles()
 		}),
 		fx.Provide(video.NewService),
 		fx.Invoke(func(s *video.Service) {
 			s.Run()
-			s.SyncTaskProgress()
-			s.DownloadFiles()
 		}),
 
 		// 即梦AI 服务
@@ -216,6 +217,22 @@ func main() {
 			service.Start()
 		}),
 
+		// MCP 服务
+		fx.Provide(mcp.NewService),
+		fx.Invoke(func(s *mcp.Service, lifecycle fx.Lifecycle) {
+			s.Run()
+			lifecycle.Append(fx.Hook{OnStop: func(context.Context) error {
+				s.CloseAll()
+				return nil
+			}})
+		}),
+
+		// 知识库服务
+		fx.Provide(rag.NewService),
+		fx.Invoke(func(s *rag.Service) {
+			s.Run()
+		}),
+
 		fx.Provide(service.NewSnowflake),
 
 		// 创建短信服务
@@ -243,6 +260,13 @@ func main() {
 
 		// 用户服务
 		fx.Provide(service.NewUserService),
+		fx.Provide(service.NewApiKeyService),
+		fx.Provide(service.NewAssistantService),
+		fx.Provide(service.NewChatStreamService),
+		fx.Invoke(func(s *service.ChatStreamService) {
+			s.Run()
+		}),
+		fx.Provide(service.NewUserLockService),
 
 		// 文本审查服务
 		fx.Provide(moderation.NewGiteeAIModeration),
@@ -305,6 +329,9 @@ func main() {
 		fx.Invoke(func(s *core.AppServer, h *admin.RedeemHandler) {
 			h.RegisterRoutes()
 		}),
+		fx.Invoke(func(s *core.AppServer, h *admin.JobHandler) {
+			h.RegisterRoutes()
+		}),
 		fx.Invoke(func(s *core.AppServer, h *admin.DashboardHandler) {
 			h.RegisterRoutes()
 		}),
@@ -350,6 +377,22 @@ func main() {
 		fx.Invoke(func(s *core.AppServer, h *handler.FunctionHandler) {
 			h.RegisterRoutes()
 		}),
+		fx.Provide(admin.NewMcpServerHandler),
+		fx.Invoke(func(s *core.AppServer, h *admin.McpServerHandler) {
+			h.RegisterRoutes()
+		}),
+		fx.Provide(handler.NewMcpHandler),
+		fx.Invoke(func(s *core.AppServer, h *handler.McpHandler) {
+			h.RegisterRoutes()
+		}),
+		fx.Provide(admin.NewKnowledgeHandler),
+		fx.Invoke(func(s *core.AppServer, h *admin.KnowledgeHandler) {
+			h.RegisterRoutes()
+		}),
+		fx.Provide(handler.NewKnowledgeHandler),
+		fx.Invoke(func(s *core.AppServer, h *handler.KnowledgeHandler) {
+			h.RegisterRoutes()
+		}),
 		fx.Provide(admin.NewChatHandler),
 		fx.Invoke(func(s *core.AppServer, h *admin.ChatHandler) {
 			h.RegisterRoutes()
@@ -380,6 +423,14 @@ func main() {
 		fx.Invoke(func(s *core.AppServer, h *handler.SunoHandler) {
 			h.RegisterRoutes()
 		}),
+		fx.Provide(handler.NewJobHandler),
+		fx.Invoke(func(s *core.AppServer, h *handler.JobHandler) {
+			h.RegisterRoutes()
+		}),
+		fx.Provide(handler.NewCallbackHandler),
+		fx.Invoke(func(s *core.AppServer, h *handler.CallbackHandler) {
+			h.RegisterRoutes()
+		}),
 		fx.Provide(handler.NewVideoHandler),
 		fx.Invoke(func(s *core.AppServer, h *handler.VideoHandler) {
 			h.RegisterRoutes()
@@ -441,6 +492,15 @@ func main() {
 		fx.Invoke(func(s *core.AppServer, h *handler.RealtimeHandler) {
 			h.RegisterRoutes()
 		}),
+		// 开放接口
+		fx.Provide(handler.NewApiTokenHandler),
+		fx.Invoke(func(s *core.AppServer, h *handler.ApiTokenHandler) {
+			h.RegisterRoutes()
+		}),
+		fx.Provide(handler.NewOpenApiHandler),
+		fx.Invoke(func(s *core.AppServer, h *handler.OpenApiHandler) {
+			h.RegisterRoutes()
+		}),
 	)
 	// 启动应用程序
 	go func() {
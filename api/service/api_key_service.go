@@ -0,0 +1,407 @@
+package service
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"geekai/service/provider"
+	"geekai/store/model"
+	"geekai/utils"
+	"math"
+	"math/rand"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"gorm.io/gorm"
+)
+
+const (
+	keyMaxAttempts       = 3                // 单次请求最多尝试的 KEY 数量
+	keyFailureThreshold  = 3                // 连续失败多少次之后熔断
+	keyFailureWindow     = 5 * time.Minute  // 连续失败的统计窗口
+	keyCircuitOpenPeriod = 60 * time.Second // 熔断之后暂停使用的时间
+	keyRateWindow        = time.Minute      // RPM/TPM 滑动窗口大小
+)
+
+var (
+	ErrNoAvailableKey = errors.New("no available key, please import key")
+	ErrKeyRateLimited = errors.New("all api keys are rate limited, please try again later")
+)
+
+// 在滑动窗口中检查并预占一次请求和 tokens 额度，多实例部署时由 Redis 保证原子性
+// KEYS: RPM 窗口, TPM 窗口
+// ARGV: 当前时间(ms), 窗口大小(ms), RPM 上限, TPM 上限, 预估 tokens, 请求标识
+var acquireScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local rpm = tonumber(ARGV[3])
+local tpm = tonumber(ARGV[4])
+local tokens = tonumber(ARGV[5])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], 0, now - window)
+redis.call('ZREMRANGEBYSCORE', KEYS[2], 0, now - window)
+if rpm > 0 and redis.call('ZCARD', KEYS[1]) >= rpm then
+	return 0
+end
+if tpm > 0 then
+	local used = 0
+	for _, member in ipairs(redis.call('ZRANGE', KEYS[2], 0, -1)) do
+		used = used + tonumber(string.match(member, ':(%d+)$'))
+	end
+	-- 窗口为空的时候放行，否则超过 TPM 上限的大请求永远都发不出去
+	if used > 0 and used + tokens > tpm then
+		return 0
+	end
+	redis.call('ZADD', KEYS[2], now, ARGV[6] .. ':' .. tokens)
+	redis.call('PEXPIRE', KEYS[2], window)
+end
+redis.call('ZADD', KEYS[1], now, ARGV[6])
+redis.call('PEXPIRE', KEYS[1], window)
+return 1
+`)
+
+// PermanentError 不需要切换 KEY 重试的错误，比如已经向客户端输出了部分内容
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+func Permanent(err error) error {
+	return &PermanentError{Err: err}
+}
+
+// ApiKeyService API KEY 调度服务，所有 KEY 的选取都要经过这里。
+// 按照权重随机挑选 KEY，跳过熔断中和达到 RPM/TPM 上限的 KEY，并负责故障转移和自动禁用
+type ApiKeyService struct {
+	db    *gorm.DB
+	redis *redis.Client
+}
+
+func NewApiKeyService(db *gorm.DB, redisCli *redis.Client) *ApiKeyService {
+	return &ApiKeyService{db: db, redis: redisCli}
+}
+
+// KeyLease 选中的 KEY 以及预占的限流额度
+type KeyLease struct {
+	Key     model.ApiKey
+	service *ApiKeyService
+	member  string
+	score   int64
+	tokens  int
+}
+
+// Done 请求结束之后根据实际消耗的 tokens 修正 TPM 窗口，usedTokens 为 0 则保留预估值
+func (l *KeyLease) Done(usedTokens int) {
+	if l.Key.Tpm <= 0 || usedTokens <= 0 || usedTokens == l.tokens {
+		return
+	}
+	ctx := context.Background()
+	tpmKey := l.service.tpmKey(l.Key.Id)
+	pipe := l.service.redis.TxPipeline()
+	pipe.ZRem(ctx, tpmKey, fmt.Sprintf("%s:%d", l.member, l.tokens))
+	pipe.ZAdd(ctx, tpmKey, &redis.Z{Score: float64(l.score), Member: fmt.Sprintf("%s:%d", l.member, usedTokens)})
+	pipe.PExpire(ctx, tpmKey, keyRateWindow)
+	if _, err := pipe.Exec(ctx); err != nil {
+		logger.Error("failed to update api key tpm window: ", err)
+	}
+	l.tokens = usedTokens
+}
+
+// Candidates 获取可用的 KEY 列表，绑定了 KEY 的模型只使用绑定的 KEY，熔断中的 KEY 会被跳过。
+// 返回的列表已经按照权重随机排序
+func (s *ApiKeyService) Candidates(keyType string, keyId uint) []model.ApiKey {
+	return s.candidates(keyType, keyId, "")
+}
+
+// channel 不为空的时候只使用这个 API 地址的 KEY
+func (s *ApiKeyService) candidates(keyType string, keyId uint, channel string) []model.ApiKey {
+	var keys []model.ApiKey
+	session := s.db.Session(&gorm.Session{}).Where("enabled", true)
+	if keyId > 0 {
+		session = session.Where("id", keyId)
+	} else {
+		session = session.Where("type", keyType)
+	}
+	if channel != "" {
+		session = session.Where("api_url", channel)
+	}
+	session.Find(&keys)
+
+	available := make([]model.ApiKey, 0, len(keys))
+	for _, key := range keys {
+		if !s.isCircuitOpen(key.Id) {
+			available = append(available, key)
+		}
+	}
+	// 所有的 KEY 都熔断了，与其直接失败不如再试一次
+	if len(available) == 0 {
+		available = keys
+	}
+	return s.shuffle(available)
+}
+
+// Acquire 按照权重挑选一个没有达到限流上限的 KEY，并预占一次请求和 tokens 额度。
+// tokens 为本次请求预估消耗的 tokens，exclude 为本次请求已经尝试过的 KEY
+func (s *ApiKeyService) Acquire(keyType string, keyId uint, tokens int, exclude ...uint) (*KeyLease, error) {
+	return s.acquire(keyType, keyId, "", tokens, exclude)
+}
+
+func (s *ApiKeyService) acquire(keyType string, keyId uint, channel string, tokens int, exclude []uint) (*KeyLease, error) {
+	keys := s.candidates(keyType, keyId, channel)
+	if len(keys) == 0 {
+		return nil, ErrNoAvailableKey
+	}
+
+	tried := 0
+	for _, key := range keys {
+		if slices.Contains(exclude, key.Id) {
+			continue
+		}
+		tried++
+		lease, ok := s.reserve(key, tokens)
+		if ok {
+			// 更新API KEY 最后使用时间
+			s.db.Model(&model.ApiKey{}).Where("id", key.Id).UpdateColumn("last_used_at", time.Now().Unix())
+			return lease, nil
+		}
+		logger.Debugf("API KEY %s(%d) 已达到限流上限，跳过", key.Name, key.Id)
+	}
+	if tried == 0 {
+		return nil, ErrNoAvailableKey
+	}
+	return nil, ErrKeyRateLimited
+}
+
+// Invoke 依次使用调度器选出的 KEY 调用 fn，遇到可重试的错误自动切换到下一个 KEY。
+// fn 返回本次请求实际消耗的 tokens，用于修正 TPM 窗口
+func (s *ApiKeyService) Invoke(ctx context.Context, keyType string, keyId uint, tokens int, fn func(apiKey model.ApiKey) (int, error)) (model.ApiKey, error) {
+	return s.invoke(ctx, keyType, keyId, "", tokens, fn)
+}
+
+// InvokeChannel 和 Invoke 一样，只使用 API 地址为 channel 的 KEY，channel 为空的时候不限制。
+// 异步任务在哪个通道提交的，查询和后续的操作都要在同一个通道上进行
+func (s *ApiKeyService) InvokeChannel(ctx context.Context, keyType string, channel string, fn func(apiKey model.ApiKey) (int, error)) (model.ApiKey, error) {
+	return s.invoke(ctx, keyType, 0, channel, 0, fn)
+}
+
+func (s *ApiKeyService) invoke(ctx context.Context, keyType string, keyId uint, channel string, tokens int, fn func(apiKey model.ApiKey) (int, error)) (model.ApiKey, error) {
+	var lastErr error
+	var tried []uint
+	for i := 0; i < keyMaxAttempts && ctx.Err() == nil; i++ {
+		lease, err := s.acquire(keyType, keyId, channel, tokens, tried)
+		if err != nil {
+			// 没有更多的 KEY 可以重试了，返回上一次请求的错误
+			if lastErr != nil {
+				break
+			}
+			return model.ApiKey{}, err
+		}
+		key := lease.Key
+		tried = append(tried, key.Id)
+		usedTokens, err := fn(key)
+		lease.Done(usedTokens)
+		if err == nil {
+			s.ReportSuccess(key)
+			return key, nil
+		}
+
+		lastErr = err
+		retry := s.ReportFailure(key, err)
+		var permanent *PermanentError
+		if errors.As(err, &permanent) || !retry {
+			return key, err
+		}
+		logger.Warnf("API KEY %s(%d) 请求失败，切换到下一个 KEY 重试：%v", key.Name, key.Id, err)
+	}
+	if lastErr == nil {
+		lastErr = ctx.Err()
+	}
+	return model.ApiKey{}, lastErr
+}
+
+// ReportSuccess 请求成功，清除连续失败的计数
+func (s *ApiKeyService) ReportSuccess(key model.ApiKey) {
+	s.redis.Del(context.Background(), s.failureKey(key.Id))
+}
+
+// ReportFailure 记录一次失败，返回是否应该切换 KEY 重试
+func (s *ApiKeyService) ReportFailure(key model.ApiKey, err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var apiErr *provider.ApiError
+	if errors.As(err, &apiErr) {
+		if reason := s.disableReason(apiErr); reason != "" {
+			s.Disable(key, reason)
+			return true
+		}
+		switch {
+		case apiErr.StatusCode == http.StatusTooManyRequests || apiErr.StatusCode >= http.StatusInternalServerError:
+		// 403 也可能是地区限制、内容审核或者模型没有权限，换一个 KEY 重试并计入熔断，不直接禁用
+		case apiErr.StatusCode == http.StatusForbidden:
+		default: // 其他 4xx 错误是请求本身的问题，换 KEY 也没用
+			return false
+		}
+	}
+
+	ctx := context.Background()
+	failures, _ := s.redis.Incr(ctx, s.failureKey(key.Id)).Result()
+	s.redis.Expire(ctx, s.failureKey(key.Id), keyFailureWindow)
+	if failures >= keyFailureThreshold {
+		logger.Warnf("API KEY %s(%d) 连续失败 %d 次，暂停使用 %v", key.Name, key.Id, failures, keyCircuitOpenPeriod)
+		s.redis.Set(ctx, s.circuitKey(key.Id), failures, keyCircuitOpenPeriod)
+		s.redis.Del(ctx, s.failureKey(key.Id))
+	}
+	return true
+}
+
+// Disable 禁用 KEY 并记录原因
+func (s *ApiKeyService) Disable(key model.ApiKey, reason string) {
+	logger.Errorf("自动禁用 API KEY %s(%d)：%s", key.Name, key.Id, reason)
+	err := s.db.Model(&model.ApiKey{}).Where("id", key.Id).Updates(map[string]any{
+		"enabled":         false,
+		"disabled_reason": fmt.Sprintf("[%s] %s", time.Now().Format("2006-01-02 15:04:05"), reason),
+	}).Error
+	if err != nil {
+		logger.Error("failed to disable api key: ", err)
+	}
+}
+
+// Reset 重新启用 KEY 时清除熔断状态
+func (s *ApiKeyService) Reset(keyId uint) {
+	s.redis.Del(context.Background(), s.failureKey(keyId), s.circuitKey(keyId))
+}
+
+// 明确表示 KEY 无效或者额度用尽的错误码，OpenAI 兼容接口的 error.code/error.type，
+// Anthropic 的 error.type，Gemini 的 error.details[].reason
+var (
+	invalidKeyCodes = []string{"invalid_api_key", "authentication_error", "account_deactivated", "api_key_invalid"}
+	noQuotaCodes    = []string{"insufficient_quota", "billing_not_active", "billing_hard_limit_reached"}
+)
+
+// 鉴权失败和额度用尽的 KEY 需要直接禁用。只看状态码和结构化的错误码，
+// 不匹配错误内容里面的文字，普通的请求错误和中转服务的错误信息里也可能出现这些词。
+// 403 不在这里，中转服务和 Azure、Gemini 的地区限制、内容审核也会返回 403
+func (s *ApiKeyService) disableReason(apiErr *provider.ApiError) string {
+	switch apiErr.StatusCode {
+	case http.StatusUnauthorized:
+		return fmt.Sprintf("鉴权失败(%d)：%s", apiErr.StatusCode, s.cut(apiErr.Body))
+	case http.StatusPaymentRequired:
+		return fmt.Sprintf("额度用尽(%d)：%s", apiErr.StatusCode, s.cut(apiErr.Body))
+	}
+
+	codes := s.errorCodes(apiErr.Body)
+	for _, code := range codes {
+		switch {
+		case slices.Contains(invalidKeyCodes, code):
+			return fmt.Sprintf("无效的 API KEY(%d)：%s", apiErr.StatusCode, s.cut(apiErr.Body))
+		case slices.Contains(noQuotaCodes, code):
+			return fmt.Sprintf("额度用尽(%d)：%s", apiErr.StatusCode, s.cut(apiErr.Body))
+		}
+	}
+	return ""
+}
+
+// 从错误响应中取出服务商的错误码，统一转成小写
+func (s *ApiKeyService) errorCodes(body string) []string {
+	var res struct {
+		Error struct {
+			Code    any    `json:"code"`
+			Type    string `json:"type"`
+			Details []struct {
+				Reason string `json:"reason"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	if err := utils.JsonDecode(body, &res); err != nil {
+		return nil
+	}
+	codes := []string{strings.ToLower(res.Error.Type)}
+	if code, ok := res.Error.Code.(string); ok {
+		codes = append(codes, strings.ToLower(code))
+	}
+	for _, detail := range res.Error.Details {
+		codes = append(codes, strings.ToLower(detail.Reason))
+	}
+	return codes
+}
+
+func (s *ApiKeyService) cut(str string) string {
+	r := []rune(str)
+	if len(r) > 150 {
+		return string(r[:150]) + "..."
+	}
+	return str
+}
+
+// 在 Redis 滑动窗口中预占额度，没有设置 RPM 和 TPM 的 KEY 不做限制
+func (s *ApiKeyService) reserve(key model.ApiKey, tokens int) (*KeyLease, bool) {
+	lease := &KeyLease{Key: key, service: s, tokens: max(tokens, 0)}
+	if key.Rpm <= 0 && key.Tpm <= 0 {
+		return lease, true
+	}
+
+	now := time.Now().UnixMilli()
+	lease.score = now
+	lease.member = fmt.Sprintf("%d-%s", now, utils.RandString(8))
+	res, err := acquireScript.Run(context.Background(), s.redis,
+		[]string{s.rpmKey(key.Id), s.tpmKey(key.Id)},
+		now, keyRateWindow.Milliseconds(), key.Rpm, key.Tpm, lease.tokens, lease.member).Int()
+	if err != nil {
+		// Redis 异常的时候不能影响正常的请求
+		logger.Error("failed to check api key rate limit: ", err)
+		return lease, true
+	}
+	return lease, res == 1
+}
+
+// 按照权重随机排序（Efraimidis-Spirakis 算法），权重越大越靠前的概率越高
+func (s *ApiKeyService) shuffle(keys []model.ApiKey) []model.ApiKey {
+	priorities := make(map[uint]float64, len(keys))
+	for _, key := range keys {
+		priorities[key.Id] = -math.Log(1-rand.Float64()) / float64(max(key.Weight, 1))
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return priorities[keys[i].Id] < priorities[keys[j].Id]
+	})
+	return keys
+}
+
+func (s *ApiKeyService) isCircuitOpen(keyId uint) bool {
+	n, err := s.redis.Exists(context.Background(), s.circuitKey(keyId)).Result()
+	return err == nil && n > 0
+}
+
+func (s *ApiKeyService) failureKey(keyId uint) string {
+	return fmt.Sprintf("api_key:failures:%d", keyId)
+}
+
+func (s *ApiKeyService) circuitKey(keyId uint) string {
+	return fmt.Sprintf("api_key:circuit:%d", keyId)
+}
+
+func (s *ApiKeyService) rpmKey(keyId uint) string {
+	return fmt.Sprintf("api_key:rpm:%d", keyId)
+}
+
+func (s *ApiKeyService) tpmKey(keyId uint) string {
+	return fmt.Sprintf("api_key:tpm:%d", keyId)
+}
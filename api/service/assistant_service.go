@@ -0,0 +1,82 @@
+package service
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"context"
+	"fmt"
+	"geekai/core/types"
+	"geekai/service/provider"
+	"geekai/store/model"
+	"geekai/utils"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// AssistantService 系统助手模型调用，用于提示词翻译、优化以及生成思维导图等非对话场景
+type AssistantService struct {
+	db            *gorm.DB
+	apiKeyService *ApiKeyService
+}
+
+func NewAssistantService(db *gorm.DB, apiKeyService *ApiKeyService) *AssistantService {
+	return &AssistantService{db: db, apiKeyService: apiKeyService}
+}
+
+// Request 发送单条提示词
+func (s *AssistantService) Request(prompt string, modelId int) (string, error) {
+	messages := make([]any, 1)
+	messages[0] = types.Message{
+		Role:    "user",
+		Content: prompt,
+	}
+	return s.SendMessage(messages, modelId)
+}
+
+// Summarize 把对话内容合并到之前的摘要中，返回新的摘要
+func (s *AssistantService) Summarize(summary string, dialog string, modelId int) (string, error) {
+	if summary == "" {
+		summary = "无"
+	}
+	return s.Request(fmt.Sprintf(ChatSummaryPromptTemplate, summary, dialog), modelId)
+}
+
+// SendMessage 发送消息列表，返回模型的回复内容
+func (s *AssistantService) SendMessage(messages []any, modelId int) (string, error) {
+	var chatModel model.ChatModel
+	s.db.Where("id", modelId).First(&chatModel)
+	if chatModel.Value == "" {
+		chatModel.Value = "gpt-4o" // 默认使用 gpt-4o
+	}
+
+	req := types.ApiRequest{
+		Model:       chatModel.Value,
+		Temperature: 0.9,
+		MaxTokens:   1024,
+		Stream:      false,
+		Messages:    messages,
+	}
+	tokens, _ := utils.CalcTokens(utils.JsonEncode(messages), chatModel.Value)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
+	defer cancel()
+
+	var response *provider.Response
+	_, err := s.apiKeyService.Invoke(ctx, "chat", chatModel.KeyId, tokens+req.MaxTokens, func(apiKey model.ApiKey) (int, error) {
+		res, err := provider.Resolve(apiKey, chatModel).Chat(ctx, apiKey, req, func(delta provider.Delta) {})
+		if err != nil {
+			return 0, err
+		}
+		response = res
+		return res.Usage.TotalTokens, nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("请求 AI 助手模型失败：%v", err)
+	}
+	return response.Content, nil
+}
@@ -0,0 +1,59 @@
+package service
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"fmt"
+	"geekai/store/model"
+	"math"
+)
+
+// TokenUsage 对话计费使用的 token 用量，PromptTokens 包含了缓存命中的 token
+type TokenUsage struct {
+	PromptTokens     int
+	CompletionTokens int
+	CachedTokens     int
+}
+
+// IsTokenBilling 模型是否按照 token 计费
+func IsTokenBilling(chatModel model.ChatModel) bool {
+	return chatModel.InputPower > 0 || chatModel.OutputPower > 0
+}
+
+// CalcChatPower 计算一次对话消耗的算力，返回算力和计费明细
+func CalcChatPower(chatModel model.ChatModel, usage TokenUsage) (int, string) {
+	if !IsTokenBilling(chatModel) {
+		return chatModel.Power, fmt.Sprintf("提问长度：%d，回复长度：%d", usage.PromptTokens, usage.CompletionTokens)
+	}
+
+	cachedTokens := min(usage.CachedTokens, usage.PromptTokens)
+	cachedPrice := chatModel.CachedPower
+	// 没有单独设置缓存价格的按照输入价格计费
+	if cachedPrice <= 0 {
+		cachedPrice = chatModel.InputPower
+	}
+	input := float64(usage.PromptTokens-cachedTokens) / 1000 * chatModel.InputPower
+	cached := float64(cachedTokens) / 1000 * cachedPrice
+	output := float64(usage.CompletionTokens) / 1000 * chatModel.OutputPower
+	power := int(math.Ceil(input + cached + output))
+
+	detail := fmt.Sprintf("输入：%d tokens × %g/1K = %.2f", usage.PromptTokens-cachedTokens, chatModel.InputPower, input)
+	if cachedTokens > 0 {
+		detail += fmt.Sprintf("，缓存：%d tokens × %g/1K = %.2f", cachedTokens, cachedPrice, cached)
+	}
+	detail += fmt.Sprintf("，输出：%d tokens × %g/1K = %.2f，合计：%d", usage.CompletionTokens, chatModel.OutputPower, output, power)
+	return power, detail
+}
+
+// EstimateChatPower 根据组装好的提示词预估对话至少需要消耗的算力，用于发起请求之前检查用户算力
+func EstimateChatPower(chatModel model.ChatModel, promptTokens int) int {
+	if !IsTokenBilling(chatModel) {
+		return chatModel.Power
+	}
+	return int(math.Ceil(float64(promptTokens) / 1000 * chatModel.InputPower))
+}
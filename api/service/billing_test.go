@@ -0,0 +1,86 @@
+package service
+
+import (
+	"geekai/store/model"
+	"testing"
+)
+
+func TestCalcChatPower(t *testing.T) {
+	tests := []struct {
+		name  string
+		model model.ChatModel
+		usage TokenUsage
+		want  int
+	}{
+		{
+			name:  "fixed power",
+			model: model.ChatModel{Power: 3},
+			usage: TokenUsage{PromptTokens: 100000, CompletionTokens: 100000},
+			want:  3,
+		},
+		{
+			name:  "input and output",
+			model: model.ChatModel{InputPower: 1, OutputPower: 2},
+			usage: TokenUsage{PromptTokens: 2000, CompletionTokens: 1000},
+			want:  4,
+		},
+		{
+			name:  "round up",
+			model: model.ChatModel{InputPower: 1, OutputPower: 1},
+			usage: TokenUsage{PromptTokens: 1, CompletionTokens: 0},
+			want:  1,
+		},
+		{
+			name:  "cached tokens use cached price",
+			model: model.ChatModel{InputPower: 10, OutputPower: 10, CachedPower: 1},
+			usage: TokenUsage{PromptTokens: 2000, CachedTokens: 1000},
+			want:  11,
+		},
+		{
+			name:  "cached tokens fall back to input price",
+			model: model.ChatModel{InputPower: 10},
+			usage: TokenUsage{PromptTokens: 2000, CachedTokens: 1000},
+			want:  20,
+		},
+		{
+			name:  "cached tokens cannot exceed prompt tokens",
+			model: model.ChatModel{InputPower: 10, CachedPower: 1},
+			usage: TokenUsage{PromptTokens: 1000, CachedTokens: 5000},
+			want:  1,
+		},
+		{
+			name:  "output only",
+			model: model.ChatModel{Power: 5, OutputPower: 3},
+			usage: TokenUsage{PromptTokens: 1000, CompletionTokens: 1000},
+			want:  3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, detail := CalcChatPower(tt.model, tt.usage)
+			if got != tt.want {
+				t.Errorf("CalcChatPower() = %d, want %d (%s)", got, tt.want, detail)
+			}
+		})
+	}
+}
+
+func TestEstimateChatPower(t *testing.T) {
+	tests := []struct {
+		name   string
+		model  model.ChatModel
+		tokens int
+		want   int
+	}{
+		{"fixed power", model.ChatModel{Power: 2}, 100000, 2},
+		{"input price", model.ChatModel{InputPower: 2, OutputPower: 8}, 1500, 3},
+		{"no input price", model.ChatModel{OutputPower: 8}, 1500, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := EstimateChatPower(tt.model, tt.tokens); got != tt.want {
+				t.Errorf("EstimateChatPower() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package service
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"fmt"
+	"geekai/core/types"
+	"geekai/store/model"
+	"geekai/store/vo"
+	"geekai/utils"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// 表单变量值的最大长度
+const appVariableMaxLength = 2000
+
+var (
+	promptVarPattern = regexp.MustCompile(`\{\{\s*([\w.]+)\s*\}\}`)
+	weekdays         = []string{"星期日", "星期一", "星期二", "星期三", "星期四", "星期五", "星期六"}
+)
+
+// AppPromptValues 应用提示词中可以使用的变量：内置变量（日期、用户信息）和用户填写的表单变量。
+// 必填的表单变量没有填写的返回错误
+func AppPromptValues(app model.ChatApp, user vo.User, input map[string]string) (map[string]string, error) {
+	now := time.Now()
+	values := map[string]string{
+		"date":          now.Format("2006-01-02"),
+		"time":          now.Format("15:04"),
+		"datetime":      now.Format("2006-01-02 15:04:05"),
+		"weekday":       weekdays[now.Weekday()],
+		"user.nickname": user.Nickname,
+		"user.username": user.Username,
+	}
+
+	var variables []types.AppVariable
+	_ = utils.JsonDecode(app.Variables, &variables)
+	for _, v := range variables {
+		label := v.Label
+		if label == "" {
+			label = v.Name
+		}
+		value := strings.TrimSpace(input[v.Name])
+		if value == "" {
+			value = v.Default
+		}
+		if value == "" && v.Required {
+			return nil, fmt.Errorf("请先填写「%s」再开始对话", label)
+		}
+		if utf8.RuneCountInString(value) > appVariableMaxLength {
+			return nil, fmt.Errorf("「%s」不能超过 %d 个字符", label, appVariableMaxLength)
+		}
+		if v.Type == "select" && value != "" && len(v.Options) > 0 && !slices.Contains(v.Options, value) {
+			return nil, fmt.Errorf("「%s」的取值无效", label)
+		}
+		values[v.Name] = value
+	}
+	return values, nil
+}
+
+// AppVariableValues 用户填写的表单变量，只保留应用定义过的变量，用于保存到会话
+func AppVariableValues(app model.ChatApp, input map[string]string) map[string]string {
+	var variables []types.AppVariable
+	_ = utils.JsonDecode(app.Variables, &variables)
+	values := make(map[string]string)
+	for _, v := range variables {
+		if value, ok := input[v.Name]; ok {
+			values[v.Name] = strings.TrimSpace(value)
+		}
+	}
+	return values
+}
+
+// RenderAppPrompt 替换提示词中的 {{name}} 变量，没有定义的变量保持原样
+func RenderAppPrompt(prompt string, values map[string]string) string {
+	if !strings.Contains(prompt, "{{") {
+		return prompt
+	}
+	return promptVarPattern.ReplaceAllStringFunc(prompt, func(s string) string {
+		name := promptVarPattern.FindStringSubmatch(s)[1]
+		if v, ok := values[name]; ok {
+			return v
+		}
+		return s
+	})
+}
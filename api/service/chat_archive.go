@@ -0,0 +1,459 @@
+package service
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"geekai/core/types"
+	"geekai/store/model"
+	"geekai/store/vo"
+	"geekai/utils"
+	"html"
+	"io"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"gorm.io/gorm"
+)
+
+// ChatArchiveVersion 对话导出文件的格式版本
+const ChatArchiveVersion = 1
+
+// 压缩包里面 conversations.json 解压之后的最大长度，防止压缩炸弹耗尽内存
+const maxArchiveJsonSize = 200 << 20
+
+// ChatArchive 对话导出文件，保存完整的消息树，可以重新导入
+type ChatArchive struct {
+	Version    int           `json:"version"`
+	ExportedAt int64         `json:"exported_at"`
+	Chats      []ArchiveChat `json:"chats"`
+}
+
+// ArchiveChat 导出的会话
+type ArchiveChat struct {
+	ChatId      string           `json:"chat_id"`
+	Title       string           `json:"title"`
+	RoleId      uint             `json:"role_id"`
+	RoleName    string           `json:"role_name"`
+	Model       string           `json:"model"`
+	ActiveMsgId uint             `json:"active_msg_id"` // 当前激活分支的消息
+	CreatedAt   int64            `json:"created_at"`
+	Messages    []ArchiveMessage `json:"messages"` // 按照 ID 升序
+}
+
+// ArchiveMessage 导出的消息，思考过程跟回复内容分开保存
+type ArchiveMessage struct {
+	Id        uint              `json:"id"`
+	ParentId  uint              `json:"parent_id"`
+	Type      string            `json:"type"` // prompt|reply
+	Model     string            `json:"model,omitempty"`
+	Content   string            `json:"content"`
+	Reasoning string            `json:"reasoning,omitempty"`
+	Files     []vo.File         `json:"files,omitempty"`
+	ToolCalls []types.ToolTrace `json:"tool_calls,omitempty"`
+	Citations []types.Citation  `json:"citations,omitempty"`
+	Tokens    int               `json:"tokens"`
+	CreatedAt int64             `json:"created_at"`
+}
+
+var thinkRegex = regexp.MustCompile(`(?s)<think>(.*?)(</think>|$)`)
+
+// 拆分回复里面的思考过程和回复内容
+func splitReasoning(text string) (string, string) {
+	reasoning := make([]string, 0)
+	for _, match := range thinkRegex.FindAllStringSubmatch(text, -1) {
+		reasoning = append(reasoning, strings.TrimSpace(match[1]))
+	}
+	return strings.Join(reasoning, "\n\n"), strings.TrimSpace(thinkRegex.ReplaceAllString(text, ""))
+}
+
+// ActivePath 当前激活分支上的消息
+func (c ArchiveChat) ActivePath() []ArchiveMessage {
+	if len(c.Messages) == 0 {
+		return nil
+	}
+	messages := make(map[uint]ArchiveMessage, len(c.Messages))
+	children := make(map[uint][]uint)
+	for _, msg := range c.Messages {
+		messages[msg.Id] = msg
+		children[msg.ParentId] = append(children[msg.ParentId], msg.Id)
+	}
+	leafId := c.Messages[len(c.Messages)-1].Id
+	if _, ok := messages[c.ActiveMsgId]; ok {
+		leafId = c.ActiveMsgId
+		for len(children[leafId]) > 0 {
+			leafId = children[leafId][len(children[leafId])-1]
+		}
+	}
+
+	path := make([]ArchiveMessage, 0)
+	for id := leafId; id > 0 && len(path) <= len(messages); {
+		msg, ok := messages[id]
+		if !ok {
+			break
+		}
+		path = append(path, msg)
+		id = msg.ParentId
+	}
+	slices.Reverse(path)
+	return path
+}
+
+// ExportChats 导出用户的会话，chatId 为空导出全部会话
+func ExportChats(db *gorm.DB, userId uint, chatId string) (ChatArchive, error) {
+	archive := ChatArchive{Version: ChatArchiveVersion, ExportedAt: time.Now().Unix(), Chats: make([]ArchiveChat, 0)}
+	session := db.Where("user_id", userId)
+	if chatId != "" {
+		session = session.Where("chat_id", chatId)
+	}
+	var items []model.ChatItem
+	if err := session.Order("id ASC").Find(&items).Error; err != nil {
+		return archive, err
+	}
+	if chatId != "" && len(items) == 0 {
+		return archive, errors.New("会话不存在")
+	}
+
+	roleIds := make([]uint, 0, len(items))
+	for _, item := range items {
+		roleIds = append(roleIds, item.RoleId)
+	}
+	var roles []model.ChatApp
+	roleNames := make(map[uint]string)
+	db.Select("id", "name").Where("id IN ?", roleIds).Find(&roles)
+	for _, role := range roles {
+		roleNames[role.Id] = role.Name
+	}
+
+	for _, item := range items {
+		var messages []model.ChatMessage
+		if err := db.Where("chat_id", item.ChatId).Order("id ASC").Find(&messages).Error; err != nil {
+			return archive, err
+		}
+		chat := ArchiveChat{
+			ChatId:      item.ChatId,
+			Title:       item.Title,
+			RoleId:      item.RoleId,
+			RoleName:    roleNames[item.RoleId],
+			Model:       item.Model,
+			ActiveMsgId: item.ActiveMsgId,
+			CreatedAt:   item.CreatedAt.Unix(),
+			Messages:    make([]ArchiveMessage, 0, len(messages)),
+		}
+		for _, msg := range messages {
+			var content vo.MsgContent
+			if err := utils.JsonDecode(msg.Content, &content); err != nil {
+				content.Text = msg.Content
+			}
+			m := ArchiveMessage{
+				Id:        msg.Id,
+				ParentId:  msg.ParentId,
+				Type:      msg.Type,
+				Model:     msg.Model,
+				Content:   content.Text,
+				Files:     content.Files,
+				Tokens:    msg.Tokens,
+				CreatedAt: msg.CreatedAt.Unix(),
+			}
+			if msg.Type == types.ReplyMsg {
+				m.Reasoning, m.Content = splitReasoning(content.Text)
+				// 回复消息上记录的文件是提问上传的，不用重复导出
+				m.Files = nil
+			}
+			_ = utils.JsonDecode(msg.ToolCalls, &m.ToolCalls)
+			_ = utils.JsonDecode(msg.Citations, &m.Citations)
+			chat.Messages = append(chat.Messages, m)
+		}
+		archive.Chats = append(archive.Chats, chat)
+	}
+	return archive, nil
+}
+
+func formatTime(timestamp int64) string {
+	return time.Unix(timestamp, 0).Format(time.DateTime)
+}
+
+// RenderMarkdown 把会话当前分支的消息导出成 Markdown
+func (a ChatArchive) RenderMarkdown() string {
+	var b strings.Builder
+	for i, chat := range a.Chats {
+		if i > 0 {
+			b.WriteString("\n---\n\n")
+		}
+		b.WriteString(fmt.Sprintf("# %s\n\n", chat.Title))
+		b.WriteString(fmt.Sprintf("> 应用：%s　模型：%s　创建时间：%s\n\n", chat.RoleName, chat.Model, formatTime(chat.CreatedAt)))
+		for _, msg := range chat.ActivePath() {
+			if msg.Type == types.PromptMsg {
+				b.WriteString(fmt.Sprintf("## 用户（%s）\n\n", formatTime(msg.CreatedAt)))
+			} else {
+				b.WriteString(fmt.Sprintf("## AI：%s（%s）\n\n", msg.Model, formatTime(msg.CreatedAt)))
+			}
+			if msg.Reasoning != "" {
+				b.WriteString("<details>\n<summary>思考过程</summary>\n\n")
+				b.WriteString(msg.Reasoning)
+				b.WriteString("\n\n</details>\n\n")
+			}
+			b.WriteString(msg.Content)
+			b.WriteString("\n\n")
+			for _, file := range msg.Files {
+				b.WriteString(fmt.Sprintf("- 附件：[%s](%s)\n", file.Name, file.URL))
+			}
+			if len(msg.Files) > 0 {
+				b.WriteString("\n")
+			}
+		}
+	}
+	return b.String()
+}
+
+var markdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+func renderMarkdown(text string) string {
+	var buf bytes.Buffer
+	// 不开启 unsafe 选项，消息里面的原始 HTML 不会输出
+	if err := markdown.Convert([]byte(text), &buf); err != nil {
+		return "<pre>" + html.EscapeString(text) + "</pre>"
+	}
+	return buf.String()
+}
+
+// RenderHTML 把会话当前分支的消息导出成可以直接在浏览器打开的 HTML 页面
+func (a ChatArchive) RenderHTML() string {
+	var b strings.Builder
+	title := "对话记录"
+	if len(a.Chats) == 1 {
+		title = a.Chats[0].Title
+	}
+	b.WriteString(`<!DOCTYPE html><html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1">`)
+	b.WriteString("<title>" + html.EscapeString(title) + "</title><style>")
+	b.WriteString(`body{max-width:860px;margin:0 auto;padding:20px;font-family:-apple-system,"Microsoft YaHei",sans-serif;line-height:1.6;color:#333}
+.meta{color:#999;font-size:13px}.msg{border-radius:8px;padding:10px 16px;margin:16px 0}.prompt{background:#f4f6f8}.text{white-space:pre-wrap;margin:8px 0}.reply{border:1px solid #e5e7eb}
+.role{font-weight:bold;font-size:14px;color:#666}.role span{font-weight:normal;color:#999}details{color:#777;font-size:14px;border-left:3px solid #ddd;padding-left:10px}
+pre{background:#282c34;color:#eee;padding:10px;border-radius:6px;overflow:auto}table{border-collapse:collapse}td,th{border:1px solid #ddd;padding:4px 8px}img{max-width:100%}`)
+	b.WriteString("</style></head><body>")
+	for i, chat := range a.Chats {
+		if i > 0 {
+			b.WriteString("<hr>")
+		}
+		b.WriteString("<h1>" + html.EscapeString(chat.Title) + "</h1>")
+		b.WriteString(fmt.Sprintf(`<div class="meta">应用：%s　模型：%s　创建时间：%s</div>`,
+			html.EscapeString(chat.RoleName), html.EscapeString(chat.Model), formatTime(chat.CreatedAt)))
+		for _, msg := range chat.ActivePath() {
+			b.WriteString(`<div class="msg ` + msg.Type + `">`)
+			if msg.Type == types.PromptMsg {
+				b.WriteString(`<div class="role">用户 <span>` + formatTime(msg.CreatedAt) + `</span></div>`)
+			} else {
+				b.WriteString(`<div class="role">AI：` + html.EscapeString(msg.Model) + ` <span>` + formatTime(msg.CreatedAt) + `</span></div>`)
+			}
+			if msg.Reasoning != "" {
+				b.WriteString("<details><summary>思考过程</summary>" + renderMarkdown(msg.Reasoning) + "</details>")
+			}
+			// 提问按照纯文本显示，回复按照 Markdown 渲染
+			if msg.Type == types.PromptMsg {
+				b.WriteString(`<div class="text">` + html.EscapeString(msg.Content) + `</div>`)
+			} else {
+				b.WriteString(renderMarkdown(msg.Content))
+			}
+			for _, file := range msg.Files {
+				b.WriteString(fmt.Sprintf(`<div>附件：<a href="%s" target="_blank">%s</a></div>`, html.EscapeString(file.URL), html.EscapeString(file.Name)))
+			}
+			b.WriteString("</div>")
+		}
+	}
+	b.WriteString("</body></html>")
+	return b.String()
+}
+
+// ParseChatArchive 解析导入的文件，支持本系统导出的 JSON 和 ChatGPT 导出的 conversations.json（或者整个导出压缩包）
+func ParseChatArchive(data []byte) (ChatArchive, error) {
+	if bytes.HasPrefix(data, []byte("PK")) {
+		r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return ChatArchive{}, fmt.Errorf("解压文件失败：%v", err)
+		}
+		data = nil
+		for _, f := range r.File {
+			if path.Base(f.Name) != "conversations.json" {
+				continue
+			}
+			if f.UncompressedSize64 > maxArchiveJsonSize {
+				return ChatArchive{}, fmt.Errorf("conversations.json 解压之后不能超过 %dMB", maxArchiveJsonSize>>20)
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return ChatArchive{}, err
+			}
+			data, err = io.ReadAll(io.LimitReader(rc, maxArchiveJsonSize+1))
+			rc.Close()
+			if err != nil {
+				return ChatArchive{}, err
+			}
+			if len(data) > maxArchiveJsonSize {
+				return ChatArchive{}, fmt.Errorf("conversations.json 解压之后不能超过 %dMB", maxArchiveJsonSize>>20)
+			}
+			break
+		}
+		if data == nil {
+			return ChatArchive{}, errors.New("压缩包里面没有 conversations.json 文件")
+		}
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return ChatArchive{}, errors.New("文件内容为空")
+	}
+	// ChatGPT 导出的是会话数组
+	if data[0] == '[' {
+		return parseChatGPTExport(data)
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return ChatArchive{}, fmt.Errorf("文件格式错误：%v", err)
+	}
+	if _, ok := fields["mapping"]; ok {
+		return parseChatGPTExport(append(append([]byte{'['}, data...), ']'))
+	}
+	var archive ChatArchive
+	if err := json.Unmarshal(data, &archive); err != nil || archive.Version == 0 {
+		return archive, errors.New("不支持的文件格式")
+	}
+	return archive, nil
+}
+
+// 按照字符数截断，避免超出数据库字段长度
+func truncateRunes(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) > n {
+		return string(runes[:n])
+	}
+	return s
+}
+
+// ImportChats 把导入的会话保存到用户的账号下面，每个会话生成新的会话 ID 和消息 ID，返回导入的会话数量
+func ImportChats(db *gorm.DB, user model.User, archive ChatArchive) (int, error) {
+	// 原来的应用不存在的时候使用默认应用
+	var roles []model.ChatApp
+	db.Select("id", "icon", "enable", "sort_num").Where("user_id IN ? OR review_status = ?", []uint{0, user.Id}, types.AppReviewApproved).
+		Order("sort_num ASC").Find(&roles)
+	roleMap := make(map[uint]model.ChatApp)
+	var defaultRole model.ChatApp
+	for _, role := range roles {
+		roleMap[role.Id] = role
+		if defaultRole.Id == 0 && role.Enable {
+			defaultRole = role
+		}
+	}
+	var models []model.ChatModel
+	db.Select("id", "value").Find(&models)
+	modelIds := make(map[string]uint)
+	for _, m := range models {
+		modelIds[m.Value] = m.Id
+	}
+
+	count := 0
+	for _, chat := range archive.Chats {
+		if len(chat.Messages) == 0 {
+			continue
+		}
+		role, ok := roleMap[chat.RoleId]
+		if !ok {
+			role = defaultRole
+		}
+		messages := slices.Clone(chat.Messages)
+		slices.SortFunc(messages, func(a, b ArchiveMessage) int {
+			return int(a.Id) - int(b.Id)
+		})
+
+		chatId := utils.RandomHex(16)
+		err := db.Transaction(func(tx *gorm.DB) error {
+			ids := make(map[uint]uint) // 原消息 ID => 新消息 ID
+			var lastId uint
+			for _, m := range messages {
+				if m.Type != types.PromptMsg && m.Type != types.ReplyMsg {
+					continue
+				}
+				text := m.Content
+				icon := role.Icon
+				if m.Type == types.PromptMsg {
+					icon = user.Avatar
+				} else if m.Reasoning != "" {
+					text = "<think>" + m.Reasoning + "</think>" + m.Content
+				}
+				tokens := m.Tokens
+				if tokens == 0 {
+					tokens, _ = utils.CalcTokens(text, m.Model)
+				}
+				createdAt := time.Now()
+				if m.CreatedAt > 0 {
+					createdAt = time.Unix(m.CreatedAt, 0)
+				}
+				msg := model.ChatMessage{
+					UserId:      user.Id,
+					ChatId:      chatId,
+					ParentId:    ids[m.ParentId],
+					Type:        m.Type,
+					Icon:        icon,
+					RoleId:      role.Id,
+					Model:       truncateRunes(m.Model, 255),
+					Content:     utils.JsonEncode(vo.MsgContent{Text: text, Files: m.Files}),
+					Tokens:      tokens,
+					TotalTokens: tokens,
+					ToolCalls:   utils.JsonEncode(m.ToolCalls),
+					Citations:   utils.JsonEncode(m.Citations),
+					SearchText:  m.Content,
+					UseContext:  true,
+					CreatedAt:   createdAt,
+					UpdatedAt:   createdAt,
+				}
+				if err := tx.Create(&msg).Error; err != nil {
+					return err
+				}
+				ids[m.Id] = msg.Id
+				lastId = msg.Id
+			}
+
+			activeMsgId := ids[chat.ActiveMsgId]
+			if activeMsgId == 0 {
+				activeMsgId = lastId
+			}
+			createdAt := time.Now()
+			if chat.CreatedAt > 0 {
+				createdAt = time.Unix(chat.CreatedAt, 0)
+			}
+			title := chat.Title
+			if title == "" {
+				title = "导入的对话"
+			}
+			return tx.Create(&model.ChatItem{
+				ChatId:      chatId,
+				UserId:      user.Id,
+				RoleId:      role.Id,
+				Title:       truncateRunes(title, 100),
+				ModelId:     modelIds[chat.Model],
+				Model:       truncateRunes(chat.Model, 30),
+				ActiveMsgId: activeMsgId,
+				CreatedAt:   createdAt,
+				UpdatedAt:   createdAt,
+			}).Error
+		})
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
@@ -0,0 +1,171 @@
+package service
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"encoding/json"
+	"fmt"
+	"geekai/core/types"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ChatGPT 官方导出的 conversations.json 结构，只解析导入需要的字段
+type gptConversation struct {
+	Title       string             `json:"title"`
+	CreateTime  float64            `json:"create_time"`
+	Mapping     map[string]gptNode `json:"mapping"`
+	CurrentNode string             `json:"current_node"`
+	ModelSlug   string             `json:"default_model_slug"`
+}
+
+type gptNode struct {
+	Id       string      `json:"id"`
+	Message  *gptMessage `json:"message"`
+	Parent   string      `json:"parent"`
+	Children []string    `json:"children"`
+}
+
+type gptMessage struct {
+	Author struct {
+		Role string `json:"role"`
+	} `json:"author"`
+	CreateTime float64 `json:"create_time"`
+	Content    struct {
+		ContentType string `json:"content_type"`
+		Parts       []any  `json:"parts"`
+		Thoughts    []struct {
+			Summary string `json:"summary"`
+			Content string `json:"content"`
+		} `json:"thoughts"`
+	} `json:"content"`
+	Metadata struct {
+		ModelSlug string `json:"model_slug"`
+		Hidden    bool   `json:"is_visually_hidden_from_conversation"`
+	} `json:"metadata"`
+}
+
+// 消息里面的文本，图片等非文本内容忽略
+func (m *gptMessage) text() string {
+	texts := make([]string, 0)
+	for _, part := range m.Content.Parts {
+		if s, ok := part.(string); ok && strings.TrimSpace(s) != "" {
+			texts = append(texts, s)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+func (m *gptMessage) thoughts() string {
+	texts := make([]string, 0)
+	for _, t := range m.Content.Thoughts {
+		texts = append(texts, strings.TrimSpace(t.Summary+"\n"+t.Content))
+	}
+	return strings.Join(texts, "\n\n")
+}
+
+// 解析 ChatGPT 导出的会话，只导入当前显示的分支
+// ChatGPT 一次回复可能拆成多条 assistant 消息（思考、工具调用、正文），这里合并成一条回复
+func parseChatGPTExport(data []byte) (ChatArchive, error) {
+	var conversations []gptConversation
+	if err := json.Unmarshal(data, &conversations); err != nil {
+		return ChatArchive{}, fmt.Errorf("解析 ChatGPT 导出文件失败：%v", err)
+	}
+
+	archive := ChatArchive{Version: ChatArchiveVersion, ExportedAt: time.Now().Unix(), Chats: make([]ArchiveChat, 0, len(conversations))}
+	for _, conv := range conversations {
+		chat := ArchiveChat{
+			Title:     conv.Title,
+			Model:     conv.ModelSlug,
+			CreatedAt: int64(conv.CreateTime),
+			Messages:  make([]ArchiveMessage, 0),
+		}
+		for _, node := range conv.path() {
+			msg := node.Message
+			if msg == nil || msg.Metadata.Hidden {
+				continue
+			}
+			createdAt := int64(msg.CreateTime)
+			if createdAt == 0 {
+				createdAt = chat.CreatedAt
+			}
+			switch msg.Author.Role {
+			case "user":
+				text := msg.text()
+				if text == "" {
+					continue
+				}
+				chat.Messages = append(chat.Messages, ArchiveMessage{Type: types.PromptMsg, Content: text, CreatedAt: createdAt})
+			case "assistant":
+				var text, reasoning string
+				switch msg.Content.ContentType {
+				case "text", "multimodal_text":
+					text = msg.text()
+				case "thoughts":
+					reasoning = msg.thoughts()
+				}
+				if text == "" && reasoning == "" {
+					continue
+				}
+				if len(chat.Messages) == 0 || chat.Messages[len(chat.Messages)-1].Type != types.ReplyMsg {
+					chat.Messages = append(chat.Messages, ArchiveMessage{Type: types.ReplyMsg, Model: msg.Metadata.ModelSlug, CreatedAt: createdAt})
+				}
+				reply := &chat.Messages[len(chat.Messages)-1]
+				reply.Content = strings.TrimSpace(reply.Content + "\n\n" + text)
+				reply.Reasoning = strings.TrimSpace(reply.Reasoning + "\n\n" + reasoning)
+				if reply.Model == "" {
+					reply.Model = msg.Metadata.ModelSlug
+				}
+			}
+		}
+
+		// 消息串成一条分支
+		for i := range chat.Messages {
+			chat.Messages[i].Id = uint(i + 1)
+			chat.Messages[i].ParentId = uint(i)
+		}
+		if len(chat.Messages) > 0 {
+			chat.ActiveMsgId = uint(len(chat.Messages))
+			archive.Chats = append(archive.Chats, chat)
+		}
+	}
+	return archive, nil
+}
+
+// 从根节点到当前节点的路径，没有当前节点的时候沿着最新的子节点往下走
+func (c gptConversation) path() []gptNode {
+	nodeId := c.CurrentNode
+	if _, ok := c.Mapping[nodeId]; !ok {
+		for id, node := range c.Mapping {
+			if node.Parent == "" {
+				nodeId = id
+				break
+			}
+		}
+		for i := 0; i < len(c.Mapping); i++ {
+			node := c.Mapping[nodeId]
+			if len(node.Children) == 0 {
+				break
+			}
+			nodeId = node.Children[len(node.Children)-1]
+		}
+	}
+
+	path := make([]gptNode, 0)
+	for nodeId != "" && len(path) <= len(c.Mapping) {
+		node, ok := c.Mapping[nodeId]
+		if !ok {
+			break
+		}
+		path = append(path, node)
+		nodeId = node.Parent
+	}
+	slices.Reverse(path)
+	return path
+}
@@ -0,0 +1,196 @@
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"geekai/core/types"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestArchiveChatActivePath(t *testing.T) {
+	// 1 -> 2 -> 3 -> 4
+	//        -> 5 -> 6
+	chat := ArchiveChat{Messages: []ArchiveMessage{
+		{Id: 1}, {Id: 2, ParentId: 1}, {Id: 3, ParentId: 2}, {Id: 4, ParentId: 3}, {Id: 5, ParentId: 2}, {Id: 6, ParentId: 5},
+	}}
+	tests := []struct {
+		name        string
+		activeMsgId uint
+		want        []uint
+	}{
+		{"active leaf", 4, []uint{1, 2, 3, 4}},
+		{"active message in the middle", 3, []uint{1, 2, 3, 4}},
+		{"active message with branches", 2, []uint{1, 2, 5, 6}},
+		{"no active message", 0, []uint{1, 2, 5, 6}},
+		{"missing active message", 99, []uint{1, 2, 5, 6}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chat.ActiveMsgId = tt.activeMsgId
+			ids := make([]uint, 0)
+			for _, msg := range chat.ActivePath() {
+				ids = append(ids, msg.Id)
+			}
+			if !slices.Equal(ids, tt.want) {
+				t.Errorf("ActivePath() = %v, want %v", ids, tt.want)
+			}
+		})
+	}
+
+	if got := (ArchiveChat{}).ActivePath(); got != nil {
+		t.Errorf("ActivePath() of an empty chat = %v, want nil", got)
+	}
+}
+
+func TestSplitReasoning(t *testing.T) {
+	tests := []struct {
+		text, reasoning, content string
+	}{
+		{"answer", "", "answer"},
+		{"<think>step 1</think>answer", "step 1", "answer"},
+		{"<think>a</think>x<think>b</think>y", "a\n\nb", "xy"},
+		{"<think>unfinished", "unfinished", ""},
+	}
+	for _, tt := range tests {
+		reasoning, content := splitReasoning(tt.text)
+		if reasoning != tt.reasoning || content != tt.content {
+			t.Errorf("splitReasoning(%q) = (%q, %q), want (%q, %q)", tt.text, reasoning, content, tt.reasoning, tt.content)
+		}
+	}
+}
+
+// ChatGPT 导出的会话：system 消息隐藏，u1 和 u2 是同一个位置的两个提问分支，
+// a1 是思考过程，a2 是回复正文
+const gptConversationJson = `{
+	"title": "测试会话",
+	"create_time": 1700000000.5,
+	"default_model_slug": "gpt-4o",
+	"current_node": "a2",
+	"mapping": {
+		"root": {"id": "root", "message": null, "parent": "", "children": ["sys"]},
+		"sys": {"id": "sys", "parent": "root", "children": ["u1", "u2"], "message": {
+			"author": {"role": "system"}, "content": {"content_type": "text", "parts": [""]},
+			"metadata": {"is_visually_hidden_from_conversation": true}}},
+		"u1": {"id": "u1", "parent": "sys", "children": ["a1"], "message": {
+			"author": {"role": "user"}, "create_time": 1700000001, "content": {"content_type": "text", "parts": ["你好"]}}},
+		"a1": {"id": "a1", "parent": "u1", "children": ["a2"], "message": {
+			"author": {"role": "assistant"}, "content": {"content_type": "thoughts", "thoughts": [{"summary": "", "content": "想一想"}]},
+			"metadata": {"model_slug": "o3"}}},
+		"a2": {"id": "a2", "parent": "a1", "children": [], "message": {
+			"author": {"role": "assistant"}, "content": {"content_type": "text", "parts": ["你好！", {"asset": "image"}]},
+			"metadata": {"model_slug": "o3"}}},
+		"u2": {"id": "u2", "parent": "sys", "children": ["a3"], "message": {
+			"author": {"role": "user"}, "content": {"content_type": "text", "parts": ["另一个分支"]}}},
+		"a3": {"id": "a3", "parent": "u2", "children": [], "message": {
+			"author": {"role": "assistant"}, "content": {"content_type": "text", "parts": ["分支回复"]}}}
+	}
+}`
+
+func TestParseChatArchiveChatGPT(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"conversation array", "[" + gptConversationJson + "]"},
+		{"single conversation", gptConversationJson},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archive, err := ParseChatArchive([]byte(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(archive.Chats) != 1 {
+				t.Fatalf("got %d chats, want 1", len(archive.Chats))
+			}
+			chat := archive.Chats[0]
+			if chat.Title != "测试会话" || chat.Model != "gpt-4o" || chat.CreatedAt != 1700000000 {
+				t.Errorf("unexpected chat: %+v", chat)
+			}
+			want := []ArchiveMessage{
+				{Id: 1, ParentId: 0, Type: types.PromptMsg, Content: "你好", CreatedAt: 1700000001},
+				{Id: 2, ParentId: 1, Type: types.ReplyMsg, Model: "o3", Content: "你好！", Reasoning: "想一想", CreatedAt: 1700000000},
+			}
+			if len(chat.Messages) != len(want) {
+				t.Fatalf("got messages %+v, want %+v", chat.Messages, want)
+			}
+			for i, msg := range chat.Messages {
+				w := want[i]
+				if msg.Id != w.Id || msg.ParentId != w.ParentId || msg.Type != w.Type || msg.Model != w.Model ||
+					msg.Content != w.Content || msg.Reasoning != w.Reasoning || msg.CreatedAt != w.CreatedAt {
+					t.Errorf("message %d = %+v, want %+v", i, msg, w)
+				}
+			}
+			if chat.ActiveMsgId != 2 {
+				t.Errorf("ActiveMsgId = %d, want 2", chat.ActiveMsgId)
+			}
+		})
+	}
+}
+
+// 没有 current_node 的时候沿着最新的分支往下走
+func TestParseChatArchiveChatGPTLatestBranch(t *testing.T) {
+	data := strings.Replace(gptConversationJson, `"current_node": "a2"`, `"current_node": ""`, 1)
+	archive, err := ParseChatArchive([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := archive.Chats[0].Messages
+	if len(messages) != 2 || messages[0].Content != "另一个分支" || messages[1].Content != "分支回复" {
+		t.Errorf("unexpected messages: %+v", messages)
+	}
+}
+
+func TestParseChatArchiveZip(t *testing.T) {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, content := range map[string]string{
+		"export/chat.html":          "<html></html>",
+		"export/conversations.json": "[" + gptConversationJson + "]",
+	} {
+		fw, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = fw.Write([]byte(content))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := ParseChatArchive(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archive.Chats) != 1 || len(archive.Chats[0].Messages) != 2 {
+		t.Errorf("unexpected archive: %+v", archive)
+	}
+}
+
+func TestParseChatArchive(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		chats   int
+		wantErr bool
+	}{
+		{"own export", `{"version": 1, "chats": [{"chat_id": "a", "messages": [{"id": 1, "type": "prompt", "content": "hi"}]}]}`, 1, false},
+		{"empty", "  \n", 0, true},
+		{"invalid json", "{", 0, true},
+		{"unknown format", `{"foo": "bar"}`, 0, true},
+		{"zip without conversations", "PK\x03\x04", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archive, err := ParseChatArchive([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseChatArchive() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(archive.Chats) != tt.chats {
+				t.Errorf("got %d chats, want %d", len(archive.Chats), tt.chats)
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package service
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"errors"
+	"geekai/store/model"
+	"geekai/store/vo"
+	"html"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+)
+
+const (
+	searchMaxTerms     = 10 // 最多支持的关键词数量
+	searchSnippetWidth = 40 // 高亮片段关键词前后保留的字数
+	// 全文索引使用 ngram 分词，默认按 2 个字切分，更短的关键词索引查不到
+	searchMinTermLen = 2
+)
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// ChatSearchParams 聊天记录搜索条件
+type ChatSearchParams struct {
+	Keywords string    // 关键词，多个关键词用空格分隔，需要同时匹配
+	UserId   uint      // 用户 ID，0 表示所有用户
+	Type     string    // 消息类型：prompt|reply
+	RoleId   uint      // 应用 ID
+	Model    string    // 模型
+	Start    time.Time // 开始时间
+	End      time.Time // 结束时间
+	Page     int
+	PageSize int
+}
+
+// SetDateRange 设置日期范围，格式 2006-01-02，包含结束日期当天
+func (p *ChatSearchParams) SetDateRange(dates []string) {
+	if len(dates) != 2 {
+		return
+	}
+	if start, err := time.ParseInLocation(time.DateOnly, dates[0], time.Local); err == nil {
+		p.Start = start
+	}
+	if end, err := time.ParseInLocation(time.DateOnly, dates[1], time.Local); err == nil {
+		p.End = end.AddDate(0, 0, 1)
+	}
+}
+
+// SearchChatMessages 通过全文索引搜索聊天记录，返回带高亮的内容片段，分页参数不合法的时候会修正成默认值
+func SearchChatMessages(db *gorm.DB, params *ChatSearchParams) (int64, []vo.ChatSearchItem, error) {
+	terms := searchTerms(params.Keywords)
+	if len(terms) == 0 {
+		return 0, nil, errors.New("请输入搜索关键词")
+	}
+
+	session := db.Session(&gorm.Session{}).Model(&model.ChatMessage{})
+	against := make([]string, 0, len(terms))
+	for _, term := range terms {
+		if utf8.RuneCountInString(term) < searchMinTermLen {
+			session = session.Where("search_text LIKE ?", "%"+likeEscaper.Replace(term)+"%")
+		} else {
+			against = append(against, `+"`+term+`"`)
+		}
+	}
+	if len(against) > 0 {
+		session = session.Where("MATCH(search_text) AGAINST(? IN BOOLEAN MODE)", strings.Join(against, " "))
+	}
+	if params.UserId > 0 {
+		session = session.Where("user_id", params.UserId)
+	}
+	if params.Type != "" {
+		session = session.Where("type", params.Type)
+	}
+	if params.RoleId > 0 {
+		session = session.Where("role_id", params.RoleId)
+	}
+	if params.Model != "" {
+		session = session.Where("model", params.Model)
+	}
+	if !params.Start.IsZero() {
+		session = session.Where("created_at >= ?", params.Start)
+	}
+	if !params.End.IsZero() {
+		session = session.Where("created_at < ?", params.End)
+	}
+
+	var total int64
+	if err := session.Count(&total).Error; err != nil {
+		return 0, nil, err
+	}
+	if params.Page < 1 {
+		params.Page = 1
+	}
+	if params.PageSize < 1 || params.PageSize > 100 {
+		params.PageSize = 20
+	}
+	var messages []model.ChatMessage
+	err := session.Select("id", "user_id", "chat_id", "type", "role_id", "model", "search_text", "created_at").
+		Order("id DESC").Offset((params.Page - 1) * params.PageSize).Limit(params.PageSize).Find(&messages).Error
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// 会话标题
+	chatIds := make([]string, 0, len(messages))
+	for _, msg := range messages {
+		chatIds = append(chatIds, msg.ChatId)
+	}
+	var chats []model.ChatItem
+	titles := make(map[string]string)
+	db.Select("chat_id", "title").Where("chat_id IN ?", chatIds).Find(&chats)
+	for _, chat := range chats {
+		titles[chat.ChatId] = chat.Title
+	}
+
+	items := make([]vo.ChatSearchItem, 0, len(messages))
+	for _, msg := range messages {
+		items = append(items, vo.ChatSearchItem{
+			Id:        msg.Id,
+			ChatId:    msg.ChatId,
+			Title:     titles[msg.ChatId],
+			UserId:    msg.UserId,
+			RoleId:    msg.RoleId,
+			Model:     msg.Model,
+			Type:      msg.Type,
+			Snippet:   SearchSnippet(msg.SearchText, terms),
+			CreatedAt: msg.CreatedAt.Unix(),
+		})
+	}
+	return total, items, nil
+}
+
+// 拆分关键词，每个关键词作为短语检索，引号里面的操作符不会生效，只需要去掉引号
+func searchTerms(keywords string) []string {
+	keywords = strings.ReplaceAll(keywords, `"`, " ")
+	terms := make([]string, 0)
+	for _, term := range strings.Fields(keywords) {
+		if len(terms) >= searchMaxTerms {
+			break
+		}
+		terms = append(terms, term)
+	}
+	return terms
+}
+
+// SearchSnippet 截取第一个关键词附近的内容，关键词使用 <em> 标签高亮，其他内容做 HTML 转义
+func SearchSnippet(text string, terms []string) string {
+	runes := []rune(text)
+	// 逐个字符转小写，保证跟原文的下标一致
+	lower := make([]rune, len(runes))
+	for i, r := range runes {
+		lower[i] = unicode.ToLower(r)
+	}
+
+	// 标记所有命中关键词的位置
+	marks := make([]bool, len(runes))
+	first := -1
+	for _, term := range terms {
+		t := []rune(strings.ToLower(term))
+		for i := 0; i+len(t) <= len(lower); i++ {
+			if string(lower[i:i+len(t)]) != string(t) {
+				continue
+			}
+			for j := i; j < i+len(t); j++ {
+				marks[j] = true
+			}
+			if first == -1 || i < first {
+				first = i
+			}
+		}
+	}
+
+	start, end := 0, len(runes)
+	if first > searchSnippetWidth {
+		start = first - searchSnippetWidth
+	}
+	if end-start > searchSnippetWidth*3 {
+		end = start + searchSnippetWidth*3
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("...")
+	}
+	for i := start; i < end; i++ {
+		if marks[i] && (i == start || !marks[i-1]) {
+			b.WriteString("<em>")
+		}
+		r := runes[i]
+		if r == '\n' || r == '\r' {
+			r = ' '
+		}
+		b.WriteString(html.EscapeString(string(r)))
+		if marks[i] && (i == end-1 || !marks[i+1]) {
+			b.WriteString("</em>")
+		}
+	}
+	if end < len(runes) {
+		b.WriteString("...")
+	}
+	return b.String()
+}
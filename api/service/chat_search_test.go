@@ -0,0 +1,55 @@
+package service
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSearchTerms(t *testing.T) {
+	tests := []struct {
+		keywords string
+		want     []string
+	}{
+		{"", []string{}},
+		{"  hello   world ", []string{"hello", "world"}},
+		{`foo "bar baz"`, []string{"foo", "bar", "baz"}},
+		{`+"机器学习" -x`, []string{"+", "机器学习", "-x"}},
+		{"1 2 3 4 5 6 7 8 9 10 11 12", []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10"}},
+	}
+	for _, tt := range tests {
+		if got := searchTerms(tt.keywords); !slices.Equal(got, tt.want) {
+			t.Errorf("searchTerms(%q) = %q, want %q", tt.keywords, got, tt.want)
+		}
+	}
+}
+
+func TestSearchSnippet(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		terms []string
+		want  string
+	}{
+		{"case insensitive", "Hello World", []string{"world"}, "Hello <em>World</em>"},
+		{"escape html", "a<b> & ai", []string{"ai"}, "a&lt;b&gt; &amp; <em>ai</em>"},
+		{"adjacent terms merge", "学习机器学习", []string{"机器", "学习"}, "<em>学习机器学习</em>"},
+		{"multiple hits", "go and Go", []string{"go"}, "<em>go</em> and <em>Go</em>"},
+		{"newlines", "a\r\nb", []string{"b"}, "a  <em>b</em>"},
+		{"no hit", "plain text", []string{"none"}, "plain text"},
+		{
+			"long text around the first hit",
+			strings.Repeat("x", 100) + "key" + strings.Repeat("y", 200),
+			[]string{"key"},
+			"..." + strings.Repeat("x", 40) + "<em>key</em>" + strings.Repeat("y", 77) + "...",
+		},
+		{"long text without hit", strings.Repeat("中", 130), []string{"none"}, strings.Repeat("中", 120) + "..."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SearchSnippet(tt.text, tt.terms); got != tt.want {
+				t.Errorf("SearchSnippet() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
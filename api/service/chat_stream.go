@@ -0,0 +1,263 @@
+package service
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"geekai/core/types"
+	"geekai/store/vo"
+	"geekai/utils"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	ChatStreamEOF = "eof" // 生成结束的标记，不会推送给客户端
+
+	chatStreamTTL      = 10 * time.Minute       // 生成结束之后事件保留的时间，用于断线重连
+	chatStreamAliveTTL = 30 * time.Second       // 生成任务的心跳有效期，超过这个时间没有续期认为任务已经中断
+	chatStreamPoll     = 500 * time.Millisecond // 生成任务不在当前节点的时候，轮询新事件的间隔
+
+	chatStreamCancelChannel = "chat_stream:cancel" // 停止生成的广播频道，消息内容为生成任务 ID
+)
+
+var ErrChatGenerationNotFound = errors.New("生成任务不存在或者已经结束")
+
+// ChatGeneration 一次对话生成任务，生成过程跟 HTTP 连接解耦，客户端断开之后继续生成
+type ChatGeneration struct {
+	Id        string    `json:"id"`
+	UserId    uint      `json:"user_id"`
+	ChatId    string    `json:"chat_id"`
+	Prompt    string    `json:"prompt"`
+	Files     []vo.File `json:"files"`
+	CreatedAt int64     `json:"created_at"`
+}
+
+// ChatStreamEvent 生成过程中推送的事件
+type ChatStreamEvent struct {
+	Id   string // 事件 ID，客户端断线重连的时候通过 Last-Event-ID 传回来
+	Type string
+	Data string // 推送给客户端的 JSON 数据
+}
+
+// ChatStreamService 把生成的事件缓存在 Redis Stream 里面，客户端可以从任意事件之后继续接收。
+// 同一个节点上的订阅者通过通知立即收到新事件，其他节点上的订阅者轮询 Redis。
+// 停止生成的请求可能发到任意节点，通过 Redis 频道广播给正在执行生成任务的节点
+type ChatStreamService struct {
+	redis   *redis.Client
+	ctx     context.Context
+	lock    sync.Mutex
+	notices map[string]chan struct{}                // 当前节点上的生成任务的新事件通知，有新事件的时候关闭并替换
+	cancels *types.LMap[string, context.CancelFunc] // 当前节点上的生成任务的取消函数
+}
+
+func NewChatStreamService(redisCli *redis.Client) *ChatStreamService {
+	return &ChatStreamService{
+		redis:   redisCli,
+		ctx:     context.Background(),
+		notices: make(map[string]chan struct{}),
+		cancels: types.NewLMap[string, context.CancelFunc](),
+	}
+}
+
+// Run 订阅停止生成的广播，取消在当前节点上执行的生成任务
+func (s *ChatStreamService) Run() {
+	go func() {
+		pubsub := s.redis.Subscribe(s.ctx, chatStreamCancelChannel)
+		defer pubsub.Close()
+		for msg := range pubsub.Channel() {
+			// 生成任务可能刚好结束，取消函数已经被删除
+			if cancel := s.cancels.Get(msg.Payload); cancel != nil {
+				logger.Infof("停止生成任务：%s", msg.Payload)
+				cancel()
+			}
+		}
+	}()
+}
+
+// Create 创建生成任务，同时记录会话当前正在进行的生成任务，页面刷新之后可以找回。
+// cancel 用于停止生成，在任意节点上调用 Stop 都会触发
+func (s *ChatStreamService) Create(gen *ChatGeneration, cancel context.CancelFunc) error {
+	gen.Id = utils.RandomHex(16)
+	gen.CreatedAt = time.Now().Unix()
+	pipe := s.redis.TxPipeline()
+	pipe.Set(s.ctx, s.metaKey(gen.Id), utils.JsonEncode(gen), chatStreamAliveTTL)
+	pipe.Set(s.ctx, s.chatKey(gen.ChatId), gen.Id, chatStreamAliveTTL)
+	if _, err := pipe.Exec(s.ctx); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	s.notices[gen.Id] = make(chan struct{})
+	s.lock.Unlock()
+	s.cancels.Put(gen.Id, cancel)
+	return nil
+}
+
+// Get 获取生成任务，已经结束的任务在事件过期之前也能查到
+func (s *ChatStreamService) Get(id string) (ChatGeneration, error) {
+	var gen ChatGeneration
+	if id == "" {
+		return gen, ErrChatGenerationNotFound
+	}
+	data, err := s.redis.Get(s.ctx, s.metaKey(id)).Result()
+	if errors.Is(err, redis.Nil) {
+		return gen, ErrChatGenerationNotFound
+	} else if err != nil {
+		return gen, err
+	}
+	err = utils.JsonDecode(data, &gen)
+	return gen, err
+}
+
+// Active 获取会话正在进行的生成任务
+func (s *ChatStreamService) Active(chatId string) (ChatGeneration, error) {
+	id, err := s.redis.Get(s.ctx, s.chatKey(chatId)).Result()
+	if errors.Is(err, redis.Nil) {
+		return ChatGeneration{}, ErrChatGenerationNotFound
+	} else if err != nil {
+		return ChatGeneration{}, err
+	}
+	return s.Get(id)
+}
+
+// Push 追加一个事件，message 为推送给客户端的消息
+func (s *ChatStreamService) Push(id string, eventType string, message any) error {
+	pipe := s.redis.TxPipeline()
+	pipe.XAdd(s.ctx, &redis.XAddArgs{
+		Stream: s.eventsKey(id),
+		Values: map[string]any{
+			"type": eventType,
+			"data": utils.JsonEncode(message),
+		},
+	})
+	pipe.Expire(s.ctx, s.eventsKey(id), chatStreamTTL)
+	_, err := pipe.Exec(s.ctx)
+	s.notify(id)
+	return err
+}
+
+// Heartbeat 生成任务续期，返回是否被用户停止。正常情况下停止信号通过广播送达，
+// 订阅连接断开重连期间的广播会丢失，这里再检查一次停止标记兜底
+func (s *ChatStreamService) Heartbeat(gen ChatGeneration) (bool, error) {
+	pipe := s.redis.TxPipeline()
+	pipe.Expire(s.ctx, s.metaKey(gen.Id), chatStreamAliveTTL)
+	pipe.Expire(s.ctx, s.chatKey(gen.ChatId), chatStreamAliveTTL)
+	stopped := pipe.Exists(s.ctx, s.stopKey(gen.Id))
+	if _, err := pipe.Exec(s.ctx); err != nil {
+		return false, err
+	}
+	return stopped.Val() > 0, nil
+}
+
+// Stop 停止生成任务，生成任务可以在任意节点上
+func (s *ChatStreamService) Stop(id string) error {
+	if cancel := s.cancels.Get(id); cancel != nil {
+		cancel()
+		return nil
+	}
+	pipe := s.redis.TxPipeline()
+	pipe.Set(s.ctx, s.stopKey(id), 1, chatStreamAliveTTL)
+	pipe.Publish(s.ctx, chatStreamCancelChannel, id)
+	_, err := pipe.Exec(s.ctx)
+	return err
+}
+
+// Finish 结束生成任务，写入结束标记，事件继续保留一段时间给断线的客户端
+func (s *ChatStreamService) Finish(gen ChatGeneration) error {
+	err := s.Push(gen.Id, ChatStreamEOF, nil)
+	pipe := s.redis.TxPipeline()
+	pipe.Expire(s.ctx, s.metaKey(gen.Id), chatStreamTTL)
+	pipe.Del(s.ctx, s.chatKey(gen.ChatId), s.stopKey(gen.Id))
+	if _, e := pipe.Exec(s.ctx); e != nil {
+		err = e
+	}
+
+	s.lock.Lock()
+	delete(s.notices, gen.Id)
+	s.lock.Unlock()
+	s.cancels.Delete(gen.Id)
+	return err
+}
+
+// Read 读取 lastId 之后的事件，没有新事件的时候等待，直到有新事件或者 ctx 结束
+func (s *ChatStreamService) Read(ctx context.Context, id string, lastId string) ([]ChatStreamEvent, error) {
+	// 低版本的 Redis 不支持开区间查询，从 lastId 开始查询再跳过 lastId 本身
+	start := "-"
+	if lastId != "" && lastId != "0" {
+		start = lastId
+	}
+	for {
+		notice := s.notice(id)
+		messages, err := s.redis.XRange(ctx, s.eventsKey(id), start, "+").Result()
+		if err != nil {
+			return nil, err
+		}
+		if len(messages) > 0 && messages[0].ID == lastId {
+			messages = messages[1:]
+		}
+		if len(messages) > 0 {
+			events := make([]ChatStreamEvent, 0, len(messages))
+			for _, msg := range messages {
+				events = append(events, ChatStreamEvent{
+					Id:   msg.ID,
+					Type: fmt.Sprint(msg.Values["type"]),
+					Data: fmt.Sprint(msg.Values["data"]),
+				})
+			}
+			return events, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-notice:
+		case <-time.After(chatStreamPoll):
+			// 生成任务已经过期，说明生成中断了（比如服务重启）
+			if n, err := s.redis.Exists(ctx, s.metaKey(id)).Result(); err == nil && n == 0 {
+				return nil, ErrChatGenerationNotFound
+			}
+		}
+	}
+}
+
+// 获取生成任务的新事件通知，生成任务不在当前节点的时候返回 nil
+func (s *ChatStreamService) notice(id string) chan struct{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.notices[id]
+}
+
+func (s *ChatStreamService) notify(id string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if ch, ok := s.notices[id]; ok {
+		close(ch)
+		s.notices[id] = make(chan struct{})
+	}
+}
+
+func (s *ChatStreamService) metaKey(id string) string {
+	return fmt.Sprintf("chat_stream:meta:%s", id)
+}
+
+func (s *ChatStreamService) eventsKey(id string) string {
+	return fmt.Sprintf("chat_stream:events:%s", id)
+}
+
+func (s *ChatStreamService) stopKey(id string) string {
+	return fmt.Sprintf("chat_stream:stop:%s", id)
+}
+
+func (s *ChatStreamService) chatKey(chatId string) string {
+	return fmt.Sprintf("chat_stream:chat:%s", chatId)
+}
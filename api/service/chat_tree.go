@@ -0,0 +1,117 @@
+package service
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"geekai/core/types"
+	"geekai/store/model"
+	"slices"
+
+	"gorm.io/gorm"
+)
+
+// ChatTree 会话的消息树
+// 每条消息通过 ParentId 指向上一条消息：提问消息指向上一轮的回复，回复消息指向对应的提问。
+// 重新生成和编辑提问都会在同一个父消息下面新增一个提问分支，原来的分支保留不变。
+type ChatTree struct {
+	messages map[uint]model.ChatMessage
+	children map[uint][]uint // 父消息 ID => 子消息 ID，按照 ID 升序
+	latestId uint
+}
+
+// LoadChatTree 加载会话的全部消息
+func LoadChatTree(db *gorm.DB, chatId string) (*ChatTree, error) {
+	var items []model.ChatMessage
+	err := db.Where("chat_id", chatId).Order("id ASC").Find(&items).Error
+	if err != nil {
+		return nil, err
+	}
+	return newChatTree(items), nil
+}
+
+// 按照 ID 升序的消息列表构建消息树
+func newChatTree(items []model.ChatMessage) *ChatTree {
+	tree := &ChatTree{
+		messages: make(map[uint]model.ChatMessage, len(items)),
+		children: make(map[uint][]uint),
+	}
+	for _, item := range items {
+		tree.messages[item.Id] = item
+		tree.children[item.ParentId] = append(tree.children[item.ParentId], item.Id)
+		tree.latestId = item.Id
+	}
+	return tree
+}
+
+// Get 获取消息
+func (t *ChatTree) Get(id uint) (model.ChatMessage, bool) {
+	msg, ok := t.messages[id]
+	return msg, ok
+}
+
+// Path 从根消息到指定消息的路径，消息不存在返回空
+func (t *ChatTree) Path(id uint) []model.ChatMessage {
+	path := make([]model.ChatMessage, 0)
+	for id > 0 {
+		msg, ok := t.messages[id]
+		// 防止脏数据导致死循环
+		if !ok || len(path) > len(t.messages) {
+			break
+		}
+		path = append(path, msg)
+		id = msg.ParentId
+	}
+	slices.Reverse(path)
+	return path
+}
+
+// Siblings 跟指定消息同一个父消息的所有分支，包括自己
+func (t *ChatTree) Siblings(id uint) []uint {
+	msg, ok := t.messages[id]
+	if !ok {
+		return nil
+	}
+	return t.children[msg.ParentId]
+}
+
+// Children 子消息
+func (t *ChatTree) Children(id uint) []uint {
+	return t.children[id]
+}
+
+// LatestLeaf 从指定消息一直往下走到最新的叶子消息
+func (t *ChatTree) LatestLeaf(id uint) uint {
+	for {
+		children := t.children[id]
+		if len(children) == 0 {
+			return id
+		}
+		id = children[len(children)-1]
+	}
+}
+
+// ActiveLeaf 会话当前激活分支的叶子消息，没有记录的老会话使用最新的消息
+func (t *ChatTree) ActiveLeaf(activeMsgId uint) uint {
+	if _, ok := t.messages[activeMsgId]; ok {
+		return t.LatestLeaf(activeMsgId)
+	}
+	return t.latestId
+}
+
+// BranchParent 新消息应该挂在哪条回复下面
+// lastMsgId 为要重新生成的回复，或者要编辑的提问的下一条回复，新的提问作为原提问的兄弟分支；
+// 否则接在当前激活分支的末尾。
+func (t *ChatTree) BranchParent(lastMsgId uint, activeMsgId uint) uint {
+	if msg, ok := t.messages[lastMsgId]; ok {
+		if msg.Type == types.ReplyMsg {
+			msg = t.messages[msg.ParentId]
+		}
+		return msg.ParentId
+	}
+	return t.ActiveLeaf(activeMsgId)
+}
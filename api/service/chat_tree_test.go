@@ -0,0 +1,118 @@
+package service
+
+import (
+	"geekai/core/types"
+	"geekai/store/model"
+	"slices"
+	"testing"
+)
+
+// 测试用的消息树：
+//
+//	1 提问 -> 2 回复 -> 3 提问 -> 4 回复
+//	                 -> 5 提问 -> 6 回复（编辑提问 3 产生的分支）
+func testChatTree() *ChatTree {
+	msg := func(id, parentId uint, typ string) model.ChatMessage {
+		return model.ChatMessage{Id: id, ParentId: parentId, Type: typ}
+	}
+	return newChatTree([]model.ChatMessage{
+		msg(1, 0, types.PromptMsg),
+		msg(2, 1, types.ReplyMsg),
+		msg(3, 2, types.PromptMsg),
+		msg(4, 3, types.ReplyMsg),
+		msg(5, 2, types.PromptMsg),
+		msg(6, 5, types.ReplyMsg),
+	})
+}
+
+func messageIds(messages []model.ChatMessage) []uint {
+	ids := make([]uint, 0, len(messages))
+	for _, m := range messages {
+		ids = append(ids, m.Id)
+	}
+	return ids
+}
+
+func TestChatTreePath(t *testing.T) {
+	tree := testChatTree()
+	tests := []struct {
+		id   uint
+		want []uint
+	}{
+		{4, []uint{1, 2, 3, 4}},
+		{6, []uint{1, 2, 5, 6}},
+		{1, []uint{1}},
+		{0, []uint{}},
+		{99, []uint{}},
+	}
+	for _, tt := range tests {
+		if got := messageIds(tree.Path(tt.id)); !slices.Equal(got, tt.want) {
+			t.Errorf("Path(%d) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestChatTreePathWithCycle(t *testing.T) {
+	tree := newChatTree([]model.ChatMessage{
+		{Id: 1, ParentId: 2},
+		{Id: 2, ParentId: 1},
+	})
+	if got := tree.Path(1); len(got) > 3 {
+		t.Errorf("Path() on a cycle returned %d messages", len(got))
+	}
+}
+
+func TestChatTreeBranches(t *testing.T) {
+	tree := testChatTree()
+	if got := tree.Siblings(3); !slices.Equal(got, []uint{3, 5}) {
+		t.Errorf("Siblings(3) = %v, want [3 5]", got)
+	}
+	if got := tree.Siblings(99); got != nil {
+		t.Errorf("Siblings(99) = %v, want nil", got)
+	}
+
+	tests := []struct {
+		name string
+		got  uint
+		want uint
+	}{
+		{"latest leaf of reply", tree.LatestLeaf(2), 6},
+		{"latest leaf of prompt", tree.LatestLeaf(3), 4},
+		{"active leaf", tree.ActiveLeaf(3), 4},
+		{"active leaf without record", tree.ActiveLeaf(0), 6},
+		{"active leaf with missing message", tree.ActiveLeaf(99), 6},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %d, want %d", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestChatTreeBranchParent(t *testing.T) {
+	tree := testChatTree()
+	tests := []struct {
+		name        string
+		lastMsgId   uint
+		activeMsgId uint
+		want        uint
+	}{
+		{"regenerate reply", 4, 0, 2},
+		{"edit prompt", 3, 0, 2},
+		{"regenerate first reply", 2, 0, 0},
+		{"append to active branch", 0, 3, 4},
+		{"append to latest message", 0, 0, 6},
+		{"unknown last message", 99, 4, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tree.BranchParent(tt.lastMsgId, tt.activeMsgId); got != tt.want {
+				t.Errorf("BranchParent(%d, %d) = %d, want %d", tt.lastMsgId, tt.activeMsgId, got, tt.want)
+			}
+		})
+	}
+
+	if got := newChatTree(nil).BranchParent(0, 0); got != 0 {
+		t.Errorf("BranchParent() on an empty chat = %d, want 0", got)
+	}
+}
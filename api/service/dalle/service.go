@@ -8,19 +8,18 @@ package dalle
 // * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
 
 import (
+	"context"
 	"fmt"
 	"geekai/core/types"
 	logger2 "geekai/logger"
 	"geekai/service"
+	"geekai/service/job"
 	"geekai/service/oss"
-	"geekai/store"
 	"geekai/store/model"
 	"geekai/utils"
 	"strings"
 	"time"
 
-	"github.com/go-redis/redis/v8"
-
 	"github.com/imroc/req/v3"
 	"gorm.io/gorm"
 )
@@ -29,69 +28,145 @@ var logger = logger2.GetLogger()
 
 // DALL-E 绘画服务
 
+const jobName = "dalle"
+
 type Service struct {
 	httpClient    *req.Client
 	db            *gorm.DB
 	uploadManager *oss.UploaderManager
-	taskQueue     *store.RedisQueue
+	engine        *job.Engine
 	userService   *service.UserService
+	apiKeyService *service.ApiKeyService
 }
 
-func NewService(db *gorm.DB, manager *oss.UploaderManager, redisCli *redis.Client, userService *service.UserService) *Service {
+func NewService(db *gorm.DB, manager *oss.UploaderManager, engine *job.Engine, userService *service.UserService, apiKeyService *service.ApiKeyService) *Service {
 	return &Service{
 		httpClient:    req.C().SetTimeout(time.Minute * 3),
 		db:            db,
-		taskQueue:     store.NewRedisQueue("DallE_Task_Queue", redisCli),
+		engine:        engine,
 		uploadManager: manager,
 		userService:   userService,
+		apiKeyService: apiKeyService,
 	}
 }
 
-// PushTask push a new mj task in to task queue
+// PushTask push a new dall-e task in to task queue
 func (s *Service) PushTask(task types.DallTask) {
-	logger.Infof("add a new DALL-E task to the task list: %+v", task)
-	if err := s.taskQueue.RPush(task); err != nil {
+	if err := s.engine.Submit(jobName, task.Id); err != nil {
 		logger.Errorf("push dall-e task to queue failed: %v", err)
 	}
 }
 
+// Admit 检查用户同时进行中的任务数量，没有达到上限的时候调用 create 创建任务
+func (s *Service) Admit(userId uint, create func() error) error {
+	return s.engine.Admit(jobName, userId, create)
+}
+
+// QueuePositions 排队中的任务的排队位置
+func (s *Service) QueuePositions() map[uint]int {
+	return s.engine.QueuePositions(jobName)
+}
+
+// Run 注册到任务引擎
 func (s *Service) Run() {
-	// 将数据库中未提交的任务加载到队列
-	var jobs []model.DallJob
-	s.db.Where("progress", 0).Find(&jobs)
-	for _, v := range jobs {
-		var task types.DallTask
-		err := utils.JsonDecode(v.TaskInfo, &task)
-		if err != nil {
-			logger.Errorf("decode task info with error: %v", err)
-			continue
-		}
-		task.Id = v.Id
-		s.PushTask(task)
+	s.engine.Register(s)
+}
+
+func (s *Service) Options() job.Options {
+	return job.Options{
+		Name:          jobName,
+		Concurrency:   5,
+		Timeout:       10 * time.Minute,
+		SubmitTimeout: 3 * time.Minute,
 	}
+}
 
-	logger.Info("Starting DALL-E job consumer...")
-	go func() {
-		for {
-			var task types.DallTask
-			err := s.taskQueue.LPop(&task)
-			if err != nil {
-				logger.Errorf("taking task with error: %v", err)
-				continue
-			}
-			logger.Infof("handle a new DALL-E task: %+v", task)
-			go func() {
-				_, err = s.Image(task, false)
-				if err != nil {
-					logger.Errorf("error with image task: %v", err)
-					s.db.Model(&model.DallJob{Id: task.Id}).UpdateColumns(map[string]interface{}{
-						"progress": service.FailTaskProgress,
-						"err_msg":  err.Error(),
-					})
-				}
-			}()
-		}
-	}()
+func (s *Service) record(v model.DallJob) job.Record {
+	rec := job.Record{Id: v.Id, UserId: v.UserId, Progress: v.Progress, Power: v.Power, CreatedAt: v.CreatedAt}
+	switch {
+	case v.Progress == service.FailTaskProgress:
+		rec.Status = job.StatusFailed
+	case v.Progress >= 100 && v.ImgURL == "" && v.OrgURL != "":
+		rec.Status = job.StatusDownloading
+	case v.Progress >= 100:
+		rec.Status = job.StatusSucceeded
+	case v.Progress > 0:
+		rec.Status = job.StatusRunning
+	default:
+		rec.Status = job.StatusQueued
+	}
+	return rec
+}
+
+func (s *Service) Load(id uint) (job.Record, error) {
+	var v model.DallJob
+	err := s.db.Where("id", id).First(&v).Error
+	return s.record(v), err
+}
+
+func (s *Service) Pending(userId uint) ([]job.Record, error) {
+	var items []model.DallJob
+	session := s.db.Session(&gorm.Session{})
+	if userId > 0 {
+		session = session.Where("user_id", userId)
+	}
+	err := session.Where("progress < ? OR (progress = ? AND img_url = ?) OR (progress = ? AND power > 0)",
+		100, 100, "", service.FailTaskProgress).Find(&items).Error
+	records := make([]job.Record, 0, len(items))
+	for _, v := range items {
+		records = append(records, s.record(v))
+	}
+	return records, err
+}
+
+func (s *Service) Submit(ctx context.Context, id uint) (job.Result, error) {
+	var v model.DallJob
+	if err := s.db.Where("id", id).First(&v).Error; err != nil {
+		return job.Result{}, job.Permanent(err)
+	}
+	var task types.DallTask
+	if err := utils.JsonDecode(v.TaskInfo, &task); err != nil {
+		return job.Result{}, job.Permanent(fmt.Errorf("decode task info with error: %v", err))
+	}
+	task.Id = v.Id
+	logger.Infof("handle a new DALL-E task: %+v", task)
+	if _, err := s.Image(task, false); err != nil {
+		return job.Result{}, err
+	}
+	// 返回 base64 的图片已经上传，返回 URL 的还需要下载
+	s.db.Where("id", id).First(&v)
+	if v.ImgURL == "" {
+		return job.Result{Status: job.StatusDownloading, Progress: 100}, nil
+	}
+	return job.Result{Status: job.StatusSucceeded, Progress: 100}, nil
+}
+
+func (s *Service) Download(ctx context.Context, id uint) error {
+	var v model.DallJob
+	if err := s.db.Where("id", id).First(&v).Error; err != nil {
+		return err
+	}
+	logger.Infof("try to download image: %s", v.OrgURL)
+	_, err := s.downloadImage(v.Id, v.OrgURL)
+	return err
+}
+
+func (s *Service) Finalize(id uint, result job.Result) error {
+	return s.db.Model(&model.DallJob{Id: id}).UpdateColumns(job.ProgressColumns(result, 100)).Error
+}
+
+func (s *Service) Refund(rec job.Record) (bool, error) {
+	return job.RefundOnce(s.db, &model.DallJob{}, rec, func() error {
+		var v model.DallJob
+		s.db.Where("id", rec.Id).First(&v)
+		var task types.DallTask
+		_ = utils.JsonDecode(v.TaskInfo, &task)
+		return s.userService.IncreasePower(rec.UserId, rec.Power, model.PowerLog{
+			Type:   types.PowerRefund,
+			Model:  task.ModelName,
+			Remark: fmt.Sprintf("任务失败，退回算力。任务ID：%d，Err: %s", rec.Id, v.ErrMsg),
+		})
+	})
 }
 
 type imgReq struct {
@@ -134,17 +209,11 @@ func (s *Service) Image(task types.DallTask, sync bool) (string, error) {
 	}
 
 	// get image generation API KEY
-	var apiKey model.ApiKey
-	session := s.db.Where("enabled", true)
-	if chatModel.KeyId > 0 {
-		session = session.Where("id = ?", chatModel.KeyId)
-	} else {
-		session = session.Where("type = ?", "dalle")
-	}
-	err := session.Order("last_used_at ASC").First(&apiKey).Error
+	lease, err := s.apiKeyService.Acquire("dalle", chatModel.KeyId, 0)
 	if err != nil {
 		return "", fmt.Errorf("no available Image Generation api key: %v", err)
 	}
+	apiKey := lease.Key
 
 	var res imgRes
 	var errRes ErrRes
@@ -182,12 +251,13 @@ func (s *Service) Image(task types.DallTask, sync bool) (string, error) {
 		return "", fmt.Errorf("error with send request, status: %s, %+v", r.Status, errRes.Error)
 	}
 
-	// update the api key last use time
-	s.db.Model(&apiKey).UpdateColumn("last_used_at", time.Now().Unix())
 	var imgURL string
 	var data = map[string]interface{}{
-		"progress": 100,
-		"prompt":   task.Prompt,
+		"prompt": task.Prompt,
+	}
+	// 通过任务引擎执行的任务由引擎更新状态
+	if sync {
+		data["progress"] = 100
 	}
 	// 如果返回的是base64，则需要上传到oss
 	if res.Data[0].B64Json != "" {
@@ -215,77 +285,6 @@ func (s *Service) Image(task types.DallTask, sync bool) (string, error) {
 	return content, nil
 }
 
-func (s *Service) CheckTaskStatus() {
-	go func() {
-		logger.Info("Running DALL-E task status checking ...")
-		for {
-			// 检查未完成任务进度
-			var jobs []model.DallJob
-			s.db.Where("progress < ?", 100).Find(&jobs)
-			for _, job := range jobs {
-				// 超时的任务标记为失败
-				if time.Since(job.CreatedAt) > time.Minute*10 {
-					job.Progress = service.FailTaskProgress
-					job.ErrMsg = "任务超时"
-					s.db.Updates(&job)
-				}
-			}
-
-			// 找出失败的任务，并恢复其扣减算力
-			s.db.Where("progress", service.FailTaskProgress).Where("power > ?", 0).Find(&jobs)
-			for _, job := range jobs {
-				var task types.DallTask
-				err := utils.JsonDecode(job.TaskInfo, &task)
-				if err != nil {
-					continue
-				}
-				err = s.userService.IncreasePower(job.UserId, job.Power, model.PowerLog{
-					Type:   types.PowerRefund,
-					Model:  task.ModelName,
-					Remark: fmt.Sprintf("任务失败，退回算力。任务ID：%d，Err: %s", job.Id, job.ErrMsg),
-				})
-				if err != nil {
-					continue
-				}
-				// 更新任务状态
-				s.db.Model(&job).UpdateColumn("power", 0)
-			}
-			time.Sleep(time.Second * 10)
-		}
-	}()
-}
-
-func (s *Service) DownloadImages() {
-	go func() {
-		var items []model.DallJob
-		for {
-			res := s.db.Where("img_url = ? AND progress = ?", "", 100).Find(&items)
-			if res.Error != nil {
-				continue
-			}
-
-			// download images
-			for _, v := range items {
-				if v.OrgURL == "" {
-					continue
-				}
-
-				logger.Infof("try to download image: %s", v.OrgURL)
-				imgURL, err := s.downloadImage(v.Id, v.OrgURL)
-				if err != nil {
-					logger.Error("error with download image: %s, error: %v", imgURL, err)
-					continue
-				} else {
-					logger.Infof("download image %s successfully.", v.OrgURL)
-				}
-
-			}
-
-			time.Sleep(time.Second * 5)
-		}
-	}()
-}
-
 func (s *Service) downloadImage(jobId uint, orgURL string) (string, error) {
 	// sava image
 	imgURL, err := s.uploadManager.GetUploadHandler().PutUrlFile(orgURL, ".png", false)
@@ -296,7 +295,7 @@ func (s *Service) downloadImage(jobId uint, orgURL string) (string, error) {
 	// update img_url
 	res := s.db.Model(&model.DallJob{Id: jobId}).UpdateColumn("img_url", imgURL)
 	if res.Error != nil {
-		return "", err
+		return "", res.Error
 	}
 	return imgURL, nil
 }
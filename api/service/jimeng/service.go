@@ -3,6 +3,7 @@ package jimeng
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
@@ -11,217 +12,296 @@ import (
 
 	"geekai/core/types"
 	logger2 "geekai/logger"
+	"geekai/service"
+	"geekai/service/job"
 	"geekai/service/oss"
-	"geekai/store"
 	"geekai/store/model"
 	"geekai/utils"
-
-	"github.com/go-redis/redis/v8"
 )
 
 var logger = logger2.GetLogger()
 
-// Service 即梦服务（合并了消费者功能）
+const jobName = "jimeng"
+
+// Service 即梦服务，任务由任务引擎调度
 type Service struct {
-	db        *gorm.DB
-	redis     *redis.Client
-	taskQueue *store.RedisQueue
-	client    *Client
-	ctx       context.Context
-	cancel    context.CancelFunc
-	running   bool
-	uploader  *oss.UploaderManager
+	db          *gorm.DB
+	engine      *job.Engine
+	client      *Client
+	uploader    *oss.UploaderManager
+	userService *service.UserService
 }
 
 // NewService 创建即梦服务
-func NewService(db *gorm.DB, redisCli *redis.Client, uploader *oss.UploaderManager, client *Client) *Service {
-	taskQueue := store.NewRedisQueue("JimengTaskQueue", redisCli)
-	ctx, cancel := context.WithCancel(context.Background())
+func NewService(db *gorm.DB, engine *job.Engine, uploader *oss.UploaderManager, client *Client, userService *service.UserService) *Service {
 	return &Service{
-		db:        db,
-		redis:     redisCli,
-		taskQueue: taskQueue,
-		client:    client,
-		ctx:       ctx,
-		cancel:    cancel,
-		running:   false,
-		uploader:  uploader,
+		db:          db,
+		engine:      engine,
+		client:      client,
+		uploader:    uploader,
+		userService: userService,
 	}
 }
 
-// Start 启动服务（包含消费者）
+// Start 注册到任务引擎
 func (s *Service) Start() {
-	if s.running {
-		return
-	}
-	logger.Info("Starting Jimeng service and task consumer...")
-	s.running = true
-	go s.consumeTasks()
-	go s.pollTaskStatus()
+	logger.Info("Starting Jimeng service...")
+	s.engine.Register(s)
 }
 
-// Stop 停止服务
-func (s *Service) Stop() {
-	if !s.running {
-		return
+func (s *Service) Options() job.Options {
+	return job.Options{
+		Name:         jobName,
+		Concurrency:  3,
+		Timeout:      10 * time.Minute,
+		PollInterval: 5 * time.Second,
 	}
-	logger.Info("Stopping Jimeng service and task consumer...")
-	s.running = false
-	s.cancel()
 }
 
-// consumeTasks 消费任务
-func (s *Service) consumeTasks() {
-	for {
-		select {
-		case <-s.ctx.Done():
-			logger.Info("Jimeng task consumer stopped")
-			return
-		default:
-			s.processNextTask()
-		}
-	}
+func (s *Service) record(v model.JimengJob) job.Record {
+	rec := job.Record{Id: v.Id, UserId: v.UserId, Progress: v.Progress, Power: v.Power, CreatedAt: v.CreatedAt}
+	switch v.Status {
+	case types.JMTaskStatusInQueue:
+		rec.Status = job.StatusQueued
+	case types.JMTaskStatusGenerating:
+		rec.Status = job.StatusRunning
+	case types.JMTaskStatusSuccess:
+		rec.Status = job.StatusSucceeded
+	default:
+		rec.Status = job.StatusFailed
+	}
+	return rec
 }
 
-// processNextTask 处理下一个任务
-func (s *Service) processNextTask() {
-	var jobId uint
-	if err := s.taskQueue.LPop(&jobId); err != nil {
-		// 队列为空，等待1秒后重试
-		time.Sleep(time.Second)
-		return
-	}
-
-	logger.Infof("Processing Jimeng task: job_id=%d", jobId)
-
-	if err := s.ProcessTask(jobId); err != nil {
-		logger.Errorf("process jimeng task failed: job_id=%d, error=%v", jobId, err)
-		s.UpdateJobStatus(jobId, types.JMTaskStatusFailed, err.Error())
-	} else {
-		logger.Infof("Jimeng task processed successfully: job_id=%d", jobId)
-	}
+func (s *Service) Load(id uint) (job.Record, error) {
+	var v model.JimengJob
+	err := s.db.Where("id", id).First(&v).Error
+	return s.record(v), err
 }
 
-// CreateTask 创建任务
-func (s *Service) CreateTask(userId uint, req *types.JimengTaskRequest) (*model.JimengJob, error) {
-	// 生成任务ID
-	taskId := utils.RandString(20)
-
-	// 创建任务记录
-	job := &model.JimengJob{
-		UserId:    userId,
-		TaskId:    taskId,
-		Type:      req.TaskType,
-		ReqKey:    req.ReqKey,
-		Prompt:    req.Prompt,
-		Params:    utils.JsonEncode(req),
-		Status:    types.JMTaskStatusInQueue,
-		Power:     req.Power,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
-	}
-
-	// 保存到数据库
-	if err := s.db.Create(job).Error; err != nil {
-		return nil, fmt.Errorf("create jimeng job failed: %w", err)
+func (s *Service) Pending(userId uint) ([]job.Record, error) {
+	var items []model.JimengJob
+	session := s.db.Session(&gorm.Session{})
+	if userId > 0 {
+		session = session.Where("user_id", userId)
 	}
-
-	// 推送到任务队列
-	if err := s.taskQueue.RPush(job.Id); err != nil {
-		return nil, fmt.Errorf("push jimeng task to queue failed: %w", err)
+	err := session.Where("status IN ? OR (status = ? AND power > 0)",
+		[]types.JMTaskStatus{types.JMTaskStatusInQueue, types.JMTaskStatusGenerating}, types.JMTaskStatusFailed).Find(&items).Error
+	records := make([]job.Record, 0, len(items))
+	for _, v := range items {
+		records = append(records, s.record(v))
 	}
-
-	return job, nil
+	return records, err
 }
 
-// ProcessTask 处理任务
-func (s *Service) ProcessTask(jobId uint) error {
-	// 获取任务记录
-	var job model.JimengJob
-	if err := s.db.First(&job, jobId).Error; err != nil {
-		return fmt.Errorf("get jimeng job failed: %w", err)
-	}
-
-	// 更新任务状态为处理中
-	if err := s.UpdateJobStatus(job.Id, types.JMTaskStatusGenerating, ""); err != nil {
-		return fmt.Errorf("update job status failed: %w", err)
+// Submit 提交任务。豆包生图 4.0 是同步任务，直接返回生成结果
+func (s *Service) Submit(ctx context.Context, id uint) (job.Result, error) {
+	var v model.JimengJob
+	if err := s.db.First(&v, id).Error; err != nil {
+		return job.Result{}, job.Permanent(fmt.Errorf("get jimeng job failed: %w", err))
 	}
 
 	// 解析任务参数
 	var req types.JimengTaskRequest
-	err := utils.JsonDecode(job.Params, &req)
-	if err != nil {
-		return fmt.Errorf("parse task params failed: %w", err)
+	if err := utils.JsonDecode(v.Params, &req); err != nil {
+		return job.Result{}, job.Permanent(fmt.Errorf("parse task params failed: %w", err))
 	}
 
 	// 构建请求并提交任务
 	params, err := s.buildTaskRequest(&req)
 	if err != nil {
-		return s.handleTaskError(job.Id, fmt.Sprintf("build task request failed: %v", err))
+		return job.Result{}, job.Permanent(fmt.Errorf("build task request failed: %v", err))
 	}
 
 	// 数字人任务，先识别主体
 	if req.TaskType == types.JMTaskTypeVirtualHuman {
 		if err := s.client.AvatarRecognition(req.ImageUrls[0], req.RecognizeKey); err != nil {
-			return s.handleTaskError(job.Id, fmt.Sprintf("avatar recognition failed: %v", err))
+			return job.Result{}, fmt.Errorf("avatar recognition failed: %v", err)
 		}
 	}
 
-	// 同步任务 ，后台执行
 	if req.ReqKey == DoubaoSeedream40ReqKey {
-		go func() {
-			resp, err := s.client.SubmitSyncImageTask(req)
-			if err != nil {
-				_ = s.handleTaskError(job.Id, fmt.Sprintf("submit task failed: %v", err))
-				return
-			}
-			logger.Infof("同步任务提交成功: %+v", resp)
-			// 更新原始数据
-			rawData, _ := json.Marshal(resp)
-			updates := map[string]any{
-				"raw_data": string(rawData),
-			}
-			if resp.Error != nil {
-				updates["status"] = types.JMTaskStatusFailed
-				updates["err_msg"] = resp.Error.Message
-				s.db.Model(&model.JimengJob{}).Where("id = ?", job.Id).Updates(updates)
-				return
-			}
-
-			// 更新任务状态
-			updates["status"] = types.JMTaskStatusSuccess
-			// 下载图片
-			imgUrl, err := s.uploader.GetUploadHandler().PutUrlFile(*resp.Data[0].Url, ".png", false)
-			if err == nil {
-				updates["img_url"] = imgUrl
-			}
-			s.db.Model(&model.JimengJob{}).Where("id = ?", job.Id).Updates(updates)
-		}()
-		return nil
+		resp, err := s.client.SubmitSyncImageTask(req)
+		if err != nil {
+			return job.Result{}, fmt.Errorf("submit task failed: %v", err)
+		}
+		logger.Infof("同步任务提交成功: %+v", resp)
+		// 更新原始数据
+		rawData, _ := json.Marshal(resp)
+		updates := map[string]any{
+			"raw_data": string(rawData),
+		}
+		if resp.Error != nil {
+			s.db.Model(&model.JimengJob{}).Where("id = ?", id).Updates(updates)
+			return job.Result{Status: job.StatusFailed, Message: resp.Error.Message}, nil
+		}
+		if len(resp.Data) == 0 || resp.Data[0].Url == nil {
+			return job.Result{}, errors.New("submit task failed: 没有返回图片")
+		}
+		// 下载图片
+		imgUrl, err := s.uploader.GetUploadHandler().PutUrlFile(*resp.Data[0].Url, ".png", false)
+		if err != nil {
+			logger.Errorf("upload image failed: %v", err)
+			imgUrl = *resp.Data[0].Url
+		}
+		updates["img_url"] = imgUrl
+		s.db.Model(&model.JimengJob{}).Where("id = ?", id).Updates(updates)
+		return job.Result{Status: job.StatusSucceeded, Progress: 100}, nil
 	}
 
 	logger.Debugf("提交即梦任务: %+v", params)
-	// 异步任务 ，前台执行
 	resp, err := s.client.SubmitTask(params)
 	if err != nil {
-		return s.handleTaskError(job.Id, fmt.Sprintf("submit task failed: %v", err))
+		return job.Result{}, fmt.Errorf("submit task failed: %v", err)
 	}
-
 	if resp.Code != CodeSuccess {
-		return s.handleTaskError(job.Id, fmt.Sprintf("submit task failed: %s", resp.Message))
+		return job.Result{}, job.Permanent(fmt.Errorf("submit task failed: %s", resp.Message))
 	}
 
 	// 更新任务ID和原始数据
 	rawData, _ := json.Marshal(resp)
-	if err := s.db.Model(&model.JimengJob{}).Where("id = ?", job.Id).Updates(map[string]any{
+	err = s.db.Model(&model.JimengJob{}).Where("id = ?", id).Updates(map[string]any{
 		"task_id":    resp.Data.TaskId,
 		"raw_data":   string(rawData),
 		"updated_at": time.Now(),
-	}).Error; err != nil {
-		logger.Errorf("update jimeng job task_id failed: %v", err)
+	}).Error
+	if err != nil {
+		return job.Result{}, job.Permanent(fmt.Errorf("update jimeng job task_id failed: %v", err))
 	}
+	return job.Result{Status: job.StatusRunning}, nil
+}
+
+// Poll 查询异步任务的状态，任务完成之后转存结果文件
+func (s *Service) Poll(ctx context.Context, id uint) (job.Result, error) {
+	var v model.JimengJob
+	if err := s.db.First(&v, id).Error; err != nil {
+		return job.Result{}, err
+	}
+	// 豆包生图 4.0 是同步任务，不需要轮询
+	if v.ReqKey == DoubaoSeedream40ReqKey {
+		return job.Result{Status: job.StatusRunning}, nil
+	}
+
+	resp, err := s.client.QueryTask(&QueryTaskRequest{
+		ReqKey:  v.ReqKey,
+		TaskId:  v.TaskId,
+		ReqJson: `{"return_url":true}`,
+	}, ASyncActionGetResult)
+	if err != nil {
+		return job.Result{}, fmt.Errorf("query task failed: %s", err.Error())
+	}
+
+	// 更新原始数据
+	rawData, _ := json.Marshal(resp)
+	s.db.Model(&model.JimengJob{}).Where("id = ?", id).Update("raw_data", string(rawData))
 
-	return nil
+	if resp.Code != CodeSuccess {
+		return job.Result{}, fmt.Errorf("query task failed: %s", resp.Message)
+	}
+
+	switch resp.Data.Status {
+	case types.JMTaskStatusDone:
+		// 判断任务是否成功
+		if resp.Message != "Success" {
+			return job.Result{Status: job.StatusFailed, Message: fmt.Sprintf("task failed: %s", resp.Data.AlgorithmBaseResp.StatusMessage)}, nil
+		}
+
+		updates := map[string]any{}
+		if len(resp.Data.ImageUrls) > 0 {
+			imgUrl, err := s.uploader.GetUploadHandler().PutUrlFile(resp.Data.ImageUrls[0], ".png", false)
+			if err != nil {
+				logger.Errorf("upload image failed: %v", err)
+				imgUrl = resp.Data.ImageUrls[0]
+			}
+			updates["img_url"] = imgUrl
+		}
+		if resp.Data.VideoUrl != "" {
+			videoUrl, err := s.uploader.GetUploadHandler().PutUrlFile(resp.Data.VideoUrl, ".mp4", false)
+			if err != nil {
+				logger.Errorf("upload video failed: %v", err)
+				videoUrl = resp.Data.VideoUrl
+			}
+			updates["video_url"] = videoUrl
+		}
+		if len(updates) > 0 {
+			if err = s.db.Model(&model.JimengJob{}).Where("id = ?", id).Updates(updates).Error; err != nil {
+				return job.Result{}, err
+			}
+		}
+		return job.Result{Status: job.StatusSucceeded, Progress: 100}, nil
+	case types.JMTaskStatusInQueue, types.JMTaskStatusGenerating:
+		return job.Result{Status: job.StatusRunning}, nil
+	case types.JMTaskStatusNotFound:
+		return job.Result{Status: job.StatusFailed, Message: "task not found"}, nil
+	case types.JMTaskStatusExpired:
+		return job.Result{Status: job.StatusFailed, Message: "task expired"}, nil
+	default:
+		logger.Warnf("unknown task status: %s", resp.Data.Status)
+		return job.Result{Status: job.StatusRunning}, nil
+	}
+}
+
+func (s *Service) Finalize(id uint, result job.Result) error {
+	updates := map[string]any{"updated_at": time.Now()}
+	switch result.Status {
+	case job.StatusQueued:
+		updates["status"] = types.JMTaskStatusInQueue
+		updates["err_msg"] = ""
+	case job.StatusRunning:
+		updates["status"] = types.JMTaskStatusGenerating
+		updates["progress"] = result.Progress
+	case job.StatusSucceeded:
+		updates["status"] = types.JMTaskStatusSuccess
+		updates["progress"] = 100
+	default:
+		updates["status"] = types.JMTaskStatusFailed
+		updates["err_msg"] = result.Message
+	}
+	return s.db.Model(&model.JimengJob{}).Where("id = ?", id).Updates(updates).Error
+}
+
+func (s *Service) Refund(rec job.Record) (bool, error) {
+	return job.RefundOnce(s.db, &model.JimengJob{}, rec, func() error {
+		var v model.JimengJob
+		s.db.First(&v, rec.Id)
+		return s.userService.IncreasePower(rec.UserId, rec.Power, model.PowerLog{
+			Type:   types.PowerRefund,
+			Model:  v.ReqKey,
+			Remark: fmt.Sprintf("任务失败，退回算力。任务ID：%d，Err: %s", rec.Id, v.ErrMsg),
+		})
+	})
+}
+
+// CreateTask 创建任务
+func (s *Service) CreateTask(userId uint, req *types.JimengTaskRequest) (*model.JimengJob, error) {
+	// 生成任务ID
+	taskId := utils.RandString(20)
+
+	// 创建任务记录
+	job := &model.JimengJob{
+		UserId:    userId,
+		TaskId:    taskId,
+		Type:      req.TaskType,
+		ReqKey:    req.ReqKey,
+		Prompt:    req.Prompt,
+		Params:    utils.JsonEncode(req),
+		Status:    types.JMTaskStatusInQueue,
+		Power:     req.Power,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+
+	// 保存到数据库
+	if err := s.db.Create(job).Error; err != nil {
+		return nil, fmt.Errorf("create jimeng job failed: %w", err)
+	}
+
+	// 推送到任务队列
+	if err := s.engine.Submit(jobName, job.Id); err != nil {
+		return nil, fmt.Errorf("push jimeng task to queue failed: %w", err)
+	}
+
+	return job, nil
 }
 
 // buildTaskRequest 构建任务请求（统一的参数解析）
@@ -272,106 +352,6 @@ func (s *Service) buildTaskRequest(req *types.JimengTaskRequest) (map[string]any
 	return params, nil
 }
 
-// pollTaskStatus 轮询任务状态
-func (s *Service) pollTaskStatus() {
-
-	for {
-		var jobs []model.JimengJob
-		s.db.Where("status IN (?)", []types.JMTaskStatus{types.JMTaskStatusGenerating, types.JMTaskStatusInQueue}).Find(&jobs)
-		if len(jobs) == 0 {
-			logger.Debugf("no jimeng task to poll, sleep 10s")
-			time.Sleep(10 * time.Second)
-			continue
-		}
-
-		for _, job := range jobs {
-			// 任务超时处理
-			if job.UpdatedAt.Before(time.Now().Add(-10 * time.Minute)) {
-				s.handleTaskError(job.Id, "task timeout")
-				continue
-			}
-
-			// 豆包生图 4.0 是同步任务，不需要轮询
-			if job.ReqKey == DoubaoSeedream40ReqKey {
-				continue
-			}
-
-			// 查询任务状态
-			resp, err := s.client.QueryTask(&QueryTaskRequest{
-				ReqKey:  job.ReqKey,
-				TaskId:  job.TaskId,
-				ReqJson: `{"return_url":true}`,
-			}, ASyncActionGetResult)
-
-			if err != nil {
-				s.handleTaskError(job.Id, fmt.Sprintf("query task failed: %s", err.Error()))
-				continue
-			}
-
-			// 更新原始数据
-			rawData, _ := json.Marshal(resp)
-			s.db.Model(&model.JimengJob{}).Where("id = ?", job.Id).Update("raw_data", string(rawData))
-
-			if resp.Code != CodeSuccess {
-				s.handleTaskError(job.Id, fmt.Sprintf("query task failed: %s", resp.Message))
-				continue
-			}
-
-			switch resp.Data.Status {
-			case types.JMTaskStatusDone:
-				// 判断任务是否成功
-				if resp.Message != "Success" {
-					s.handleTaskError(job.Id, fmt.Sprintf("task failed: %s", resp.Data.AlgorithmBaseResp.StatusMessage))
-					continue
-				}
-
-				// 任务完成，更新结果
-				updates := map[string]any{
-					"status":     types.JMTaskStatusSuccess,
-					"updated_at": time.Now(),
-				}
-
-				// 设置结果URL
-				if len(resp.Data.ImageUrls) > 0 {
-					imgUrl, err := s.uploader.GetUploadHandler().PutUrlFile(resp.Data.ImageUrls[0], ".png", false)
-					if err != nil {
-						logger.Errorf("upload image failed: %v", err)
-						imgUrl = resp.Data.ImageUrls[0]
-					}
-					updates["img_url"] = imgUrl
-				}
-				if resp.Data.VideoUrl != "" {
-					videoUrl, err := s.uploader.GetUploadHandler().PutUrlFile(resp.Data.VideoUrl, ".mp4", false)
-					if err != nil {
-						logger.Errorf("upload video failed: %v", err)
-						videoUrl = resp.Data.VideoUrl
-					}
-					updates["video_url"] = videoUrl
-				}
-
-				s.db.Model(&model.JimengJob{}).Where("id = ?", job.Id).Updates(updates)
-			case types.JMTaskStatusInQueue, types.JMTaskStatusGenerating:
-				// 任务处理中
-				s.UpdateJobStatus(job.Id, types.JMTaskStatusGenerating, "")
-
-			case types.JMTaskStatusNotFound:
-				// 任务未找到
-				s.handleTaskError(job.Id, "task not found")
-
-			case types.JMTaskStatusExpired:
-				continue
-			default:
-				logger.Warnf("unknown task status: %s", resp.Data.Status)
-			}
-
-		}
-
-		time.Sleep(5 * time.Second)
-
-	}
-
-}
-
 // UpdateJobStatus 更新任务状态
 func (s *Service) UpdateJobStatus(jobId uint, status types.JMTaskStatus, errMsg string) error {
 	updates := map[string]any{
@@ -384,15 +364,19 @@ func (s *Service) UpdateJobStatus(jobId uint, status types.JMTaskStatus, errMsg
 	return s.db.Model(&model.JimengJob{}).Where("id = ?", jobId).Updates(updates).Error
 }
 
-// handleTaskError 处理任务错误
-func (s *Service) handleTaskError(jobId uint, errMsg string) error {
-	logger.Errorf("Jimeng task error (job_id: %d): %s", jobId, errMsg)
-	return s.UpdateJobStatus(jobId, types.JMTaskStatusFailed, errMsg)
-}
-
 // PushTaskToQueue 推送任务到队列（用于手动重试）
 func (s *Service) PushTaskToQueue(jobId uint) error {
-	return s.taskQueue.RPush(jobId)
+	return s.engine.Submit(jobName, jobId)
+}
+
+// Admit 检查用户同时进行中的任务数量，没有达到上限的时候调用 create 创建任务
+func (s *Service) Admit(userId uint, create func() error) error {
+	return s.engine.Admit(jobName, userId, create)
+}
+
+// QueuePositions 排队中的任务的排队位置
+func (s *Service) QueuePositions() map[uint]int {
+	return s.engine.QueuePositions(jobName)
 }
 
 // GetTaskStats 获取任务统计信息
@@ -0,0 +1,79 @@
+package job
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Callbacker 支持回调通知的服务，解析上游的回调数据，返回任务的最新状态
+type Callbacker interface {
+	Callback(id uint, body []byte) (Result, error)
+}
+
+// CallbackURL 任务的回调地址。签名放在地址里面，上游服务原样回调即可，不需要支持签名。
+// 没有开启回调的时候返回空字符串
+func (e *Engine) CallbackURL(name string, id uint) string {
+	if !e.CallbackEnabled() {
+		return ""
+	}
+	return fmt.Sprintf("%s/api/callback/%s/%d?sign=%s", strings.TrimRight(e.callback.BaseURL, "/"), name, id, e.sign(name, id))
+}
+
+// CallbackEnabled 是否开启了回调，没有配置签名密钥的不开启
+func (e *Engine) CallbackEnabled() bool {
+	return e.callback.Enabled && e.callback.BaseURL != "" && e.callback.SecretKey != ""
+}
+
+// VerifyCallback 校验回调地址的签名
+func (e *Engine) VerifyCallback(name string, id uint, sign string) bool {
+	return e.CallbackEnabled() && hmac.Equal([]byte(sign), []byte(e.sign(name, id)))
+}
+
+// Callback 处理上游的回调通知，立即更新任务状态，生成完成的任务马上开始下载
+func (e *Engine) Callback(name string, id uint, body []byte) error {
+	r, err := e.runner(name)
+	if err != nil {
+		return err
+	}
+	cb, ok := r.handler.(Callbacker)
+	if !ok {
+		return fmt.Errorf("%s jobs do not support callback", name)
+	}
+	// 和兜底的轮询互斥，同一个结果不会被处理两次。任务正在被处理的时候返回错误，
+	// 上游会重新回调，或者等轮询查到结果
+	var cbErr error
+	locked := e.withLock(r, id, func(ctx context.Context) {
+		var result Result
+		result, cbErr = safeCall(func() (Result, error) {
+			return cb.Callback(id, body)
+		})
+		if cbErr == nil {
+			e.transition(r, id, result)
+		}
+	})
+	if !locked {
+		return ErrJobRunning
+	}
+	if cbErr != nil {
+		return cbErr
+	}
+	r.wakeup()
+	return nil
+}
+
+func (e *Engine) sign(name string, id uint) string {
+	mac := hmac.New(sha256.New, []byte(e.callback.SecretKey))
+	mac.Write([]byte(fmt.Sprintf("%s:%d", name, id)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,724 @@
+package job
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"geekai/core/types"
+	logger2 "geekai/logger"
+	"geekai/store"
+	"geekai/store/model"
+	"geekai/utils"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"gorm.io/gorm"
+)
+
+var logger = logger2.GetLogger()
+
+const (
+	jobCancelChannel = "job:cancel"     // 取消任务的广播频道，消息内容为 类型:任务ID
+	jobLockMargin    = time.Minute      // 任务锁的有效期比操作的超时时间多出来的部分
+	jobReclaimPeriod = 30 * time.Second // 检查超时未确认的队列消息的间隔
+)
+
+var (
+	ErrJobFinished = errors.New("任务已经结束")
+	ErrJobRunning  = errors.New("任务正在处理中")
+)
+
+// 只有锁的持有者才能释放
+var unlockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// Engine 后台任务引擎。所有生成服务的任务都通过引擎调度：Redis Stream 可靠队列排队，优先用户的任务先提交，按照并发数提交，
+// 失败之后指数退避重试，定时查询进度和下载结果，超时、取消和失败的任务统一退回算力。
+// 任务的状态变化都经过 transition，同时记录到任务日志并推送给用户
+type Engine struct {
+	db       *gorm.DB
+	redis    *redis.Client
+	config   map[string]types.JobConfig
+	callback types.CallbackConfig
+	ctx      context.Context
+	lock     sync.Mutex
+	runners  map[string]*runner
+	cancels  *types.LMap[string, context.CancelFunc] // 当前节点上正在提交的任务
+	notices  map[uint]chan struct{}                  // 当前节点上等待任务事件的用户，有新事件的时候关闭
+}
+
+// 一种任务类型的调度器
+type runner struct {
+	handler Handler
+	opts    Options
+	queue   *store.RedisStreamQueue
+	tasks   chan delivery
+	idle    chan struct{} // 空闲的 worker，有空闲的 worker 才从队列取任务，后来的优先任务不会排在已经取出的任务后面
+	lock    sync.Mutex
+	retries map[uint]*retryState // 查询和下载连续失败的任务
+	polled  map[uint]time.Time   // 开启了回调的任务最后一次查询的时间
+	wake    chan struct{}        // 收到回调之后立即处理，不用等到下一次轮询
+}
+
+type queuedJob struct {
+	Id       uint `json:"id"`
+	Attempt  int  `json:"attempt"`            // 已经重试的次数
+	Priority bool `json:"priority,omitempty"` // 是否进入优先通道
+}
+
+// 从队列取出的任务，提交完成之后确认消息
+type delivery struct {
+	job queuedJob
+	msg store.StreamMessage
+}
+
+type retryState struct {
+	count int
+	next  time.Time
+}
+
+func NewEngine(db *gorm.DB, redisCli *redis.Client, config *types.AppConfig) *Engine {
+	return &Engine{
+		db:       db,
+		redis:    redisCli,
+		config:   config.Jobs,
+		callback: config.Callback,
+		ctx:      context.Background(),
+		runners:  make(map[string]*runner),
+		cancels:  types.NewLMap[string, context.CancelFunc](),
+		notices:  make(map[uint]chan struct{}),
+	}
+}
+
+// Run 订阅取消任务的广播，中断当前节点上正在提交的任务；订阅任务事件的广播，通知当前节点上的事件连接
+func (e *Engine) Run() {
+	go func() {
+		pubsub := e.redis.Subscribe(e.ctx, jobCancelChannel, jobEventChannel)
+		defer pubsub.Close()
+		for msg := range pubsub.Channel() {
+			switch msg.Channel {
+			case jobEventChannel:
+				e.notify(msg.Payload)
+			case jobCancelChannel:
+				// 任务可能刚好提交完成，取消函数已经被删除
+				if cancel := e.cancels.Get(msg.Payload); cancel != nil {
+					cancel()
+				}
+			}
+		}
+	}()
+}
+
+// Register 注册任务插件，恢复还没有提交的任务并启动调度
+func (e *Engine) Register(h Handler) {
+	opts := h.Options()
+	opts = opts.withDefaults(e.config[opts.Name])
+	// 取出之后等待空闲 worker 和提交的时间都不能超过可见性超时，否则会被重复投递
+	visibility := 2*opts.SubmitTimeout + jobLockMargin
+	r := &runner{
+		handler: h,
+		opts:    opts,
+		queue:   store.NewRedisStreamQueue("job:stream:"+opts.Name, e.redis, visibility, opts.MaxDeliveries),
+		tasks:   make(chan delivery),
+		idle:    make(chan struct{}, opts.Concurrency),
+		retries: make(map[uint]*retryState),
+		polled:  make(map[uint]time.Time),
+		wake:    make(chan struct{}, 1),
+	}
+	e.lock.Lock()
+	e.runners[opts.Name] = r
+	e.lock.Unlock()
+
+	// 入队之前就中断的任务重新入队，重复入队的任务在提交之前会被跳过
+	records, err := h.Pending(0)
+	if err != nil {
+		logger.Errorf("load pending %s jobs with error: %v", opts.Name, err)
+	}
+	for _, rec := range records {
+		if rec.Status == StatusQueued {
+			_ = e.push(r, queuedJob{Id: rec.Id, Priority: e.priority(rec.UserId)})
+		}
+	}
+
+	logger.Infof("Starting %s job runner, concurrency: %d", opts.Name, opts.Concurrency)
+	go e.consume(r)
+	for i := 0; i < opts.Concurrency; i++ {
+		r.idle <- struct{}{}
+		go e.work(r)
+	}
+	go e.schedule(r)
+	go e.poll(r)
+}
+
+// Submit 任务加入队列
+func (e *Engine) Submit(name string, id uint) error {
+	r, err := e.runner(name)
+	if err != nil {
+		return err
+	}
+	rec, err := r.handler.Load(id)
+	if err != nil {
+		return err
+	}
+	logger.Infof("add a new %s job to the queue: %d", name, id)
+	if err = e.push(r, queuedJob{Id: id, Priority: e.priority(rec.UserId)}); err != nil {
+		return err
+	}
+	e.publish(r, rec, EventCreated, Result{Status: StatusQueued})
+	return nil
+}
+
+// Load 读取任务记录
+func (e *Engine) Load(name string, id uint) (Record, error) {
+	r, err := e.runner(name)
+	if err != nil {
+		return Record{}, err
+	}
+	return r.handler.Load(id)
+}
+
+// Cancel 取消任务，退回算力。正在提交的任务会被中断，包括在其他节点上提交的
+func (e *Engine) Cancel(name string, id uint) error {
+	r, err := e.runner(name)
+	if err != nil {
+		return err
+	}
+	rec, err := r.handler.Load(id)
+	if err != nil {
+		return err
+	}
+	if rec.Status.Finished() {
+		return ErrJobFinished
+	}
+	e.transition(r, id, Result{Status: StatusCanceled, Message: "任务已取消"})
+	return e.redis.Publish(e.ctx, jobCancelChannel, jobKey(name, id)).Err()
+}
+
+// Report 同步生成的服务在提交过程中汇报生成进度
+func (e *Engine) Report(name string, id uint, progress int) {
+	r, err := e.runner(name)
+	if err != nil {
+		return
+	}
+	e.transition(r, id, Result{Status: StatusRunning, Progress: progress})
+}
+
+// DeadLetters 死信列表
+func (e *Engine) DeadLetters(name string, page int, pageSize int) ([]store.DeadLetter, int64, error) {
+	r, err := e.runner(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	return r.queue.DeadLetters(page, pageSize)
+}
+
+// RequeueDeadLetter 重新投递死信。进入死信队列的任务已经失败并退回了算力，重新投递之后不再扣费
+func (e *Engine) RequeueDeadLetter(name string, id string) error {
+	r, err := e.runner(name)
+	if err != nil {
+		return err
+	}
+	dl, err := r.queue.DeadLetter(id)
+	if err != nil {
+		return err
+	}
+	var task queuedJob
+	if err = utils.JsonDecode(dl.Body, &task); err != nil {
+		return err
+	}
+	rec, err := r.handler.Load(task.Id)
+	if err != nil {
+		return err
+	}
+	switch rec.Status {
+	case StatusSucceeded:
+		return ErrJobFinished
+	case StatusRunning, StatusDownloading:
+		return ErrJobRunning
+	case StatusFailed, StatusCanceled:
+		// 已经结束的任务不能通过 transition 修改状态
+		if err = r.handler.Finalize(task.Id, Result{Status: StatusQueued}); err != nil {
+			return err
+		}
+		e.log(r, rec, StatusQueued, "重新投递死信")
+		e.publish(r, rec, EventProgress, Result{Status: StatusQueued})
+	}
+	if err = e.push(r, queuedJob{Id: task.Id, Priority: task.Priority}); err != nil {
+		return err
+	}
+	return r.queue.RemoveDeadLetter(id)
+}
+
+// RemoveDeadLetter 删除死信
+func (e *Engine) RemoveDeadLetter(name string, id string) error {
+	r, err := e.runner(name)
+	if err != nil {
+		return err
+	}
+	return r.queue.RemoveDeadLetter(id)
+}
+
+func (e *Engine) runner(name string) (*runner, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	r, ok := e.runners[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown job type: %s", name)
+	}
+	return r, nil
+}
+
+// 从队列取出任务交给空闲的 worker，worker 都在忙的时候任务留在队列里
+func (e *Engine) consume(r *runner) {
+	for range r.idle {
+		var task queuedJob
+		msg, err := r.queue.Pop(&task)
+		if err != nil {
+			logger.Errorf("taking %s job with error: %v", r.opts.Name, err)
+			time.Sleep(time.Second)
+			r.idle <- struct{}{}
+			continue
+		}
+		if msg.Deliveries > 1 {
+			logger.Warnf("redeliver %s job %d, deliveries: %d", r.opts.Name, task.Id, msg.Deliveries)
+		}
+		r.tasks <- delivery{job: task, msg: msg}
+	}
+}
+
+// 提交完成之后才确认消息，进程在提交过程中退出的任务会被重新投递
+func (e *Engine) work(r *runner) {
+	for d := range r.tasks {
+		e.submit(r, d.job)
+		if err := r.queue.Ack(d.msg); err != nil {
+			logger.Errorf("ack %s job %d with error: %v", r.opts.Name, d.job.Id, err)
+		}
+		r.idle <- struct{}{}
+	}
+}
+
+func (e *Engine) submit(r *runner, task queuedJob) {
+	key := jobKey(r.opts.Name, task.Id)
+	token, ok := e.tryLock(key, r.opts.SubmitTimeout+jobLockMargin)
+	if !ok {
+		return // 其他节点正在处理
+	}
+	defer e.unlock(key, token)
+
+	rec, err := r.handler.Load(task.Id)
+	if err != nil {
+		logger.Errorf("load %s job %d with error: %v", r.opts.Name, task.Id, err)
+		return
+	}
+	// 重复入队或者已经取消的任务
+	if rec.Status != StatusQueued {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(e.ctx, r.opts.SubmitTimeout)
+	defer cancel()
+	e.cancels.Put(key, cancel)
+	defer e.cancels.Delete(key)
+
+	e.transition(r, task.Id, Result{Status: StatusRunning})
+	logger.Infof("submit %s job %d, attempt: %d", r.opts.Name, task.Id, task.Attempt+1)
+	result, err := safeCall(func() (Result, error) {
+		return r.handler.Submit(ctx, task.Id)
+	})
+	if err == nil {
+		e.transition(r, task.Id, result)
+		return
+	}
+
+	// 提交过程中被取消的任务
+	if rec, e2 := r.handler.Load(task.Id); e2 == nil && rec.Status.Finished() {
+		return
+	}
+	if IsPermanent(err) || task.Attempt >= r.opts.MaxRetries {
+		e.transition(r, task.Id, Result{Status: StatusFailed, Message: err.Error()})
+		return
+	}
+	delay := r.opts.backoff(task.Attempt + 1)
+	logger.Warnf("submit %s job %d with error, retry after %s: %v", r.opts.Name, task.Id, delay, err)
+	e.transition(r, task.Id, Result{Status: StatusQueued})
+	err = e.redis.ZAdd(e.ctx, e.delayKey(r.opts.Name), &redis.Z{
+		Score:  float64(time.Now().Add(delay).UnixMilli()),
+		Member: utils.JsonEncode(queuedJob{Id: task.Id, Attempt: task.Attempt + 1, Priority: task.Priority}),
+	}).Err()
+	if err != nil {
+		logger.Errorf("delay %s job %d with error: %v", r.opts.Name, task.Id, err)
+	}
+}
+
+// 重新投递超时没有确认的消息，多次投递都没有完成的任务转入死信队列并标记为失败
+func (e *Engine) reclaim(r *runner) {
+	deadLetters, err := r.queue.Reclaim()
+	if err != nil {
+		logger.Errorf("reclaim %s jobs with error: %v", r.opts.Name, err)
+		return
+	}
+	for _, dl := range deadLetters {
+		var task queuedJob
+		if err = utils.JsonDecode(dl.Body, &task); err != nil {
+			continue
+		}
+		logger.Errorf("%s job %d moved to dead letter queue: %s", r.opts.Name, task.Id, dl.Reason)
+		e.withLock(r, task.Id, func(ctx context.Context) {
+			e.transition(r, task.Id, Result{Status: StatusFailed, Message: "任务多次投递都没有处理完成：" + dl.Reason})
+		})
+	}
+}
+
+// 到期的重试任务重新加入队列，多个节点同时处理的时候只有删除成功的节点入队
+func (e *Engine) schedule(r *runner) {
+	key := e.delayKey(r.opts.Name)
+	lastReclaim := time.Now()
+	for {
+		time.Sleep(time.Second)
+		if time.Since(lastReclaim) > jobReclaimPeriod {
+			e.reclaim(r)
+			lastReclaim = time.Now()
+		}
+		members, err := e.redis.ZRangeByScore(e.ctx, key, &redis.ZRangeBy{
+			Min: "-inf",
+			Max: strconv.FormatInt(time.Now().UnixMilli(), 10),
+		}).Result()
+		if err != nil {
+			continue
+		}
+		for _, member := range members {
+			if n, err := e.redis.ZRem(e.ctx, key, member).Result(); err != nil || n == 0 {
+				continue
+			}
+			var task queuedJob
+			if err = utils.JsonDecode(member, &task); err == nil {
+				_ = e.push(r, task)
+			}
+		}
+	}
+}
+
+// 定时检查没有结束的任务：超时，查询进度，下载结果，退回失败任务的算力
+func (e *Engine) poll(r *runner) {
+	poller, canPoll := r.handler.(Poller)
+	downloader, canDownload := r.handler.(Downloader)
+	for {
+		records, err := r.handler.Pending(0)
+		if err != nil {
+			logger.Errorf("load pending %s jobs with error: %v", r.opts.Name, err)
+		}
+		for _, rec := range records {
+			switch {
+			case rec.Status.Finished():
+				if rec.Status != StatusSucceeded {
+					e.refund(r, rec)
+				}
+			case rec.Status != StatusDownloading && e.expired(r, rec):
+				e.withLock(r, rec.Id, func(ctx context.Context) {
+					e.transition(r, rec.Id, Result{Status: StatusFailed, Message: "任务超时"})
+				})
+			case rec.Status == StatusRunning && canPoll && r.due(rec.Id) && e.pollDue(r, rec):
+				e.withLock(r, rec.Id, func(ctx context.Context) {
+					result, err := safeCall(func() (Result, error) {
+						return poller.Poll(ctx, rec.Id)
+					})
+					e.afterRetryable(r, rec.Id, result, err, "查询任务失败")
+				})
+			case rec.Status == StatusDownloading && canDownload && r.due(rec.Id):
+				e.withLock(r, rec.Id, func(ctx context.Context) {
+					_, err := safeCall(func() (Result, error) {
+						return Result{}, downloader.Download(ctx, rec.Id)
+					})
+					e.afterRetryable(r, rec.Id, Result{Status: StatusSucceeded, Progress: 100}, err, "下载文件失败")
+				})
+			}
+		}
+		r.forget(records)
+		select {
+		case <-r.wake:
+		case <-time.After(r.opts.PollInterval):
+		}
+	}
+}
+
+// 开启了回调的任务只需要低频查询，兜底回调没有送达的情况
+func (e *Engine) pollDue(r *runner, rec Record) bool {
+	if !rec.Callback {
+		return true
+	}
+	interval := time.Duration(e.callback.PollInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if last, ok := r.polled[rec.Id]; ok && time.Since(last) < interval {
+		return false
+	}
+	r.polled[rec.Id] = time.Now()
+	return true
+}
+
+// 查询和下载出错之后按照退避时间重试，连续失败超过重试次数的任务标记为失败
+func (e *Engine) afterRetryable(r *runner, id uint, result Result, err error, message string) {
+	r.lock.Lock()
+	state, ok := r.retries[id]
+	if err == nil {
+		delete(r.retries, id)
+		r.lock.Unlock()
+		e.transition(r, id, result)
+		return
+	}
+	if !ok {
+		state = &retryState{}
+		r.retries[id] = state
+	}
+	state.count++
+	state.next = time.Now().Add(r.opts.backoff(state.count))
+	failed := IsPermanent(err) || state.count > r.opts.MaxRetries
+	if failed {
+		delete(r.retries, id)
+	}
+	r.lock.Unlock()
+
+	logger.Errorf("%s job %d: %s: %v", r.opts.Name, id, message, err)
+	if failed {
+		e.transition(r, id, Result{Status: StatusFailed, Message: fmt.Sprintf("%s：%v", message, err)})
+	}
+}
+
+// transition 任务状态变化的唯一入口：保存状态，记录日志，推送任务事件，失败和取消的任务退回算力
+func (e *Engine) transition(r *runner, id uint, result Result) {
+	rec, err := r.handler.Load(id)
+	if err != nil {
+		logger.Errorf("load %s job %d with error: %v", r.opts.Name, id, err)
+		return
+	}
+	// 已经结束的任务（比如已经被用户取消）不再更新
+	if rec.Status.Finished() || (rec.Status == result.Status && rec.Progress == result.Progress) {
+		return
+	}
+	// 回调和查询同时返回结果的时候，状态不能倒退
+	if rec.Status == StatusDownloading && (result.Status == StatusQueued || result.Status == StatusRunning) {
+		return
+	}
+	if err = r.handler.Finalize(id, result); err != nil {
+		logger.Errorf("update %s job %d with error: %v", r.opts.Name, id, err)
+		return
+	}
+	if rec.Status != result.Status {
+		e.log(r, rec, result.Status, result.Message)
+	}
+	switch result.Status {
+	case StatusSucceeded:
+		e.publish(r, rec, EventFinished, result)
+	case StatusFailed, StatusCanceled:
+		e.publish(r, rec, EventFailed, result)
+		rec.Status = result.Status
+		e.refund(r, rec)
+	default:
+		e.publish(r, rec, EventProgress, result)
+	}
+}
+
+// 记录任务状态变化
+func (e *Engine) log(r *runner, rec Record, status Status, message string) {
+	logger.Infof("%s job %d: %s -> %s %s", r.opts.Name, rec.Id, rec.Status, status, message)
+	err := e.db.Create(&model.JobLog{
+		Type:       r.opts.Name,
+		JobId:      rec.Id,
+		UserId:     rec.UserId,
+		FromStatus: string(rec.Status),
+		ToStatus:   string(status),
+		Message:    truncate(message, 1000),
+		CreatedAt:  time.Now(),
+	}).Error
+	if err != nil {
+		logger.Errorf("save job log with error: %v", err)
+	}
+}
+
+// 任务是否超时。重新排队的任务（重试或者重新投递死信）从最后一次排队的时间算起
+func (e *Engine) expired(r *runner, rec Record) bool {
+	if time.Since(rec.CreatedAt) <= r.opts.Timeout {
+		return false
+	}
+	var log model.JobLog
+	err := e.db.Where("type", r.opts.Name).Where("job_id", rec.Id).
+		Where("to_status", StatusQueued).Order("id DESC").First(&log).Error
+	return err != nil || time.Since(log.CreatedAt) > r.opts.Timeout
+}
+
+func (e *Engine) refund(r *runner, rec Record) {
+	if rec.Power <= 0 {
+		return
+	}
+	refunded, err := r.handler.Refund(rec)
+	if err != nil {
+		logger.Errorf("refund %s job %d with error: %v", r.opts.Name, rec.Id, err)
+		return
+	}
+	// 其他节点或者之前的处理已经退过款了，不再重复通知
+	if refunded {
+		e.publish(r, rec, EventRefunded, Result{Status: rec.Status})
+	}
+}
+
+// 加锁之后执行，多个节点不会同时处理同一个任务，已经被锁定的任务跳过，返回是否执行了
+func (e *Engine) withLock(r *runner, id uint, fn func(ctx context.Context)) bool {
+	key := jobKey(r.opts.Name, id)
+	token, ok := e.tryLock(key, r.opts.SubmitTimeout+jobLockMargin)
+	if !ok {
+		return false
+	}
+	defer e.unlock(key, token)
+	ctx, cancel := context.WithTimeout(e.ctx, r.opts.SubmitTimeout)
+	defer cancel()
+	fn(ctx)
+	return true
+}
+
+func (e *Engine) tryLock(key string, ttl time.Duration) (string, bool) {
+	token := utils.RandomHex(8)
+	ok, err := e.redis.SetNX(e.ctx, "job:lock:"+key, token, ttl).Result()
+	if err != nil {
+		logger.Errorf("lock job %s with error: %v", key, err)
+		return "", false
+	}
+	return token, ok
+}
+
+func (e *Engine) unlock(key string, token string) {
+	if err := unlockScript.Run(e.ctx, e.redis, []string{"job:lock:" + key}, token).Err(); err != nil {
+		logger.Errorf("unlock job %s with error: %v", key, err)
+	}
+}
+
+func (e *Engine) delayKey(name string) string {
+	return "job:delay:" + name
+}
+
+func jobKey(name string, id uint) string {
+	return fmt.Sprintf("%s:%d", name, id)
+}
+
+func truncate(s string, n int) string {
+	if runes := []rune(s); len(runes) > n {
+		return string(runes[:n])
+	}
+	return s
+}
+
+// 插件的方法 panic 不能影响调度
+func safeCall(fn func() (Result, error)) (result Result, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	return fn()
+}
+
+func (r *runner) wakeup() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// 清理已经结束的任务的查询时间
+func (r *runner) forget(records []Record) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.polled) == 0 {
+		return
+	}
+	pending := make(map[uint]bool, len(records))
+	for _, rec := range records {
+		pending[rec.Id] = true
+	}
+	for id := range r.polled {
+		if !pending[id] {
+			delete(r.polled, id)
+		}
+	}
+}
+
+// 是否到了重试时间
+func (r *runner) due(id uint) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	state, ok := r.retries[id]
+	return !ok || time.Now().After(state.next)
+}
+
+func (o Options) withDefaults(c types.JobConfig) Options {
+	if c.Concurrency > 0 {
+		o.Concurrency = c.Concurrency
+	}
+	if c.MaxRetries > 0 {
+		o.MaxRetries = c.MaxRetries
+	}
+	if c.MaxDeliveries > 0 {
+		o.MaxDeliveries = c.MaxDeliveries
+	}
+	if c.Timeout > 0 {
+		o.Timeout = time.Duration(c.Timeout) * time.Minute
+	}
+	if c.UserLimit > 0 {
+		o.UserLimit = c.UserLimit
+	}
+	if c.VipUserLimit > 0 {
+		o.VipUserLimit = c.VipUserLimit
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = 1
+	}
+	if o.MaxRetries <= 0 {
+		o.MaxRetries = 3
+	}
+	if o.MaxDeliveries <= 0 {
+		o.MaxDeliveries = 5
+	}
+	if o.RetryDelay <= 0 {
+		o.RetryDelay = 5 * time.Second
+	}
+	if o.MaxRetryDelay <= 0 {
+		o.MaxRetryDelay = 5 * time.Minute
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = 30 * time.Minute
+	}
+	if o.SubmitTimeout <= 0 {
+		o.SubmitTimeout = 3 * time.Minute
+	}
+	if o.PollInterval <= 0 {
+		o.PollInterval = 5 * time.Second
+	}
+	if o.VipUserLimit <= 0 {
+		o.VipUserLimit = o.UserLimit
+	}
+	return o
+}
+
+// 第 attempt 次重试之前等待的时间
+func (o Options) backoff(attempt int) time.Duration {
+	delay := o.RetryDelay
+	for i := 1; i < attempt && delay < o.MaxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, o.MaxRetryDelay)
+}
@@ -0,0 +1,157 @@
+package job
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"context"
+	"fmt"
+	"geekai/utils"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	EventCreated  = "created"
+	EventProgress = "progress" // 排队、生成进度变化和开始下载
+	EventFinished = "finished"
+	EventFailed   = "failed" // 失败、超时和取消
+	EventRefunded = "refunded"
+
+	jobEventChannel = "job:events"     // 新事件的广播频道，消息内容为用户 ID
+	jobEventMaxLen  = 500              // 每个用户保留的事件数量，断线太久的客户端需要重新加载列表
+	jobEventTTL     = 24 * time.Hour   // 用户没有新事件之后事件保留的时间
+	jobEventPoll    = 30 * time.Second // 订阅连接断开期间的广播会丢失，兜底查询新事件的间隔
+)
+
+// Event 推送给用户的任务事件
+type Event struct {
+	Id       string `json:"id"` // 事件 ID，客户端断线重连的时候通过 Last-Event-ID 传回来
+	Type     string `json:"type"`
+	JobType  string `json:"job_type"` // 任务类型：mj, sd, dalle, suno, video, jimeng
+	JobId    uint   `json:"job_id"`
+	Status   Status `json:"status"`
+	Progress int    `json:"progress"`
+	Message  string `json:"message,omitempty"`
+	Power    int    `json:"power,omitempty"` // 退回的算力
+	Time     int64  `json:"time"`
+}
+
+// 记录任务事件。事件保存在用户的 Redis Stream 里，支持断线之后从任意事件继续接收，
+// 再通过 Redis 频道通知所有节点上的订阅者
+func (e *Engine) publish(r *runner, rec Record, eventType string, result Result) {
+	if rec.UserId == 0 {
+		return
+	}
+	event := Event{
+		Type:     eventType,
+		JobType:  r.opts.Name,
+		JobId:    rec.Id,
+		Status:   result.Status,
+		Progress: result.Progress,
+		Message:  result.Message,
+		Time:     time.Now().Unix(),
+	}
+	if eventType == EventRefunded {
+		event.Power = rec.Power
+	}
+	key := e.eventsKey(rec.UserId)
+	pipe := e.redis.TxPipeline()
+	pipe.XAdd(e.ctx, &redis.XAddArgs{
+		Stream: key,
+		MaxLen: jobEventMaxLen,
+		Approx: true,
+		Values: map[string]any{"data": utils.JsonEncode(event)},
+	})
+	pipe.Expire(e.ctx, key, jobEventTTL)
+	pipe.Publish(e.ctx, jobEventChannel, rec.UserId)
+	if _, err := pipe.Exec(e.ctx); err != nil {
+		logger.Errorf("publish %s job %d event with error: %v", r.opts.Name, rec.Id, err)
+	}
+}
+
+// LatestEventId 用户最新的事件 ID，新建立的连接从这里开始接收
+func (e *Engine) LatestEventId(userId uint) string {
+	messages, err := e.redis.XRevRangeN(e.ctx, e.eventsKey(userId), "+", "-", 1).Result()
+	if err != nil || len(messages) == 0 {
+		return ""
+	}
+	return messages[0].ID
+}
+
+// Events 读取 lastId 之后的事件，没有新事件的时候等待，直到有新事件或者 ctx 结束
+func (e *Engine) Events(ctx context.Context, userId uint, lastId string) ([]Event, error) {
+	// 低版本的 Redis 不支持开区间查询，从 lastId 开始查询再跳过 lastId 本身
+	start := "-"
+	if lastId != "" && lastId != "0" {
+		start = lastId
+	}
+	for {
+		notice := e.notice(userId)
+		messages, err := e.redis.XRange(ctx, e.eventsKey(userId), start, "+").Result()
+		if err != nil {
+			return nil, err
+		}
+		if len(messages) > 0 && messages[0].ID == lastId {
+			messages = messages[1:]
+		}
+		if len(messages) > 0 {
+			events := make([]Event, 0, len(messages))
+			for _, msg := range messages {
+				var event Event
+				if err = utils.JsonDecode(fmt.Sprint(msg.Values["data"]), &event); err != nil {
+					continue
+				}
+				event.Id = msg.ID
+				events = append(events, event)
+			}
+			if len(events) > 0 {
+				return events, nil
+			}
+			start, lastId = messages[len(messages)-1].ID, messages[len(messages)-1].ID
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-notice:
+		case <-time.After(jobEventPoll):
+		}
+	}
+}
+
+// 获取用户新事件的通知，有新事件的时候关闭
+func (e *Engine) notice(userId uint) chan struct{} {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	ch, ok := e.notices[userId]
+	if !ok {
+		ch = make(chan struct{})
+		e.notices[userId] = ch
+	}
+	return ch
+}
+
+// 收到新事件的广播，唤醒当前节点上等待这个用户事件的连接
+func (e *Engine) notify(payload string) {
+	userId, err := strconv.ParseUint(payload, 10, 64)
+	if err != nil {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if ch, ok := e.notices[uint(userId)]; ok {
+		close(ch)
+		delete(e.notices, uint(userId))
+	}
+}
+
+func (e *Engine) eventsKey(userId uint) string {
+	return fmt.Sprintf("job:events:%d", userId)
+}
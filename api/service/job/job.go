@@ -0,0 +1,152 @@
+package job
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"context"
+	"errors"
+	"geekai/service"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Status 任务状态，各个服务的任务表用自己的字段表示状态，由插件负责转换
+type Status string
+
+const (
+	StatusQueued      = Status("queued")      // 等待提交
+	StatusRunning     = Status("running")     // 已经提交，等待上游生成结果
+	StatusDownloading = Status("downloading") // 生成完成，等待把结果文件转存到 OSS
+	StatusSucceeded   = Status("succeeded")
+	StatusFailed      = Status("failed")
+	StatusCanceled    = Status("canceled")
+)
+
+// Finished 任务是否已经结束
+func (s Status) Finished() bool {
+	return s == StatusSucceeded || s == StatusFailed || s == StatusCanceled
+}
+
+// Record 任务记录，对应服务任务表中的一行
+type Record struct {
+	Id        uint
+	UserId    uint
+	Status    Status
+	Progress  int
+	Power     int  // 还没有退回的算力
+	Callback  bool // 结果通过回调通知，只需要低频查询兜底
+	CreatedAt time.Time
+}
+
+// Result 任务执行的结果，引擎根据结果切换任务状态
+type Result struct {
+	Status   Status
+	Progress int
+	Message  string // 失败的原因
+}
+
+// Options 任务类型的调度参数
+type Options struct {
+	Name          string        // 任务类型，同时用于队列名称
+	Concurrency   int           // 同时提交的任务数量
+	MaxRetries    int           // 提交、查询和下载失败之后的最大重试次数
+	MaxDeliveries int           // 队列消息的最大投递次数，超过之后转入死信队列
+	RetryDelay    time.Duration // 第一次重试的等待时间，之后每次翻倍
+	MaxRetryDelay time.Duration // 重试等待时间的上限
+	Timeout       time.Duration // 任务从创建到生成完成的最长时间
+	SubmitTimeout time.Duration // 单次提交的超时时间，同步生成的服务需要覆盖整个生成过程
+	PollInterval  time.Duration // 查询任务进度的间隔
+	UserLimit     int           // 每个用户同时进行中的任务数量上限，0 表示不限制
+	VipUserLimit  int           // 优先用户同时进行中的任务数量上限
+}
+
+// Handler 任务插件，每种生成服务实现一个，由引擎负责排队、重试、超时、取消和退款
+type Handler interface {
+	Options() Options
+	// Load 读取任务记录
+	Load(id uint) (Record, error)
+	// Pending 需要引擎继续处理的任务：没有结束的任务和还没有退回算力的失败任务，userId 不为 0 的时候只查询这个用户的任务
+	Pending(userId uint) ([]Record, error)
+	// Submit 提交任务。同步生成的服务直接返回最终结果，异步的服务返回 StatusRunning 等待查询进度
+	Submit(ctx context.Context, id uint) (Result, error)
+	// Finalize 保存任务的状态和进度
+	Finalize(id uint, result Result) error
+	// Refund 退回失败任务的算力，返回是否退款了
+	Refund(rec Record) (bool, error)
+}
+
+// Poller 异步生成的服务查询任务进度
+type Poller interface {
+	Poll(ctx context.Context, id uint) (Result, error)
+}
+
+// Downloader 需要把生成结果转存到 OSS 的服务
+type Downloader interface {
+	Download(ctx context.Context, id uint) error
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent 标记不需要重试的错误，比如提示词违规，重试也不会成功
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err: err}
+}
+
+// IsPermanent 是否为不需要重试的错误
+func IsPermanent(err error) bool {
+	var e permanentError
+	return errors.As(err, &e)
+}
+
+// ProgressColumns 用 progress 字段表示状态的任务表，状态对应的字段值。
+// 0 表示排队中，1-99 表示生成中，101 表示失败，downloading 为等待下载文件时的 progress 值
+func ProgressColumns(result Result, downloading int) map[string]any {
+	switch result.Status {
+	case StatusQueued:
+		return map[string]any{"progress": 0, "err_msg": ""}
+	case StatusRunning:
+		return map[string]any{"progress": min(max(result.Progress, 1), 99)}
+	case StatusDownloading:
+		return map[string]any{"progress": downloading}
+	case StatusSucceeded:
+		return map[string]any{"progress": 100}
+	default:
+		return map[string]any{"progress": service.FailTaskProgress, "err_msg": result.Message}
+	}
+}
+
+// RefundOnce 退回任务的算力。先把任务的算力清零再退款，多个实例同时处理的时候只会退款一次。
+// 返回是否退款了，已经被其他实例或者之前的处理退过款的返回 false
+func RefundOnce(db *gorm.DB, table any, rec Record, refund func() error) (bool, error) {
+	res := db.Model(table).Where("id = ? AND power > 0", rec.Id).UpdateColumn("power", 0)
+	if res.Error != nil {
+		return false, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return false, nil
+	}
+	if err := refund(); err != nil {
+		db.Model(table).Where("id", rec.Id).UpdateColumn("power", rec.Power)
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,76 @@
+package job
+
+import (
+	"errors"
+	"fmt"
+	"geekai/service"
+	"maps"
+	"testing"
+)
+
+func TestProgressColumns(t *testing.T) {
+	tests := []struct {
+		name   string
+		result Result
+		want   map[string]any
+	}{
+		{"queued", Result{Status: StatusQueued}, map[string]any{"progress": 0, "err_msg": ""}},
+		{"running", Result{Status: StatusRunning, Progress: 42}, map[string]any{"progress": 42}},
+		{"running without progress", Result{Status: StatusRunning}, map[string]any{"progress": 1}},
+		{"running progress capped", Result{Status: StatusRunning, Progress: 100}, map[string]any{"progress": 99}},
+		{"downloading", Result{Status: StatusDownloading}, map[string]any{"progress": 99}},
+		{"succeeded", Result{Status: StatusSucceeded}, map[string]any{"progress": 100}},
+		{"failed", Result{Status: StatusFailed, Message: "boom"}, map[string]any{"progress": service.FailTaskProgress, "err_msg": "boom"}},
+		{"canceled", Result{Status: StatusCanceled, Message: "canceled"}, map[string]any{"progress": service.FailTaskProgress, "err_msg": "canceled"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ProgressColumns(tt.result, 99); !maps.Equal(got, tt.want) {
+				t.Errorf("ProgressColumns() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsPermanent(t *testing.T) {
+	base := errors.New("prompt rejected")
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"plain error", base, false},
+		{"permanent", Permanent(base), true},
+		{"wrapped permanent", fmt.Errorf("submit: %w", Permanent(base)), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsPermanent(tt.err); got != tt.want {
+				t.Errorf("IsPermanent() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if Permanent(nil) != nil {
+		t.Error("Permanent(nil) should be nil")
+	}
+	if err := Permanent(base); !errors.Is(err, base) || err.Error() != base.Error() {
+		t.Errorf("Permanent() should keep the original error, got %v", err)
+	}
+}
+
+func TestStatusFinished(t *testing.T) {
+	for status, want := range map[Status]bool{
+		StatusQueued:      false,
+		StatusRunning:     false,
+		StatusDownloading: false,
+		StatusSucceeded:   true,
+		StatusFailed:      true,
+		StatusCanceled:    true,
+	} {
+		if got := status.Finished(); got != want {
+			t.Errorf("%s.Finished() = %v, want %v", status, got, want)
+		}
+	}
+}
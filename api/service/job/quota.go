@@ -0,0 +1,122 @@
+package job
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"errors"
+	"fmt"
+	"geekai/core/types"
+	"geekai/store/model"
+	"geekai/utils"
+	"time"
+)
+
+const (
+	jobQuotaWait    = 5 * time.Second  // 等待用户任务锁的最长时间
+	jobQuotaLockTTL = 30 * time.Second // 用户任务锁的有效期，检查和创建任务需要在这个时间内完成
+)
+
+// Admit 检查用户同时进行中的任务数量，没有达到上限的时候调用 create 创建任务，会员和付费用户的上限更高。
+// 同一个用户同一种任务的检查和创建在同一把锁里面完成，并发提交也不会超过上限
+func (e *Engine) Admit(name string, userId uint, create func() error) error {
+	r, err := e.runner(name)
+	if err != nil {
+		return err
+	}
+	limit := r.opts.UserLimit
+	if e.priority(userId) {
+		limit = r.opts.VipUserLimit
+	}
+	if limit <= 0 {
+		return create()
+	}
+
+	key := fmt.Sprintf("quota:%s:%d", name, userId)
+	token, ok := e.waitLock(key)
+	if !ok {
+		return errors.New("提交任务太频繁，请稍后再试")
+	}
+	defer e.unlock(key, token)
+
+	records, err := r.handler.Pending(userId)
+	if err != nil {
+		return err
+	}
+	running := 0
+	for _, rec := range records {
+		if !rec.Status.Finished() {
+			running++
+		}
+	}
+	if running >= limit {
+		return fmt.Errorf("同时进行中的任务不能超过 %d 个，请等待之前的任务完成之后再提交", limit)
+	}
+	return create()
+}
+
+// 等待获取锁，同一个用户并发提交的请求依次检查任务数量
+func (e *Engine) waitLock(key string) (string, bool) {
+	deadline := time.Now().Add(jobQuotaWait)
+	for {
+		if token, ok := e.tryLock(key, jobQuotaLockTTL); ok {
+			return token, true
+		}
+		if time.Now().After(deadline) {
+			return "", false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// QueuePositions 排队中的任务前面还有多少个任务，key 为任务 ID，值从 1 开始。
+// 等待重试的任务不在队列里，没有排队位置
+func (e *Engine) QueuePositions(name string) map[uint]int {
+	positions := make(map[uint]int)
+	r, err := e.runner(name)
+	if err != nil {
+		return positions
+	}
+	items, err := r.queue.Waiting()
+	if err != nil {
+		logger.Errorf("load waiting %s jobs with error: %v", name, err)
+		return positions
+	}
+	for _, item := range items {
+		var task queuedJob
+		if err = utils.JsonDecode(item, &task); err != nil {
+			continue
+		}
+		// 同一个任务重复入队的时候只算第一次
+		if _, ok := positions[task.Id]; !ok {
+			positions[task.Id] = len(positions) + 1
+		}
+	}
+	return positions
+}
+
+// 优先用户：会员有效期内的 VIP 用户和充值过的用户，任务进入优先通道
+func (e *Engine) priority(userId uint) bool {
+	var user model.User
+	if err := e.db.Select("id", "vip", "expired_time").Where("id", userId).First(&user).Error; err != nil {
+		return false
+	}
+	if user.Vip && (user.ExpiredTime == 0 || user.ExpiredTime > time.Now().Unix()) {
+		return true
+	}
+	var count int64
+	e.db.Model(&model.Order{}).Where("user_id", userId).Where("status", types.OrderPaidSuccess).Count(&count)
+	return count > 0
+}
+
+// 任务加入队列，优先用户的任务加入优先通道
+func (e *Engine) push(r *runner, task queuedJob) error {
+	if task.Priority {
+		return r.queue.PushPriority(task)
+	}
+	return r.queue.Push(task)
+}
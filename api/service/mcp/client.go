@@ -0,0 +1,171 @@
+package mcp
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// Client MCP 客户端，一个客户端对应一个 MCP 服务连接
+type Client struct {
+	transport    transport
+	nextId       atomic.Int64
+	hasTools     bool
+	hasResources bool
+	ServerName   string
+}
+
+// Connect 连接 MCP 服务并完成初始化握手
+func Connect(ctx context.Context, t transport) (*Client, error) {
+	c := &Client{transport: t}
+	var res initializeResult
+	err := c.call(ctx, "initialize", map[string]any{
+		"protocolVersion": protocolVersion,
+		"capabilities":    map[string]any{},
+		"clientInfo": map[string]any{
+			"name":    "geekai",
+			"version": "1.0.0",
+		},
+	}, &res)
+	if err != nil {
+		_ = t.close()
+		return nil, fmt.Errorf("MCP 服务初始化失败：%v", err)
+	}
+	c.hasTools = res.Capabilities.Tools != nil
+	c.hasResources = res.Capabilities.Resources != nil
+	c.ServerName = res.ServerInfo.Name
+
+	if err = t.notify(ctx, request{JsonRPC: "2.0", Method: "notifications/initialized"}); err != nil {
+		_ = t.close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Client) call(ctx context.Context, method string, params any, result any) error {
+	id := c.nextId.Add(1)
+	msg, err := c.transport.call(ctx, request{JsonRPC: "2.0", Id: &id, Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+	if msg.Error != nil {
+		return msg.Error
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(msg.Result, result)
+}
+
+// ListTools 获取服务提供的全部工具
+func (c *Client) ListTools(ctx context.Context) ([]Tool, error) {
+	if !c.hasTools {
+		return nil, nil
+	}
+	tools := make([]Tool, 0)
+	cursor := ""
+	for {
+		var params any
+		if cursor != "" {
+			params = map[string]any{"cursor": cursor}
+		}
+		var res listToolsResult
+		if err := c.call(ctx, "tools/list", params, &res); err != nil {
+			return nil, err
+		}
+		tools = append(tools, res.Tools...)
+		if res.NextCursor == "" || res.NextCursor == cursor {
+			return tools, nil
+		}
+		cursor = res.NextCursor
+	}
+}
+
+// ListResources 获取服务提供的全部资源
+func (c *Client) ListResources(ctx context.Context) ([]Resource, error) {
+	if !c.hasResources {
+		return nil, nil
+	}
+	resources := make([]Resource, 0)
+	cursor := ""
+	for {
+		var params any
+		if cursor != "" {
+			params = map[string]any{"cursor": cursor}
+		}
+		var res listResourcesResult
+		if err := c.call(ctx, "resources/list", params, &res); err != nil {
+			return nil, err
+		}
+		resources = append(resources, res.Resources...)
+		if res.NextCursor == "" || res.NextCursor == cursor {
+			return resources, nil
+		}
+		cursor = res.NextCursor
+	}
+}
+
+// ReadResource 读取资源内容，二进制内容只返回类型说明
+func (c *Client) ReadResource(ctx context.Context, uri string) (string, error) {
+	var res readResourceResult
+	if err := c.call(ctx, "resources/read", map[string]any{"uri": uri}, &res); err != nil {
+		return "", err
+	}
+	parts := make([]string, 0, len(res.Contents))
+	for _, v := range res.Contents {
+		if v.Text != "" {
+			parts = append(parts, v.Text)
+		} else if v.Blob != "" {
+			parts = append(parts, fmt.Sprintf("[二进制内容：%s, %s]", v.Uri, v.MimeType))
+		}
+	}
+	return strings.Join(parts, "\n"), nil
+}
+
+// CallTool 调用工具，把返回的内容拼接成文本交给大模型
+func (c *Client) CallTool(ctx context.Context, name string, arguments map[string]any) (string, error) {
+	if arguments == nil {
+		arguments = map[string]any{}
+	}
+	var res callToolResult
+	if err := c.call(ctx, "tools/call", map[string]any{"name": name, "arguments": arguments}, &res); err != nil {
+		return "", err
+	}
+	parts := make([]string, 0, len(res.Content))
+	for _, v := range res.Content {
+		switch v.Type {
+		case "text":
+			parts = append(parts, v.Text)
+		case "resource":
+			if v.Resource != nil {
+				parts = append(parts, v.Resource.Text)
+			}
+		default:
+			parts = append(parts, fmt.Sprintf("[%s 内容：%s]", v.Type, v.MimeType))
+		}
+	}
+	text := strings.Join(parts, "\n")
+	if res.IsError {
+		return "", errors.New(text)
+	}
+	return text, nil
+}
+
+// Ping 检查连接是否可用
+func (c *Client) Ping(ctx context.Context) error {
+	return c.call(ctx, "ping", nil, nil)
+}
+
+func (c *Client) Close() error {
+	return c.transport.close()
+}
@@ -0,0 +1,290 @@
+package mcp
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SSE 事件
+type sseEvent struct {
+	Event string
+	Data  string
+}
+
+// 逐个读取 SSE 事件，回调返回 false 时停止读取
+func readSSE(r io.Reader, fn func(e sseEvent) bool) error {
+	reader := bufio.NewReaderSize(r, 64*1024)
+	var event sseEvent
+	var data []string
+	for {
+		line, err := reader.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "":
+			if len(data) > 0 {
+				event.Data = strings.Join(data, "\n")
+				if !fn(event) {
+					return nil
+				}
+			}
+			event, data = sseEvent{}, nil
+		case strings.HasPrefix(line, ":"):
+			// 注释，心跳包
+		case strings.HasPrefix(line, "event:"):
+			event.Event = strings.TrimSpace(line[6:])
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(line[5:], " "))
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func newRequest(ctx context.Context, method string, url string, body []byte, headers map[string]string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	return req, nil
+}
+
+// Streamable HTTP 传输，每个请求单独 POST，服务端可以直接返回 JSON，也可以返回 SSE 流
+type httpTransport struct {
+	url       string
+	headers   map[string]string
+	client    *http.Client
+	lock      sync.Mutex
+	sessionId string
+}
+
+func newHttpTransport(url string, headers map[string]string) *httpTransport {
+	return &httpTransport{url: url, headers: headers, client: &http.Client{}}
+}
+
+func (t *httpTransport) post(ctx context.Context, req request) (*http.Response, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newRequest(ctx, http.MethodPost, t.url, body, t.headers)
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Accept", "application/json, text/event-stream")
+	t.lock.Lock()
+	if t.sessionId != "" {
+		r.Header.Set("Mcp-Session-Id", t.sessionId)
+	}
+	t.lock.Unlock()
+
+	res, err := t.client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	if sessionId := res.Header.Get("Mcp-Session-Id"); sessionId != "" {
+		t.lock.Lock()
+		t.sessionId = sessionId
+		t.lock.Unlock()
+	}
+	if res.StatusCode >= 400 {
+		data, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		_ = res.Body.Close()
+		return nil, fmt.Errorf("MCP 服务响应异常：%s, %s", res.Status, string(data))
+	}
+	return res, nil
+}
+
+func (t *httpTransport) call(ctx context.Context, req request) (*message, error) {
+	res, err := t.post(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "text/event-stream") {
+		var msg message
+		if err = json.NewDecoder(res.Body).Decode(&msg); err != nil {
+			return nil, fmt.Errorf("解析 MCP 服务响应失败：%v", err)
+		}
+		return &msg, nil
+	}
+
+	// SSE 流中可能夹杂服务端的通知，找到 id 匹配的响应为止
+	var result *message
+	err = readSSE(res.Body, func(e sseEvent) bool {
+		var msg message
+		if json.Unmarshal([]byte(e.Data), &msg) != nil {
+			return true
+		}
+		if msg.Id != nil && *msg.Id == *req.Id && msg.Method == "" {
+			result = &msg
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, errors.New("MCP 服务没有返回响应")
+	}
+	return result, nil
+}
+
+func (t *httpTransport) notify(ctx context.Context, req request) error {
+	res, err := t.post(ctx, req)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// 结束会话
+func (t *httpTransport) close() error {
+	t.lock.Lock()
+	sessionId := t.sessionId
+	t.lock.Unlock()
+	if sessionId == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r, err := newRequest(ctx, http.MethodDelete, t.url, nil, t.headers)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Mcp-Session-Id", sessionId)
+	res, err := t.client.Do(r)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// 旧版的 HTTP + SSE 传输，先建立 SSE 长连接拿到消息提交地址，请求通过 POST 提交，响应从 SSE 连接返回
+type sseTransport struct {
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+	cancel   context.CancelFunc
+	*dispatcher
+}
+
+func newSseTransport(ctx context.Context, sseUrl string, headers map[string]string) (*sseTransport, error) {
+	connCtx, cancel := context.WithCancel(context.Background())
+	r, err := newRequest(connCtx, http.MethodGet, sseUrl, nil, headers)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	r.Header.Set("Accept", "text/event-stream")
+	client := &http.Client{}
+	res, err := client.Do(r)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		_ = res.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("连接 MCP 服务失败：%s", res.Status)
+	}
+
+	t := &sseTransport{headers: headers, client: client, cancel: cancel, dispatcher: newDispatcher()}
+	endpoint := make(chan string, 1)
+	go func() {
+		defer res.Body.Close()
+		err := readSSE(res.Body, func(e sseEvent) bool {
+			if e.Event == "endpoint" {
+				endpoint <- e.Data
+				return true
+			}
+			t.dispatch([]byte(e.Data))
+			return true
+		})
+		t.fail(err)
+	}()
+
+	select {
+	case uri := <-endpoint:
+		base, _ := url.Parse(sseUrl)
+		ref, err := url.Parse(uri)
+		if err != nil {
+			_ = t.close()
+			return nil, fmt.Errorf("MCP 服务返回的消息地址无效：%s", uri)
+		}
+		t.endpoint = base.ResolveReference(ref).String()
+		return t, nil
+	case <-ctx.Done():
+		_ = t.close()
+		return nil, errors.New("等待 MCP 服务返回消息地址超时")
+	}
+}
+
+func (t *sseTransport) post(ctx context.Context, req request) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := newRequest(ctx, http.MethodPost, t.endpoint, body, t.headers)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	res, err := t.client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 400 {
+		return fmt.Errorf("MCP 服务响应异常：%s", res.Status)
+	}
+	return nil
+}
+
+func (t *sseTransport) call(ctx context.Context, req request) (*message, error) {
+	ch, err := t.register(*req.Id)
+	if err != nil {
+		return nil, err
+	}
+	if err = t.post(ctx, req); err != nil {
+		t.remove(*req.Id)
+		return nil, err
+	}
+	return t.wait(ctx, *req.Id, ch)
+}
+
+func (t *sseTransport) notify(ctx context.Context, req request) error {
+	return t.post(ctx, req)
+}
+
+func (t *sseTransport) close() error {
+	t.cancel()
+	t.fail(errClosed)
+	return nil
+}
@@ -0,0 +1,375 @@
+package mcp
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	logger2 "geekai/logger"
+	"geekai/store/model"
+	"geekai/utils"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var logger = logger2.GetLogger()
+
+const (
+	connectTimeout = 30 * time.Second
+	callTimeout    = 2 * time.Minute
+	// 读取资源的内置工具名称
+	readResourceTool = "read_resource"
+)
+
+var invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// Service MCP 服务管理，负责维护到各个 MCP 服务的连接，并把服务提供的工具同步成工具函数
+type Service struct {
+	db          *gorm.DB
+	lock        sync.Mutex // 只保护 clients 和 serverLocks 的读写
+	clients     map[uint]*Client
+	serverLocks map[uint]*sync.Mutex // 每个服务一把锁，建立连接比较慢，不能阻塞其他服务的调用
+}
+
+func NewService(db *gorm.DB) *Service {
+	return &Service{db: db, clients: make(map[uint]*Client), serverLocks: make(map[uint]*sync.Mutex)}
+}
+
+// Run 启动时同步所有启用的 MCP 服务
+func (s *Service) Run() {
+	var servers []model.McpServer
+	s.db.Where("enabled", true).Find(&servers)
+	for _, server := range servers {
+		go func(id uint) {
+			if err := s.Sync(id); err != nil {
+				logger.Errorf("同步 MCP 服务 %d 失败：%v", id, err)
+			}
+		}(server.Id)
+	}
+}
+
+func (s *Service) connect(server model.McpServer) (*Client, error) {
+	var headers map[string]string
+	_ = utils.JsonDecode(server.Headers, &headers)
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	defer cancel()
+
+	var t transport
+	switch server.Transport {
+	case TransportStdio:
+		var args []string
+		var env map[string]string
+		_ = utils.JsonDecode(server.Args, &args)
+		_ = utils.JsonDecode(server.Env, &env)
+		st, err := newStdioTransport(server.Command, args, env)
+		if err != nil {
+			return nil, err
+		}
+		t = st
+	case TransportHttp:
+		t = newHttpTransport(server.URL, headers)
+	case TransportSse:
+		st, err := newSseTransport(ctx, server.URL, headers)
+		if err != nil {
+			return nil, err
+		}
+		t = st
+	default:
+		return nil, fmt.Errorf("不支持的传输方式：%s", server.Transport)
+	}
+	return Connect(ctx, t)
+}
+
+func (s *Service) serverLock(serverId uint) *sync.Mutex {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	l, ok := s.serverLocks[serverId]
+	if !ok {
+		l = &sync.Mutex{}
+		s.serverLocks[serverId] = l
+	}
+	return l
+}
+
+func (s *Service) cachedClient(serverId uint) (*Client, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c, ok := s.clients[serverId]
+	return c, ok
+}
+
+// 获取服务的连接，没有连接的时候新建。同一个服务同时只有一个协程在建立连接
+func (s *Service) client(serverId uint) (*Client, error) {
+	if c, ok := s.cachedClient(serverId); ok {
+		return c, nil
+	}
+	l := s.serverLock(serverId)
+	l.Lock()
+	defer l.Unlock()
+	if c, ok := s.cachedClient(serverId); ok {
+		return c, nil
+	}
+
+	var server model.McpServer
+	if err := s.db.Where("id", serverId).First(&server).Error; err != nil {
+		return nil, errors.New("MCP 服务不存在")
+	}
+	if !server.Enabled {
+		return nil, errors.New("MCP 服务已经被禁用")
+	}
+	c, err := s.connect(server)
+	if err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	s.clients[serverId] = c
+	s.lock.Unlock()
+	return c, nil
+}
+
+// Close 关闭服务连接，配置修改或者服务被禁用的时候调用。正在建立的连接会等它建立完成之后再关闭
+func (s *Service) Close(serverId uint) {
+	l := s.serverLock(serverId)
+	l.Lock()
+	defer l.Unlock()
+	s.lock.Lock()
+	c, ok := s.clients[serverId]
+	delete(s.clients, serverId)
+	s.lock.Unlock()
+	if ok {
+		_ = c.Close()
+	}
+}
+
+// CloseAll 关闭所有服务连接，退出 stdio 服务进程
+func (s *Service) CloseAll() {
+	s.lock.Lock()
+	clients := s.clients
+	s.clients = make(map[uint]*Client)
+	s.lock.Unlock()
+	for _, c := range clients {
+		_ = c.Close()
+	}
+}
+
+// 调用服务，连接断开的时候重新连接再试一次
+func (s *Service) invoke(serverId uint, fn func(c *Client) error) error {
+	c, err := s.client(serverId)
+	if err != nil {
+		return err
+	}
+	err = fn(c)
+	var rpcErr *rpcError
+	if err == nil || errors.As(err, &rpcErr) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+
+	logger.Warnf("MCP 服务 %d 调用失败，重新连接：%v", serverId, err)
+	s.Close(serverId)
+	c, err = s.client(serverId)
+	if err != nil {
+		return err
+	}
+	return fn(c)
+}
+
+// Sync 拉取服务的工具和资源列表，同步到工具函数表
+func (s *Service) Sync(serverId uint) error {
+	var server model.McpServer
+	if err := s.db.Where("id", serverId).First(&server).Error; err != nil {
+		return errors.New("MCP 服务不存在")
+	}
+	// 重新建立连接，让修改后的配置生效
+	s.Close(serverId)
+
+	var tools []Tool
+	var resources []Resource
+	err := s.invoke(serverId, func(c *Client) error {
+		ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+		defer cancel()
+		var err error
+		if tools, err = c.ListTools(ctx); err != nil {
+			return err
+		}
+		resources, err = c.ListResources(ctx)
+		return err
+	})
+	if err != nil {
+		s.db.Model(&server).UpdateColumns(map[string]any{"err_msg": cutRunes(err.Error(), 1000), "last_synced_at": time.Now().Unix()})
+		return err
+	}
+
+	// 服务提供了资源的，增加一个读取资源的工具，把资源列表写进工具描述
+	if len(resources) > 0 {
+		tools = append(tools, resourceTool(resources))
+	}
+	if err = s.saveTools(server, tools); err != nil {
+		return err
+	}
+	return s.db.Model(&server).UpdateColumns(map[string]any{
+		"tool_num":       len(tools),
+		"err_msg":        "",
+		"last_synced_at": time.Now().Unix(),
+	}).Error
+}
+
+func resourceTool(resources []Resource) Tool {
+	var builder strings.Builder
+	builder.WriteString("读取 MCP 服务提供的资源内容，可用的资源有：")
+	for _, r := range resources {
+		builder.WriteString(fmt.Sprintf("\n- %s：%s", r.Uri, r.Name))
+		if r.Description != "" {
+			builder.WriteString("，" + r.Description)
+		}
+	}
+	return Tool{
+		Name:        readResourceTool,
+		Title:       "读取资源",
+		Description: builder.String(),
+		InputSchema: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"uri": map[string]any{"type": "string", "description": "资源 URI"},
+			},
+			"required": []string{"uri"},
+		},
+	}
+}
+
+// 工具函数名称只能包含字母、数字、下划线和中划线，并且不能超过 64 个字符，加上服务 ID 前缀避免重名
+func functionName(serverId uint, tool string, used map[string]bool) string {
+	prefix := fmt.Sprintf("mcp%d_", serverId)
+	base := prefix + cutRunes(invalidNameChars.ReplaceAllString(tool, "_"), 64-len(prefix))
+	name := base
+	for i := 2; used[name]; i++ {
+		suffix := fmt.Sprintf("_%d", i)
+		name = base[:min(len(base), 64-len(suffix))] + suffix
+	}
+	used[name] = true
+	return name
+}
+
+// 按照字符截取字符串，数据库字段按照字符计算长度
+func cutRunes(str string, num int) string {
+	runes := []rune(str)
+	if len(runes) > num {
+		return string(runes[:num])
+	}
+	return str
+}
+
+func (s *Service) saveTools(server model.McpServer, tools []Tool) error {
+	var functions []model.Function
+	s.db.Where("mcp_server_id", server.Id).Find(&functions)
+	exists := make(map[string]model.Function)
+	for _, f := range functions {
+		exists[f.McpTool] = f
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		used := make(map[string]bool)
+		for _, tool := range tools {
+			label := tool.Title
+			if label == "" {
+				label = tool.Name
+			}
+			schema := tool.InputSchema
+			if schema == nil {
+				schema = map[string]any{"type": "object", "properties": map[string]any{}}
+			}
+			f := exists[tool.Name]
+			delete(exists, tool.Name)
+			f.Name = functionName(server.Id, tool.Name, used)
+			f.Label = cutRunes(label, 30)
+			f.Description = cutRunes(tool.Description, 255)
+			f.Parameters = utils.JsonEncode(schema)
+			f.Enabled = server.Enabled
+			f.McpServerId = server.Id
+			f.McpTool = tool.Name
+			if err := tx.Save(&f).Error; err != nil {
+				return fmt.Errorf("保存工具 %s 失败：%v", tool.Name, err)
+			}
+		}
+		// 服务已经不再提供的工具直接删除
+		for _, f := range exists {
+			if err := tx.Delete(&f).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SetEnabled 启用或者禁用服务，同时启用或者禁用服务的工具
+func (s *Service) SetEnabled(serverId uint, enabled bool) error {
+	if !enabled {
+		s.Close(serverId)
+	}
+	return s.db.Model(&model.Function{}).Where("mcp_server_id", serverId).Update("enabled", enabled).Error
+}
+
+// Remove 删除服务以及服务的工具和用户启用记录
+func (s *Service) Remove(serverId uint) error {
+	s.Close(serverId)
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("mcp_server_id", serverId).Delete(&model.Function{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("server_id", serverId).Delete(&model.UserMcpServer{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&model.McpServer{Id: serverId}).Error
+	})
+}
+
+// UserServerIds 用户启用的 MCP 服务
+func (s *Service) UserServerIds(userId uint) []uint {
+	ids := make([]uint, 0)
+	if userId == 0 {
+		return ids
+	}
+	s.db.Model(&model.UserMcpServer{}).Where("user_id", userId).Pluck("server_id", &ids)
+	return ids
+}
+
+// UserFunctions 过滤掉用户没有启用的 MCP 服务的工具
+func (s *Service) UserFunctions(userId uint, functions []model.Function) []model.Function {
+	ids := s.UserServerIds(userId)
+	items := make([]model.Function, 0, len(functions))
+	for _, f := range functions {
+		if f.McpServerId == 0 || slices.Contains(ids, f.McpServerId) {
+			items = append(items, f)
+		}
+	}
+	return items
+}
+
+// CallTool 调用 MCP 工具
+func (s *Service) CallTool(ctx context.Context, function model.Function, arguments map[string]any) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, callTimeout)
+	defer cancel()
+
+	var result string
+	err := s.invoke(function.McpServerId, func(c *Client) error {
+		var err error
+		if function.McpTool == readResourceTool {
+			uri, _ := arguments["uri"].(string)
+			result, err = c.ReadResource(ctx, uri)
+		} else {
+			result, err = c.CallTool(ctx, function.McpTool, arguments)
+		}
+		return err
+	})
+	return result, err
+}
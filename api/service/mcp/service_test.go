@@ -0,0 +1,41 @@
+package mcp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFunctionName(t *testing.T) {
+	long := strings.Repeat("a", 80)
+	tests := []struct {
+		name string
+		tool string
+		used []string
+		want string
+	}{
+		{"plain", "search", nil, "mcp1_search"},
+		{"invalid chars", "web.search/查询 v2", nil, "mcp1_web_search____v2"},
+		{"truncate", long, nil, "mcp1_" + long[:59]},
+		{"duplicate", "search", []string{"mcp1_search"}, "mcp1_search_2"},
+		{"duplicate twice", "search", []string{"mcp1_search", "mcp1_search_2"}, "mcp1_search_3"},
+		{"duplicate truncated", long, []string{"mcp1_" + long[:59]}, "mcp1_" + long[:57] + "_2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			used := make(map[string]bool)
+			for _, name := range tt.used {
+				used[name] = true
+			}
+			got := functionName(1, tt.tool, used)
+			if got != tt.want {
+				t.Errorf("functionName() = %q, want %q", got, tt.want)
+			}
+			if len(got) > 64 {
+				t.Errorf("functionName() is %d characters long", len(got))
+			}
+			if !used[got] {
+				t.Errorf("functionName() did not mark %q as used", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package mcp
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+// 通过子进程的标准输入输出通信，每条消息一行 JSON
+type stdioTransport struct {
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	writeLock sync.Mutex
+	*dispatcher
+}
+
+func newStdioTransport(command string, args []string, env map[string]string) (*stdioTransport, error) {
+	cmd := exec.Command(command, args...)
+	cmd.Env = os.Environ()
+	for k, v := range env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, fmt.Errorf("启动 MCP 服务进程失败：%v", err)
+	}
+
+	t := &stdioTransport{cmd: cmd, stdin: stdin, dispatcher: newDispatcher()}
+	go t.readLoop(stdout)
+	// 服务进程的日志输出到 stderr，转发到系统日志方便排查问题
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			logger.Debugf("MCP[%s]: %s", command, scanner.Text())
+		}
+	}()
+	go func() {
+		err := cmd.Wait()
+		t.fail(fmt.Errorf("MCP 服务进程已退出：%v", err))
+	}()
+	return t, nil
+}
+
+func (t *stdioTransport) readLoop(r io.Reader) {
+	reader := bufio.NewReaderSize(r, 64*1024)
+	for {
+		line, err := reader.ReadBytes('\n')
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 && !t.dispatch(line) {
+			t.handleServerMessage(line)
+		}
+		if err != nil {
+			t.fail(err)
+			return
+		}
+	}
+}
+
+// 处理服务端发起的请求，目前只回应 ping，其他请求一律返回方法不存在
+func (t *stdioTransport) handleServerMessage(data []byte) {
+	var msg message
+	if err := json.Unmarshal(data, &msg); err != nil || msg.Id == nil {
+		return
+	}
+	res := map[string]any{"jsonrpc": "2.0", "id": *msg.Id}
+	if msg.Method == "ping" {
+		res["result"] = map[string]any{}
+	} else {
+		res["error"] = rpcError{Code: -32601, Message: "Method not found"}
+	}
+	_ = t.write(res)
+}
+
+func (t *stdioTransport) write(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+	_, err = t.stdin.Write(append(data, '\n'))
+	return err
+}
+
+func (t *stdioTransport) call(ctx context.Context, req request) (*message, error) {
+	ch, err := t.register(*req.Id)
+	if err != nil {
+		return nil, err
+	}
+	if err = t.write(req); err != nil {
+		t.remove(*req.Id)
+		return nil, err
+	}
+	return t.wait(ctx, *req.Id, ch)
+}
+
+func (t *stdioTransport) notify(_ context.Context, req request) error {
+	return t.write(req)
+}
+
+func (t *stdioTransport) close() error {
+	_ = t.stdin.Close()
+	t.fail(errClosed)
+	if t.cmd.Process != nil {
+		return t.cmd.Process.Kill()
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package mcp
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+var errClosed = errors.New("MCP 连接已经关闭")
+
+// 传输层，负责把 JSON-RPC 消息发给 MCP 服务并取回响应
+type transport interface {
+	// 发送请求并等待对应 id 的响应
+	call(ctx context.Context, req request) (*message, error)
+	// 发送通知，不需要响应
+	notify(ctx context.Context, req request) error
+	close() error
+}
+
+// 长连接的传输方式（stdio 和 SSE）都是异步收到响应，按照请求 id 分发给等待的调用方
+type dispatcher struct {
+	lock    sync.Mutex
+	pending map[int64]chan *message
+	err     error // 连接断开的原因
+}
+
+func newDispatcher() *dispatcher {
+	return &dispatcher{pending: make(map[int64]chan *message)}
+}
+
+func (d *dispatcher) register(id int64) (chan *message, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.err != nil {
+		return nil, d.err
+	}
+	ch := make(chan *message, 1)
+	d.pending[id] = ch
+	return ch, nil
+}
+
+func (d *dispatcher) remove(id int64) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.pending, id)
+}
+
+// 收到服务端的消息，返回 false 表示不是响应消息
+func (d *dispatcher) dispatch(data []byte) bool {
+	var msg message
+	if err := json.Unmarshal(data, &msg); err != nil || msg.Id == nil || msg.Method != "" {
+		return false
+	}
+	d.lock.Lock()
+	ch, ok := d.pending[*msg.Id]
+	delete(d.pending, *msg.Id)
+	d.lock.Unlock()
+	if ok {
+		ch <- &msg
+	}
+	return true
+}
+
+// 连接断开，所有等待中的请求都返回错误
+func (d *dispatcher) fail(err error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.err != nil {
+		return
+	}
+	if err == nil {
+		err = errClosed
+	}
+	d.err = err
+	for id, ch := range d.pending {
+		close(ch)
+		delete(d.pending, id)
+	}
+}
+
+func (d *dispatcher) wait(ctx context.Context, id int64, ch chan *message) (*message, error) {
+	select {
+	case msg, ok := <-ch:
+		if !ok {
+			d.lock.Lock()
+			defer d.lock.Unlock()
+			return nil, d.err
+		}
+		return msg, nil
+	case <-ctx.Done():
+		d.remove(id)
+		return nil, ctx.Err()
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"geekai/core/types"
 	"geekai/store"
 	"geekai/store/model"
+	"geekai/utils"
 	"strings"
 
 	"github.com/go-redis/redis/v8"
@@ -169,6 +170,29 @@ func (s *MigrationService) TableMigration() {
 	if !s.db.Migrator().HasTable(&model.Moderation{}) {
 		s.db.AutoMigrate(&model.Moderation{})
 	}
+	if !s.db.Migrator().HasTable(&model.ApiToken{}) {
+		s.db.AutoMigrate(&model.ApiToken{})
+	}
+	if !s.db.Migrator().HasTable(&model.McpServer{}) {
+		s.db.AutoMigrate(&model.McpServer{})
+	}
+	if !s.db.Migrator().HasTable(&model.UserMcpServer{}) {
+		s.db.AutoMigrate(&model.UserMcpServer{})
+	}
+	if !s.db.Migrator().HasTable(&model.ChatShare{}) {
+		s.db.AutoMigrate(&model.ChatShare{})
+	}
+	if !s.db.Migrator().HasTable(&model.ChatCompare{}) {
+		s.db.AutoMigrate(&model.ChatCompare{})
+	}
+	if !s.db.Migrator().HasTable(&model.JobLog{}) {
+		s.db.AutoMigrate(&model.JobLog{})
+	}
+	for _, table := range []any{&model.KnowledgeBase{}, &model.KnowledgeDoc{}, &model.KnowledgeChunk{}} {
+		if !s.db.Migrator().HasTable(table) {
+			s.db.AutoMigrate(table)
+		}
+	}
 
 	// 订单字段整理
 	if s.db.Migrator().HasColumn(&model.Order{}, "pay_type") {
@@ -178,6 +202,128 @@ func (s *MigrationService) TableMigration() {
 		s.db.Migrator().AddColumn(&model.Order{}, "checked")
 	}
 
+	// API KEY 服务商字段
+	if !s.db.Migrator().HasColumn(&model.ApiKey{}, "provider") {
+		s.db.Migrator().AddColumn(&model.ApiKey{}, "provider")
+	}
+	if !s.db.Migrator().HasColumn(&model.ApiKey{}, "disabled_reason") {
+		s.db.Migrator().AddColumn(&model.ApiKey{}, "disabled_reason")
+	}
+	for _, column := range []string{"weight", "rpm", "tpm"} {
+		if !s.db.Migrator().HasColumn(&model.ApiKey{}, column) {
+			s.db.Migrator().AddColumn(&model.ApiKey{}, column)
+		}
+	}
+
+	// 开放接口访问令牌改为只保存哈希值
+	if !s.db.Migrator().HasColumn(&model.ApiToken{}, "token_mask") {
+		s.db.Migrator().AddColumn(&model.ApiToken{}, "token_mask")
+		if err := s.hashApiTokens(); err != nil {
+			logger.Errorf("迁移访问令牌失败：%v", err)
+		}
+	}
+
+	// 对话消息 token 用量明细
+	if columns, err := s.db.Migrator().ColumnTypes(&model.ChatMessage{}); err == nil {
+		for _, column := range columns {
+			if column.Name() == "tokens" && strings.ToLower(column.DatabaseTypeName()) == "smallint" {
+				s.db.Migrator().AlterColumn(&model.ChatMessage{}, "tokens")
+			}
+		}
+	}
+	for _, column := range []string{"prompt_tokens", "completion_tokens", "reasoning_tokens", "cached_tokens", "usage_estimated", "tool_calls"} {
+		if !s.db.Migrator().HasColumn(&model.ChatMessage{}, column) {
+			s.db.Migrator().AddColumn(&model.ChatMessage{}, column)
+		}
+	}
+
+	// MCP 工具字段，MCP 工具的函数名称比较长
+	if !s.db.Migrator().HasColumn(&model.Function{}, "mcp_server_id") {
+		s.db.Migrator().AlterColumn(&model.Function{}, "name")
+	}
+	for _, column := range []string{"mcp_server_id", "mcp_tool"} {
+		if !s.db.Migrator().HasColumn(&model.Function{}, column) {
+			s.db.Migrator().AddColumn(&model.Function{}, column)
+		}
+	}
+
+	// 对话消息树，老的会话消息按照时间顺序串成一个分支
+	if !s.db.Migrator().HasColumn(&model.ChatMessage{}, "parent_id") {
+		s.db.Migrator().AddColumn(&model.ChatMessage{}, "parent_id")
+		if err := s.linkChatMessages(); err != nil {
+			logger.Errorf("初始化对话消息分支失败：%v", err)
+		}
+	}
+	if !s.db.Migrator().HasColumn(&model.ChatItem{}, "active_msg_id") {
+		s.db.Migrator().AddColumn(&model.ChatItem{}, "active_msg_id")
+	}
+
+	// 上下文压缩
+	for _, column := range []string{"summary", "summary_msg_id"} {
+		if !s.db.Migrator().HasColumn(&model.ChatItem{}, column) {
+			s.db.Migrator().AddColumn(&model.ChatItem{}, column)
+		}
+	}
+	if !s.db.Migrator().HasColumn(&model.ChatApp{}, "context_compact") {
+		s.db.Migrator().AddColumn(&model.ChatApp{}, "context_compact")
+	}
+
+	// 知识库
+	if !s.db.Migrator().HasColumn(&model.ChatApp{}, "knowledge_ids") {
+		s.db.Migrator().AddColumn(&model.ChatApp{}, "knowledge_ids")
+	}
+	if !s.db.Migrator().HasColumn(&model.ChatMessage{}, "citations") {
+		s.db.Migrator().AddColumn(&model.ChatMessage{}, "citations")
+	}
+
+	// 聊天记录全文检索，使用 ngram 分词支持中文
+	if !s.db.Migrator().HasColumn(&model.ChatMessage{}, "search_text") {
+		s.db.Migrator().AddColumn(&model.ChatMessage{}, "search_text")
+		if err := s.fillSearchText(); err != nil {
+			logger.Errorf("初始化聊天记录检索内容失败：%v", err)
+		}
+	}
+	if !s.db.Migrator().HasIndex(&model.ChatMessage{}, "ft_search_text") {
+		err := s.db.Exec("ALTER TABLE geekai_chat_history ADD FULLTEXT INDEX ft_search_text (search_text) WITH PARSER ngram").Error
+		if err != nil {
+			logger.Errorf("创建聊天记录全文索引失败：%v", err)
+		}
+	}
+
+	// 多模型对比
+	if !s.db.Migrator().HasColumn(&model.ChatMessage{}, "compare_id") {
+		s.db.Migrator().AddColumn(&model.ChatMessage{}, "compare_id")
+	}
+
+	// 用户自定义应用
+	for _, column := range []string{"user_id", "temperature", "tools", "review_status", "review_remark"} {
+		if !s.db.Migrator().HasColumn(&model.ChatApp{}, column) {
+			s.db.Migrator().AddColumn(&model.ChatApp{}, column)
+		}
+	}
+
+	// 应用的请求参数、绑定工具和表单变量
+	for _, column := range []string{"top_p", "max_tokens", "response_format", "function_ids", "variables"} {
+		if !s.db.Migrator().HasColumn(&model.ChatApp{}, column) {
+			s.db.Migrator().AddColumn(&model.ChatApp{}, column)
+		}
+	}
+	if !s.db.Migrator().HasColumn(&model.ChatItem{}, "variables") {
+		s.db.Migrator().AddColumn(&model.ChatItem{}, "variables")
+	}
+
+	// 文件提取的文本内容缓存
+	if !s.db.Migrator().HasColumn(&model.File{}, "content") {
+		s.db.Migrator().AddColumn(&model.File{}, "content")
+	}
+
+	// 模型按 token 计费字段
+	for _, column := range []string{"input_power", "output_power", "cached_power"} {
+		if !s.db.Migrator().HasColumn(&model.ChatModel{}, column) {
+			s.db.Migrator().AddColumn(&model.ChatModel{}, column)
+		}
+	}
+
 	// 重命名 config 表字段
 	if s.db.Migrator().HasColumn(&model.Config{}, "config_json") {
 		s.db.Migrator().RenameColumn(&model.Config{}, "config_json", "value")
@@ -348,3 +494,44 @@ func (s *MigrationService) saveConfig(key string, config any) error {
 	logger.Infof("成功迁移配置 %s", key)
 	return nil
 }
+
+// 把每个会话的消息按照 ID 顺序依次指向上一条消息，整表一条语句更新，避免逐行更新拖慢启动
+func (s *MigrationService) linkChatMessages() error {
+	return s.db.Exec(`UPDATE geekai_chat_history m
+		JOIN (SELECT id, LAG(id) OVER (PARTITION BY chat_id ORDER BY id) AS prev_id FROM geekai_chat_history) p ON p.id = m.id
+		SET m.parent_id = p.prev_id
+		WHERE p.prev_id IS NOT NULL`).Error
+}
+
+// 老的访问令牌是明文保存的，替换成哈希值，同时保存脱敏之后的令牌用于展示
+func (s *MigrationService) hashApiTokens() error {
+	var rows []model.ApiToken
+	if err := s.db.Select("id", "token").Find(&rows).Error; err != nil {
+		return err
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		for _, row := range rows {
+			if !strings.HasPrefix(row.Token, "sk-") {
+				continue
+			}
+			err := tx.Model(&model.ApiToken{}).Where("id", row.Id).UpdateColumns(map[string]any{
+				"token":      utils.Sha256(row.Token),
+				"token_mask": utils.MaskToken(row.Token),
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// 老的聊天记录从 JSON 内容里面提取纯文本，用于全文检索。不是 JSON 对象的内容按照纯文本处理，
+// 整表一条语句更新，避免逐行更新拖慢启动
+func (s *MigrationService) fillSearchText() error {
+	return s.db.Exec(`UPDATE geekai_chat_history SET search_text = CASE
+		WHEN JSON_VALID(content) THEN CASE
+			WHEN JSON_TYPE(content) = 'OBJECT' THEN COALESCE(JSON_UNQUOTE(JSON_EXTRACT(content, '$.text')), '')
+			ELSE content END
+		ELSE content END`).Error
+}
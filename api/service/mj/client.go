@@ -8,16 +8,17 @@ package mj
 // * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
 
 import (
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"geekai/core/types"
 	logger2 "geekai/logger"
 	"geekai/service"
+	"geekai/service/provider"
 	"geekai/store/model"
 	"geekai/utils"
 	"github.com/imroc/req/v3"
-	"gorm.io/gorm"
 	"io"
 	"time"
 
@@ -28,7 +29,7 @@ import (
 type Client struct {
 	client         *req.Client
 	licenseService *service.LicenseService
-	db             *gorm.DB
+	apiKeyService  *service.ApiKeyService
 }
 
 type ImageReq struct {
@@ -50,23 +51,25 @@ type ImageRes struct {
 	Channel string `json:"channel,omitempty"`
 }
 
+type Button struct {
+	CustomId string `json:"customId"`
+	Emoji    string `json:"emoji"`
+	Label    string `json:"label"`
+	Style    int    `json:"style"`
+	Type     int    `json:"type"`
+}
+
 type QueryRes struct {
-	Action  string `json:"action"`
-	Buttons []struct {
-		CustomId string `json:"customId"`
-		Emoji    string `json:"emoji"`
-		Label    string `json:"label"`
-		Style    int    `json:"style"`
-		Type     int    `json:"type"`
-	} `json:"buttons"`
-	Description string `json:"description"`
-	FailReason  string `json:"failReason"`
-	FinishTime  int    `json:"finishTime"`
-	Id          string `json:"id"`
-	ImageUrl    string `json:"imageUrl"`
-	Progress    string `json:"progress"`
-	Prompt      string `json:"prompt"`
-	PromptEn    string `json:"promptEn"`
+	Action      string   `json:"action"`
+	Buttons     []Button `json:"buttons"`
+	Description string   `json:"description"`
+	FailReason  string   `json:"failReason"`
+	FinishTime  int      `json:"finishTime"`
+	Id          string   `json:"id"`
+	ImageUrl    string   `json:"imageUrl"`
+	Progress    string   `json:"progress"`
+	Prompt      string   `json:"prompt"`
+	PromptEn    string   `json:"promptEn"`
 	Properties  struct {
 	} `json:"properties"`
 	StartTime  int    `json:"startTime"`
@@ -77,11 +80,11 @@ type QueryRes struct {
 
 var logger = logger2.GetLogger()
 
-func NewClient(licenseService *service.LicenseService, db *gorm.DB) *Client {
+func NewClient(licenseService *service.LicenseService, apiKeyService *service.ApiKeyService) *Client {
 	return &Client{
 		client:         req.C().SetTimeout(time.Minute).SetUserAgent("Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/123.0.0.0 Safari/537.36"),
 		licenseService: licenseService,
-		db:             db,
+		apiKeyService:  apiKeyService,
 	}
 }
 
@@ -95,6 +98,7 @@ func (c *Client) Imagine(task types.MjTask) (ImageRes, error) {
 		BotType:     "MID_JOURNEY",
 		Prompt:      prompt,
 		Base64Array: make([]string, 0),
+		NotifyHook:  task.NotifyHook,
 	}
 	// 生成图片 Base64 编码
 	if len(task.ImgArr) > 0 {
@@ -116,6 +120,7 @@ func (c *Client) Blend(task types.MjTask) (ImageRes, error) {
 		BotType:     "MID_JOURNEY",
 		Dimensions:  "SQUARE",
 		Base64Array: make([]string, 0),
+		NotifyHook:  task.NotifyHook,
 	}
 	// 生成图片 Base64 编码
 	if len(task.ImgArr) > 0 {
@@ -159,7 +164,8 @@ func (c *Client) SwapFace(task types.MjTask) (ImageRes, error) {
 		"accountFilter": gin.H{
 			"instanceId": "",
 		},
-		"state": "",
+		"state":      "",
+		"notifyHook": task.NotifyHook,
 	}
 	return c.doRequest(body, apiPath, task.ChannelId)
 }
@@ -167,8 +173,9 @@ func (c *Client) SwapFace(task types.MjTask) (ImageRes, error) {
 // Upscale 放大指定的图片
 func (c *Client) Upscale(task types.MjTask) (ImageRes, error) {
 	body := map[string]string{
-		"customId": fmt.Sprintf("MJ::JOB::upsample::%d::%s", task.Index, task.MessageHash),
-		"taskId":   task.MessageId,
+		"customId":   fmt.Sprintf("MJ::JOB::upsample::%d::%s", task.Index, task.MessageHash),
+		"taskId":     task.MessageId,
+		"notifyHook": task.NotifyHook,
 	}
 	apiPath := fmt.Sprintf("mj-%s/mj/submit/action", task.Mode)
 	return c.doRequest(body, apiPath, task.ChannelId)
@@ -177,8 +184,9 @@ func (c *Client) Upscale(task types.MjTask) (ImageRes, error) {
 // Variation  以指定的图片的视角进行变换再创作，注意需要在对应的频道中关闭 Remix 变换，否则 Variation 指令将不会生效
 func (c *Client) Variation(task types.MjTask) (ImageRes, error) {
 	body := map[string]string{
-		"customId": fmt.Sprintf("MJ::JOB::variation::%d::%s", task.Index, task.MessageHash),
-		"taskId":   task.MessageId,
+		"customId":   fmt.Sprintf("MJ::JOB::variation::%d::%s", task.Index, task.MessageHash),
+		"taskId":     task.MessageId,
+		"notifyHook": task.NotifyHook,
 	}
 	apiPath := fmt.Sprintf("mj-%s/mj/submit/action", task.Mode)
 
@@ -187,64 +195,51 @@ func (c *Client) Variation(task types.MjTask) (ImageRes, error) {
 
 func (c *Client) doRequest(body interface{}, apiPath string, channel string) (ImageRes, error) {
 	var res ImageRes
-	session := c.db.Session(&gorm.Session{}).Where("type", "mj").Where("enabled", true)
-	if channel != "" {
-		session = session.Where("api_url", channel)
-	}
-
-	var apiKey model.ApiKey
-	err := session.Order("last_used_at ASC").First(&apiKey).Error
-	if err != nil {
-		return ImageRes{}, fmt.Errorf("no available MidJourney api key: %v", err)
-	}
+	apiKey, err := c.apiKeyService.InvokeChannel(context.Background(), "mj", channel, func(apiKey model.ApiKey) (int, error) {
+		if err := c.licenseService.IsValidApiURL(apiKey.ApiURL); err != nil {
+			return 0, service.Permanent(err)
+		}
 
-	if err = c.licenseService.IsValidApiURL(apiKey.ApiURL); err != nil {
-		return ImageRes{}, err
-	}
+		apiURL := fmt.Sprintf("%s/%s", apiKey.ApiURL, apiPath)
+		logger.Info("API URL: ", apiURL)
+		r, err := req.C().R().
+			SetHeader("Authorization", "Bearer "+apiKey.Value).
+			SetBody(body).
+			SetSuccessResult(&res).
+			Post(apiURL)
+		if err != nil {
+			return 0, fmt.Errorf("请求 API 出错：%v", err)
+		}
 
-	apiURL := fmt.Sprintf("%s/%s", apiKey.ApiURL, apiPath)
-	logger.Info("API URL: ", apiURL)
-	r, err := req.C().R().
-		SetHeader("Authorization", "Bearer "+apiKey.Value).
-		SetBody(body).
-		SetSuccessResult(&res).
-		Post(apiURL)
+		if r.IsErrorState() {
+			errMsg, _ := io.ReadAll(r.Body)
+			return 0, &provider.ApiError{Provider: "MidJourney", StatusCode: r.StatusCode, Body: string(errMsg)}
+		}
+		return 0, nil
+	})
 	if err != nil {
-		return ImageRes{}, fmt.Errorf("请求 API 出错：%v", err)
-	}
-
-	if r.IsErrorState() {
-		errMsg, _ := io.ReadAll(r.Body)
-		return ImageRes{}, fmt.Errorf("API 返回错误：%s", string(errMsg))
-	}
-
-	// update the api key last used time
-	if err = c.db.Model(&apiKey).Update("last_used_at", time.Now().Unix()).Error; err != nil {
-		logger.Error("update api key last used time error: ", err)
+		return ImageRes{}, err
 	}
 	res.Channel = apiKey.ApiURL
 	return res, nil
 }
 
 func (c *Client) QueryTask(taskId string, channel string) (QueryRes, error) {
-	var apiKey model.ApiKey
-	err := c.db.Where("type", "mj").Where("enabled", true).Where("api_url", channel).First(&apiKey).Error
-	if err != nil {
-		return QueryRes{}, fmt.Errorf("no available MidJourney api key: %v", err)
-	}
-	apiURL := fmt.Sprintf("%s/mj/task/%s/fetch", apiKey.ApiURL, taskId)
 	var res QueryRes
-	r, err := c.client.R().SetHeader("Authorization", "Bearer "+apiKey.Value).
-		SetSuccessResult(&res).
-		Get(apiURL)
-
-	if err != nil {
-		return QueryRes{}, err
-	}
+	_, err := c.apiKeyService.InvokeChannel(context.Background(), "mj", channel, func(apiKey model.ApiKey) (int, error) {
+		apiURL := fmt.Sprintf("%s/mj/task/%s/fetch", apiKey.ApiURL, taskId)
+		r, err := c.client.R().SetHeader("Authorization", "Bearer "+apiKey.Value).
+			SetSuccessResult(&res).
+			Get(apiURL)
 
-	if r.IsErrorState() {
-		return QueryRes{}, errors.New("error status:" + r.Status)
-	}
+		if err != nil {
+			return 0, err
+		}
 
-	return res, nil
+		if r.IsErrorState() {
+			return 0, &provider.ApiError{Provider: "MidJourney", StatusCode: r.StatusCode, Body: r.String()}
+		}
+		return 0, nil
+	})
+	return res, err
 }
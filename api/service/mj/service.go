@@ -8,121 +8,246 @@ package mj
 // * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"geekai/core/types"
 	"geekai/service"
+	"geekai/service/job"
 	"geekai/service/oss"
-	"geekai/store"
 	"geekai/store/model"
 	"geekai/utils"
 	"strings"
 	"time"
 
-	"github.com/go-redis/redis/v8"
-
 	"gorm.io/gorm"
 )
 
+const jobName = "mj"
+
 // Service MJ 绘画服务
 type Service struct {
 	client          *Client // MJ Client
-	taskQueue       *store.RedisQueue
+	engine          *job.Engine
 	db              *gorm.DB
 	uploaderManager *oss.UploaderManager
 	userService     *service.UserService
 }
 
-func NewService(redisCli *redis.Client, db *gorm.DB, client *Client, manager *oss.UploaderManager, userService *service.UserService) *Service {
+func NewService(db *gorm.DB, client *Client, manager *oss.UploaderManager, engine *job.Engine, userService *service.UserService) *Service {
 	return &Service{
 		db:              db,
-		taskQueue:       store.NewRedisQueue("MidJourney_Task_Queue", redisCli),
+		engine:          engine,
 		client:          client,
 		uploaderManager: manager,
 		userService:     userService,
 	}
 }
 
+// Run 注册到任务引擎
 func (s *Service) Run() {
-	// 将数据库中未提交的人物加载到队列
-	var jobs []model.MidJourneyJob
-	s.db.Where("task_id", "").Where("progress", 0).Find(&jobs)
-	for _, v := range jobs {
-		var task types.MjTask
-		err := utils.JsonDecode(v.TaskInfo, &task)
-		if err != nil {
-			logger.Errorf("decode task info with error: %v", err)
-			continue
-		}
-		task.Id = v.Id
-		s.PushTask(task)
+	s.engine.Register(s)
+}
+
+func (s *Service) Options() job.Options {
+	return job.Options{
+		Name:         jobName,
+		Concurrency:  3,
+		Timeout:      10 * time.Minute,
+		PollInterval: 5 * time.Second,
 	}
+}
 
-	logger.Info("Starting MidJourney job consumer for service")
-	go func() {
-		for {
-			var task types.MjTask
-			err := s.taskQueue.LPop(&task)
-			if err != nil {
-				logger.Errorf("taking task with error: %v", err)
-				continue
-			}
+func (s *Service) record(v model.MidJourneyJob) job.Record {
+	rec := job.Record{Id: v.Id, UserId: v.UserId, Progress: v.Progress, Power: v.Power, CreatedAt: v.CreatedAt}
+	rec.Callback = s.engine.CallbackEnabled()
+	switch {
+	case v.Progress == service.FailTaskProgress:
+		rec.Status = job.StatusFailed
+	case v.Progress >= 100 && v.ImgURL == "" && v.OrgURL != "":
+		rec.Status = job.StatusDownloading
+	case v.Progress >= 100:
+		rec.Status = job.StatusSucceeded
+	case v.TaskId == "" && v.Progress == 0:
+		rec.Status = job.StatusQueued
+	default:
+		rec.Status = job.StatusRunning
+	}
+	return rec
+}
 
-			// use fast mode as default
-			if task.Mode == "" {
-				task.Mode = "fast"
-			}
+func (s *Service) Load(id uint) (job.Record, error) {
+	var v model.MidJourneyJob
+	err := s.db.Where("id", id).First(&v).Error
+	return s.record(v), err
+}
 
-			var job model.MidJourneyJob
-			tx := s.db.Where("id = ?", task.Id).First(&job)
-			if tx.Error != nil {
-				logger.Error("任务不存在，任务ID：", task.TaskId)
-				continue
-			}
+func (s *Service) Pending(userId uint) ([]job.Record, error) {
+	var items []model.MidJourneyJob
+	session := s.db.Session(&gorm.Session{})
+	if userId > 0 {
+		session = session.Where("user_id", userId)
+	}
+	err := session.Where("progress < ? OR (progress = ? AND img_url = ?) OR (progress = ? AND power > 0)",
+		100, 100, "", service.FailTaskProgress).Find(&items).Error
+	records := make([]job.Record, 0, len(items))
+	for _, v := range items {
+		records = append(records, s.record(v))
+	}
+	return records, err
+}
 
-			logger.Infof("handle a new MidJourney task: %+v", task)
-			var res ImageRes
-			switch task.Type {
-			case types.TaskImage:
-				res, err = s.client.Imagine(task)
-				break
-			case types.TaskUpscale:
-				res, err = s.client.Upscale(task)
-				break
-			case types.TaskVariation:
-				res, err = s.client.Variation(task)
-				break
-			case types.TaskBlend:
-				res, err = s.client.Blend(task)
-				break
-			case types.TaskSwapFace:
-				res, err = s.client.SwapFace(task)
-				break
-			}
+func (s *Service) Submit(ctx context.Context, id uint) (job.Result, error) {
+	var v model.MidJourneyJob
+	if err := s.db.Where("id", id).First(&v).Error; err != nil {
+		return job.Result{}, job.Permanent(err)
+	}
+	var task types.MjTask
+	if err := utils.JsonDecode(v.TaskInfo, &task); err != nil {
+		return job.Result{}, job.Permanent(fmt.Errorf("decode task info with error: %v", err))
+	}
+	task.Id = v.Id
+	task.NotifyHook = s.engine.CallbackURL(jobName, v.Id)
+	// use fast mode as default
+	if task.Mode == "" {
+		task.Mode = "fast"
+	}
 
-			if err != nil || (res.Code != 1 && res.Code != 22) {
-				var errMsg string
-				if err != nil {
-					errMsg = err.Error()
-				} else {
-					errMsg = fmt.Sprintf("%v,%s", err, res.Description)
-				}
+	logger.Infof("handle a new MidJourney task: %+v", task)
+	var res ImageRes
+	var err error
+	switch task.Type {
+	case types.TaskImage:
+		res, err = s.client.Imagine(task)
+	case types.TaskUpscale:
+		res, err = s.client.Upscale(task)
+	case types.TaskVariation:
+		res, err = s.client.Variation(task)
+	case types.TaskBlend:
+		res, err = s.client.Blend(task)
+	case types.TaskSwapFace:
+		res, err = s.client.SwapFace(task)
+	default:
+		return job.Result{}, job.Permanent(fmt.Errorf("unknown task type: %s", task.Type))
+	}
+	if err != nil {
+		return job.Result{}, err
+	}
+	// 上游拒绝的任务（比如提示词违规），重试也不会成功
+	if res.Code != 1 && res.Code != 22 {
+		return job.Result{}, job.Permanent(errors.New(res.Description))
+	}
+
+	logger.Infof("任务提交成功：%+v", res)
+	// 更新任务 ID/频道
+	err = s.db.Model(&model.MidJourneyJob{Id: id}).UpdateColumns(map[string]any{
+		"task_id":    res.Result,
+		"message_id": res.Result,
+		"channel_id": res.Channel,
+	}).Error
+	if err != nil {
+		return job.Result{}, job.Permanent(err)
+	}
+	return job.Result{Status: job.StatusRunning}, nil
+}
+
+// Poll 查询任务进度
+func (s *Service) Poll(ctx context.Context, id uint) (job.Result, error) {
+	var v model.MidJourneyJob
+	if err := s.db.Where("id", id).First(&v).Error; err != nil {
+		return job.Result{}, err
+	}
+	if v.ChannelId == "" {
+		return job.Result{}, errors.New("任务还没有提交成功")
+	}
+
+	task, err := s.client.QueryTask(v.TaskId, v.ChannelId)
+	if err != nil {
+		return job.Result{}, err
+	}
+	return s.update(id, task)
+}
+
+// Callback MJ-Proxy 的回调通知
+func (s *Service) Callback(id uint, body []byte) (job.Result, error) {
+	var cb CBReq
+	if err := utils.JsonDecode(string(body), &cb); err != nil {
+		return job.Result{}, err
+	}
+	var v model.MidJourneyJob
+	if err := s.db.Where("id", id).First(&v).Error; err != nil {
+		return job.Result{}, err
+	}
+	// 提交的返回结果还没有保存，交给兜底查询处理
+	if v.TaskId == "" || v.TaskId != cb.Id {
+		return job.Result{}, fmt.Errorf("task id mismatch: %s", cb.Id)
+	}
 
-				logger.Error("绘画任务执行失败：", errMsg)
-				job.Progress = service.FailTaskProgress
-				job.ErrMsg = errMsg
-				// update the task progress
-				s.db.Updates(&job)
-				// 任务失败，通知前端
-				continue
-			}
-			logger.Infof("任务提交成功：%+v", res)
-			// 更新任务 ID/频道
-			job.TaskId = res.Result
-			job.MessageId = res.Result
-			job.ChannelId = res.Channel
-			s.db.Updates(&job)
+	task := QueryRes{Id: cb.Id, Status: cb.Status, Progress: cb.Progress, ImageUrl: cb.ImageUrl, Buttons: cb.Buttons}
+	if cb.FailReason != nil {
+		task.FailReason = fmt.Sprint(cb.FailReason)
+	}
+	return s.update(id, task)
+}
+
+// 根据查询或者回调返回的任务信息更新任务
+func (s *Service) update(id uint, task QueryRes) (job.Result, error) {
+	// 任务执行失败了
+	if task.FailReason != "" {
+		return job.Result{Status: job.StatusFailed, Message: task.FailReason}, nil
+	}
+
+	data := make(map[string]any)
+	if len(task.Buttons) > 0 {
+		data["hash"] = GetImageHash(task.Buttons[0].CustomId)
+	}
+	if task.ImageUrl != "" {
+		data["org_url"] = task.ImageUrl
+	}
+	if len(data) > 0 {
+		if err := s.db.Model(&model.MidJourneyJob{Id: id}).UpdateColumns(data).Error; err != nil {
+			return job.Result{}, err
 		}
-	}()
+	}
+
+	progress := utils.IntValue(strings.Replace(task.Progress, "%", "", 1), 0)
+	if progress >= 100 && task.ImageUrl != "" {
+		return job.Result{Status: job.StatusDownloading, Progress: 100}, nil
+	}
+	return job.Result{Status: job.StatusRunning, Progress: progress}, nil
+}
+
+// Download 把生成的图片转存到 OSS
+func (s *Service) Download(ctx context.Context, id uint) error {
+	var v model.MidJourneyJob
+	if err := s.db.Where("id", id).First(&v).Error; err != nil {
+		return err
+	}
+	logger.Infof("try to download image: %s", v.OrgURL)
+	// 如果是返回的是 discord 图片地址，则使用代理下载
+	proxy := strings.HasPrefix(v.OrgURL, "https://cdn.discordapp.com")
+	imgURL, err := s.uploaderManager.GetUploadHandler().PutUrlFile(v.OrgURL, ".png", proxy)
+	if err != nil {
+		return err
+	}
+	logger.Infof("download image %s successfully.", v.OrgURL)
+	return s.db.Model(&model.MidJourneyJob{Id: id}).UpdateColumn("img_url", imgURL).Error
+}
+
+func (s *Service) Finalize(id uint, result job.Result) error {
+	return s.db.Model(&model.MidJourneyJob{Id: id}).UpdateColumns(job.ProgressColumns(result, 100)).Error
+}
+
+func (s *Service) Refund(rec job.Record) (bool, error) {
+	return job.RefundOnce(s.db, &model.MidJourneyJob{}, rec, func() error {
+		var v model.MidJourneyJob
+		s.db.Where("id", rec.Id).First(&v)
+		return s.userService.IncreasePower(rec.UserId, rec.Power, model.PowerLog{
+			Type:   types.PowerRefund,
+			Model:  "mid-journey",
+			Remark: fmt.Sprintf("任务失败，退回算力。任务ID：%d，Err: %s", rec.Id, v.ErrMsg),
+		})
+	})
 }
 
 type CBReq struct {
@@ -138,6 +263,7 @@ type CBReq struct {
 	Progress    string      `json:"progress"`
 	ImageUrl    string      `json:"imageUrl"`
 	FailReason  interface{} `json:"failReason"`
+	Buttons     []Button    `json:"buttons"`
 	Properties  struct {
 		FinalPrompt string `json:"finalPrompt"`
 	} `json:"properties"`
@@ -151,122 +277,19 @@ func GetImageHash(action string) string {
 	return split[len(split)-1]
 }
 
-func (s *Service) DownloadImages() {
-	go func() {
-		var items []model.MidJourneyJob
-		for {
-			res := s.db.Where("img_url = ? AND progress = ?", "", 100).Find(&items)
-			if res.Error != nil {
-				continue
-			}
-
-			// download images
-			for _, v := range items {
-				if v.OrgURL == "" {
-					continue
-				}
-
-				logger.Infof("try to download image: %s", v.OrgURL)
-				// 如果是返回的是 discord 图片地址，则使用代理下载
-				proxy := false
-				if strings.HasPrefix(v.OrgURL, "https://cdn.discordapp.com") {
-					proxy = true
-				}
-				imgURL, err := s.uploaderManager.GetUploadHandler().PutUrlFile(v.OrgURL, ".png", proxy)
-
-				if err != nil {
-					logger.Errorf("error with download image %s, %v", v.OrgURL, err)
-					continue
-				} else {
-					logger.Infof("download image %s successfully.", v.OrgURL)
-				}
-
-				v.ImgURL = imgURL
-				s.db.Updates(&v)
-			}
-
-			time.Sleep(time.Second * 5)
-		}
-	}()
-}
-
 // PushTask push a new mj task in to task queue
 func (s *Service) PushTask(task types.MjTask) {
-	logger.Debugf("add a new MidJourney task to the task list: %+v", task)
-	if err := s.taskQueue.RPush(task); err != nil {
+	if err := s.engine.Submit(jobName, task.Id); err != nil {
 		logger.Errorf("push mj task to queue failed: %v", err)
 	}
 }
 
-// SyncTaskProgress 异步拉取任务
-func (s *Service) SyncTaskProgress() {
-	go func() {
-		var jobs []model.MidJourneyJob
-		for {
-			err := s.db.Where("progress < ?", 100).Find(&jobs).Error
-			if err != nil {
-				continue
-			}
-
-			for _, job := range jobs {
-				// 10 分钟还没完成的任务标记为失败
-				if time.Since(job.CreatedAt) > time.Minute*10 {
-					job.Progress = service.FailTaskProgress
-					job.ErrMsg = "任务超时"
-					s.db.Updates(&job)
-					continue
-				}
-
-				if job.ChannelId == "" {
-					continue
-				}
-
-				task, err := s.client.QueryTask(job.TaskId, job.ChannelId)
-				if err != nil {
-					logger.Errorf("error with query task: %v", err)
-					continue
-				}
-
-				// 任务执行失败了
-				if task.FailReason != "" {
-					s.db.Model(&model.MidJourneyJob{Id: job.Id}).UpdateColumns(map[string]interface{}{
-						"progress": service.FailTaskProgress,
-						"err_msg":  task.FailReason,
-					})
-					logger.Errorf("task failed: %v", task.FailReason)
-					continue
-				}
-
-				if len(task.Buttons) > 0 {
-					job.Hash = GetImageHash(task.Buttons[0].CustomId)
-				}
-				job.Progress = utils.IntValue(strings.Replace(task.Progress, "%", "", 1), 0)
-				if task.ImageUrl != "" {
-					job.OrgURL = task.ImageUrl
-				}
-				err = s.db.Updates(&job).Error
-				if err != nil {
-					logger.Errorf("error with update database: %v", err)
-					continue
-				}
-			}
-
-			// 找出失败的任务，并恢复其扣减算力
-			s.db.Where("progress", service.FailTaskProgress).Where("power > ?", 0).Find(&jobs)
-			for _, job := range jobs {
-				err := s.userService.IncreasePower(job.UserId, job.Power, model.PowerLog{
-					Type:   types.PowerRefund,
-					Model:  "mid-journey",
-					Remark: fmt.Sprintf("任务失败，退回算力。任务ID：%d，Err: %s", job.Id, job.ErrMsg),
-				})
-				if err != nil {
-					continue
-				}
-				// 更新任务状态
-				s.db.Model(&job).UpdateColumn("power", 0)
-			}
+// Admit 检查用户同时进行中的任务数量，没有达到上限的时候调用 create 创建任务
+func (s *Service) Admit(userId uint, create func() error) error {
+	return s.engine.Admit(jobName, userId, create)
+}
 
-			time.Sleep(time.Second * 5)
-		}
-	}()
+// QueuePositions 排队中的任务的排队位置
+func (s *Service) QueuePositions() map[uint]int {
+	return s.engine.QueuePositions(jobName)
 }
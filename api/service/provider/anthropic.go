@@ -0,0 +1,397 @@
+package provider
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"geekai/core/types"
+	"geekai/store/model"
+	"geekai/utils"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Anthropic Messages API
+type anthropicProvider struct{}
+
+const anthropicVersion = "2023-06-01"
+const anthropicDefaultMaxTokens = 4096
+
+type anthropicRequest struct {
+	Model       string             `json:"model"`
+	System      string             `json:"system,omitempty"`
+	Messages    []anthropicMessage `json:"messages"`
+	MaxTokens   int                `json:"max_tokens"`
+	Temperature *float32           `json:"temperature,omitempty"`
+	TopP        *float32           `json:"top_p,omitempty"`
+	Stream      bool               `json:"stream,omitempty"`
+	Tools       []anthropicTool    `json:"tools,omitempty"`
+	ToolChoice  map[string]string  `json:"tool_choice,omitempty"`
+	Thinking    map[string]any     `json:"thinking,omitempty"`
+}
+
+type anthropicMessage struct {
+	Role    string           `json:"role"`
+	Content []map[string]any `json:"content"`
+}
+
+type anthropicTool struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	InputSchema map[string]any `json:"input_schema"`
+}
+
+type anthropicUsage struct {
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+}
+
+type anthropicContentBlock struct {
+	Type      string          `json:"type"`
+	Text      string          `json:"text"`
+	Thinking  string          `json:"thinking"`
+	Signature string          `json:"signature"`
+	Data      string          `json:"data"` // redacted_thinking 加密的思考内容
+	Id        string          `json:"id"`
+	Name      string          `json:"name"`
+	Input     json.RawMessage `json:"input"`
+}
+
+type anthropicResponse struct {
+	Content    []anthropicContentBlock `json:"content"`
+	StopReason string                  `json:"stop_reason"`
+	Usage      anthropicUsage          `json:"usage"`
+}
+
+type anthropicEvent struct {
+	Type         string                `json:"type"`
+	Index        int                   `json:"index"`
+	Message      anthropicResponse     `json:"message"`
+	ContentBlock anthropicContentBlock `json:"content_block"`
+	Delta        struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		Thinking    string `json:"thinking"`
+		Signature   string `json:"signature"`
+		PartialJson string `json:"partial_json"`
+		StopReason  string `json:"stop_reason"`
+	} `json:"delta"`
+	Usage anthropicUsage `json:"usage"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (p *anthropicProvider) Name() string {
+	return Anthropic
+}
+
+func (p *anthropicProvider) Chat(ctx context.Context, apiKey model.ApiKey, req types.ApiRequest, callback func(delta Delta)) (*Response, error) {
+	body := p.buildRequest(req)
+	apiURL := buildURL(apiKey.ApiURL, "/v1/messages")
+	requestBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL, bytes.NewBuffer(requestBody))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("x-api-key", apiKey.Value)
+	request.Header.Set("anthropic-version", anthropicVersion)
+	logger.Infof("Sending %s request, API URL: %s, PROXY: %s, Model: %s", p.Name(), apiURL, apiKey.ProxyURL, req.Model)
+	response, err := newHttpClient(apiKey).Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(response.Body)
+		return nil, &ApiError{Provider: "Anthropic", StatusCode: response.StatusCode, Body: string(data)}
+	}
+
+	if !body.Stream {
+		var res anthropicResponse
+		data, err := io.ReadAll(response.Body)
+		if err != nil {
+			return nil, fmt.Errorf("读取响应失败：%v", err)
+		}
+		if err = json.Unmarshal(data, &res); err != nil {
+			return nil, fmt.Errorf("解析响应失败：%s", string(data))
+		}
+		result := &Response{FinishReason: p.finishReason(res.StopReason)}
+		for i, block := range res.Content {
+			switch block.Type {
+			case "thinking":
+				result.Reasoning += block.Thinking
+				result.ThinkingBlocks = append(result.ThinkingBlocks, ThinkingBlock{Type: block.Type, Thinking: block.Thinking, Signature: block.Signature})
+			case "redacted_thinking":
+				result.ThinkingBlocks = append(result.ThinkingBlocks, ThinkingBlock{Type: block.Type, Data: block.Data})
+			case "text":
+				result.Content += block.Text
+			case "tool_use":
+				call := types.ToolCall{Index: i, Id: block.Id, Type: "function"}
+				call.Function.Name = block.Name
+				call.Function.Arguments = string(block.Input)
+				result.ToolCalls = append(result.ToolCalls, call)
+			}
+		}
+		if result.Reasoning != "" {
+			callback(Delta{Type: DeltaReasoning, Content: result.Reasoning})
+		}
+		if result.Content != "" {
+			callback(Delta{Type: DeltaContent, Content: result.Content})
+		}
+		result.Usage = p.usage(res.Usage)
+		return result, nil
+	}
+
+	result := &Response{}
+	contents := make([]string, 0)
+	reasoning := make([]string, 0)
+	toolCalls := make(map[int]*types.ToolCall)
+	thinking := make(map[int]*ThinkingBlock)
+	var usage anthropicUsage
+	scanner := bufio.NewScanner(response.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		var event anthropicEvent
+		if err := json.Unmarshal([]byte(strings.TrimSpace(line[5:])), &event); err != nil {
+			return nil, errors.New(line)
+		}
+
+		switch event.Type {
+		case "message_start":
+			usage = event.Message.Usage
+		case "content_block_start":
+			switch event.ContentBlock.Type {
+			case "tool_use":
+				call := &types.ToolCall{Index: event.Index, Id: event.ContentBlock.Id, Type: "function"}
+				call.Function.Name = event.ContentBlock.Name
+				toolCalls[event.Index] = call
+				callback(Delta{Type: DeltaToolCall, ToolCall: call})
+			case "thinking", "redacted_thinking":
+				thinking[event.Index] = &ThinkingBlock{Type: event.ContentBlock.Type, Data: event.ContentBlock.Data}
+			}
+		case "content_block_delta":
+			switch event.Delta.Type {
+			case "text_delta":
+				contents = append(contents, event.Delta.Text)
+				callback(Delta{Type: DeltaContent, Content: event.Delta.Text})
+			case "thinking_delta":
+				reasoning = append(reasoning, event.Delta.Thinking)
+				if block, ok := thinking[event.Index]; ok {
+					block.Thinking += event.Delta.Thinking
+				}
+				callback(Delta{Type: DeltaReasoning, Content: event.Delta.Thinking})
+			case "signature_delta":
+				if block, ok := thinking[event.Index]; ok {
+					block.Signature += event.Delta.Signature
+				}
+			case "input_json_delta":
+				if call, ok := toolCalls[event.Index]; ok {
+					call.Function.Arguments += event.Delta.PartialJson
+				}
+			}
+		case "message_delta":
+			result.FinishReason = p.finishReason(event.Delta.StopReason)
+			if event.Usage.OutputTokens > 0 {
+				usage.OutputTokens = event.Usage.OutputTokens
+			}
+		case "error":
+			return nil, fmt.Errorf("Anthropic API 返回错误：%s, %s", event.Error.Type, event.Error.Message)
+		}
+	}
+
+	// 用户主动停止的保留已经输出的内容，其他原因中断的不能当作正常结束
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		return nil, fmt.Errorf("读取响应数据出错：%v", err)
+	}
+
+	result.Content = strings.Join(contents, "")
+	result.Reasoning = strings.Join(reasoning, "")
+	result.ThinkingBlocks = sortThinkingBlocks(thinking)
+	result.ToolCalls = sortToolCalls(toolCalls)
+	result.Usage = p.usage(usage)
+	return result, nil
+}
+
+// 将 OpenAI 格式的请求转换为 Anthropic Messages 格式
+func (p *anthropicProvider) buildRequest(req types.ApiRequest) anthropicRequest {
+	body := anthropicRequest{
+		Model:     req.Model,
+		MaxTokens: maxTokens(req),
+		Stream:    req.Stream,
+	}
+	if body.MaxTokens <= 0 {
+		body.MaxTokens = anthropicDefaultMaxTokens
+	}
+	if req.ThinkingBudget > 0 {
+		// 开启思考模式之后不允许设置温度，并且 max_tokens 必须大于思考预算
+		body.Thinking = map[string]any{"type": "enabled", "budget_tokens": req.ThinkingBudget}
+		if body.MaxTokens <= req.ThinkingBudget {
+			body.MaxTokens = req.ThinkingBudget + anthropicDefaultMaxTokens
+		}
+	} else {
+		temperature := req.Temperature
+		if temperature > 1 { // Anthropic 的温度取值范围为 0 ~ 1
+			temperature = 1
+		}
+		body.Temperature = &temperature
+		if req.TopP > 0 {
+			topP := req.TopP
+			body.TopP = &topP
+		}
+	}
+
+	for _, tool := range req.Tools {
+		body.Tools = append(body.Tools, anthropicTool{
+			Name:        tool.Function.Name,
+			Description: tool.Function.Description,
+			InputSchema: tool.Function.Parameters,
+		})
+	}
+	if len(body.Tools) > 0 {
+		body.ToolChoice = map[string]string{"type": "auto"}
+	}
+
+	systems := make([]string, 0)
+	for _, msg := range parseMessages(req.Messages) {
+		var role string
+		var blocks []map[string]any
+		switch msg.Role {
+		case "system":
+			systems = append(systems, msg.Text)
+			continue
+		case "tool":
+			role = "user"
+			blocks = append(blocks, map[string]any{
+				"type":        "tool_result",
+				"tool_use_id": msg.ToolCallId,
+				"content":     msg.Text,
+			})
+		case "assistant":
+			role = "assistant"
+			// 开启思考模式之后，带有工具调用的回复必须以原样的思考内容开头
+			for _, block := range msg.Thinking {
+				if block.Type == "redacted_thinking" {
+					blocks = append(blocks, map[string]any{"type": block.Type, "data": block.Data})
+				} else {
+					blocks = append(blocks, map[string]any{"type": block.Type, "thinking": block.Thinking, "signature": block.Signature})
+				}
+			}
+			if msg.Text != "" {
+				blocks = append(blocks, map[string]any{"type": "text", "text": msg.Text})
+			}
+			for _, call := range msg.ToolCalls {
+				var input map[string]any
+				_ = utils.JsonDecode(call.Function.Arguments, &input)
+				if input == nil {
+					input = map[string]any{}
+				}
+				blocks = append(blocks, map[string]any{
+					"type":  "tool_use",
+					"id":    call.Id,
+					"name":  call.Function.Name,
+					"input": input,
+				})
+			}
+		default:
+			role = "user"
+			for _, img := range msg.Images {
+				blocks = append(blocks, p.imageBlock(img))
+			}
+			if msg.Text != "" {
+				blocks = append(blocks, map[string]any{"type": "text", "text": msg.Text})
+			}
+		}
+		if len(blocks) == 0 {
+			continue
+		}
+
+		// Anthropic 要求 user 和 assistant 消息交替出现，连续的同角色消息需要合并
+		n := len(body.Messages)
+		if n > 0 && body.Messages[n-1].Role == role {
+			body.Messages[n-1].Content = append(body.Messages[n-1].Content, blocks...)
+		} else {
+			body.Messages = append(body.Messages, anthropicMessage{Role: role, Content: blocks})
+		}
+	}
+	body.System = strings.Join(systems, "\n\n")
+	return body
+}
+
+// 按照序号排列思考内容
+func sortThinkingBlocks(blocks map[int]*ThinkingBlock) []ThinkingBlock {
+	indexes := make([]int, 0, len(blocks))
+	for index := range blocks {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	result := make([]ThinkingBlock, 0, len(blocks))
+	for _, index := range indexes {
+		result = append(result, *blocks[index])
+	}
+	return result
+}
+
+func (p *anthropicProvider) imageBlock(imageURL string) map[string]any {
+	if strings.HasPrefix(imageURL, "data:") {
+		mimeType, data, err := loadImage(imageURL)
+		if err == nil {
+			return map[string]any{
+				"type":   "image",
+				"source": map[string]any{"type": "base64", "media_type": mimeType, "data": data},
+			}
+		}
+	}
+	return map[string]any{
+		"type":   "image",
+		"source": map[string]any{"type": "url", "url": imageURL},
+	}
+}
+
+// 将 Anthropic 的停止原因转换成 OpenAI 的 finish_reason
+func (p *anthropicProvider) finishReason(stopReason string) string {
+	switch stopReason {
+	case "end_turn", "stop_sequence":
+		return "stop"
+	case "max_tokens":
+		return "length"
+	case "tool_use":
+		return "tool_calls"
+	}
+	return stopReason
+}
+
+func (p *anthropicProvider) usage(u anthropicUsage) Usage {
+	// Anthropic 的 input_tokens 不包含缓存命中的部分
+	prompt := u.InputTokens + u.CacheReadInputTokens + u.CacheCreationInputTokens
+	return Usage{
+		PromptTokens:     prompt,
+		CompletionTokens: u.OutputTokens,
+		TotalTokens:      prompt + u.OutputTokens,
+		CachedTokens:     u.CacheReadInputTokens,
+	}
+}
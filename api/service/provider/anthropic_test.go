@@ -0,0 +1,215 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"geekai/core/types"
+	"geekai/store/model"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAnthropicBuildRequest(t *testing.T) {
+	p := &anthropicProvider{}
+	tests := []struct {
+		name string
+		req  types.ApiRequest
+		want string
+	}{
+		{
+			"system and consecutive messages",
+			types.ApiRequest{Model: "claude", Temperature: 1.5, Messages: []any{
+				map[string]any{"role": "system", "content": "你是助手"},
+				map[string]any{"role": "system", "content": "用中文回答"},
+				map[string]any{"role": "user", "content": "你好"},
+				map[string]any{"role": "user", "content": []any{
+					map[string]any{"type": "image_url", "image_url": map[string]any{"url": "data:image/png;base64,aGVsbG8="}},
+				}},
+				map[string]any{"role": "assistant", "content": ""},
+			}},
+			`{"model": "claude", "system": "你是助手\n\n用中文回答", "max_tokens": 4096, "temperature": 1, "messages": [
+				{"role": "user", "content": [
+					{"type": "text", "text": "你好"},
+					{"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "aGVsbG8="}}
+				]}
+			]}`,
+		},
+		{
+			"thinking and tool calls",
+			types.ApiRequest{Model: "claude", MaxTokens: 1000, ThinkingBudget: 2000, Stream: true,
+				Tools: []types.Tool{{Type: "function", Function: types.Function{Name: "weather", Description: "查天气", Parameters: map[string]any{"type": "object"}}}},
+				Messages: []any{
+					map[string]any{"role": "user", "content": "北京天气"},
+					map[string]any{
+						"role":       "assistant",
+						"content":    "我查一下",
+						"tool_calls": []any{map[string]any{"id": "toolu_1", "type": "function", "function": map[string]any{"name": "weather", "arguments": `{"city":"北京"}`}}},
+						"thinking_blocks": []any{
+							map[string]any{"type": "thinking", "thinking": "需要查天气", "signature": "sig"},
+							map[string]any{"type": "redacted_thinking", "data": "secret"},
+						},
+					},
+					map[string]any{"role": "tool", "tool_call_id": "toolu_1", "content": "晴"},
+					map[string]any{"role": "user", "content": "谢谢"},
+				}},
+			`{"model": "claude", "max_tokens": 6096, "stream": true,
+				"thinking": {"type": "enabled", "budget_tokens": 2000},
+				"tools": [{"name": "weather", "description": "查天气", "input_schema": {"type": "object"}}],
+				"tool_choice": {"type": "auto"},
+				"messages": [
+					{"role": "user", "content": [{"type": "text", "text": "北京天气"}]},
+					{"role": "assistant", "content": [
+						{"type": "thinking", "thinking": "需要查天气", "signature": "sig"},
+						{"type": "redacted_thinking", "data": "secret"},
+						{"type": "text", "text": "我查一下"},
+						{"type": "tool_use", "id": "toolu_1", "name": "weather", "input": {"city": "北京"}}
+					]},
+					{"role": "user", "content": [
+						{"type": "tool_result", "tool_use_id": "toolu_1", "content": "晴"},
+						{"type": "text", "text": "谢谢"}
+					]}
+				]}`,
+		},
+		{
+			"max completion tokens and top p",
+			types.ApiRequest{Model: "claude", MaxTokens: 100, MaxCompletionTokens: 200, Temperature: 0.5, TopP: 0.9, Messages: []any{
+				map[string]any{"role": "user", "content": "hi"},
+			}},
+			`{"model": "claude", "max_tokens": 200, "temperature": 0.5, "top_p": 0.9, "messages": [
+				{"role": "user", "content": [{"type": "text", "text": "hi"}]}
+			]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertJSON(t, p.buildRequest(tt.req), tt.want)
+		})
+	}
+}
+
+func TestAnthropicFinishReason(t *testing.T) {
+	p := &anthropicProvider{}
+	for stopReason, want := range map[string]string{
+		"end_turn":      "stop",
+		"stop_sequence": "stop",
+		"max_tokens":    "length",
+		"tool_use":      "tool_calls",
+		"refusal":       "refusal",
+	} {
+		if got := p.finishReason(stopReason); got != want {
+			t.Errorf("finishReason(%q) = %q, want %q", stopReason, got, want)
+		}
+	}
+}
+
+func TestSortThinkingBlocks(t *testing.T) {
+	got := sortThinkingBlocks(map[int]*ThinkingBlock{
+		2: {Type: "redacted_thinking", Data: "b"},
+		0: {Type: "thinking", Thinking: "a"},
+	})
+	want := []ThinkingBlock{{Type: "thinking", Thinking: "a"}, {Type: "redacted_thinking", Data: "b"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sortThinkingBlocks() = %+v, want %+v", got, want)
+	}
+}
+
+// 启动一个返回固定内容的测试服务器，并检查请求头
+func testServer(t *testing.T, path string, header string, contentType string, body string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			t.Errorf("request path = %s, want %s", r.URL.Path, path)
+		}
+		if r.Header.Get(header) != "sk-test" {
+			t.Errorf("missing %s header", header)
+		}
+		w.Header().Set("Content-Type", contentType)
+		_, _ = fmt.Fprint(w, body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestAnthropicChatStream(t *testing.T) {
+	events := []string{
+		`{"type":"message_start","message":{"usage":{"input_tokens":10,"cache_read_input_tokens":5,"output_tokens":1}}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"thinking","thinking":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"thinking_delta","thinking":"想"}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"thinking_delta","thinking":"一想"}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"signature_delta","signature":"sig"}}`,
+		`{"type":"content_block_start","index":1,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"text_delta","text":"你"}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"text_delta","text":"好"}}`,
+		`{"type":"content_block_start","index":2,"content_block":{"type":"tool_use","id":"toolu_1","name":"weather"}}`,
+		`{"type":"content_block_delta","index":2,"delta":{"type":"input_json_delta","partial_json":"{\"city\":"}}`,
+		`{"type":"content_block_delta","index":2,"delta":{"type":"input_json_delta","partial_json":"\"北京\"}"}}`,
+		`{"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":20}}`,
+		`{"type":"message_stop"}`,
+	}
+	var body strings.Builder
+	for _, event := range events {
+		body.WriteString("event: message\ndata: " + event + "\n\n")
+	}
+	server := testServer(t, "/v1/messages", "x-api-key", "text/event-stream", body.String())
+
+	deltas := make([]Delta, 0)
+	res, err := (&anthropicProvider{}).Chat(context.Background(), model.ApiKey{ApiURL: server.URL, Value: "sk-test"},
+		types.ApiRequest{Model: "claude", Stream: true, Messages: []any{map[string]any{"role": "user", "content": "hi"}}},
+		func(delta Delta) { deltas = append(deltas, delta) })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Content != "你好" || res.Reasoning != "想一想" || res.FinishReason != "tool_calls" {
+		t.Errorf("unexpected response: %+v", res)
+	}
+	if want := []ThinkingBlock{{Type: "thinking", Thinking: "想一想", Signature: "sig"}}; !reflect.DeepEqual(res.ThinkingBlocks, want) {
+		t.Errorf("ThinkingBlocks = %+v, want %+v", res.ThinkingBlocks, want)
+	}
+	if len(res.ToolCalls) != 1 || res.ToolCalls[0].Id != "toolu_1" || res.ToolCalls[0].Function.Name != "weather" ||
+		res.ToolCalls[0].Function.Arguments != `{"city":"北京"}` {
+		t.Errorf("ToolCalls = %+v", res.ToolCalls)
+	}
+	if want := (Usage{PromptTokens: 15, CompletionTokens: 20, TotalTokens: 35, CachedTokens: 5}); res.Usage != want {
+		t.Errorf("Usage = %+v, want %+v", res.Usage, want)
+	}
+	kinds := make([]DeltaType, 0, len(deltas))
+	for _, delta := range deltas {
+		kinds = append(kinds, delta.Type)
+	}
+	want := []DeltaType{DeltaReasoning, DeltaReasoning, DeltaContent, DeltaContent, DeltaToolCall}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Errorf("delta types = %v, want %v", kinds, want)
+	}
+}
+
+func TestAnthropicChat(t *testing.T) {
+	p := &anthropicProvider{}
+	req := types.ApiRequest{Model: "claude", Messages: []any{map[string]any{"role": "user", "content": "hi"}}}
+
+	server := testServer(t, "/v1/messages", "x-api-key", "application/json", `{
+		"content": [{"type": "thinking", "thinking": "想", "signature": "sig"}, {"type": "text", "text": "你好"}],
+		"stop_reason": "end_turn",
+		"usage": {"input_tokens": 3, "output_tokens": 2}
+	}`)
+	res, err := p.Chat(context.Background(), model.ApiKey{ApiURL: server.URL, Value: "sk-test"}, req, func(Delta) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Content != "你好" || res.Reasoning != "想" || res.FinishReason != "stop" || res.Usage.TotalTokens != 5 || len(res.ThinkingBlocks) != 1 {
+		t.Errorf("unexpected response: %+v", res)
+	}
+
+	errServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = fmt.Fprint(w, `{"error":"rate limited"}`)
+	}))
+	defer errServer.Close()
+	_, err = p.Chat(context.Background(), model.ApiKey{ApiURL: errServer.URL}, req, func(Delta) {})
+	apiErr, ok := err.(*ApiError)
+	if !ok || apiErr.StatusCode != http.StatusTooManyRequests || apiErr.Body != `{"error":"rate limited"}` {
+		t.Errorf("Chat() error = %v, want ApiError 429", err)
+	}
+}
@@ -0,0 +1,75 @@
+package provider
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"geekai/store/model"
+	"io"
+	"net/http"
+)
+
+// EmbeddingRequest OpenAI /v1/embeddings 请求
+type EmbeddingRequest struct {
+	Model          string `json:"model"`
+	Input          any    `json:"input"`
+	EncodingFormat string `json:"encoding_format,omitempty"`
+	Dimensions     int    `json:"dimensions,omitempty"`
+}
+
+type EmbeddingResponse struct {
+	Object string `json:"object"`
+	Data   []struct {
+		Object    string          `json:"object"`
+		Index     int             `json:"index"`
+		Embedding json.RawMessage `json:"embedding"` // 浮点数组或者 base64 字符串，由 encoding_format 决定
+	} `json:"data"`
+	Model string `json:"model"`
+	Usage struct {
+		PromptTokens int `json:"prompt_tokens"`
+		TotalTokens  int `json:"total_tokens"`
+	} `json:"usage"`
+}
+
+// CreateEmbeddings 调用 OpenAI 兼容的向量化接口
+func CreateEmbeddings(ctx context.Context, apiKey model.ApiKey, req EmbeddingRequest) (*EmbeddingResponse, error) {
+	apiURL := buildURL(apiKey.ApiURL, "/v1/embeddings")
+	requestBody, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL, bytes.NewBuffer(requestBody))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiKey.Value))
+	logger.Infof("Sending embedding request, API URL: %s, PROXY: %s, Model: %s", apiURL, apiKey.ProxyURL, req.Model)
+	response, err := newHttpClient(apiKey).Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("读取响应失败：%v", err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, &ApiError{Provider: "Embedding", StatusCode: response.StatusCode, Body: string(body)}
+	}
+
+	var res EmbeddingResponse
+	if err = json.Unmarshal(body, &res); err != nil {
+		return nil, fmt.Errorf("解析响应失败：%s", string(body))
+	}
+	return &res, nil
+}
@@ -0,0 +1,307 @@
+package provider
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"geekai/core/types"
+	"geekai/store/model"
+	"geekai/utils"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Google Gemini generateContent/streamGenerateContent 接口
+type geminiProvider struct{}
+
+type geminiPart struct {
+	Text             string                  `json:"text,omitempty"`
+	Thought          bool                    `json:"thought,omitempty"`
+	InlineData       *geminiInlineData       `json:"inlineData,omitempty"`
+	FunctionCall     *geminiFunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *geminiFunctionResponse `json:"functionResponse,omitempty"`
+}
+
+type geminiInlineData struct {
+	MimeType string `json:"mimeType"`
+	Data     string `json:"data"`
+}
+
+type geminiFunctionCall struct {
+	Id   string         `json:"id,omitempty"`
+	Name string         `json:"name"`
+	Args map[string]any `json:"args"`
+}
+
+type geminiFunctionResponse struct {
+	Id       string         `json:"id,omitempty"`
+	Name     string         `json:"name"`
+	Response map[string]any `json:"response"`
+}
+
+type geminiContent struct {
+	Role  string       `json:"role,omitempty"`
+	Parts []geminiPart `json:"parts"`
+}
+
+type geminiRequest struct {
+	Contents          []geminiContent  `json:"contents"`
+	SystemInstruction *geminiContent   `json:"systemInstruction,omitempty"`
+	Tools             []map[string]any `json:"tools,omitempty"`
+	GenerationConfig  map[string]any   `json:"generationConfig,omitempty"`
+}
+
+type geminiResponse struct {
+	Candidates []struct {
+		Content      geminiContent `json:"content"`
+		FinishReason string        `json:"finishReason"`
+	} `json:"candidates"`
+	UsageMetadata struct {
+		PromptTokenCount        int `json:"promptTokenCount"`
+		CandidatesTokenCount    int `json:"candidatesTokenCount"`
+		TotalTokenCount         int `json:"totalTokenCount"`
+		ThoughtsTokenCount      int `json:"thoughtsTokenCount"`
+		CachedContentTokenCount int `json:"cachedContentTokenCount"`
+	} `json:"usageMetadata"`
+	Error *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (p *geminiProvider) Name() string {
+	return Gemini
+}
+
+func (p *geminiProvider) Chat(ctx context.Context, apiKey model.ApiKey, req types.ApiRequest, callback func(delta Delta)) (*Response, error) {
+	body := p.buildRequest(req)
+	baseURL := strings.TrimRight(buildURL(apiKey.ApiURL, "/v1beta"), "/")
+	var apiURL string
+	if req.Stream {
+		apiURL = fmt.Sprintf("%s/models/%s:streamGenerateContent?alt=sse", baseURL, req.Model)
+	} else {
+		apiURL = fmt.Sprintf("%s/models/%s:generateContent", baseURL, req.Model)
+	}
+	requestBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL, bytes.NewBuffer(requestBody))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("x-goog-api-key", apiKey.Value)
+	logger.Infof("Sending %s request, API URL: %s, PROXY: %s, Model: %s", p.Name(), apiURL, apiKey.ProxyURL, req.Model)
+	response, err := newHttpClient(apiKey).Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(response.Body)
+		return nil, &ApiError{Provider: "Gemini", StatusCode: response.StatusCode, Body: string(data)}
+	}
+
+	result := &Response{}
+	contents := make([]string, 0)
+	reasoning := make([]string, 0)
+	// Gemini 每次都返回完整的函数调用，不需要拼接参数
+	handleChunk := func(chunk geminiResponse) error {
+		if chunk.Error != nil {
+			return fmt.Errorf("Gemini API 返回错误：%d, %s", chunk.Error.Code, chunk.Error.Message)
+		}
+		if chunk.UsageMetadata.TotalTokenCount > 0 {
+			u := chunk.UsageMetadata
+			result.Usage = Usage{
+				PromptTokens:     u.PromptTokenCount,
+				CompletionTokens: u.CandidatesTokenCount + u.ThoughtsTokenCount,
+				TotalTokens:      u.TotalTokenCount,
+				ReasoningTokens:  u.ThoughtsTokenCount,
+				CachedTokens:     u.CachedContentTokenCount,
+			}
+		}
+		if len(chunk.Candidates) == 0 {
+			return nil
+		}
+		candidate := chunk.Candidates[0]
+		if candidate.FinishReason != "" {
+			result.FinishReason = p.finishReason(candidate.FinishReason)
+		}
+		for _, part := range candidate.Content.Parts {
+			switch {
+			case part.FunctionCall != nil:
+				call := types.ToolCall{Index: len(result.ToolCalls), Id: part.FunctionCall.Id, Type: "function"}
+				if call.Id == "" {
+					call.Id = fmt.Sprintf("call_%d", call.Index)
+				}
+				call.Function.Name = part.FunctionCall.Name
+				call.Function.Arguments = utils.JsonEncode(part.FunctionCall.Args)
+				result.ToolCalls = append(result.ToolCalls, call)
+				callback(Delta{Type: DeltaToolCall, ToolCall: &call})
+			case part.Thought:
+				reasoning = append(reasoning, part.Text)
+				callback(Delta{Type: DeltaReasoning, Content: part.Text})
+			case part.Text != "":
+				contents = append(contents, part.Text)
+				callback(Delta{Type: DeltaContent, Content: part.Text})
+			}
+		}
+		return nil
+	}
+
+	if req.Stream {
+		scanner := bufio.NewScanner(response.Body)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "data:") {
+				continue
+			}
+			var chunk geminiResponse
+			if err := json.Unmarshal([]byte(strings.TrimSpace(line[5:])), &chunk); err != nil {
+				return nil, errors.New(line)
+			}
+			if err := handleChunk(chunk); err != nil {
+				return nil, err
+			}
+		}
+		// 用户主动停止的保留已经输出的内容，其他原因中断的不能当作正常结束
+		if err := scanner.Err(); err != nil && ctx.Err() == nil {
+			return nil, fmt.Errorf("读取响应数据出错：%v", err)
+		}
+	} else {
+		var chunk geminiResponse
+		data, err := io.ReadAll(response.Body)
+		if err != nil {
+			return nil, fmt.Errorf("读取响应失败：%v", err)
+		}
+		if err = json.Unmarshal(data, &chunk); err != nil {
+			return nil, fmt.Errorf("解析响应失败：%s", string(data))
+		}
+		if err = handleChunk(chunk); err != nil {
+			return nil, err
+		}
+	}
+
+	result.Content = strings.Join(contents, "")
+	result.Reasoning = strings.Join(reasoning, "")
+	if len(result.ToolCalls) > 0 {
+		result.FinishReason = "tool_calls"
+	}
+	return result, nil
+}
+
+// 将 OpenAI 格式的请求转换为 Gemini 格式
+func (p *geminiProvider) buildRequest(req types.ApiRequest) geminiRequest {
+	body := geminiRequest{Contents: make([]geminiContent, 0)}
+	config := map[string]any{"temperature": req.Temperature}
+	if tokens := maxTokens(req); tokens > 0 {
+		config["maxOutputTokens"] = tokens
+	}
+	if req.TopP > 0 {
+		config["topP"] = req.TopP
+	}
+	// Gemini 没有 response_format 参数，使用 responseMimeType 要求返回 JSON
+	if format, ok := req.ResponseFormat.(map[string]any); ok && format["type"] == "json_object" {
+		config["responseMimeType"] = "application/json"
+	}
+	if req.ThinkingBudget > 0 {
+		config["thinkingConfig"] = map[string]any{"includeThoughts": true, "thinkingBudget": req.ThinkingBudget}
+	}
+	body.GenerationConfig = config
+
+	if len(req.Tools) > 0 {
+		declarations := make([]map[string]any, 0, len(req.Tools))
+		for _, tool := range req.Tools {
+			declarations = append(declarations, map[string]any{
+				"name":        tool.Function.Name,
+				"description": tool.Function.Description,
+				"parameters":  tool.Function.Parameters,
+			})
+		}
+		body.Tools = []map[string]any{{"functionDeclarations": declarations}}
+	}
+
+	systems := make([]geminiPart, 0)
+	toolNames := make(map[string]string) // tool_call_id => 函数名称
+	for _, msg := range parseMessages(req.Messages) {
+		var content geminiContent
+		switch msg.Role {
+		case "system":
+			systems = append(systems, geminiPart{Text: msg.Text})
+			continue
+		case "tool":
+			var response map[string]any
+			if err := utils.JsonDecode(msg.Text, &response); err != nil || response == nil {
+				response = map[string]any{"result": msg.Text}
+			}
+			part := geminiPart{FunctionResponse: &geminiFunctionResponse{Name: toolNames[msg.ToolCallId], Response: response}}
+			content = geminiContent{Role: "user", Parts: []geminiPart{part}}
+		case "assistant":
+			content.Role = "model"
+			if msg.Text != "" {
+				content.Parts = append(content.Parts, geminiPart{Text: msg.Text})
+			}
+			for _, call := range msg.ToolCalls {
+				toolNames[call.Id] = call.Function.Name
+				var args map[string]any
+				_ = utils.JsonDecode(call.Function.Arguments, &args)
+				content.Parts = append(content.Parts, geminiPart{FunctionCall: &geminiFunctionCall{Name: call.Function.Name, Args: args}})
+			}
+		default:
+			content.Role = "user"
+			for _, img := range msg.Images {
+				mimeType, data, err := loadImage(img)
+				if err != nil {
+					logger.Errorf("error with load image %s: %v", img, err)
+					continue
+				}
+				content.Parts = append(content.Parts, geminiPart{InlineData: &geminiInlineData{MimeType: mimeType, Data: data}})
+			}
+			if msg.Text != "" {
+				content.Parts = append(content.Parts, geminiPart{Text: msg.Text})
+			}
+		}
+		if len(content.Parts) == 0 {
+			continue
+		}
+
+		// 连续的同角色消息合并成一条
+		n := len(body.Contents)
+		if n > 0 && body.Contents[n-1].Role == content.Role {
+			body.Contents[n-1].Parts = append(body.Contents[n-1].Parts, content.Parts...)
+		} else {
+			body.Contents = append(body.Contents, content)
+		}
+	}
+	if len(systems) > 0 {
+		body.SystemInstruction = &geminiContent{Parts: systems}
+	}
+	return body
+}
+
+// 将 Gemini 的停止原因转换成 OpenAI 的 finish_reason
+func (p *geminiProvider) finishReason(reason string) string {
+	switch reason {
+	case "STOP":
+		return "stop"
+	case "MAX_TOKENS":
+		return "length"
+	case "SAFETY", "RECITATION", "BLOCKLIST", "PROHIBITED_CONTENT", "SPII":
+		return "content_filter"
+	}
+	return strings.ToLower(reason)
+}
@@ -0,0 +1,131 @@
+package provider
+
+import (
+	"context"
+	"geekai/core/types"
+	"geekai/store/model"
+	"reflect"
+	"testing"
+)
+
+func TestGeminiBuildRequest(t *testing.T) {
+	p := &geminiProvider{}
+	tests := []struct {
+		name string
+		req  types.ApiRequest
+		want string
+	}{
+		{
+			"system, image and json output",
+			types.ApiRequest{Temperature: 0.7, MaxTokens: 100, TopP: 0.9, ResponseFormat: map[string]any{"type": "json_object"}, Messages: []any{
+				map[string]any{"role": "system", "content": "你是助手"},
+				map[string]any{"role": "user", "content": []any{
+					map[string]any{"type": "text", "text": "描述图片"},
+					map[string]any{"type": "image_url", "image_url": map[string]any{"url": "data:image/png;base64,aGVsbG8="}},
+				}},
+				map[string]any{"role": "user", "content": "用 JSON 返回"},
+			}},
+			`{
+				"systemInstruction": {"parts": [{"text": "你是助手"}]},
+				"generationConfig": {"temperature": 0.7, "maxOutputTokens": 100, "topP": 0.9, "responseMimeType": "application/json"},
+				"contents": [{"role": "user", "parts": [
+					{"inlineData": {"mimeType": "image/png", "data": "aGVsbG8="}},
+					{"text": "描述图片"},
+					{"text": "用 JSON 返回"}
+				]}]
+			}`,
+		},
+		{
+			"thinking and tool calls",
+			types.ApiRequest{ThinkingBudget: 1024,
+				Tools: []types.Tool{{Type: "function", Function: types.Function{Name: "weather", Description: "查天气", Parameters: map[string]any{"type": "object"}}}},
+				Messages: []any{
+					map[string]any{"role": "user", "content": "北京天气"},
+					map[string]any{"role": "assistant", "content": nil,
+						"tool_calls": []any{map[string]any{"id": "call_0", "type": "function", "function": map[string]any{"name": "weather", "arguments": `{"city":"北京"}`}}}},
+					map[string]any{"role": "tool", "tool_call_id": "call_0", "content": `{"weather":"晴"}`},
+					map[string]any{"role": "tool", "tool_call_id": "call_0", "content": "纯文本结果"},
+				}},
+			`{
+				"generationConfig": {"temperature": 0, "thinkingConfig": {"includeThoughts": true, "thinkingBudget": 1024}},
+				"tools": [{"functionDeclarations": [{"name": "weather", "description": "查天气", "parameters": {"type": "object"}}]}],
+				"contents": [
+					{"role": "user", "parts": [{"text": "北京天气"}]},
+					{"role": "model", "parts": [{"functionCall": {"name": "weather", "args": {"city": "北京"}}}]},
+					{"role": "user", "parts": [
+						{"functionResponse": {"name": "weather", "response": {"weather": "晴"}}},
+						{"functionResponse": {"name": "weather", "response": {"result": "纯文本结果"}}}
+					]}
+				]
+			}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertJSON(t, p.buildRequest(tt.req), tt.want)
+		})
+	}
+}
+
+func TestGeminiFinishReason(t *testing.T) {
+	p := &geminiProvider{}
+	for reason, want := range map[string]string{
+		"STOP":       "stop",
+		"MAX_TOKENS": "length",
+		"SAFETY":     "content_filter",
+		"RECITATION": "content_filter",
+		"OTHER":      "other",
+	} {
+		if got := p.finishReason(reason); got != want {
+			t.Errorf("finishReason(%q) = %q, want %q", reason, got, want)
+		}
+	}
+}
+
+func TestGeminiChatStream(t *testing.T) {
+	body := `data: {"candidates":[{"content":{"role":"model","parts":[{"text":"想一想","thought":true}]}}]}
+
+data: {"candidates":[{"content":{"role":"model","parts":[{"text":"你"}]}}]}
+
+data: {"candidates":[{"content":{"role":"model","parts":[{"text":"好"},{"functionCall":{"name":"weather","args":{"city":"北京"}}}]},"finishReason":"STOP"}],"usageMetadata":{"promptTokenCount":10,"candidatesTokenCount":5,"thoughtsTokenCount":3,"totalTokenCount":18,"cachedContentTokenCount":4}}
+
+`
+	server := testServer(t, "/v1beta/models/gemini-pro:streamGenerateContent", "x-goog-api-key", "text/event-stream", body)
+
+	deltas := make([]Delta, 0)
+	res, err := (&geminiProvider{}).Chat(context.Background(), model.ApiKey{ApiURL: server.URL, Value: "sk-test"},
+		types.ApiRequest{Model: "gemini-pro", Stream: true, Messages: []any{map[string]any{"role": "user", "content": "hi"}}},
+		func(delta Delta) { deltas = append(deltas, delta) })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Content != "你好" || res.Reasoning != "想一想" || res.FinishReason != "tool_calls" {
+		t.Errorf("unexpected response: %+v", res)
+	}
+	if len(res.ToolCalls) != 1 || res.ToolCalls[0].Id != "call_0" || res.ToolCalls[0].Function.Name != "weather" ||
+		res.ToolCalls[0].Function.Arguments != `{"city":"北京"}` {
+		t.Errorf("ToolCalls = %+v", res.ToolCalls)
+	}
+	if want := (Usage{PromptTokens: 10, CompletionTokens: 8, TotalTokens: 18, ReasoningTokens: 3, CachedTokens: 4}); res.Usage != want {
+		t.Errorf("Usage = %+v, want %+v", res.Usage, want)
+	}
+	kinds := make([]DeltaType, 0, len(deltas))
+	for _, delta := range deltas {
+		kinds = append(kinds, delta.Type)
+	}
+	want := []DeltaType{DeltaReasoning, DeltaContent, DeltaContent, DeltaToolCall}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Errorf("delta types = %v, want %v", kinds, want)
+	}
+}
+
+func TestGeminiChatError(t *testing.T) {
+	server := testServer(t, "/v1beta/models/gemini-pro:streamGenerateContent", "x-goog-api-key", "text/event-stream",
+		"data: {\"error\":{\"code\":500,\"message\":\"internal\"}}\n\n")
+	_, err := (&geminiProvider{}).Chat(context.Background(), model.ApiKey{ApiURL: server.URL, Value: "sk-test"},
+		types.ApiRequest{Model: "gemini-pro", Stream: true}, func(Delta) {})
+	if err == nil {
+		t.Error("Chat() should return the error in the stream")
+	}
+}
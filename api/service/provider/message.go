@@ -0,0 +1,108 @@
+package provider
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"geekai/core/types"
+	"geekai/utils"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// 统一格式的对话消息，由 ApiRequest.Messages 中各种形式的消息转换而来
+type chatMessage struct {
+	Role       string
+	Text       string
+	Images     []string // 图片地址，可能是 http 链接或者 data URI
+	ToolCalls  []types.ToolCall
+	ToolCallId string
+	Thinking   []ThinkingBlock // assistant 消息的思考内容，只有 Anthropic 会用到
+}
+
+type contentPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text"`
+	ImageURL struct {
+		URL string `json:"url"`
+	} `json:"image_url"`
+}
+
+// 解析 OpenAI 格式的消息列表
+func parseMessages(messages []any) []chatMessage {
+	var items []struct {
+		Role           string           `json:"role"`
+		Content        any              `json:"content"`
+		ToolCalls      []types.ToolCall `json:"tool_calls"`
+		ToolCallId     string           `json:"tool_call_id"`
+		ThinkingBlocks []ThinkingBlock  `json:"thinking_blocks"`
+	}
+	if err := utils.JsonDecode(utils.JsonEncode(messages), &items); err != nil {
+		logger.Error("error with decode messages: ", err)
+		return nil
+	}
+
+	result := make([]chatMessage, 0, len(items))
+	for _, item := range items {
+		msg := chatMessage{Role: item.Role, ToolCalls: item.ToolCalls, ToolCallId: item.ToolCallId, Thinking: item.ThinkingBlocks}
+		switch content := item.Content.(type) {
+		case string:
+			msg.Text = content
+		case []any:
+			var parts []contentPart
+			_ = utils.JsonDecode(utils.JsonEncode(content), &parts)
+			texts := make([]string, 0)
+			for _, part := range parts {
+				switch part.Type {
+				case "text":
+					texts = append(texts, part.Text)
+				case "image_url":
+					msg.Images = append(msg.Images, part.ImageURL.URL)
+				}
+			}
+			msg.Text = strings.Join(texts, "\n")
+		}
+		result = append(result, msg)
+	}
+	return result
+}
+
+// 读取图片数据，返回 MIME 类型和 base64 编码后的内容
+func loadImage(imageURL string) (string, string, error) {
+	// data:image/png;base64,xxxx
+	if strings.HasPrefix(imageURL, "data:") {
+		meta, data, found := strings.Cut(imageURL[5:], ",")
+		if !found {
+			return "", "", errors.New("invalid data uri")
+		}
+		return strings.TrimSuffix(meta, ";base64"), data, nil
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	r, err := client.Get(imageURL)
+	if err != nil {
+		return "", "", err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("download image failed: %s", r.Status)
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return "", "", err
+	}
+	mimeType := r.Header.Get("Content-Type")
+	if !strings.HasPrefix(mimeType, "image/") {
+		mimeType = http.DetectContentType(data)
+	}
+	return mimeType, base64.StdEncoding.EncodeToString(data), nil
+}
@@ -0,0 +1,102 @@
+package provider
+
+import (
+	"encoding/json"
+	"geekai/core/types"
+	"geekai/utils"
+	"reflect"
+	"testing"
+)
+
+func TestParseMessages(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []any
+		want     []chatMessage
+	}{
+		{
+			"plain text",
+			[]any{map[string]any{"role": "user", "content": "你好"}},
+			[]chatMessage{{Role: "user", Text: "你好"}},
+		},
+		{
+			"content parts",
+			[]any{map[string]any{"role": "user", "content": []any{
+				map[string]any{"type": "text", "text": "描述一下"},
+				map[string]any{"type": "image_url", "image_url": map[string]any{"url": "https://example.com/a.png"}},
+				map[string]any{"type": "text", "text": "这张图片"},
+			}}},
+			[]chatMessage{{Role: "user", Text: "描述一下\n这张图片", Images: []string{"https://example.com/a.png"}}},
+		},
+		{
+			"tool call and result",
+			[]any{
+				map[string]any{
+					"role":            "assistant",
+					"content":         nil,
+					"tool_calls":      []any{map[string]any{"id": "call_1", "type": "function", "function": map[string]any{"name": "weather", "arguments": `{"city":"北京"}`}}},
+					"thinking_blocks": []any{map[string]any{"type": "thinking", "thinking": "查天气", "signature": "sig"}},
+				},
+				map[string]any{"role": "tool", "tool_call_id": "call_1", "content": "晴"},
+			},
+			[]chatMessage{
+				{Role: "assistant", ToolCalls: toolCalls("call_1", "weather", `{"city":"北京"}`), Thinking: []ThinkingBlock{{Type: "thinking", Thinking: "查天气", Signature: "sig"}}},
+				{Role: "tool", Text: "晴", ToolCallId: "call_1"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseMessages(tt.messages); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseMessages() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadImage(t *testing.T) {
+	mimeType, data, err := loadImage("data:image/png;base64,aGVsbG8=")
+	if err != nil || mimeType != "image/png" || data != "aGVsbG8=" {
+		t.Errorf("loadImage() = (%q, %q, %v)", mimeType, data, err)
+	}
+	if _, _, err = loadImage("data:image/png;base64"); err == nil {
+		t.Error("loadImage() should fail on an invalid data uri")
+	}
+}
+
+func TestBuildURL(t *testing.T) {
+	tests := []struct {
+		apiURL, want string
+	}{
+		{"https://api.anthropic.com", "https://api.anthropic.com/v1/messages"},
+		{"https://api.anthropic.com/", "https://api.anthropic.com/v1/messages"},
+		{"https://proxy.example.com/anthropic/v1/messages", "https://proxy.example.com/anthropic/v1/messages"},
+	}
+	for _, tt := range tests {
+		if got := buildURL(tt.apiURL, "/v1/messages"); got != tt.want {
+			t.Errorf("buildURL(%q) = %q, want %q", tt.apiURL, got, tt.want)
+		}
+	}
+}
+
+func toolCalls(id, name, arguments string) []types.ToolCall {
+	call := types.ToolCall{Id: id, Type: "function"}
+	call.Function.Name = name
+	call.Function.Arguments = arguments
+	return []types.ToolCall{call}
+}
+
+// 比较两个值序列化之后的 JSON 是否相同
+func assertJSON(t *testing.T, got any, want string) {
+	t.Helper()
+	var g, w any
+	if err := json.Unmarshal([]byte(utils.JsonEncode(got)), &g); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(g, w) {
+		t.Errorf("got %s, want %s", utils.JsonEncode(got), want)
+	}
+}
@@ -0,0 +1,259 @@
+package provider
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"geekai/core/types"
+	"geekai/store/model"
+	"geekai/utils"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// OpenAI /v1/chat/completions 接口，同时兼容各种 OpenAI 格式的中转平台
+type openAIProvider struct{}
+
+type openAIResponse struct {
+	Choices []struct {
+		Message struct {
+			Role             string           `json:"role"`
+			Content          string           `json:"content"`
+			ReasoningContent string           `json:"reasoning_content"`
+			ToolCalls        []types.ToolCall `json:"tool_calls"`
+		} `json:"message"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *openAIUsage `json:"usage"`
+}
+
+// OpenAI 格式的 token 用量，兼容各家的扩展字段
+type openAIUsage struct {
+	PromptTokens        int `json:"prompt_tokens"`
+	CompletionTokens    int `json:"completion_tokens"`
+	TotalTokens         int `json:"total_tokens"`
+	PromptTokensDetails struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"prompt_tokens_details"`
+	CompletionTokensDetails struct {
+		ReasoningTokens int `json:"reasoning_tokens"`
+	} `json:"completion_tokens_details"`
+	CachedTokens         int `json:"cached_tokens"`           // Moonshot
+	PromptCacheHitTokens int `json:"prompt_cache_hit_tokens"` // DeepSeek
+}
+
+// 流式输出的用量数据块，大部分平台放在最后一个 choices 为空的数据块中，Moonshot 放在 choices 里面
+type openAIUsageChunk struct {
+	Choices []struct {
+		Usage *openAIUsage `json:"usage"`
+	} `json:"choices"`
+	Usage *openAIUsage `json:"usage"`
+}
+
+func (u *openAIUsage) toUsage() Usage {
+	usage := Usage{
+		PromptTokens:     u.PromptTokens,
+		CompletionTokens: u.CompletionTokens,
+		TotalTokens:      u.TotalTokens,
+		ReasoningTokens:  u.CompletionTokensDetails.ReasoningTokens,
+		CachedTokens:     max(u.PromptTokensDetails.CachedTokens, u.CachedTokens, u.PromptCacheHitTokens),
+	}
+	if usage.TotalTokens == 0 {
+		usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	}
+	return usage
+}
+
+// 思考内容是 Anthropic 的私有字段，切换到 OpenAI 格式的渠道时要去掉
+func stripThinkingBlocks(messages []any) []any {
+	result := make([]any, 0, len(messages))
+	for _, message := range messages {
+		if m, ok := message.(map[string]any); ok && m["thinking_blocks"] != nil {
+			copied := make(map[string]any, len(m))
+			for k, v := range m {
+				if k != "thinking_blocks" {
+					copied[k] = v
+				}
+			}
+			message = copied
+		}
+		result = append(result, message)
+	}
+	return result
+}
+
+func (p *openAIProvider) Name() string {
+	return OpenAI
+}
+
+func (p *openAIProvider) Chat(ctx context.Context, apiKey model.ApiKey, req types.ApiRequest, callback func(delta Delta)) (*Response, error) {
+	apiURL := buildURL(apiKey.ApiURL, "/v1/chat/completions")
+	// 流式输出默认要求返回 token 用量
+	if req.Stream && req.StreamOptions == nil {
+		req.StreamOptions = &types.StreamOptions{IncludeUsage: true}
+	}
+	req.Messages = stripThinkingBlocks(req.Messages)
+	requestBody, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL, bytes.NewBuffer(requestBody))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiKey.Value))
+	logger.Infof("Sending %s request, API URL: %s, PROXY: %s, Model: %s", p.Name(), apiURL, apiKey.ProxyURL, req.Model)
+	response, err := newHttpClient(apiKey).Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(response.Body)
+		return nil, &ApiError{Provider: "OpenAI", StatusCode: response.StatusCode, Body: string(body)}
+	}
+
+	if !strings.Contains(response.Header.Get("Content-Type"), "text/event-stream") {
+		var res openAIResponse
+		body, err := io.ReadAll(response.Body)
+		if err != nil {
+			return nil, fmt.Errorf("读取响应失败：%v", err)
+		}
+		err = json.Unmarshal(body, &res)
+		if err != nil || len(res.Choices) == 0 {
+			return nil, fmt.Errorf("解析响应失败：%s", string(body))
+		}
+		message := res.Choices[0].Message
+		if message.ReasoningContent != "" {
+			callback(Delta{Type: DeltaReasoning, Content: message.ReasoningContent})
+		}
+		if message.Content != "" {
+			callback(Delta{Type: DeltaContent, Content: message.Content})
+		}
+		result := &Response{
+			Content:      message.Content,
+			Reasoning:    message.ReasoningContent,
+			ToolCalls:    message.ToolCalls,
+			FinishReason: res.Choices[0].FinishReason,
+		}
+		if res.Usage != nil {
+			result.Usage = res.Usage.toUsage()
+		}
+		return result, nil
+	}
+
+	result := &Response{}
+	contents := make([]string, 0)
+	reasoning := make([]string, 0)
+	toolCalls := make(map[int]*types.ToolCall)
+	scanner := bufio.NewScanner(response.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		data := strings.TrimSpace(line[5:])
+		if data == "[DONE]" {
+			break
+		}
+		var chunk types.ApiResponse
+		err = json.Unmarshal([]byte(data), &chunk)
+		if err != nil { // 数据解析出错
+			return nil, errors.New(line)
+		}
+		if strings.Contains(data, `"usage"`) {
+			var usageChunk openAIUsageChunk
+			if json.Unmarshal([]byte(data), &usageChunk) == nil {
+				if usageChunk.Usage != nil {
+					result.Usage = usageChunk.Usage.toUsage()
+				} else if len(usageChunk.Choices) > 0 && usageChunk.Choices[0].Usage != nil {
+					result.Usage = usageChunk.Choices[0].Usage.toUsage()
+				}
+			}
+		}
+		if len(chunk.Choices) == 0 { // Fixed: 兼容 Azure API 第一个输出空行
+			continue
+		}
+
+		choice := chunk.Choices[0]
+		if choice.FinishReason != "" {
+			result.FinishReason = choice.FinishReason
+		}
+
+		for _, tool := range choice.Delta.ToolCalls {
+			call, ok := toolCalls[tool.Index]
+			if !ok {
+				call = &types.ToolCall{Index: tool.Index, Id: tool.Id, Type: "function"}
+				toolCalls[tool.Index] = call
+			}
+			if tool.Function.Name != "" {
+				call.Function.Name = tool.Function.Name
+				callback(Delta{Type: DeltaToolCall, ToolCall: call})
+			}
+			call.Function.Arguments += tool.Function.Arguments
+		}
+
+		// 兼容 Function Call
+		fun := choice.Delta.FunctionCall
+		if fun.Name != "" || fun.Arguments != "" {
+			call, ok := toolCalls[0]
+			if !ok {
+				call = &types.ToolCall{Type: "function"}
+				toolCalls[0] = call
+			}
+			if fun.Name != "" {
+				call.Function.Name = fun.Name
+				callback(Delta{Type: DeltaToolCall, ToolCall: call})
+			}
+			call.Function.Arguments += fun.Arguments
+		}
+
+		if choice.Delta.ReasoningContent != "" {
+			reasoning = append(reasoning, choice.Delta.ReasoningContent)
+			callback(Delta{Type: DeltaReasoning, Content: choice.Delta.ReasoningContent})
+		}
+		if content := utils.InterfaceToString(choice.Delta.Content); choice.Delta.Content != nil && content != "" {
+			contents = append(contents, content)
+			callback(Delta{Type: DeltaContent, Content: content})
+		}
+	}
+
+	// 用户主动停止的保留已经输出的内容，其他原因中断的不能当作正常结束
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		return nil, fmt.Errorf("读取响应数据出错：%v", err)
+	}
+
+	result.Content = strings.Join(contents, "")
+	result.Reasoning = strings.Join(reasoning, "")
+	result.ToolCalls = sortToolCalls(toolCalls)
+	return result, nil
+}
+
+// 按照序号排列工具调用
+func sortToolCalls(calls map[int]*types.ToolCall) []types.ToolCall {
+	indexes := make([]int, 0, len(calls))
+	for index := range calls {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	result := make([]types.ToolCall, 0, len(calls))
+	for _, index := range indexes {
+		result = append(result, *calls[index])
+	}
+	return result
+}
@@ -0,0 +1,156 @@
+package provider
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"context"
+	"fmt"
+	"geekai/core/types"
+	logger2 "geekai/logger"
+	"geekai/store/model"
+	"geekai/utils"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var logger = logger2.GetLogger()
+
+// 支持的大模型服务商
+const (
+	OpenAI    = "openai"
+	Anthropic = "anthropic"
+	Gemini    = "gemini"
+)
+
+type DeltaType string
+
+const (
+	DeltaContent   = DeltaType("content")   // 回复内容
+	DeltaReasoning = DeltaType("reasoning") // 思考过程
+	DeltaToolCall  = DeltaType("tool_call") // 开始调用工具
+)
+
+// Delta 流式输出的增量片段
+type Delta struct {
+	Type     DeltaType
+	Content  string
+	ToolCall *types.ToolCall
+}
+
+// Usage 服务商返回的 token 用量
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+	ReasoningTokens  int `json:"reasoning_tokens"`
+	CachedTokens     int `json:"cached_tokens"`
+}
+
+// ThinkingBlock 带签名的思考内容。Anthropic 开启思考模式之后，工具调用的下一轮请求需要把思考内容原样带回去
+type ThinkingBlock struct {
+	Type      string `json:"type"` // thinking, redacted_thinking
+	Thinking  string `json:"thinking,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	Data      string `json:"data,omitempty"` // 加密的思考内容
+}
+
+// Response 一次对话请求的完整结果
+type Response struct {
+	Content        string
+	Reasoning      string
+	ThinkingBlocks []ThinkingBlock
+	ToolCalls      []types.ToolCall
+	FinishReason   string
+	Usage          Usage
+}
+
+// Provider 大模型服务商适配器，负责将 OpenAI 格式的请求转换为服务商的原生接口
+type Provider interface {
+	Name() string
+	// Chat 发送对话请求，流式输出时每收到一个增量片段都会调用 callback
+	Chat(ctx context.Context, apiKey model.ApiKey, req types.ApiRequest, callback func(delta Delta)) (*Response, error)
+}
+
+// ApiError 服务商接口返回的错误
+type ApiError struct {
+	Provider   string
+	StatusCode int
+	Body       string
+}
+
+func (e *ApiError) Error() string {
+	return fmt.Sprintf("请求 %s API 失败：%d, %s", e.Provider, e.StatusCode, e.Body)
+}
+
+var providers = map[string]Provider{
+	OpenAI:    &openAIProvider{},
+	Anthropic: &anthropicProvider{},
+	Gemini:    &geminiProvider{},
+}
+
+// GetProvider 根据名称获取服务商适配器，未知的服务商一律按 OpenAI 兼容接口处理
+func GetProvider(name string) Provider {
+	if p, ok := providers[strings.ToLower(name)]; ok {
+		return p
+	}
+	return providers[OpenAI]
+}
+
+// Resolve 确定一次对话请求使用的服务商
+// 优先级：模型选项中的 provider > API KEY 上配置的服务商 > 根据 API 地址推断
+func Resolve(apiKey model.ApiKey, chatModel model.ChatModel) Provider {
+	var options map[string]string
+	if err := utils.JsonDecode(chatModel.Options, &options); err == nil && options["provider"] != "" {
+		return GetProvider(options["provider"])
+	}
+	if apiKey.Provider != "" {
+		return GetProvider(apiKey.Provider)
+	}
+
+	u, err := url.Parse(apiKey.ApiURL)
+	if err == nil {
+		switch {
+		case strings.HasSuffix(u.Host, "anthropic.com"):
+			return providers[Anthropic]
+		case strings.HasSuffix(u.Host, "generativelanguage.googleapis.com"):
+			return providers[Gemini]
+		}
+	}
+	return providers[OpenAI]
+}
+
+// 创建 HttpClient，如果 API KEY 配置了代理则走代理
+func newHttpClient(apiKey model.ApiKey) *http.Client {
+	if len(apiKey.ProxyURL) > 5 {
+		proxy, _ := url.Parse(apiKey.ProxyURL)
+		return &http.Client{
+			Transport: &http.Transport{
+				Proxy: http.ProxyURL(proxy),
+			},
+		}
+	}
+	return http.DefaultClient
+}
+
+// 拼接接口地址，如果设置的是 BASE_URL 没有路径，则添加默认路径
+func buildURL(apiURL string, defaultPath string) string {
+	p, err := url.Parse(apiURL)
+	if err == nil && (p.Path == "" || p.Path == "/") {
+		return strings.TrimRight(apiURL, "/") + defaultPath
+	}
+	return apiURL
+}
+
+// 请求参数中的最大输出长度，兼容 O1 模型的 max_completion_tokens
+func maxTokens(req types.ApiRequest) int {
+	if req.MaxCompletionTokens > 0 {
+		return req.MaxCompletionTokens
+	}
+	return req.MaxTokens
+}
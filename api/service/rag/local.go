@@ -0,0 +1,111 @@
+package rag
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"context"
+	"geekai/store/model"
+	"sort"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// LocalStore 本地向量存储，向量保存在分段表中，检索时加载整个知识库的向量到内存中计算相似度。
+// 适合几十万个分段以内的知识库，更大的知识库请使用外部的向量数据库
+type LocalStore struct {
+	db    *gorm.DB
+	lock  sync.RWMutex
+	cache map[uint]localCache // 知识库 ID => 向量
+}
+
+type localCache struct {
+	points   []Point
+	loadedAt time.Time
+}
+
+// 多实例部署时其他实例更新了知识库，缓存过期之后才能检索到
+const localCacheTTL = 5 * time.Minute
+
+func NewLocalStore(db *gorm.DB) *LocalStore {
+	return &LocalStore{db: db, cache: make(map[uint]localCache)}
+}
+
+func (s *LocalStore) Upsert(ctx context.Context, kbId uint, points []Point) error {
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, p := range points {
+			err := tx.Model(&model.KnowledgeChunk{}).Where("id", p.ChunkId).UpdateColumn("embedding", encodeVector(p.Vector)).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	s.evict(kbId)
+	return err
+}
+
+func (s *LocalStore) DeleteDoc(ctx context.Context, kbId uint, docId uint) error {
+	// 分段删除的时候向量跟着删除了，这里只需要清理缓存
+	s.evict(kbId)
+	return nil
+}
+
+func (s *LocalStore) DeleteKb(ctx context.Context, kbId uint) error {
+	s.evict(kbId)
+	return nil
+}
+
+func (s *LocalStore) Search(ctx context.Context, kbId uint, vector []float32, topK int) ([]Match, error) {
+	points, err := s.load(ctx, kbId)
+	if err != nil {
+		return nil, err
+	}
+	matches := make([]Match, 0, len(points))
+	for _, p := range points {
+		matches = append(matches, Match{ChunkId: p.ChunkId, Score: cosine(vector, p.Vector)})
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].Score > matches[j].Score
+	})
+	return matches[:min(topK, len(matches))], nil
+}
+
+func (s *LocalStore) load(ctx context.Context, kbId uint) ([]Point, error) {
+	s.lock.RLock()
+	cache, ok := s.cache[kbId]
+	s.lock.RUnlock()
+	if ok && time.Since(cache.loadedAt) < localCacheTTL {
+		return cache.points, nil
+	}
+
+	points := make([]Point, 0)
+	var chunks []model.KnowledgeChunk
+	err := s.db.WithContext(ctx).Select("id", "doc_id", "embedding").
+		Where("kb_id", kbId).Where("embedding IS NOT NULL").
+		FindInBatches(&chunks, 1000, func(tx *gorm.DB, batch int) error {
+			for _, chunk := range chunks {
+				points = append(points, Point{ChunkId: chunk.Id, DocId: chunk.DocId, Vector: decodeVector(chunk.Embedding)})
+			}
+			return nil
+		}).Error
+	if err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	s.cache[kbId] = localCache{points: points, loadedAt: time.Now()}
+	s.lock.Unlock()
+	return points, nil
+}
+
+func (s *LocalStore) evict(kbId uint) {
+	s.lock.Lock()
+	delete(s.cache, kbId)
+	s.lock.Unlock()
+}
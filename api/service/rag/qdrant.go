@@ -0,0 +1,150 @@
+package rag
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"geekai/core/types"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// QdrantStore Qdrant 向量数据库，每个知识库一个集合，集合在第一次写入向量的时候创建
+type QdrantStore struct {
+	url    string
+	apiKey string
+	client *http.Client
+}
+
+func NewQdrantStore(config types.QdrantConfig) *QdrantStore {
+	return &QdrantStore{
+		url:    strings.TrimRight(config.URL, "/"),
+		apiKey: config.ApiKey,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (s *QdrantStore) collection(kbId uint) string {
+	return fmt.Sprintf("geekai_kb_%d", kbId)
+}
+
+func (s *QdrantStore) Upsert(ctx context.Context, kbId uint, points []Point) error {
+	if len(points) == 0 {
+		return nil
+	}
+	name := s.collection(kbId)
+	status, err := s.do(ctx, http.MethodGet, "/collections/"+name, nil, nil)
+	if status == http.StatusNotFound {
+		_, err = s.do(ctx, http.MethodPut, "/collections/"+name, map[string]any{
+			"vectors": map[string]any{"size": len(points[0].Vector), "distance": "Cosine"},
+		}, nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	items := make([]map[string]any, 0, len(points))
+	for _, p := range points {
+		items = append(items, map[string]any{
+			"id":      p.ChunkId,
+			"vector":  p.Vector,
+			"payload": map[string]any{"doc_id": p.DocId},
+		})
+	}
+	_, err = s.do(ctx, http.MethodPut, "/collections/"+name+"/points?wait=true", map[string]any{"points": items}, nil)
+	return err
+}
+
+func (s *QdrantStore) DeleteDoc(ctx context.Context, kbId uint, docId uint) error {
+	status, err := s.do(ctx, http.MethodPost, "/collections/"+s.collection(kbId)+"/points/delete?wait=true", map[string]any{
+		"filter": map[string]any{
+			"must": []map[string]any{{"key": "doc_id", "match": map[string]any{"value": docId}}},
+		},
+	}, nil)
+	if status == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+func (s *QdrantStore) DeleteKb(ctx context.Context, kbId uint) error {
+	status, err := s.do(ctx, http.MethodDelete, "/collections/"+s.collection(kbId), nil, nil)
+	if status == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+func (s *QdrantStore) Search(ctx context.Context, kbId uint, vector []float32, topK int) ([]Match, error) {
+	var res struct {
+		Result []struct {
+			Id    uint    `json:"id"`
+			Score float64 `json:"score"`
+		} `json:"result"`
+	}
+	status, err := s.do(ctx, http.MethodPost, "/collections/"+s.collection(kbId)+"/points/search", map[string]any{
+		"vector": vector,
+		"limit":  topK,
+	}, &res)
+	// 还没有上传文档的知识库
+	if status == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	matches := make([]Match, 0, len(res.Result))
+	for _, v := range res.Result {
+		matches = append(matches, Match{ChunkId: v.Id, Score: v.Score})
+	}
+	return matches, nil
+}
+
+// 调用 Qdrant REST 接口，返回 HTTP 状态码
+func (s *QdrantStore) do(ctx context.Context, method string, path string, body any, result any) (int, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, s.url+path, reader)
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if s.apiKey != "" {
+		request.Header.Set("api-key", s.apiKey)
+	}
+	response, err := s.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return response.StatusCode, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return response.StatusCode, fmt.Errorf("Qdrant 请求失败，状态码：%d，%s", response.StatusCode, string(data))
+	}
+	if result != nil {
+		if err = json.Unmarshal(data, result); err != nil {
+			return response.StatusCode, fmt.Errorf("解析 Qdrant 响应失败：%v", err)
+		}
+	}
+	return response.StatusCode, nil
+}
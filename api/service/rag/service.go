@@ -0,0 +1,439 @@
+package rag
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"geekai/core/types"
+	logger2 "geekai/logger"
+	"geekai/service"
+	"geekai/service/oss"
+	"geekai/service/provider"
+	"geekai/store/model"
+	"geekai/utils"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var logger = logger2.GetLogger()
+
+const (
+	DocPending    = "pending"
+	DocProcessing = "processing"
+	DocDone       = "done"
+	DocFailed     = "failed"
+)
+
+const (
+	defaultChunkSize = 500
+	embedBatchSize   = 32               // 每次向量化请求的分段数量
+	processTimeout   = 30 * time.Minute // 单个文档的处理超时时间，超时的文档重启之后重新处理
+	workerNum        = 2                // 同时处理的文档数量
+)
+
+// Service 知识库服务，负责文档的切分、向量化以及检索
+type Service struct {
+	db             *gorm.DB
+	config         *types.AppConfig
+	apiKeyService  *service.ApiKeyService
+	userService    *service.UserService
+	licenseService *service.LicenseService
+	store          VectorStore
+	queue          chan uint
+}
+
+func NewService(config *types.AppConfig, db *gorm.DB, apiKeyService *service.ApiKeyService, userService *service.UserService, licenseService *service.LicenseService) *Service {
+	var store VectorStore
+	switch config.VectorStore.Active {
+	case Qdrant:
+		store = NewQdrantStore(config.VectorStore.Qdrant)
+	default:
+		store = NewLocalStore(db)
+	}
+	return &Service{
+		db:             db,
+		config:         config,
+		apiKeyService:  apiKeyService,
+		userService:    userService,
+		licenseService: licenseService,
+		store:          store,
+		queue:          make(chan uint, 1000),
+	}
+}
+
+// Run 启动文档处理协程，并把上次没有处理完的文档重新加入队列
+func (s *Service) Run() {
+	for i := 0; i < workerNum; i++ {
+		go func() {
+			for docId := range s.queue {
+				if err := s.process(docId); err != nil {
+					logger.Errorf("处理知识库文档 %d 失败：%v", docId, err)
+					s.db.Model(&model.KnowledgeDoc{}).Where("id", docId).UpdateColumns(map[string]any{
+						"status":  DocFailed,
+						"err_msg": utils.CutWords(err.Error(), 1000),
+					})
+				}
+			}
+		}()
+	}
+
+	s.db.Model(&model.KnowledgeDoc{}).Where("status", DocProcessing).
+		Where("updated_at < ?", time.Now().Add(-processTimeout)).UpdateColumn("status", DocPending)
+	var ids []uint
+	s.db.Model(&model.KnowledgeDoc{}).Where("status", DocPending).Pluck("id", &ids)
+	go func() {
+		for _, id := range ids {
+			s.queue <- id
+		}
+	}()
+}
+
+// Enqueue 把文档加入处理队列
+func (s *Service) Enqueue(docId uint) {
+	go func() {
+		s.queue <- docId
+	}()
+}
+
+// 处理文档：提取文本内容，切分成分段，向量化之后写入向量存储
+func (s *Service) process(docId uint) error {
+	// 多实例部署时只有一个实例能抢到文档
+	res := s.db.Model(&model.KnowledgeDoc{}).Where("id", docId).Where("status", DocPending).
+		UpdateColumns(map[string]any{"status": DocProcessing, "updated_at": time.Now()})
+	if res.Error != nil || res.RowsAffected == 0 {
+		return res.Error
+	}
+
+	var doc model.KnowledgeDoc
+	if err := s.db.Where("id", docId).First(&doc).Error; err != nil {
+		return err
+	}
+	var kb model.KnowledgeBase
+	if err := s.db.Where("id", doc.KbId).First(&kb).Error; err != nil {
+		return errors.New("知识库不存在")
+	}
+	embedModel, err := s.embedModel(kb.ModelId)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), processTimeout)
+	defer cancel()
+	content, err := utils.ReadFileContent(doc.URL, s.config.TikaHost)
+	if err != nil {
+		return fmt.Errorf("读取文档内容失败：%v", err)
+	}
+	texts := SplitText(content, kb.ChunkSize, kb.ChunkOverlap)
+	if len(texts) == 0 {
+		return errors.New("文档内容为空")
+	}
+	chunkTokens := make([]int, len(texts))
+	estimated := 0
+	for i, text := range texts {
+		chunkTokens[i], _ = utils.CalcTokens(text, embedModel.Value)
+		estimated += chunkTokens[i]
+	}
+
+	// 用户自己的知识库向量化之前先按照分段的 token 数量预估算力，算力不足的不处理
+	if doc.UserId > 0 {
+		var user model.User
+		if err = s.db.Select("power").Where("id", doc.UserId).First(&user).Error; err != nil {
+			return errors.New("用户不存在")
+		}
+		if power := service.EstimateChatPower(embedModel, estimated); user.Power < power {
+			return fmt.Errorf("算力不足，向量化这个文档预计需要 %d 算力，当前剩余 %d 算力", power, user.Power)
+		}
+	}
+
+	// 重新处理的文档先删除旧的分段
+	if err = s.removeChunks(ctx, kb.Id, doc.Id); err != nil {
+		return err
+	}
+	totalTokens := 0
+	for i := 0; i < len(texts); i += embedBatchSize {
+		batch := texts[i:min(i+embedBatchSize, len(texts))]
+		vectors, tokens, err := s.Embed(ctx, embedModel, batch)
+		if err != nil {
+			return fmt.Errorf("文档向量化失败：%v", err)
+		}
+		totalTokens += tokens
+
+		chunks := make([]model.KnowledgeChunk, 0, len(batch))
+		for j, text := range batch {
+			chunks = append(chunks, model.KnowledgeChunk{KbId: kb.Id, DocId: doc.Id, Seq: i + j, Content: text, Tokens: chunkTokens[i+j]})
+		}
+		if err = s.db.Create(&chunks).Error; err != nil {
+			return err
+		}
+		points := make([]Point, 0, len(chunks))
+		for j, chunk := range chunks {
+			points = append(points, Point{ChunkId: chunk.Id, DocId: doc.Id, Vector: vectors[j]})
+		}
+		if err = s.store.Upsert(ctx, kb.Id, points); err != nil {
+			return fmt.Errorf("写入向量失败：%v", err)
+		}
+	}
+
+	s.db.Model(&model.KnowledgeDoc{}).Where("id", doc.Id).UpdateColumns(map[string]any{
+		"status":    DocDone,
+		"err_msg":   "",
+		"chunk_num": len(texts),
+		"tokens":    totalTokens,
+	})
+	logger.Infof("知识库文档 %s 处理完成，分段数量：%d，消耗 tokens：%d", doc.Name, len(texts), totalTokens)
+
+	// 用户自己的知识库向量化需要扣减算力
+	if doc.UserId > 0 {
+		power, detail := service.CalcChatPower(embedModel, service.TokenUsage{PromptTokens: totalTokens})
+		if power > 0 {
+			err = s.userService.DecreasePower(doc.UserId, power, model.PowerLog{
+				Type:   types.PowerConsume,
+				Model:  embedModel.Value,
+				Remark: fmt.Sprintf("知识库文档向量化：%s，%s", doc.Name, detail),
+			})
+			if err != nil {
+				logger.Errorf("扣减知识库文档向量化算力失败：%v", err)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Service) embedModel(modelId uint) (model.ChatModel, error) {
+	var chatModel model.ChatModel
+	err := s.db.Where("id", modelId).Where("type", "embedding").Where("enabled", true).First(&chatModel).Error
+	if err != nil {
+		return chatModel, errors.New("知识库的向量模型不存在或者未启用")
+	}
+	return chatModel, nil
+}
+
+// Embed 调用向量模型，返回每段文本的向量和消耗的 tokens
+func (s *Service) Embed(ctx context.Context, embedModel model.ChatModel, texts []string) ([][]float32, int, error) {
+	tokens, _ := utils.CalcTokens(utils.JsonEncode(texts), embedModel.Value)
+	var res *provider.EmbeddingResponse
+	_, err := s.apiKeyService.Invoke(ctx, "embedding", embedModel.KeyId, tokens, func(apiKey model.ApiKey) (int, error) {
+		if err := s.licenseService.IsValidApiURL(apiKey.ApiURL); err != nil {
+			return 0, service.Permanent(err)
+		}
+		r, err := provider.CreateEmbeddings(ctx, apiKey, provider.EmbeddingRequest{Model: embedModel.Value, Input: texts})
+		if err != nil {
+			return 0, err
+		}
+		res = r
+		return r.Usage.TotalTokens, nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	vectors := make([][]float32, len(texts))
+	for _, item := range res.Data {
+		if item.Index < 0 || item.Index >= len(texts) {
+			continue
+		}
+		if err = json.Unmarshal(item.Embedding, &vectors[item.Index]); err != nil {
+			return nil, 0, fmt.Errorf("解析向量失败：%v", err)
+		}
+	}
+	for _, v := range vectors {
+		if len(v) == 0 {
+			return nil, 0, errors.New("向量模型返回的结果数量不正确")
+		}
+	}
+	if res.Usage.TotalTokens > 0 {
+		tokens = res.Usage.TotalTokens
+	}
+	return vectors, tokens, nil
+}
+
+// Search 在知识库中检索跟 query 相关的分段，按照相似度从高到低返回。
+// 使用相同向量模型的知识库共用一次查询向量化，返回的数量为各个知识库 TopK 的最大值
+func (s *Service) Search(ctx context.Context, kbIds []uint, query string) ([]types.Citation, error) {
+	var kbs []model.KnowledgeBase
+	s.db.Where("id IN ?", kbIds).Find(&kbs)
+	if len(kbs) == 0 {
+		return nil, nil
+	}
+
+	type hit struct {
+		Match
+		kbId uint
+	}
+	hits := make([]hit, 0)
+	vectors := make(map[uint][]float32) // 向量模型 ID => 查询向量
+	topK := 0
+	for _, kb := range kbs {
+		vector, ok := vectors[kb.ModelId]
+		if !ok {
+			embedModel, err := s.embedModel(kb.ModelId)
+			if err != nil {
+				return nil, err
+			}
+			res, _, err := s.Embed(ctx, embedModel, []string{query})
+			if err != nil {
+				return nil, err
+			}
+			vector = res[0]
+			vectors[kb.ModelId] = vector
+		}
+
+		k := kb.TopK
+		if k <= 0 {
+			k = 5
+		}
+		topK = max(topK, k)
+		matches, err := s.store.Search(ctx, kb.Id, vector, k)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			hits = append(hits, hit{Match: m, kbId: kb.Id})
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		return hits[i].Score > hits[j].Score
+	})
+	hits = hits[:min(topK, len(hits))]
+
+	ids := make([]uint, 0, len(hits))
+	for _, h := range hits {
+		ids = append(ids, h.ChunkId)
+	}
+	var chunks []model.KnowledgeChunk
+	s.db.Select("id", "kb_id", "doc_id", "content").Where("id IN ?", ids).Find(&chunks)
+	chunkMap := make(map[uint]model.KnowledgeChunk, len(chunks))
+	docIds := make([]uint, 0, len(chunks))
+	for _, chunk := range chunks {
+		chunkMap[chunk.Id] = chunk
+		docIds = append(docIds, chunk.DocId)
+	}
+	var docs []model.KnowledgeDoc
+	s.db.Select("id", "name").Where("id IN ?", docIds).Find(&docs)
+	docNames := make(map[uint]string, len(docs))
+	for _, doc := range docs {
+		docNames[doc.Id] = doc.Name
+	}
+
+	citations := make([]types.Citation, 0, len(hits))
+	for _, h := range hits {
+		// 向量存储中可能残留已经删除的分段
+		chunk, ok := chunkMap[h.ChunkId]
+		if !ok || chunk.KbId != h.kbId {
+			continue
+		}
+		citations = append(citations, types.Citation{
+			Index:   len(citations) + 1,
+			KbId:    chunk.KbId,
+			DocId:   chunk.DocId,
+			DocName: docNames[chunk.DocId],
+			ChunkId: chunk.Id,
+			Content: chunk.Content,
+			Score:   h.Score,
+		})
+	}
+	return citations, nil
+}
+
+// RemoveDoc 删除文档以及文档的分段
+func (s *Service) RemoveDoc(doc model.KnowledgeDoc) error {
+	if err := s.removeChunks(context.Background(), doc.KbId, doc.Id); err != nil {
+		return err
+	}
+	if err := s.db.Where("id", doc.Id).Delete(&model.KnowledgeDoc{}).Error; err != nil {
+		return err
+	}
+	return s.UpdateDocNum(doc.KbId)
+}
+
+// RemoveKb 删除知识库以及知识库的所有文档
+func (s *Service) RemoveKb(kbId uint) error {
+	if err := s.store.DeleteKb(context.Background(), kbId); err != nil {
+		return err
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("kb_id", kbId).Delete(&model.KnowledgeChunk{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("kb_id", kbId).Delete(&model.KnowledgeDoc{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id", kbId).Delete(&model.KnowledgeBase{}).Error
+	})
+}
+
+// UpdateDocNum 更新知识库的文档数量
+func (s *Service) UpdateDocNum(kbId uint) error {
+	var count int64
+	s.db.Model(&model.KnowledgeDoc{}).Where("kb_id", kbId).Count(&count)
+	return s.db.Model(&model.KnowledgeBase{}).Where("id", kbId).UpdateColumn("doc_num", count).Error
+}
+
+// 先删除数据库中的分段，向量存储中残留的向量在检索的时候会被忽略
+func (s *Service) removeChunks(ctx context.Context, kbId uint, docId uint) error {
+	if err := s.db.Where("doc_id", docId).Delete(&model.KnowledgeChunk{}).Error; err != nil {
+		return err
+	}
+	return s.store.DeleteDoc(ctx, kbId, docId)
+}
+
+// 支持提取文本内容的文档类型
+var docExts = []string{".pdf", ".doc", ".docx", ".ppt", ".pptx", ".xls", ".xlsx", ".txt", ".md", ".csv", ".html", ".json"}
+
+// AddDoc 把上传的文件添加到知识库，文档会在后台异步处理
+func (s *Service) AddDoc(kb model.KnowledgeBase, userId uint, file oss.File) (model.KnowledgeDoc, error) {
+	if !slices.Contains(docExts, strings.ToLower(file.Ext)) {
+		return model.KnowledgeDoc{}, fmt.Errorf("不支持的文档类型，目前只支持 %s", strings.Join(docExts, ", "))
+	}
+	doc := model.KnowledgeDoc{
+		KbId:   kb.Id,
+		UserId: userId,
+		Name:   file.Name,
+		URL:    file.URL,
+		Ext:    strings.ToLower(file.Ext),
+		Size:   file.Size,
+		Status: DocPending,
+	}
+	if err := s.db.Create(&doc).Error; err != nil {
+		return doc, err
+	}
+	_ = s.UpdateDocNum(kb.Id)
+	s.Enqueue(doc.Id)
+	return doc, nil
+}
+
+// Retry 重新处理文档
+func (s *Service) Retry(doc model.KnowledgeDoc) error {
+	if doc.Status == DocProcessing {
+		return errors.New("文档正在处理中，请稍后再试")
+	}
+	err := s.db.Model(&doc).UpdateColumns(map[string]any{"status": DocPending, "err_msg": ""}).Error
+	if err != nil {
+		return err
+	}
+	s.Enqueue(doc.Id)
+	return nil
+}
+
+// BuildPrompt 把检索到的分段组装成参考资料提示词，要求模型使用 [编号] 标注引用的来源
+func BuildPrompt(citations []types.Citation) string {
+	var builder strings.Builder
+	builder.WriteString("以下是从知识库中检索到的参考资料，请优先根据参考资料回答用户的问题。")
+	builder.WriteString("引用参考资料时在句子末尾使用 [编号] 标注来源，参考资料与问题无关时请忽略，不要编造参考资料中没有的内容。\n\n")
+	for _, v := range citations {
+		builder.WriteString(fmt.Sprintf("[%d] 来源：%s\n%s\n\n", v.Index, v.DocName, v.Content))
+	}
+	return builder.String()
+}
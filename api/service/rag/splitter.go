@@ -0,0 +1,100 @@
+package rag
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"strings"
+	"unicode"
+)
+
+// 句子结束的标点，超长的段落在这些位置切分
+const sentenceEnds = "。！？；!?;\n"
+
+// SplitText 把文本切分成不超过 size 个字符的分段，尽量在段落和句子的边界切分。
+// 每个分段的开头会重复上一个分段末尾的 overlap 个字符，避免切断上下文
+func SplitText(text string, size int, overlap int) []string {
+	if size <= 0 {
+		size = defaultChunkSize
+	}
+	if overlap < 0 || overlap >= size {
+		overlap = 0
+	}
+
+	// 先切分成不超过 size 的片段，再把相邻的片段合并成分段
+	pieces := make([]string, 0)
+	for _, para := range strings.Split(text, "\n\n") {
+		para = strings.TrimSpace(para)
+		if para == "" {
+			continue
+		}
+		pieces = append(pieces, splitLong(para, max(size-overlap-1, 1))...)
+	}
+
+	chunks := make([]string, 0)
+	var current []rune
+	for _, piece := range pieces {
+		runes := []rune(piece)
+		if len(current) > 0 && len(current)+len(runes)+1 > size {
+			chunks = append(chunks, string(current))
+			current = tail(current, overlap)
+		}
+		if len(current) > 0 {
+			current = append(current, '\n')
+		}
+		current = append(current, runes...)
+	}
+	if len(current) > 0 {
+		chunks = append(chunks, string(current))
+	}
+	return chunks
+}
+
+// 超长的段落按照句子切分，单个句子也超长的直接按长度截断
+func splitLong(text string, size int) []string {
+	runes := []rune(text)
+	if len(runes) <= size {
+		return []string{text}
+	}
+	pieces := make([]string, 0)
+	for len(runes) > size {
+		cut := lastIndex(runes[:size], func(r rune) bool { return strings.ContainsRune(sentenceEnds, r) })
+		// 没有句子边界的在空白处切分，避免切断英文单词
+		if cut <= size/2 {
+			cut = lastIndex(runes[:size], unicode.IsSpace)
+		}
+		if cut <= size/2 {
+			cut = size
+		}
+		pieces = append(pieces, strings.TrimSpace(string(runes[:cut])))
+		runes = runes[cut:]
+	}
+	if s := strings.TrimSpace(string(runes)); s != "" {
+		pieces = append(pieces, s)
+	}
+	return pieces
+}
+
+// 最后一个满足条件的字符之后的位置，没有找到返回 0
+func lastIndex(runes []rune, fn func(rune) bool) int {
+	for i := len(runes) - 1; i >= 0; i-- {
+		if fn(runes[i]) {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func tail(runes []rune, n int) []rune {
+	if n <= 0 {
+		return nil
+	}
+	if len(runes) <= n {
+		return append([]rune(nil), runes...)
+	}
+	return append([]rune(nil), runes[len(runes)-n:]...)
+}
@@ -0,0 +1,58 @@
+package rag
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitText(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		size    int
+		overlap int
+		want    []string
+	}{
+		{"empty", " \n\n ", 10, 0, []string{}},
+		{"merge short paragraphs", "a\n\nb", 10, 0, []string{"a\nb"}},
+		{"split paragraphs", "aaaa\n\nbbbb", 6, 0, []string{"aaaa", "bbbb"}},
+		{"overlap", "aaaa\n\nbbbb", 8, 2, []string{"aaaa", "aa\nbbbb"}},
+		{"invalid overlap", "aaaa\n\nbbbb", 6, 6, []string{"aaaa", "bbbb"}},
+		{"sentence boundary", "第一句。第二句。第三句。", 10, 0, []string{"第一句。第二句。", "第三句。"}},
+		{"word boundary", "hello world foo", 8, 0, []string{"hello", "world", "foo"}},
+		{"hard cut", "abcdefghij", 5, 0, []string{"abcd", "efgh", "ij"}},
+		{"default size", strings.Repeat("字", 600), 0, 0, []string{strings.Repeat("字", 499), strings.Repeat("字", 101)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SplitText(tt.text, tt.size, tt.overlap); !slices.Equal(got, tt.want) {
+				t.Errorf("SplitText() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// 分段的长度不能超过 size，相邻分段之间保留 overlap 个字符
+func TestSplitTextChunkSize(t *testing.T) {
+	text := strings.Repeat("The quick brown fox jumps over the lazy dog. 敏捷的棕色狐狸跳过了懒狗。\n", 50) +
+		"\n\n" + strings.Repeat("没有标点的超长段落", 100)
+	size, overlap := 100, 20
+	chunks := SplitText(text, size, overlap)
+	if len(chunks) < 2 {
+		t.Fatalf("got %d chunks, want more than 1", len(chunks))
+	}
+	for i, chunk := range chunks {
+		if n := utf8.RuneCountInString(chunk); n > size {
+			t.Errorf("chunk %d has %d runes, want at most %d", i, n, size)
+		}
+		if i == 0 {
+			continue
+		}
+		prev := []rune(chunks[i-1])
+		if !strings.HasPrefix(chunk, string(prev[len(prev)-overlap:])) {
+			t.Errorf("chunk %d does not start with the tail of chunk %d", i, i-1)
+		}
+	}
+}
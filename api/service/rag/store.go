@@ -0,0 +1,75 @@
+package rag
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+)
+
+const (
+	Local  = "local"
+	Qdrant = "qdrant"
+)
+
+// Point 分段的向量
+type Point struct {
+	ChunkId uint
+	DocId   uint
+	Vector  []float32
+}
+
+// Match 检索命中的分段
+type Match struct {
+	ChunkId uint
+	Score   float64
+}
+
+// VectorStore 向量存储，分段内容保存在数据库，这里只负责向量的存储和检索
+type VectorStore interface {
+	Upsert(ctx context.Context, kbId uint, points []Point) error
+	DeleteDoc(ctx context.Context, kbId uint, docId uint) error
+	DeleteKb(ctx context.Context, kbId uint) error
+	// Search 在知识库中检索跟 vector 最相似的 topK 个分段，按照相似度从高到低排序
+	Search(ctx context.Context, kbId uint, vector []float32, topK int) ([]Match, error)
+}
+
+// 向量编码成 float32 小端序字节
+func encodeVector(vector []float32) []byte {
+	buf := make([]byte, 4*len(vector))
+	for i, v := range vector {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(v))
+	}
+	return buf
+}
+
+func decodeVector(buf []byte) []float32 {
+	vector := make([]float32, len(buf)/4)
+	for i := range vector {
+		vector[i] = math.Float32frombits(binary.LittleEndian.Uint32(buf[4*i:]))
+	}
+	return vector
+}
+
+// 余弦相似度
+func cosine(a []float32, b []float32) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
@@ -8,18 +8,17 @@ package sd
 // * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
 
 import (
+	"context"
 	"fmt"
 	"geekai/core/types"
 	logger2 "geekai/logger"
 	"geekai/service"
+	"geekai/service/job"
 	"geekai/service/oss"
-	"geekai/store"
 	"geekai/store/model"
 	"geekai/utils"
 	"time"
 
-	"github.com/go-redis/redis/v8"
-
 	"github.com/imroc/req/v3"
 	"gorm.io/gorm"
 )
@@ -28,81 +27,132 @@ var logger = logger2.GetLogger()
 
 // SD 绘画服务
 
+const jobName = "sd"
+
 type Service struct {
-	httpClient    *req.Client
-	taskQueue     *store.RedisQueue
-	db            *gorm.DB
-	uploadManager *oss.UploaderManager
-	userService   *service.UserService
+	httpClient       *req.Client
+	engine           *job.Engine
+	db               *gorm.DB
+	uploadManager    *oss.UploaderManager
+	userService      *service.UserService
+	apiKeyService    *service.ApiKeyService
+	assistantService *service.AssistantService
 }
 
-func NewService(db *gorm.DB, manager *oss.UploaderManager, redisCli *redis.Client, userService *service.UserService) *Service {
+func NewService(db *gorm.DB, manager *oss.UploaderManager, engine *job.Engine, userService *service.UserService, apiKeyService *service.ApiKeyService, assistantService *service.AssistantService) *Service {
 	return &Service{
-		httpClient:    req.C(),
-		taskQueue:     store.NewRedisQueue("StableDiffusion_Task_Queue", redisCli),
-		db:            db,
-		uploadManager: manager,
-		userService:   userService,
+		httpClient:       req.C(),
+		engine:           engine,
+		db:               db,
+		uploadManager:    manager,
+		userService:      userService,
+		apiKeyService:    apiKeyService,
+		assistantService: assistantService,
 	}
 }
 
+// Run 注册到任务引擎
 func (s *Service) Run() {
-	// 将数据库中未提交的人物加载到队列
-	var jobs []model.SdJob
-	s.db.Where("progress", 0).Find(&jobs)
-	for _, v := range jobs {
-		var task types.SdTask
-		err := utils.JsonDecode(v.TaskInfo, &task)
-		if err != nil {
-			logger.Errorf("decode task info with error: %v", err)
-			continue
-		}
-		task.Id = int(v.Id)
-		s.PushTask(task)
+	s.engine.Register(s)
+}
+
+func (s *Service) Options() job.Options {
+	// SD 是同步生成的，提交的超时时间需要覆盖整个生成过程
+	return job.Options{
+		Name:          jobName,
+		Concurrency:   1,
+		Timeout:       5 * time.Minute,
+		SubmitTimeout: 5 * time.Minute,
 	}
-	logger.Infof("Starting Stable-Diffusion job consumer")
-	go func() {
-		for {
-			var task types.SdTask
-			err := s.taskQueue.LPop(&task)
-			if err != nil {
-				logger.Errorf("taking task with error: %v", err)
-				continue
-			}
+}
 
-			// translate prompt
-			if utils.HasChinese(task.Params.Prompt) {
-				content, err := utils.OpenAIRequest(s.db, fmt.Sprintf(service.TranslatePromptTemplate, task.Params.Prompt), task.TranslateModelId)
-				if err == nil {
-					task.Params.Prompt = content
-				} else {
-					logger.Warnf("error with translate prompt: %v", err)
-				}
-			}
+func (s *Service) record(v model.SdJob) job.Record {
+	rec := job.Record{Id: v.Id, UserId: v.UserId, Progress: v.Progress, Power: v.Power, CreatedAt: v.CreatedAt}
+	switch {
+	case v.Progress == service.FailTaskProgress:
+		rec.Status = job.StatusFailed
+	case v.Progress >= 100:
+		rec.Status = job.StatusSucceeded
+	case v.Progress > 0:
+		rec.Status = job.StatusRunning
+	default:
+		rec.Status = job.StatusQueued
+	}
+	return rec
+}
 
-			// translate negative prompt
-			if task.Params.NegPrompt != "" && utils.HasChinese(task.Params.NegPrompt) {
-				content, err := utils.OpenAIRequest(s.db, fmt.Sprintf(service.TranslatePromptTemplate, task.Params.NegPrompt), task.TranslateModelId)
-				if err == nil {
-					task.Params.NegPrompt = content
-				} else {
-					logger.Warnf("error with translate prompt: %v", err)
-				}
-			}
+func (s *Service) Load(id uint) (job.Record, error) {
+	var v model.SdJob
+	err := s.db.Where("id", id).First(&v).Error
+	return s.record(v), err
+}
 
-			logger.Infof("handle a new Stable-Diffusion task: %+v", task)
-			err = s.Txt2Img(task)
-			if err != nil {
-				logger.Error("绘画任务执行失败：", err.Error())
-				// update the task progress
-				s.db.Model(&model.SdJob{Id: uint(task.Id)}).UpdateColumns(map[string]interface{}{
-					"progress": service.FailTaskProgress,
-					"err_msg":  err.Error(),
-				})
-				continue
-			}
+func (s *Service) Pending(userId uint) ([]job.Record, error) {
+	var items []model.SdJob
+	session := s.db.Session(&gorm.Session{})
+	if userId > 0 {
+		session = session.Where("user_id", userId)
+	}
+	err := session.Where("progress < ? OR (progress = ? AND power > 0)", 100, service.FailTaskProgress).Find(&items).Error
+	records := make([]job.Record, 0, len(items))
+	for _, v := range items {
+		records = append(records, s.record(v))
+	}
+	return records, err
+}
+
+func (s *Service) Submit(ctx context.Context, id uint) (job.Result, error) {
+	var v model.SdJob
+	if err := s.db.Where("id", id).First(&v).Error; err != nil {
+		return job.Result{}, job.Permanent(err)
+	}
+	var task types.SdTask
+	if err := utils.JsonDecode(v.TaskInfo, &task); err != nil {
+		return job.Result{}, job.Permanent(fmt.Errorf("decode task info with error: %v", err))
+	}
+	task.Id = int(v.Id)
+
+	// translate prompt
+	if utils.HasChinese(task.Params.Prompt) {
+		content, err := s.assistantService.Request(fmt.Sprintf(service.TranslatePromptTemplate, task.Params.Prompt), task.TranslateModelId)
+		if err == nil {
+			task.Params.Prompt = content
+		} else {
+			logger.Warnf("error with translate prompt: %v", err)
 		}
-	}()
+	}
+
+	// translate negative prompt
+	if task.Params.NegPrompt != "" && utils.HasChinese(task.Params.NegPrompt) {
+		content, err := s.assistantService.Request(fmt.Sprintf(service.TranslatePromptTemplate, task.Params.NegPrompt), task.TranslateModelId)
+		if err == nil {
+			task.Params.NegPrompt = content
+		} else {
+			logger.Warnf("error with translate prompt: %v", err)
+		}
+	}
+
+	logger.Infof("handle a new Stable-Diffusion task: %+v", task)
+	if err := s.Txt2Img(ctx, task); err != nil {
+		return job.Result{}, err
+	}
+	return job.Result{Status: job.StatusSucceeded, Progress: 100}, nil
+}
+
+func (s *Service) Finalize(id uint, result job.Result) error {
+	return s.db.Model(&model.SdJob{Id: id}).UpdateColumns(job.ProgressColumns(result, 100)).Error
+}
+
+func (s *Service) Refund(rec job.Record) (bool, error) {
+	return job.RefundOnce(s.db, &model.SdJob{}, rec, func() error {
+		var v model.SdJob
+		s.db.Where("id", rec.Id).First(&v)
+		return s.userService.IncreasePower(rec.UserId, rec.Power, model.PowerLog{
+			Type:   types.PowerRefund,
+			Model:  "stable-diffusion",
+			Remark: fmt.Sprintf("任务失败，退回算力。任务ID：%d， Err: %s", rec.Id, v.ErrMsg),
+		})
+	})
 }
 
 // Txt2ImgReq 文生图请求实体
@@ -139,7 +189,7 @@ type TaskProgressResp struct {
 }
 
 // Txt2Img 文生图 API
-func (s *Service) Txt2Img(task types.SdTask) error {
+func (s *Service) Txt2Img(ctx context.Context, task types.SdTask) error {
 	body := Txt2ImgReq{
 		Prompt:         task.Params.Prompt,
 		NegativePrompt: task.Params.NegPrompt,
@@ -162,19 +212,20 @@ func (s *Service) Txt2Img(task types.SdTask) error {
 		body.DenoisingStrength = task.Params.HdRedrawRate
 	}
 	var res Txt2ImgResp
-	var errChan = make(chan error)
+	var errChan = make(chan error, 1)
 
-	var apiKey model.ApiKey
-	err := s.db.Where("type", "sd").Where("enabled", true).Order("last_used_at ASC").First(&apiKey).Error
+	lease, err := s.apiKeyService.Acquire("sd", 0, 0)
 	if err != nil {
 		return fmt.Errorf("no available Stable-Diffusion api key: %v", err)
 	}
+	apiKey := lease.Key
 
 	apiURL := fmt.Sprintf("%s/sdapi/v1/txt2img", apiKey.ApiURL)
 	logger.Infof("send image request to %s", apiURL)
 	// send a request to sd api endpoint
 	go func() {
 		response, err := s.httpClient.R().
+			SetContext(ctx).
 			SetHeader("Authorization", apiKey.Value).
 			SetBody(body).
 			SetSuccessResult(&res).
@@ -188,10 +239,6 @@ func (s *Service) Txt2Img(task types.SdTask) error {
 			return
 		}
 
-		// update the last used time
-		apiKey.LastUsedAt = time.Now().Unix()
-		s.db.Updates(&apiKey)
-
 		// 保存 Base64 图片
 		imgURL, err := s.uploadManager.GetUploadHandler().PutBase64(res.Images[0])
 		if err != nil {
@@ -214,20 +261,15 @@ func (s *Service) Txt2Img(task types.SdTask) error {
 	for {
 		select {
 		case err := <-errChan:
-			if err != nil {
-				return err
-			}
-
-			// task finished
-			s.db.Model(&model.SdJob{Id: uint(task.Id)}).UpdateColumn("progress", 100)
-			return nil
-		default:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
 			resp, err := s.checkTaskProgress(apiKey)
 			// 更新任务进度
 			if err == nil && resp.Progress > 0 {
-				s.db.Model(&model.SdJob{Id: uint(task.Id)}).UpdateColumn("progress", int(resp.Progress*100))
+				s.engine.Report(jobName, uint(task.Id), int(resp.Progress*100))
 			}
-			time.Sleep(time.Second)
 		}
 	}
 
@@ -251,49 +293,19 @@ func (s *Service) checkTaskProgress(apiKey model.ApiKey) (*TaskProgressResp, err
 	return &res, nil
 }
 
+// PushTask 任务加入队列
 func (s *Service) PushTask(task types.SdTask) {
-	logger.Debugf("add a new MidJourney task to the task list: %+v", task)
-	if err := s.taskQueue.RPush(task); err != nil {
+	if err := s.engine.Submit(jobName, uint(task.Id)); err != nil {
 		logger.Errorf("push sd task to queue failed: %v", err)
 	}
 }
 
-// CheckTaskStatus 检查任务状态，自动删除过期或者失败的任务
-func (s *Service) CheckTaskStatus() {
-	go func() {
-		logger.Info("Running Stable-Diffusion task status checking ...")
-		for {
-			var jobs []model.SdJob
-			res := s.db.Where("progress < ?", 100).Find(&jobs)
-			if res.Error != nil {
-				time.Sleep(5 * time.Second)
-				continue
-			}
-
-			for _, job := range jobs {
-				// 5 分钟还没完成的任务标记为失败
-				if time.Since(job.CreatedAt) > time.Minute*5 {
-					job.Progress = service.FailTaskProgress
-					job.ErrMsg = "任务超时"
-					s.db.Updates(&job)
-				}
-			}
+// Admit 检查用户同时进行中的任务数量，没有达到上限的时候调用 create 创建任务
+func (s *Service) Admit(userId uint, create func() error) error {
+	return s.engine.Admit(jobName, userId, create)
+}
 
-			// 找出失败的任务，并恢复其扣减算力
-			s.db.Where("progress", service.FailTaskProgress).Where("power > ?", 0).Find(&jobs)
-			for _, job := range jobs {
-				err := s.userService.IncreasePower(job.UserId, job.Power, model.PowerLog{
-					Type:   types.PowerRefund,
-					Model:  "stable-diffusion",
-					Remark: fmt.Sprintf("任务失败，退回算力。任务ID：%d， Err: %s", job.Id, job.ErrMsg),
-				})
-				if err != nil {
-					continue
-				}
-				// 更新任务状态
-				s.db.Model(&job).UpdateColumn("power", 0)
-			}
-			time.Sleep(time.Second * 5)
-		}
-	}()
+// QueuePositions 排队中的任务的排队位置
+func (s *Service) QueuePositions() map[uint]int {
+	return s.engine.QueuePositions(jobName)
 }
@@ -8,103 +8,298 @@ package suno
 // * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"geekai/core/types"
 	logger2 "geekai/logger"
 	"geekai/service"
+	"geekai/service/job"
 	"geekai/service/oss"
-	"geekai/store"
+	"geekai/service/provider"
 	"geekai/store/model"
 	"geekai/utils"
 	"io"
+	"net/http"
+	"strings"
 	"time"
 
-	"github.com/go-redis/redis/v8"
-
 	"github.com/imroc/req/v3"
 	"gorm.io/gorm"
 )
 
 var logger = logger2.GetLogger()
 
+const jobName = "suno"
+
+// 歌曲已经生成，音频和封面还没有转存
+const downloadingProgress = 102
+
 type Service struct {
 	httpClient    *req.Client
 	db            *gorm.DB
 	uploadManager *oss.UploaderManager
-	taskQueue     *store.RedisQueue
-	notifyQueue   *store.RedisQueue
+	engine        *job.Engine
 	userService   *service.UserService
+	apiKeyService *service.ApiKeyService
 }
 
-func NewService(db *gorm.DB, manager *oss.UploaderManager, redisCli *redis.Client, userService *service.UserService) *Service {
+func NewService(db *gorm.DB, manager *oss.UploaderManager, engine *job.Engine, userService *service.UserService, apiKeyService *service.ApiKeyService) *Service {
 	return &Service{
 		httpClient:    req.C().SetTimeout(time.Minute * 3),
 		db:            db,
-		taskQueue:     store.NewRedisQueue("Suno_Task_Queue", redisCli),
-		notifyQueue:   store.NewRedisQueue("Suno_Notify_Queue", redisCli),
+		engine:        engine,
 		uploadManager: manager,
 		userService:   userService,
+		apiKeyService: apiKeyService,
 	}
 }
 
 func (s *Service) PushTask(task types.SunoTask) {
-	logger.Infof("add a new Suno task to the task list: %+v", task)
-	if err := s.taskQueue.RPush(task); err != nil {
+	if err := s.engine.Submit(jobName, task.Id); err != nil {
 		logger.Errorf("push suno task to queue failed: %v", err)
 	}
 }
 
+// Admit 检查用户同时进行中的任务数量，没有达到上限的时候调用 create 创建任务
+func (s *Service) Admit(userId uint, create func() error) error {
+	return s.engine.Admit(jobName, userId, create)
+}
+
+// QueuePositions 排队中的任务的排队位置
+func (s *Service) QueuePositions() map[uint]int {
+	return s.engine.QueuePositions(jobName)
+}
+
+// Run 注册到任务引擎
 func (s *Service) Run() {
-	// 将数据库中未提交的人物加载到队列
-	var jobs []model.SunoJob
-	s.db.Where("task_id", "").Where("progress", 0).Find(&jobs)
-	for _, v := range jobs {
-		var task types.SunoTask
-		err := utils.JsonDecode(v.TaskInfo, &task)
-		if err != nil {
-			logger.Errorf("decode task info with error: %v", err)
-			continue
+	s.engine.Register(s)
+}
+
+func (s *Service) Options() job.Options {
+	return job.Options{
+		Name:         jobName,
+		Concurrency:  3,
+		Timeout:      30 * time.Minute,
+		PollInterval: 10 * time.Second,
+	}
+}
+
+func (s *Service) record(v model.SunoJob) job.Record {
+	rec := job.Record{Id: v.Id, UserId: v.UserId, Progress: v.Progress, Power: v.Power, CreatedAt: v.CreatedAt}
+	rec.Callback = s.engine.CallbackEnabled()
+	switch {
+	case v.Progress == service.FailTaskProgress:
+		rec.Status = job.StatusFailed
+	case v.Progress == downloadingProgress:
+		rec.Status = job.StatusDownloading
+	case v.Progress >= 100:
+		rec.Status = job.StatusSucceeded
+	case v.TaskId == "" && v.Progress == 0:
+		rec.Status = job.StatusQueued
+	default:
+		rec.Status = job.StatusRunning
+	}
+	return rec
+}
+
+func (s *Service) Load(id uint) (job.Record, error) {
+	var v model.SunoJob
+	err := s.db.Where("id", id).First(&v).Error
+	return s.record(v), err
+}
+
+func (s *Service) Pending(userId uint) ([]job.Record, error) {
+	var items []model.SunoJob
+	session := s.db.Session(&gorm.Session{})
+	if userId > 0 {
+		session = session.Where("user_id", userId)
+	}
+	err := session.Where("progress < ? OR progress = ? OR (progress = ? AND power > 0)",
+		100, downloadingProgress, service.FailTaskProgress).Find(&items).Error
+	records := make([]job.Record, 0, len(items))
+	for _, v := range items {
+		records = append(records, s.record(v))
+	}
+	return records, err
+}
+
+func (s *Service) Submit(ctx context.Context, id uint) (job.Result, error) {
+	var v model.SunoJob
+	if err := s.db.Where("id", id).First(&v).Error; err != nil {
+		return job.Result{}, job.Permanent(err)
+	}
+	var task types.SunoTask
+	if err := utils.JsonDecode(v.TaskInfo, &task); err != nil {
+		return job.Result{}, job.Permanent(fmt.Errorf("decode task info with error: %v", err))
+	}
+	task.Id = v.Id
+	task.NotifyHook = s.engine.CallbackURL(jobName, v.Id)
+
+	var r RespVo
+	var err error
+	if task.Type == 3 && task.SongId != "" { // 歌曲拼接
+		r, err = s.Merge(task)
+	} else if task.Type == 4 && task.AudioURL != "" { // 上传歌曲
+		r, err = s.Upload(task)
+	} else { // 歌曲创作
+		r, err = s.Create(task)
+	}
+	if err != nil {
+		return job.Result{}, err
+	}
+	logger.Infof("任务提交成功: %+v", r)
+
+	// 更新任务信息
+	err = s.db.Model(&model.SunoJob{Id: id}).UpdateColumns(map[string]any{
+		"task_id": r.Data,
+		"channel": r.Channel,
+	}).Error
+	if err != nil {
+		return job.Result{}, job.Permanent(err)
+	}
+	return job.Result{Status: job.StatusRunning}, nil
+}
+
+// Poll 查询任务进度。一个任务会生成多首歌曲，第一首保存到原来的任务，其余的插入新的任务
+func (s *Service) Poll(ctx context.Context, id uint) (job.Result, error) {
+	var v model.SunoJob
+	if err := s.db.Where("id", id).First(&v).Error; err != nil {
+		return job.Result{}, err
+	}
+	if v.TaskId == "" {
+		return job.Result{}, errors.New("任务还没有提交成功")
+	}
+
+	task, err := s.QueryTask(v.TaskId, v.Channel)
+	if err != nil {
+		return job.Result{}, err
+	}
+	if task.Code != "success" {
+		return job.Result{}, errors.New(task.Message)
+	}
+	return s.update(v, task.Data)
+}
+
+// Callback Suno 的回调通知，兼容和查询接口相同的格式，以及直接推送任务数据的格式
+func (s *Service) Callback(id uint, body []byte) (job.Result, error) {
+	var res QueryRespVo
+	if err := utils.JsonDecode(string(body), &res); err != nil {
+		return job.Result{}, err
+	}
+	task := res.Data
+	if task.TaskId == "" {
+		if err := utils.JsonDecode(string(body), &task); err != nil {
+			return job.Result{}, err
 		}
-		task.Id = v.Id
-		s.PushTask(task)
-	}
-	logger.Info("Starting Suno job consumer...")
-	go func() {
-		for {
-			var task types.SunoTask
-			err := s.taskQueue.LPop(&task)
-			if err != nil {
-				logger.Errorf("taking task with error: %v", err)
-				continue
+	}
+
+	var v model.SunoJob
+	if err := s.db.Where("id", id).First(&v).Error; err != nil {
+		return job.Result{}, err
+	}
+	// 提交的返回结果还没有保存，交给兜底查询处理
+	if v.TaskId == "" || v.TaskId != task.TaskId {
+		return job.Result{}, fmt.Errorf("task id mismatch: %s", task.TaskId)
+	}
+	return s.update(v, task)
+}
+
+// 根据查询或者回调返回的任务信息更新任务
+func (s *Service) update(v model.SunoJob, task TaskVo) (job.Result, error) {
+	logger.Debugf("task: %+v", task.Status)
+	if task.FailReason != "" {
+		return job.Result{Status: job.StatusFailed, Message: task.FailReason}, nil
+	}
+	if task.Status != "SUCCESS" {
+		progress := utils.IntValue(strings.Replace(task.Progress, "%", "", 1), 0)
+		return job.Result{Status: job.StatusRunning, Progress: progress}, nil
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		for i, song := range task.Data {
+			item := v
+			item.Title = song.Title
+			item.SongId = song.Id
+			item.Duration = int(song.Metadata.Duration)
+			item.Prompt = song.Metadata.Prompt
+			// 修复 tags 字段过长导致插入数据库失败
+			if len(song.Metadata.Tags) > 255 {
+				item.Tags = song.Metadata.Tags[:255]
+			} else {
+				item.Tags = song.Metadata.Tags
 			}
-			var r RespVo
-			if task.Type == 3 && task.SongId != "" { // 歌曲拼接
-				r, err = s.Merge(task)
-			} else if task.Type == 4 && task.AudioURL != "" { // 上传歌曲
-				r, err = s.Upload(task)
-			} else { // 歌曲创作
-				r, err = s.Create(task)
+			item.ModelName = song.ModelName
+			item.RawData = utils.JsonEncode(song)
+			item.CoverURL = song.ImageLargeUrl
+			item.AudioURL = song.AudioUrl
+			if i == 0 {
+				// 原来的任务由引擎更新进度
+				if err := tx.Select("title", "song_id", "duration", "prompt", "tags", "model_name", "raw_data", "cover_url", "audio_url").Updates(&item).Error; err != nil {
+					return err
+				}
+				continue
 			}
-			if err != nil {
-				logger.Errorf("create task with error: %v", err)
-				s.db.Model(&model.SunoJob{Id: task.Id}).UpdateColumns(map[string]interface{}{
-					"err_msg":  err.Error(),
-					"progress": service.FailTaskProgress,
-				})
+			// 之前已经插入过的歌曲
+			var count int64
+			tx.Model(&model.SunoJob{}).Where("task_id", v.TaskId).Where("song_id", song.Id).Count(&count)
+			if count > 0 {
 				continue
 			}
+			// 算力记在原来的任务上
+			item.Id = 0
+			item.Power = 0
+			item.Progress = downloadingProgress
+			if err := tx.Create(&item).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return job.Result{}, err
+	}
+	return job.Result{Status: job.StatusDownloading, Progress: downloadingProgress}, nil
+}
 
-			logger.Infof("任务提交成功: %+v", r)
+// Download 把封面和音频转存到 OSS
+func (s *Service) Download(ctx context.Context, id uint) error {
+	var v model.SunoJob
+	if err := s.db.Where("id", id).First(&v).Error; err != nil {
+		return err
+	}
+	logger.Infof("try download cover image: %s", v.CoverURL)
+	coverURL, err := s.uploadManager.GetUploadHandler().PutUrlFile(v.CoverURL, ".png", true)
+	if err != nil {
+		return fmt.Errorf("download image with error: %v", err)
+	}
 
-			// 更新任务信息
-			s.db.Model(&model.SunoJob{Id: task.Id}).UpdateColumns(map[string]interface{}{
-				"task_id": r.Data,
-				"channel": r.Channel,
-			})
-		}
-	}()
+	logger.Infof("try download audio: %s", v.AudioURL)
+	audioURL, err := s.uploadManager.GetUploadHandler().PutUrlFile(v.AudioURL, ".mp3", true)
+	if err != nil {
+		return fmt.Errorf("download audio with error: %v", err)
+	}
+	return s.db.Model(&model.SunoJob{Id: id}).UpdateColumns(map[string]any{
+		"cover_url": coverURL,
+		"audio_url": audioURL,
+	}).Error
+}
+
+func (s *Service) Finalize(id uint, result job.Result) error {
+	return s.db.Model(&model.SunoJob{Id: id}).UpdateColumns(job.ProgressColumns(result, downloadingProgress)).Error
+}
+
+func (s *Service) Refund(rec job.Record) (bool, error) {
+	return job.RefundOnce(s.db, &model.SunoJob{}, rec, func() error {
+		var v model.SunoJob
+		s.db.Where("id", rec.Id).First(&v)
+		return s.userService.IncreasePower(rec.UserId, rec.Power, model.PowerLog{
+			Type:   types.PowerRefund,
+			Model:  v.ModelName,
+			Remark: fmt.Sprintf("Suno 任务失败，退回算力。任务ID：%s，Err:%s", v.TaskId, v.ErrMsg),
+		})
+	})
 }
 
 type RespVo struct {
@@ -119,17 +314,6 @@ type RespVo struct {
 }
 
 func (s *Service) Create(task types.SunoTask) (RespVo, error) {
-	// 读取 API KEY
-	var apiKey model.ApiKey
-	session := s.db.Session(&gorm.Session{}).Where("type", "suno").Where("enabled", true)
-	if task.Channel != "" {
-		session = session.Where("api_url", task.Channel)
-	}
-	tx := session.Order("last_used_at DESC").First(&apiKey)
-	if tx.Error != nil {
-		return RespVo{}, errors.New("no available API KEY for Suno")
-	}
-
 	reqBody := map[string]any{
 		"task_id":           task.RefTaskId,
 		"continue_clip_id":  task.RefSongId,
@@ -145,20 +329,16 @@ func (s *Service) Create(task types.SunoTask) (RespVo, error) {
 		reqBody["tags"] = task.Tags
 		reqBody["title"] = task.Title
 	}
+	if task.NotifyHook != "" {
+		reqBody["notify_hook"] = task.NotifyHook
+	}
 
-	var res RespVo
-	apiURL := fmt.Sprintf("%s/suno/submit/music", apiKey.ApiURL)
-	logger.Debugf("API URL: %s, request body: %s", apiURL, utils.JsonEncode(reqBody))
-	r, err := req.C().R().
-		SetHeader("Authorization", "Bearer "+apiKey.Value).
-		SetBody(reqBody).
-		Post(apiURL)
+	body, channel, err := s.doRequest(http.MethodPost, "suno/submit/music", reqBody, task.Channel)
 	if err != nil {
-		return RespVo{}, fmt.Errorf("请求 API 出错：%v", err)
+		return RespVo{}, err
 	}
-
-	body, _ := io.ReadAll(r.Body)
 	logger.Debugf("API response: %s", string(body))
+	var res RespVo
 	err = json.Unmarshal(body, &res)
 	if err != nil {
 		return RespVo{}, fmt.Errorf("解析API数据失败：%v, %s", err, string(body))
@@ -167,42 +347,24 @@ func (s *Service) Create(task types.SunoTask) (RespVo, error) {
 	if res.Code != "success" {
 		return RespVo{}, fmt.Errorf("API 返回失败：%s", res.Error.Message)
 	}
-	// update the last_use_at for api key
-	apiKey.LastUsedAt = time.Now().Unix()
-	session.Updates(&apiKey)
-	res.Channel = apiKey.ApiURL
+	res.Channel = channel
 	return res, nil
 }
 
 func (s *Service) Merge(task types.SunoTask) (RespVo, error) {
-	// 读取 API KEY
-	var apiKey model.ApiKey
-	session := s.db.Session(&gorm.Session{}).Where("type", "suno").Where("enabled", true)
-	if task.Channel != "" {
-		session = session.Where("api_url", task.Channel)
-	}
-	tx := session.Order("last_used_at DESC").First(&apiKey)
-	if tx.Error != nil {
-		return RespVo{}, errors.New("no available API KEY for Suno")
-	}
-
 	reqBody := map[string]interface{}{
 		"clip_id":   task.SongId,
 		"is_infill": false,
 	}
+	if task.NotifyHook != "" {
+		reqBody["notify_hook"] = task.NotifyHook
+	}
 
-	var res RespVo
-	apiURL := fmt.Sprintf("%s/suno/submit/concat", apiKey.ApiURL)
-	logger.Debugf("API URL: %s, request body: %+v", apiURL, reqBody)
-	r, err := req.C().R().
-		SetHeader("Authorization", "Bearer "+apiKey.Value).
-		SetBody(reqBody).
-		Post(apiURL)
+	body, channel, err := s.doRequest(http.MethodPost, "suno/submit/concat", reqBody, task.Channel)
 	if err != nil {
-		return RespVo{}, fmt.Errorf("请求 API 出错：%v", err)
+		return RespVo{}, err
 	}
-
-	body, _ := io.ReadAll(r.Body)
+	var res RespVo
 	err = json.Unmarshal(body, &res)
 	if err != nil {
 		return RespVo{}, fmt.Errorf("解析API数据失败：%v, %s", err, string(body))
@@ -211,45 +373,23 @@ func (s *Service) Merge(task types.SunoTask) (RespVo, error) {
 	if res.Code != "success" {
 		return RespVo{}, fmt.Errorf("API 返回失败：%s", res.Message)
 	}
-	// update the last_use_at for api key
-	apiKey.LastUsedAt = time.Now().Unix()
-	session.Updates(&apiKey)
-	res.Channel = apiKey.ApiURL
+	res.Channel = channel
 	return res, nil
 }
 
 func (s *Service) Upload(task types.SunoTask) (RespVo, error) {
-	// 读取 API KEY
-	var apiKey model.ApiKey
-	session := s.db.Session(&gorm.Session{}).Where("type", "suno").Where("enabled", true)
-	if task.Channel != "" {
-		session = session.Where("api_url", task.Channel)
-	}
-	tx := session.Order("last_used_at DESC").First(&apiKey)
-	if tx.Error != nil {
-		return RespVo{}, errors.New("no available API KEY for Suno")
-	}
-
 	reqBody := map[string]any{
 		"url": task.AudioURL,
 	}
-
-	var res RespVo
-	apiURL := fmt.Sprintf("%s/suno/uploads/audio-url", apiKey.ApiURL)
-	logger.Debugf("API URL: %s, request body: %+v", apiURL, reqBody)
-	r, err := req.C().R().
-		SetHeader("Authorization", "Bearer "+apiKey.Value).
-		SetBody(reqBody).
-		Post(apiURL)
-	if err != nil {
-		return RespVo{}, fmt.Errorf("请求 API 出错：%v", err)
+	if task.NotifyHook != "" {
+		reqBody["notify_hook"] = task.NotifyHook
 	}
 
-	if r.StatusCode != 200 {
-		return RespVo{}, fmt.Errorf("请求 API 出错：%d, %s", r.StatusCode, r.String())
+	body, channel, err := s.doRequest(http.MethodPost, "suno/uploads/audio-url", reqBody, task.Channel)
+	if err != nil {
+		return RespVo{}, err
 	}
-
-	body, _ := io.ReadAll(r.Body)
+	var res RespVo
 	err = json.Unmarshal(body, &res)
 	if err != nil {
 		return RespVo{}, fmt.Errorf("解析API数据失败：%v, %s", err, string(body))
@@ -258,194 +398,80 @@ func (s *Service) Upload(task types.SunoTask) (RespVo, error) {
 	if res.Code != "success" {
 		return RespVo{}, fmt.Errorf("API 返回失败：%s", res.Message)
 	}
-	// update the last_use_at for api key
-	apiKey.LastUsedAt = time.Now().Unix()
-	session.Updates(&apiKey)
-	res.Channel = apiKey.ApiURL
+	res.Channel = channel
 	return res, nil
 }
 
-func (s *Service) DownloadFiles() {
-	go func() {
-		var items []model.SunoJob
-		for {
-			res := s.db.Where("progress", 102).Find(&items)
-			if res.Error != nil {
-				continue
-			}
-
-			for _, v := range items {
-				// 下载图片和音频
-				logger.Infof("try download cover image: %s", v.CoverURL)
-				coverURL, err := s.uploadManager.GetUploadHandler().PutUrlFile(v.CoverURL, ".png", true)
-				if err != nil {
-					logger.Errorf("download image with error: %v", err)
-					continue
-				}
-
-				logger.Infof("try download audio: %s", v.AudioURL)
-				audioURL, err := s.uploadManager.GetUploadHandler().PutUrlFile(v.AudioURL, ".mp3", true)
-				if err != nil {
-					logger.Errorf("download audio with error: %v", err)
-					continue
-				}
-				v.CoverURL = coverURL
-				v.AudioURL = audioURL
-				v.Progress = 100
-				s.db.Updates(&v)
-			}
-
-			time.Sleep(time.Second * 10)
+// 通过 KEY 调度器请求 Suno 接口，失败的时候自动切换到同一个通道的其他 KEY，返回响应内容和使用的通道
+func (s *Service) doRequest(method string, apiPath string, reqBody any, channel string) ([]byte, string, error) {
+	var body []byte
+	apiKey, err := s.apiKeyService.InvokeChannel(context.Background(), "suno", channel, func(apiKey model.ApiKey) (int, error) {
+		apiURL := fmt.Sprintf("%s/%s", apiKey.ApiURL, apiPath)
+		logger.Debugf("API URL: %s, request body: %s", apiURL, utils.JsonEncode(reqBody))
+		request := req.C().R().SetHeader("Authorization", "Bearer "+apiKey.Value)
+		if reqBody != nil {
+			request.SetBody(reqBody)
 		}
-	}()
-}
-
-// SyncTaskProgress 异步拉取任务
-func (s *Service) SyncTaskProgress() {
-	go func() {
-		var jobs []model.SunoJob
-		for {
-			res := s.db.Where("progress < ?", 100).Where("task_id <> ?", "").Find(&jobs)
-			if res.Error != nil {
-				continue
-			}
-
-			for _, job := range jobs {
-				task, err := s.QueryTask(job.TaskId, job.Channel)
-				if err != nil {
-					logger.Errorf("query task with error: %v", err)
-					continue
-				}
-
-				if task.Code != "success" {
-					logger.Errorf("query task with error: %v", task.Message)
-					continue
-				}
-
-				logger.Debugf("task: %+v", task.Data.Status)
-				// 任务完成，删除旧任务插入两条新任务
-				if task.Data.Status == "SUCCESS" {
-					var jobId = job.Id
-					var flag = false
-					tx := s.db.Begin()
-					for _, v := range task.Data.Data {
-						job.Id = 0
-						job.Progress = 102 // 102 表示资源未下载完成
-						job.Title = v.Title
-						job.SongId = v.Id
-						job.Duration = int(v.Metadata.Duration)
-						job.Prompt = v.Metadata.Prompt
-						// 修复 tags 字段过长导致插入数据库失败
-						if len(v.Metadata.Tags) > 255 {
-							job.Tags = v.Metadata.Tags[:255]
-						} else {
-							job.Tags = v.Metadata.Tags
-						}
-
-						job.ModelName = v.ModelName
-						job.RawData = utils.JsonEncode(v)
-						job.CoverURL = v.ImageLargeUrl
-						job.AudioURL = v.AudioUrl
-
-						if err = tx.Create(&job).Error; err != nil {
-							logger.Error("create job with error: %v", err)
-							tx.Rollback()
-							break
-						}
-						flag = true
-					}
-
-					// 删除旧任务
-					if flag {
-						if err = tx.Delete(&model.SunoJob{}, "id = ?", jobId).Error; err != nil {
-							logger.Error("create job with error: %v", err)
-							tx.Rollback()
-							continue
-						}
-					}
-					tx.Commit()
-				} else if task.Data.FailReason != "" {
-					job.Progress = service.FailTaskProgress
-					job.ErrMsg = task.Data.FailReason
-					s.db.Updates(&job)
-				}
-			}
-
-			// 找出失败的任务，并恢复其扣减算力
-			s.db.Where("progress", service.FailTaskProgress).Where("power > ?", 0).Find(&jobs)
-			for _, job := range jobs {
-				err := s.userService.IncreasePower(job.UserId, job.Power, model.PowerLog{
-					Type:   types.PowerRefund,
-					Model:  job.ModelName,
-					Remark: fmt.Sprintf("Suno 任务失败，退回算力。任务ID：%s，Err:%s", job.TaskId, job.ErrMsg),
-				})
-				if err != nil {
-					continue
-				}
-				// 更新任务状态
-				s.db.Model(&job).UpdateColumn("power", 0)
-			}
-			time.Sleep(time.Second * 10)
+		r, err := request.Send(method, apiURL)
+		if err != nil {
+			return 0, fmt.Errorf("请求 API 出错：%v", err)
+		}
+		defer r.Body.Close()
+		body, _ = io.ReadAll(r.Body)
+		if r.IsErrorState() {
+			return 0, &provider.ApiError{Provider: "Suno", StatusCode: r.StatusCode, Body: string(body)}
 		}
-	}()
+		return 0, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return body, apiKey.ApiURL, nil
 }
 
 type QueryRespVo struct {
 	Code    string `json:"code"`
 	Message string `json:"message"`
-	Data    struct {
-		TaskId     string `json:"task_id"`
-		Action     string `json:"action"`
-		Status     string `json:"status"`
-		FailReason string `json:"fail_reason"`
-		SubmitTime int    `json:"submit_time"`
-		StartTime  int    `json:"start_time"`
-		FinishTime int    `json:"finish_time"`
-		Progress   string `json:"progress"`
-		Data       []struct {
-			Id       string `json:"id"`
-			Title    string `json:"title"`
-			Status   string `json:"status"`
-			Metadata struct {
-				Tags         string      `json:"tags"`
-				Type         string      `json:"type"`
-				Prompt       string      `json:"prompt"`
-				Stream       bool        `json:"stream"`
-				Duration     float64     `json:"duration"`
-				ErrorMessage interface{} `json:"error_message"`
-			} `json:"metadata"`
-			AudioUrl          string `json:"audio_url"`
-			ImageUrl          string `json:"image_url"`
-			VideoUrl          string `json:"video_url"`
-			ModelName         string `json:"model_name"`
-			DisplayName       string `json:"display_name"`
-			ImageLargeUrl     string `json:"image_large_url"`
-			MajorModelVersion string `json:"major_model_version"`
-		} `json:"data"`
+	Data    TaskVo `json:"data"`
+}
+
+type TaskVo struct {
+	TaskId     string `json:"task_id"`
+	Action     string `json:"action"`
+	Status     string `json:"status"`
+	FailReason string `json:"fail_reason"`
+	SubmitTime int    `json:"submit_time"`
+	StartTime  int    `json:"start_time"`
+	FinishTime int    `json:"finish_time"`
+	Progress   string `json:"progress"`
+	Data       []struct {
+		Id       string `json:"id"`
+		Title    string `json:"title"`
+		Status   string `json:"status"`
+		Metadata struct {
+			Tags         string      `json:"tags"`
+			Type         string      `json:"type"`
+			Prompt       string      `json:"prompt"`
+			Stream       bool        `json:"stream"`
+			Duration     float64     `json:"duration"`
+			ErrorMessage interface{} `json:"error_message"`
+		} `json:"metadata"`
+		AudioUrl          string `json:"audio_url"`
+		ImageUrl          string `json:"image_url"`
+		VideoUrl          string `json:"video_url"`
+		ModelName         string `json:"model_name"`
+		DisplayName       string `json:"display_name"`
+		ImageLargeUrl     string `json:"image_large_url"`
+		MajorModelVersion string `json:"major_model_version"`
 	} `json:"data"`
 }
 
 func (s *Service) QueryTask(taskId string, channel string) (QueryRespVo, error) {
-	// 读取 API KEY
-	var apiKey model.ApiKey
-	err := s.db.Session(&gorm.Session{}).Where("type", "suno").
-		Where("api_url", channel).
-		Where("enabled", true).
-		Order("last_used_at DESC").First(&apiKey).Error
+	body, _, err := s.doRequest(http.MethodGet, "suno/fetch/"+taskId, nil, channel)
 	if err != nil {
-		return QueryRespVo{}, errors.New("no available API KEY for Suno")
+		return QueryRespVo{}, err
 	}
-
-	apiURL := fmt.Sprintf("%s/suno/fetch/%s", apiKey.ApiURL, taskId)
 	var res QueryRespVo
-	r, err := req.C().R().SetHeader("Authorization", "Bearer "+apiKey.Value).Get(apiURL)
-
-	if err != nil {
-		return QueryRespVo{}, fmt.Errorf("请求 API 失败：%v", err)
-	}
-
-	defer r.Body.Close()
-	body, _ := io.ReadAll(r.Body)
 	err = json.Unmarshal(body, &res)
 	if err != nil {
 		return QueryRespVo{}, fmt.Errorf("解析API数据失败：%v, %s", err, string(body))
@@ -9,14 +9,6 @@ const (
 	TaskStatusFailed   = "FAIL"
 )
 
-type NotifyMessage struct {
-	UserId   int    `json:"user_id"`
-	ClientId string `json:"client_id"`
-	JobId    int    `json:"job_id"`
-	Message  string `json:"message"`
-	Type     string `json:"type"`
-}
-
 var logger = logger2.GetLogger()
 
 const TranslatePromptTemplate = "Translate the following painting prompt words into English keyword phrases. Without any explanation, directly output the keyword phrases separated by commas. The content to be translated is: [%s]"
@@ -148,3 +140,18 @@ The final prompt you output should adhere to the following structure below. Do n
 
 [optional: edge cases, details, and an area to call or repeat out specific important considerations]
 `
+
+const ChatSummaryPromptTemplate = `你是一个对话摘要助手，负责把一段较早的对话历史压缩成简洁的摘要，摘要会代替这些历史消息作为后续对话的上下文。
+
+要求：
+1. 保留用户的身份、偏好、目标和约束条件，以及已经确定的结论、关键数据、代码和文件名等细节。
+2. 保留尚未解决的问题和后续待办事项。
+3. 如果提供了之前的摘要，把新的对话内容合并进去，输出一份完整的新摘要，不要丢失之前摘要中仍然有用的信息。
+4. 使用对话所用的语言，直接输出摘要内容，不要输出任何解释。
+
+===之前的摘要===
+%s
+
+===新的对话内容===
+%s
+`
@@ -0,0 +1,100 @@
+package service
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"geekai/utils"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// 用户锁的租约有效期，持有锁的实例需要在到期之前续期，实例异常退出之后租约到期自动释放
+const UserLockTTL = 30 * time.Second
+
+var ErrUserLockLost = errors.New("user lock lost")
+
+// 只有租约的持有者才能续期和释放，防止租约过期之后误删别人的锁
+var (
+	renewLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+	releaseLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+)
+
+// UserLockService 基于 Redis 租约的用户锁，多实例部署的时候也能保证同一用户同时只有一个对话请求
+type UserLockService struct {
+	redis *redis.Client
+	ctx   context.Context
+}
+
+func NewUserLockService(redisCli *redis.Client) *UserLockService {
+	return &UserLockService{redis: redisCli, ctx: context.Background()}
+}
+
+// UserLease 用户锁的租约
+type UserLease struct {
+	UserId  uint
+	token   string
+	service *UserLockService
+}
+
+// TryLock 尝试为指定用户加锁，已经被占用返回 false
+func (s *UserLockService) TryLock(userId uint) (*UserLease, bool) {
+	lease := &UserLease{UserId: userId, token: utils.RandomHex(16), service: s}
+	if userId == 0 {
+		return lease, true
+	}
+	ok, err := s.redis.SetNX(s.ctx, s.key(userId), lease.token, UserLockTTL).Result()
+	if err != nil {
+		logger.Errorf("用户 %d 加锁失败：%v", userId, err)
+		return nil, false
+	}
+	return lease, ok
+}
+
+// Renew 续期，租约已经过期并且被其他请求占用的返回 ErrUserLockLost
+func (l *UserLease) Renew() error {
+	if l.UserId == 0 {
+		return nil
+	}
+	n, err := renewLockScript.Run(l.service.ctx, l.service.redis, []string{l.service.key(l.UserId)}, l.token, UserLockTTL.Milliseconds()).Int()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUserLockLost
+	}
+	return nil
+}
+
+// Release 释放锁
+func (l *UserLease) Release() {
+	if l.UserId == 0 {
+		return
+	}
+	err := releaseLockScript.Run(l.service.ctx, l.service.redis, []string{l.service.key(l.UserId)}, l.token).Err()
+	if err != nil {
+		logger.Errorf("用户 %d 释放锁失败：%v", l.UserId, err)
+	}
+}
+
+func (s *UserLockService) key(userId uint) string {
+	return fmt.Sprintf("user_lock:chat:%d", userId)
+}
@@ -8,322 +8,327 @@ package video
 // * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"geekai/core/types"
 	logger2 "geekai/logger"
 	"geekai/service"
+	"geekai/service/job"
 	"geekai/service/oss"
-	"geekai/store"
+	"geekai/service/provider"
 	"geekai/store/model"
 	"geekai/utils"
 	"io"
 	"net/http"
 	"time"
 
-	"github.com/go-redis/redis/v8"
-
 	"github.com/imroc/req/v3"
 	"gorm.io/gorm"
 )
 
 var logger = logger2.GetLogger()
 
+const jobName = "video"
+
+// 视频已经生成，还没有转存
+const downloadingProgress = 102
+
 type Service struct {
-	httpClient    *req.Client
-	db            *gorm.DB
-	uploadManager *oss.UploaderManager
-	taskQueue     *store.RedisQueue
-	userService   *service.UserService
+	httpClient       *req.Client
+	db               *gorm.DB
+	uploadManager    *oss.UploaderManager
+	engine           *job.Engine
+	userService      *service.UserService
+	assistantService *service.AssistantService
+	apiKeyService    *service.ApiKeyService
 }
 
-func NewService(db *gorm.DB, manager *oss.UploaderManager, redisCli *redis.Client, userService *service.UserService) *Service {
+func NewService(db *gorm.DB, manager *oss.UploaderManager, engine *job.Engine, userService *service.UserService, assistantService *service.AssistantService, apiKeyService *service.ApiKeyService) *Service {
 	return &Service{
-		httpClient:    req.C().SetTimeout(time.Minute * 3),
-		db:            db,
-		taskQueue:     store.NewRedisQueue("Video_Task_Queue", redisCli),
-		uploadManager: manager,
-		userService:   userService,
+		httpClient:       req.C().SetTimeout(time.Minute * 3),
+		db:               db,
+		engine:           engine,
+		uploadManager:    manager,
+		userService:      userService,
+		assistantService: assistantService,
+		apiKeyService:    apiKeyService,
 	}
 }
 
 func (s *Service) PushTask(task types.VideoTask) {
-	logger.Infof("add a new Video task to the task list: %+v", task)
-	if err := s.taskQueue.RPush(task); err != nil {
+	if err := s.engine.Submit(jobName, task.Id); err != nil {
 		logger.Errorf("push video task to queue failed: %v", err)
 	}
 }
 
+// Admit 检查用户同时进行中的任务数量，没有达到上限的时候调用 create 创建任务
+func (s *Service) Admit(userId uint, create func() error) error {
+	return s.engine.Admit(jobName, userId, create)
+}
+
+// QueuePositions 排队中的任务的排队位置
+func (s *Service) QueuePositions() map[uint]int {
+	return s.engine.QueuePositions(jobName)
+}
+
+// Run 注册到任务引擎
 func (s *Service) Run() {
-	// 将数据库中未提交的任务加载到队列
-	var jobs []model.VideoJob
-	s.db.Where("task_id", "").Where("progress", 0).Find(&jobs)
-	for _, v := range jobs {
-		var task types.VideoTask
-		err := utils.JsonDecode(v.TaskInfo, &task)
-		if err != nil {
-			logger.Errorf("decode task info with error: %v", err)
-			continue
-		}
-		task.Id = v.Id
-		s.PushTask(task)
-	}
-	logger.Info("Starting Video job consumer...")
-	go func() {
-		for {
-			var task types.VideoTask
-			err := s.taskQueue.LPop(&task)
-			if err != nil {
-				logger.Errorf("taking task with error: %v", err)
-				continue
-			}
+	s.engine.Register(s)
+}
 
-			if task.Type == types.VideoLuma {
-				// translate prompt
-				if utils.HasChinese(task.Prompt) {
-					content, err := utils.OpenAIRequest(s.db, fmt.Sprintf(service.TranslatePromptTemplate, task.Prompt), task.TranslateModelId)
-					if err == nil {
-						task.Prompt = content
-					} else {
-						logger.Warnf("error with translate prompt: %v", err)
-					}
-				}
-				var r LumaRespVo
-				r, err = s.LumaCreate(task)
-				if err != nil {
-					logger.Errorf("create task with error: %v", err)
-					err = s.db.Model(&model.VideoJob{Id: task.Id}).UpdateColumns(map[string]interface{}{
-						"err_msg":   err.Error(),
-						"progress":  service.FailTaskProgress,
-						"cover_url": "/images/failed.jpg",
-					}).Error
-					if err != nil {
-						logger.Errorf("update task with error: %v", err)
-					}
-					continue
-				}
-
-				// 更新任务信息
-				err = s.db.Model(&model.VideoJob{Id: task.Id}).UpdateColumns(map[string]interface{}{
-					"task_id":    r.Id,
-					"channel":    r.Channel,
-					"prompt_ext": r.Prompt,
-				}).Error
-				if err != nil {
-					logger.Errorf("update task with error: %v", err)
-					s.PushTask(task)
-				}
-			} else if task.Type == types.VideoKeLing {
-				var r KeLingRespVo
-				r, err = s.KeLingCreate(task)
-				logger.Debugf("ke ling create task result: %+v", r)
-
-				if err != nil {
-					logger.Errorf("create task with error: %v", err)
-					err = s.db.Model(&model.VideoJob{Id: task.Id}).UpdateColumns(map[string]interface{}{
-						"err_msg":   err.Error(),
-						"progress":  service.FailTaskProgress,
-						"cover_url": "/images/failed.jpg",
-					}).Error
-					if err != nil {
-						logger.Errorf("update task with error: %v", err)
-					}
-					continue
-				}
-
-				// 更新任务信息
-				err = s.db.Model(&model.VideoJob{Id: task.Id}).UpdateColumns(map[string]interface{}{
-					"task_id":    r.Data.TaskID,
-					"channel":    r.Channel,
-					"prompt_ext": task.Prompt,
-				}).Error
-				if err != nil {
-					logger.Errorf("update task with error: %v", err)
-					s.PushTask(task)
-				}
-			}
+func (s *Service) Options() job.Options {
+	return job.Options{
+		Name:         jobName,
+		Concurrency:  3,
+		Timeout:      30 * time.Minute,
+		PollInterval: 10 * time.Second,
+	}
+}
 
-		}
-	}()
+func (s *Service) record(v model.VideoJob) job.Record {
+	rec := job.Record{Id: v.Id, UserId: v.UserId, Progress: v.Progress, Power: v.Power, CreatedAt: v.CreatedAt}
+	// 只有可灵支持回调
+	rec.Callback = v.Type == types.VideoKeLing && s.engine.CallbackEnabled()
+	switch {
+	case v.Progress == service.FailTaskProgress:
+		rec.Status = job.StatusFailed
+	case v.Progress == downloadingProgress:
+		rec.Status = job.StatusDownloading
+	case v.Progress >= 100:
+		rec.Status = job.StatusSucceeded
+	case v.TaskId == "" && v.Progress == 0:
+		rec.Status = job.StatusQueued
+	default:
+		rec.Status = job.StatusRunning
+	}
+	return rec
 }
 
-func (s *Service) DownloadFiles() {
-	go func() {
-		var items []model.VideoJob
-		for {
-			res := s.db.Where("progress", 102).Find(&items)
-			if res.Error != nil {
-				continue
-			}
+func (s *Service) Load(id uint) (job.Record, error) {
+	var v model.VideoJob
+	err := s.db.Where("id", id).First(&v).Error
+	return s.record(v), err
+}
 
-			for _, v := range items {
-				if v.WaterURL == "" {
-					continue
-				}
-
-				logger.Infof("try download video: %s", v.WaterURL)
-				videoURL, err := s.uploadManager.GetUploadHandler().PutUrlFile(v.WaterURL, ".mp4", true)
-				if err != nil {
-					logger.Errorf("download video with error: %v", err)
-					continue
-				}
-				logger.Infof("download video success: %s", videoURL)
-				v.WaterURL = videoURL
-
-				if v.VideoURL != "" {
-					logger.Infof("try download no water video: %s", v.VideoURL)
-					videoURL, err = s.uploadManager.GetUploadHandler().PutUrlFile(v.VideoURL, ".mp4", true)
-					if err != nil {
-						logger.Errorf("download video with error: %v", err)
-						continue
-					}
-				}
-				logger.Infof("download no water video success: %s", videoURL)
-				v.VideoURL = videoURL
-				v.Progress = 100
-				s.db.Updates(&v)
-
-				// Convert TaskInfo to VideoTask
-				var videoTask types.VideoTask
-				if err := json.Unmarshal([]byte(v.TaskInfo), &videoTask); err != nil {
-					logger.Errorf("failed to unmarshal task info to VideoTask: %v", err)
-					continue
-				}
+func (s *Service) Pending(userId uint) ([]job.Record, error) {
+	var items []model.VideoJob
+	session := s.db.Session(&gorm.Session{})
+	if userId > 0 {
+		session = session.Where("user_id", userId)
+	}
+	err := session.Where("progress < ? OR progress = ? OR (progress = ? AND power > 0)",
+		100, downloadingProgress, service.FailTaskProgress).Find(&items).Error
+	records := make([]job.Record, 0, len(items))
+	for _, v := range items {
+		records = append(records, s.record(v))
+	}
+	return records, err
+}
 
+func (s *Service) Submit(ctx context.Context, id uint) (job.Result, error) {
+	var v model.VideoJob
+	if err := s.db.Where("id", id).First(&v).Error; err != nil {
+		return job.Result{}, job.Permanent(err)
+	}
+	var task types.VideoTask
+	if err := utils.JsonDecode(v.TaskInfo, &task); err != nil {
+		return job.Result{}, job.Permanent(fmt.Errorf("decode task info with error: %v", err))
+	}
+	task.Id = v.Id
+
+	data := make(map[string]any)
+	switch task.Type {
+	case types.VideoLuma:
+		// translate prompt
+		if utils.HasChinese(task.Prompt) {
+			content, err := s.assistantService.Request(fmt.Sprintf(service.TranslatePromptTemplate, task.Prompt), task.TranslateModelId)
+			if err == nil {
+				task.Prompt = content
+			} else {
+				logger.Warnf("error with translate prompt: %v", err)
 			}
+		}
+		r, err := s.LumaCreate(task)
+		if err != nil {
+			return job.Result{}, err
+		}
+		data["task_id"] = r.Id
+		data["channel"] = r.Channel
+		data["prompt_ext"] = r.Prompt
+	case types.VideoKeLing:
+		task.NotifyHook = s.engine.CallbackURL(jobName, v.Id)
+		r, err := s.KeLingCreate(task)
+		logger.Debugf("ke ling create task result: %+v", r)
+		if err != nil {
+			return job.Result{}, err
+		}
+		if r.Code != 0 {
+			return job.Result{}, job.Permanent(fmt.Errorf("API 返回失败：%s", r.Message))
+		}
+		data["task_id"] = r.Data.TaskID
+		data["channel"] = r.Channel
+		data["prompt_ext"] = task.Prompt
+	default:
+		return job.Result{}, job.Permanent(fmt.Errorf("unknown video type: %s", task.Type))
+	}
+
+	// 更新任务信息
+	if err := s.db.Model(&model.VideoJob{Id: id}).UpdateColumns(data).Error; err != nil {
+		return job.Result{}, job.Permanent(err)
+	}
+	return job.Result{Status: job.StatusRunning}, nil
+}
 
-			time.Sleep(time.Second * 10)
+// Poll 查询任务进度
+func (s *Service) Poll(ctx context.Context, id uint) (job.Result, error) {
+	var v model.VideoJob
+	if err := s.db.Where("id", id).First(&v).Error; err != nil {
+		return job.Result{}, err
+	}
+	if v.TaskId == "" {
+		return job.Result{}, errors.New("任务还没有提交成功")
+	}
+
+	data := make(map[string]any)
+	switch v.Type {
+	case types.VideoLuma:
+		task, err := s.QueryLumaTask(v.TaskId, v.Channel)
+		if err != nil {
+			return job.Result{}, err
+		}
+		logger.Debugf("task: %+v", task)
+		if task.State != "completed" {
+			return job.Result{Status: job.StatusRunning}, nil
+		}
+		data["water_url"] = task.Video.Url
+		data["raw_data"] = utils.JsonEncode(task)
+		data["prompt_ext"] = task.Prompt
+		data["cover_url"] = task.Thumbnail.Url
+		if task.Video.DownloadUrl != "" {
+			data["video_url"] = task.Video.DownloadUrl
+		}
+	case types.VideoKeLing:
+		var videoTask types.VideoTask
+		if err := utils.JsonDecode(v.TaskInfo, &videoTask); err != nil {
+			return job.Result{}, job.Permanent(fmt.Errorf("failed to unmarshal task info to VideoTask: %v", err))
+		}
+		var params types.KeLingVideoParams
+		if err := utils.JsonDecode(utils.JsonEncode(videoTask.Params), &params); err != nil {
+			return job.Result{}, job.Permanent(fmt.Errorf("failed to unmarshal params: %v", err))
 		}
-	}()
+
+		task, err := s.QueryKeLingTask(v.TaskId, v.Channel, params.TaskType)
+		if err != nil {
+			return job.Result{}, err
+		}
+		return s.updateKeLing(v, task)
+	default:
+		return job.Result{}, job.Permanent(fmt.Errorf("unknown video type: %s", v.Type))
+	}
+
+	if err := s.db.Model(&model.VideoJob{Id: id}).UpdateColumns(data).Error; err != nil {
+		return job.Result{}, err
+	}
+	return job.Result{Status: job.StatusDownloading, Progress: downloadingProgress}, nil
 }
 
-// SyncTaskProgress 异步拉取任务
-func (s *Service) SyncTaskProgress() {
-	go func() {
-		var jobs []model.VideoJob
-		for {
-			res := s.db.Where("progress < ?", 100).Where("task_id <> ?", "").Find(&jobs)
-			if res.Error != nil {
-				continue
-			}
+// Callback 可灵的回调通知
+func (s *Service) Callback(id uint, body []byte) (job.Result, error) {
+	var task VideoCallbackData
+	if err := utils.JsonDecode(string(body), &task); err != nil {
+		return job.Result{}, err
+	}
+	var v model.VideoJob
+	if err := s.db.Where("id", id).First(&v).Error; err != nil {
+		return job.Result{}, err
+	}
+	// 提交的返回结果还没有保存，交给兜底查询处理
+	if v.Type != types.VideoKeLing || v.TaskId == "" || v.TaskId != task.TaskID {
+		return job.Result{}, fmt.Errorf("task id mismatch: %s", task.TaskID)
+	}
+	return s.updateKeLing(v, task)
+}
+
+// 根据可灵查询或者回调返回的任务信息更新任务
+func (s *Service) updateKeLing(v model.VideoJob, task VideoCallbackData) (job.Result, error) {
+	logger.Debugf("task: %+v", task)
+	if task.TaskStatus == "failed" {
+		return job.Result{Status: job.StatusFailed, Message: task.TaskStatusMsg}, nil
+	}
+	if task.TaskStatus != "succeed" {
+		return job.Result{Status: job.StatusRunning}, nil
+	}
+	if len(task.TaskResult.Videos) == 0 {
+		return job.Result{Status: job.StatusFailed, Message: "没有返回视频"}, nil
+	}
+	err := s.db.Model(&model.VideoJob{Id: v.Id}).UpdateColumns(map[string]any{
+		"water_url":  task.TaskResult.Videos[0].URL,
+		"video_url":  task.TaskResult.Videos[0].URL,
+		"raw_data":   utils.JsonEncode(task),
+		"prompt_ext": v.Prompt,
+		"cover_url":  "",
+	}).Error
+	if err != nil {
+		return job.Result{}, err
+	}
+	return job.Result{Status: job.StatusDownloading, Progress: downloadingProgress}, nil
+}
 
-			for _, job := range jobs {
-				if job.Type == types.VideoLuma {
-					task, err := s.QueryLumaTask(job.TaskId, job.Channel)
-					if err != nil {
-						logger.Errorf("query task with error: %v", err)
-						// 更新任务信息
-						s.db.Model(&model.VideoJob{Id: job.Id}).UpdateColumns(map[string]interface{}{
-							"progress":  service.FailTaskProgress, // 102 表示资源未下载完成,
-							"err_msg":   err.Error(),
-							"cover_url": "/images/failed.jpg",
-						})
-						continue
-					}
-
-					logger.Debugf("task: %+v", task)
-					if task.State == "completed" { // 更新任务信息
-						data := map[string]interface{}{
-							"progress":   102, // 102 表示资源未下载完成,
-							"water_url":  task.Video.Url,
-							"raw_data":   utils.JsonEncode(task),
-							"prompt_ext": task.Prompt,
-							"cover_url":  task.Thumbnail.Url,
-						}
-						if task.Video.DownloadUrl != "" {
-							data["video_url"] = task.Video.DownloadUrl
-						}
-						err = s.db.Model(&model.VideoJob{Id: job.Id}).UpdateColumns(data).Error
-						if err != nil {
-							logger.Errorf("更新数据库失败：%v", err)
-							continue
-						}
-					}
-				} else if job.Type == types.VideoKeLing {
-					// Convert TaskInfo to VideoTask
-					var videoTask types.VideoTask
-					if err := json.Unmarshal([]byte(job.TaskInfo), &videoTask); err != nil {
-						logger.Errorf("failed to unmarshal task info to VideoTask: %v", err)
-						continue
-					}
-
-					// Type assert task.Params to KeLingVideoParams
-					paramsMap, ok := videoTask.Params.(map[string]interface{})
-					if !ok {
-						continue
-					}
-
-					// Convert map to KeLingVideoParams
-					paramsBytes, err := json.Marshal(paramsMap)
-					if err != nil {
-						continue
-					}
-
-					var params types.KeLingVideoParams
-					if err := json.Unmarshal(paramsBytes, &params); err != nil {
-						continue
-					}
-
-					task, err := s.QueryKeLingTask(job.TaskId, job.Channel, params.TaskType)
-					if err != nil {
-						logger.Errorf("query task with error: %v", err)
-						// 更新任务信息
-						s.db.Model(&model.VideoJob{Id: job.Id}).UpdateColumns(map[string]interface{}{
-							"progress":  service.FailTaskProgress, // 102 表示资源未下载完成,
-							"err_msg":   err.Error(),
-							"cover_url": "/images/failed.jpg",
-						})
-						continue
-					}
-
-					logger.Debugf("task: %+v", task)
-					if task.TaskStatus == "succeed" { // 更新任务信息
-						data := map[string]interface{}{
-							"progress":   102, // 102 表示资源未下载完成,
-							"water_url":  task.TaskResult.Videos[0].URL,
-							"raw_data":   utils.JsonEncode(task),
-							"prompt_ext": job.Prompt,
-							"cover_url":  "",
-						}
-						if len(task.TaskResult.Videos) > 0 {
-							data["video_url"] = task.TaskResult.Videos[0].URL
-						}
-						err = s.db.Model(&model.VideoJob{Id: job.Id}).UpdateColumns(data).Error
-						if err != nil {
-							logger.Errorf("更新数据库失败：%v", err)
-							continue
-						}
-					} else if task.TaskStatus == "failed" {
-						// 更新任务信息
-						s.db.Model(&model.VideoJob{Id: job.Id}).UpdateColumns(map[string]interface{}{
-							"progress":  service.FailTaskProgress,
-							"err_msg":   task.TaskStatusMsg,
-							"cover_url": "/images/failed.jpg",
-						})
-					}
-				}
+// Download 把视频转存到 OSS
+func (s *Service) Download(ctx context.Context, id uint) error {
+	var v model.VideoJob
+	if err := s.db.Where("id", id).First(&v).Error; err != nil {
+		return err
+	}
+	if v.WaterURL == "" {
+		return job.Permanent(errors.New("视频地址为空"))
+	}
 
-			}
+	logger.Infof("try download video: %s", v.WaterURL)
+	waterURL, err := s.uploadManager.GetUploadHandler().PutUrlFile(v.WaterURL, ".mp4", true)
+	if err != nil {
+		return fmt.Errorf("download video with error: %v", err)
+	}
+	logger.Infof("download video success: %s", waterURL)
 
-			// 找出失败的任务，并恢复其扣减算力
-			s.db.Where("progress", service.FailTaskProgress).Where("power > ?", 0).Find(&jobs)
-			for _, job := range jobs {
-				err := s.userService.IncreasePower(job.UserId, job.Power, model.PowerLog{
-					Type:   types.PowerRefund,
-					Model:  job.Type,
-					Remark: fmt.Sprintf("%s 任务失败，退回算力。任务ID：%s，Err:%s", job.Type, job.TaskId, job.ErrMsg),
-				})
-				if err != nil {
-					continue
-				}
-				// 更新任务状态
-				s.db.Model(&job).UpdateColumn("power", 0)
-			}
-			time.Sleep(time.Second * 10)
+	videoURL := waterURL
+	if v.VideoURL != "" {
+		logger.Infof("try download no water video: %s", v.VideoURL)
+		videoURL, err = s.uploadManager.GetUploadHandler().PutUrlFile(v.VideoURL, ".mp4", true)
+		if err != nil {
+			return fmt.Errorf("download video with error: %v", err)
 		}
-	}()
+		logger.Infof("download no water video success: %s", videoURL)
+	}
+	return s.db.Model(&model.VideoJob{Id: id}).UpdateColumns(map[string]any{
+		"water_url": waterURL,
+		"video_url": videoURL,
+	}).Error
+}
+
+func (s *Service) Finalize(id uint, result job.Result) error {
+	data := job.ProgressColumns(result, downloadingProgress)
+	switch result.Status {
+	case job.StatusFailed, job.StatusCanceled:
+		data["cover_url"] = "/images/failed.jpg"
+	case job.StatusQueued:
+		data["cover_url"] = ""
+	}
+	return s.db.Model(&model.VideoJob{Id: id}).UpdateColumns(data).Error
+}
+
+func (s *Service) Refund(rec job.Record) (bool, error) {
+	return job.RefundOnce(s.db, &model.VideoJob{}, rec, func() error {
+		var v model.VideoJob
+		s.db.Where("id", rec.Id).First(&v)
+		return s.userService.IncreasePower(rec.UserId, rec.Power, model.PowerLog{
+			Type:   types.PowerRefund,
+			Model:  v.Type,
+			Remark: fmt.Sprintf("%s 任务失败，退回算力。任务ID：%s，Err:%s", v.Type, v.TaskId, v.ErrMsg),
+		})
+	})
 }
 
 type LumaTaskVo struct {
@@ -373,17 +378,6 @@ type LumaRespVo struct {
 }
 
 func (s *Service) LumaCreate(task types.VideoTask) (LumaRespVo, error) {
-	// 读取 API KEY
-	var apiKey model.ApiKey
-	session := s.db.Session(&gorm.Session{}).Where("type", "luma").Where("enabled", true)
-	if task.Channel != "" {
-		session = session.Where("api_url", task.Channel)
-	}
-	tx := session.Order("last_used_at DESC").First(&apiKey)
-	if tx.Error != nil {
-		return LumaRespVo{}, errors.New("no available API KEY for Luma")
-	}
-
 	// Type assert task.Params to LumaVideoParams
 	paramsMap, ok := task.Params.(map[string]interface{})
 	if !ok {
@@ -409,59 +403,26 @@ func (s *Service) LumaCreate(task types.VideoTask) (LumaRespVo, error) {
 		"image_end_url": params.EndImgURL,   // 图生视频
 	}
 
-	var res LumaRespVo
-	apiURL := fmt.Sprintf("%s/luma/generations", apiKey.ApiURL)
-	logger.Debugf("API URL: %s, request body: %+v", apiURL, reqBody)
-	r, err := req.C().R().
-		SetHeader("Authorization", "Bearer "+apiKey.Value).
-		SetBody(reqBody).
-		Post(apiURL)
+	body, channel, err := s.doRequest("luma", http.MethodPost, "luma/generations", reqBody, task.Channel)
 	if err != nil {
-		return LumaRespVo{}, fmt.Errorf("请求 API 出错：%v", err)
+		return LumaRespVo{}, err
 	}
-
-	if r.StatusCode != 200 && r.StatusCode != 201 {
-		return LumaRespVo{}, fmt.Errorf("请求 API 出错：%d, %s", r.StatusCode, r.String())
-	}
-
-	body, _ := io.ReadAll(r.Body)
+	var res LumaRespVo
 	err = json.Unmarshal(body, &res)
 	if err != nil {
 		return LumaRespVo{}, fmt.Errorf("解析API数据失败：%v, %s", err, string(body))
 	}
 
-	// update the last_use_at for api key
-	apiKey.LastUsedAt = time.Now().Unix()
-	session.Updates(&apiKey)
-	res.Channel = apiKey.ApiURL
+	res.Channel = channel
 	return res, nil
 }
 
 func (s *Service) QueryLumaTask(taskId string, channel string) (LumaTaskVo, error) {
-	// 读取 API KEY
-	var apiKey model.ApiKey
-	err := s.db.Session(&gorm.Session{}).Where("type", "luma").
-		Where("api_url", channel).
-		Where("enabled", true).
-		Order("last_used_at DESC").First(&apiKey).Error
+	body, _, err := s.doRequest("luma", http.MethodGet, "luma/generations/"+taskId, nil, channel)
 	if err != nil {
-		return LumaTaskVo{}, errors.New("no available API KEY for Luma")
+		return LumaTaskVo{}, err
 	}
-
-	apiURL := fmt.Sprintf("%s/luma/generations/%s", apiKey.ApiURL, taskId)
 	var res LumaTaskVo
-	r, err := req.C().R().SetHeader("Authorization", "Bearer "+apiKey.Value).Get(apiURL)
-
-	if err != nil {
-		return LumaTaskVo{}, fmt.Errorf("请求 API 失败：%v", err)
-	}
-	defer r.Body.Close()
-
-	if r.StatusCode != 200 {
-		return LumaTaskVo{}, fmt.Errorf("API 返回失败：%v", r.String())
-	}
-
-	body, _ := io.ReadAll(r.Body)
 	err = json.Unmarshal(body, &res)
 	if err != nil {
 		return LumaTaskVo{}, fmt.Errorf("解析API数据失败：%v, %s", err, string(body))
@@ -484,16 +445,6 @@ type KeLingRespVo struct {
 }
 
 func (s *Service) KeLingCreate(task types.VideoTask) (KeLingRespVo, error) {
-	var apiKey model.ApiKey
-	session := s.db.Session(&gorm.Session{}).Where("type", "keling").Where("enabled", true)
-	if task.Channel != "" {
-		session = session.Where("api_url", task.Channel)
-	}
-	tx := session.Order("last_used_at DESC").First(&apiKey)
-	if tx.Error != nil {
-		return KeLingRespVo{}, errors.New("no available API KEY for keling")
-	}
-
 	// Type assert task.Params to KeLingVideoParams
 	paramsMap, ok := task.Params.(map[string]interface{})
 	if !ok {
@@ -536,51 +487,29 @@ func (s *Service) KeLingCreate(task types.VideoTask) (KeLingRespVo, error) {
 		payload["camera_control"] = cameraControl
 	}
 
+	if task.NotifyHook != "" {
+		payload["callback_url"] = task.NotifyHook
+	}
+
 	// 处理图生视频
 	if params.TaskType == "image2video" {
 		payload["image"] = params.Image
 		payload["image_tail"] = params.ImageTail
 	}
 
-	jsonPayload, err := json.Marshal(payload)
-	if err != nil {
-		return KeLingRespVo{}, fmt.Errorf("failed to marshal payload: %v", err)
-	}
-
-	// 3. 准备HTTP请求
-	url := fmt.Sprintf("%s/kling/v1/videos/%s", apiKey.ApiURL, params.TaskType)
-	req, err := http.NewRequest("POST", url, bytes.NewReader(jsonPayload))
+	// 3. 发送请求
+	body, channel, err := s.doRequest("keling", http.MethodPost, "kling/v1/videos/"+params.TaskType, payload, task.Channel)
 	if err != nil {
-		return KeLingRespVo{}, fmt.Errorf("failed to create request: %v", err)
-	}
-
-	req.Header.Set("Authorization", "Bearer "+apiKey.Value)
-	req.Header.Set("Content-Type", "application/json")
-
-	// 4. 发送请求
-	client := &http.Client{Timeout: time.Duration(30) * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return KeLingRespVo{}, fmt.Errorf("failed to send request: %v", err)
-	}
-	defer resp.Body.Close()
-
-	// 5. 处理响应
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return KeLingRespVo{}, fmt.Errorf("failed to read response: %v", err)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return KeLingRespVo{}, fmt.Errorf("API error (status %d): %s", resp.StatusCode, string(body))
+		return KeLingRespVo{}, err
 	}
 
+	// 4. 处理响应
 	var apiResponse = KeLingRespVo{}
 	if err := json.Unmarshal(body, &apiResponse); err != nil {
 		return KeLingRespVo{}, fmt.Errorf("failed to parse response: %v", err)
 	}
 	// 设置 API 通道
-	apiResponse.Channel = apiKey.ApiURL
+	apiResponse.Channel = channel
 	return apiResponse, nil
 }
 
@@ -611,38 +540,10 @@ type CallBackVideoResult struct {
 }
 
 func (s *Service) QueryKeLingTask(taskId string, channel string, action string) (VideoCallbackData, error) {
-	var apiKey model.ApiKey
-	err := s.db.Session(&gorm.Session{}).Where("type", "keling").
-		//Where("api_url", channel).
-		Where("enabled", true).
-		Order("last_used_at DESC").First(&apiKey).Error
-	if err != nil {
-		return VideoCallbackData{}, errors.New("no available API KEY for keling")
-	}
-
-	url := fmt.Sprintf("%s/kling/v1/videos/%s/%s", apiKey.ApiURL, action, taskId)
-	req, err := http.NewRequest("GET", url, nil)
+	// 可灵的任务查询不限制通道
+	body, _, err := s.doRequest("keling", http.MethodGet, fmt.Sprintf("kling/v1/videos/%s/%s", action, taskId), nil, "")
 	if err != nil {
-		return VideoCallbackData{}, fmt.Errorf("failed to create request: %w", err)
-	}
-
-	req.Header.Set("Authorization", "Bearer "+apiKey.Value)
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	res, err := client.Do(req)
-	if err != nil {
-		return VideoCallbackData{}, fmt.Errorf("failed to execute request: %w", err)
-	}
-	defer res.Body.Close()
-
-	if res.StatusCode != http.StatusOK {
-		return VideoCallbackData{}, fmt.Errorf("unexpected status code: %d", res.StatusCode)
-	}
-
-	body, err := io.ReadAll(res.Body)
-	if err != nil {
-		return VideoCallbackData{}, fmt.Errorf("failed to read response body: %w", err)
+		return VideoCallbackData{}, err
 	}
 
 	var response struct {
@@ -661,3 +562,30 @@ func (s *Service) QueryKeLingTask(taskId string, channel string, action string)
 
 	return response.Data, nil
 }
+
+// 通过 KEY 调度器请求视频接口，失败的时候自动切换到同一个通道的其他 KEY，返回响应内容和使用的通道
+func (s *Service) doRequest(keyType string, method string, apiPath string, reqBody any, channel string) ([]byte, string, error) {
+	var body []byte
+	apiKey, err := s.apiKeyService.InvokeChannel(context.Background(), keyType, channel, func(apiKey model.ApiKey) (int, error) {
+		apiURL := fmt.Sprintf("%s/%s", apiKey.ApiURL, apiPath)
+		logger.Debugf("API URL: %s, request body: %+v", apiURL, reqBody)
+		request := req.C().R().SetHeader("Authorization", "Bearer "+apiKey.Value)
+		if reqBody != nil {
+			request.SetBody(reqBody)
+		}
+		r, err := request.Send(method, apiURL)
+		if err != nil {
+			return 0, fmt.Errorf("请求 API 出错：%v", err)
+		}
+		defer r.Body.Close()
+		body, _ = io.ReadAll(r.Body)
+		if r.IsErrorState() {
+			return 0, &provider.ApiError{Provider: keyType, StatusCode: r.StatusCode, Body: string(body)}
+		}
+		return 0, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return body, apiKey.ApiURL, nil
+}
@@ -6,16 +6,22 @@ import (
 
 // ApiKey OpenAI API 模型
 type ApiKey struct {
-	Id         uint      `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
-	Name       string    `gorm:"column:name;type:varchar(30);comment:名称" json:"name"`
-	Value      string    `gorm:"column:value;type:varchar(255);not null;comment:API KEY value" json:"value"`
-	Type       string    `gorm:"column:type;type:varchar(10);default:chat;not null;comment:用途（chat=>聊天，img=>图片）" json:"type"`
-	LastUsedAt int64     `gorm:"column:last_used_at;type:int;not null;comment:最后使用时间" json:"last_used_at"`
-	ApiURL     string    `gorm:"column:api_url;type:varchar(255);comment:API 地址" json:"api_url"`
-	Enabled    bool      `gorm:"column:enabled;type:tinyint(1);comment:是否启用" json:"enabled"`
-	ProxyURL   string    `gorm:"column:proxy_url;type:varchar(100);comment:代理地址" json:"proxy_url"`
-	CreatedAt  time.Time `gorm:"column:created_at;type:datetime;not null" json:"created_at"`
-	UpdatedAt  time.Time `gorm:"column:updated_at;type:datetime;not null" json:"updated_at"`
+	Id         uint   `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+	Name       string `gorm:"column:name;type:varchar(30);comment:名称" json:"name"`
+	Value      string `gorm:"column:value;type:varchar(255);not null;comment:API KEY value" json:"value"`
+	Type       string `gorm:"column:type;type:varchar(10);default:chat;not null;comment:用途（chat=>聊天，img=>图片）" json:"type"`
+	Provider   string `gorm:"column:provider;type:varchar(20);not null;default:'';comment:服务商（openai,anthropic,gemini）" json:"provider"`
+	LastUsedAt int64  `gorm:"column:last_used_at;type:int;not null;comment:最后使用时间" json:"last_used_at"`
+	ApiURL     string `gorm:"column:api_url;type:varchar(255);comment:API 地址" json:"api_url"`
+	Enabled    bool   `gorm:"column:enabled;type:tinyint(1);comment:是否启用" json:"enabled"`
+	ProxyURL   string `gorm:"column:proxy_url;type:varchar(100);comment:代理地址" json:"proxy_url"`
+	Weight     int    `gorm:"column:weight;type:int;not null;default:1;comment:调度权重" json:"weight"`
+	Rpm        int    `gorm:"column:rpm;type:int;not null;default:0;comment:每分钟请求数上限，0 表示不限制" json:"rpm"`
+	Tpm        int    `gorm:"column:tpm;type:int;not null;default:0;comment:每分钟 token 数上限，0 表示不限制" json:"tpm"`
+	// 自动禁用的原因，比如鉴权失败或者额度用尽
+	DisabledReason string    `gorm:"column:disabled_reason;type:varchar(255);not null;default:'';comment:禁用原因" json:"disabled_reason"`
+	CreatedAt      time.Time `gorm:"column:created_at;type:datetime;not null" json:"created_at"`
+	UpdatedAt      time.Time `gorm:"column:updated_at;type:datetime;not null" json:"updated_at"`
 }
 
 // TableName 表名
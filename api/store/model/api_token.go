@@ -0,0 +1,24 @@
+package model
+
+import (
+	"time"
+)
+
+// ApiToken 用户调用开放接口（OpenAI 兼容接口）的访问令牌
+type ApiToken struct {
+	Id         uint      `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+	UserId     uint      `gorm:"column:user_id;type:int(11);not null;index;comment:用户 ID" json:"user_id"`
+	Name       string    `gorm:"column:name;type:varchar(30);not null;comment:令牌名称" json:"name"`
+	Token      string    `gorm:"column:token;type:varchar(64);uniqueIndex;not null;comment:访问令牌的 SHA256 值" json:"token"`
+	TokenMask  string    `gorm:"column:token_mask;type:varchar(30);not null;default:'';comment:脱敏之后的令牌，用于列表展示" json:"token_mask"`
+	Models     string    `gorm:"column:models;type:text;default:null;comment:允许访问的模型ID json，为空不限制" json:"models"`
+	Enabled    bool      `gorm:"column:enabled;type:tinyint(1);not null;default:1;comment:是否启用" json:"enabled"`
+	ExpiredAt  int64     `gorm:"column:expired_at;type:int;not null;default:0;comment:过期时间，0 为永不过期" json:"expired_at"`
+	LastUsedAt int64     `gorm:"column:last_used_at;type:int;not null;default:0;comment:最后使用时间" json:"last_used_at"`
+	CreatedAt  time.Time `gorm:"column:created_at;type:datetime;not null" json:"created_at"`
+	UpdatedAt  time.Time `gorm:"column:updated_at;type:datetime;not null" json:"updated_at"`
+}
+
+func (m *ApiToken) TableName() string {
+	return "geekai_api_tokens"
+}
@@ -1,6 +1,7 @@
 package model
 
 import (
+	"geekai/core/types"
 	"time"
 )
 
@@ -17,6 +18,24 @@ type ChatApp struct {
 	ModelId   uint      `gorm:"column:model_id;type:int(11);not null;default:0;comment:绑定模型ID" json:"model_id"`
 	CreatedAt time.Time `gorm:"column:created_at;type:datetime;not null" json:"created_at"`
 	UpdatedAt time.Time `gorm:"column:updated_at;type:datetime;not null" json:"updated_at"`
+	// 上下文压缩：0 跟随模型设置，1 开启，2 关闭
+	ContextCompact int `gorm:"column:context_compact;type:tinyint;not null;default:0;comment:上下文压缩" json:"context_compact"`
+	// 绑定的知识库，对话时检索知识库的内容作为参考资料
+	KnowledgeIds string `gorm:"column:knowledge_ids;type:varchar(255);not null;default:'';comment:绑定的知识库 ID（JSON）" json:"knowledge_ids"`
+	// 用户创建的私有应用，审核通过之后公开给所有用户
+	UserId       uint                  `gorm:"column:user_id;type:int;not null;default:0;index;comment:创建者 ID，0 为系统应用" json:"user_id"`
+	Temperature  float32               `gorm:"column:temperature;type:float;not null;default:0;comment:模型温度，0 为跟随模型设置" json:"temperature"`
+	Tools        string                `gorm:"column:tools;type:varchar(255);not null;default:'';comment:默认启用的工具 ID（JSON）" json:"tools"`
+	ReviewStatus types.AppReviewStatus `gorm:"column:review_status;type:tinyint;not null;default:0;comment:审核状态" json:"review_status"`
+	ReviewRemark string                `gorm:"column:review_remark;type:varchar(255);not null;default:'';comment:审核意见" json:"review_remark"`
+	// 覆盖模型的请求参数，0 或者空为使用模型的设置
+	TopP           float32 `gorm:"column:top_p;type:float;not null;default:0;comment:核采样参数" json:"top_p"`
+	MaxTokens      int     `gorm:"column:max_tokens;type:int;not null;default:0;comment:最大响应长度" json:"max_tokens"`
+	ResponseFormat string  `gorm:"column:response_format;type:varchar(20);not null;default:'';comment:响应格式：text|json_object" json:"response_format"`
+	// 绑定的工具，对话时总是启用，不受用户选择影响
+	FunctionIds string `gorm:"column:function_ids;type:varchar(255);not null;default:'';comment:绑定的工具 ID（JSON）" json:"function_ids"`
+	// 提示词中的表单变量，用户在发送第一条消息之前填写
+	Variables string `gorm:"column:variables;type:text;comment:表单变量（JSON）" json:"variables"`
 }
 
 func (m *ChatApp) TableName() string {
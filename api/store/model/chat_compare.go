@@ -0,0 +1,21 @@
+package model
+
+import (
+	"time"
+)
+
+// ChatCompare 多模型对比，同一个提问同时发给多个模型，每个模型的回复都挂在提问下面，用户选出的最佳回答作为会话的正式回复
+type ChatCompare struct {
+	Id        uint      `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+	UserId    uint      `gorm:"column:user_id;type:int;not null;index;comment:用户 ID" json:"user_id"`
+	ChatId    string    `gorm:"column:chat_id;type:char(40);not null;index;comment:会话 ID" json:"chat_id"`
+	PromptId  uint      `gorm:"column:prompt_id;type:int;not null;default:0;comment:提问消息 ID" json:"prompt_id"`
+	ModelIds  string    `gorm:"column:model_ids;type:varchar(255);not null;comment:参与对比的模型 ID" json:"model_ids"`
+	WinnerId  uint      `gorm:"column:winner_id;type:int;not null;default:0;comment:最佳回答的消息 ID" json:"winner_id"`
+	CreatedAt time.Time `gorm:"column:created_at;type:datetime;not null" json:"created_at"`
+	UpdatedAt time.Time `gorm:"column:updated_at;type:datetime;not null" json:"updated_at"`
+}
+
+func (m *ChatCompare) TableName() string {
+	return "geekai_chat_compares"
+}
@@ -14,6 +14,13 @@ type ChatItem struct {
 	Model     string    `gorm:"column:model;type:varchar(30);comment:模型名称" json:"model"`
 	CreatedAt time.Time `gorm:"column:created_at;type:datetime;not null;comment:创建时间" json:"created_at"`
 	UpdatedAt time.Time `gorm:"column:updated_at;type:datetime;not null;comment:更新时间" json:"updated_at"`
+	// 当前激活分支的最后一条消息
+	ActiveMsgId uint `gorm:"column:active_msg_id;type:int;not null;default:0;comment:当前分支消息 ID" json:"active_msg_id"`
+	// 上下文压缩的滚动摘要，SummaryMsgId 为摘要覆盖到的最后一条消息
+	Summary      string `gorm:"column:summary;type:text;not null;comment:历史对话摘要" json:"summary"`
+	SummaryMsgId uint   `gorm:"column:summary_msg_id;type:int;not null;default:0;comment:摘要覆盖的最后一条消息 ID" json:"summary_msg_id"`
+	// 用户填写的应用表单变量，会话中的每次对话都使用这些值渲染提示词
+	Variables string `gorm:"column:variables;type:text;comment:应用表单变量（JSON）" json:"variables"`
 }
 
 func (m *ChatItem) TableName() string {
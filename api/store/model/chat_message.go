@@ -5,19 +5,30 @@ import (
 )
 
 type ChatMessage struct {
-	Id          uint      `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
-	UserId      uint      `gorm:"column:user_id;type:int(11);not null;index;comment:用户 ID" json:"user_id"`
-	ChatId      string    `gorm:"column:chat_id;type:char(40);not null;index;comment:会话 ID" json:"chat_id"`
-	Type        string    `gorm:"column:type;type:varchar(10);not null;comment:类型：prompt|reply" json:"type"`
-	Icon        string    `gorm:"column:icon;type:varchar(255);not null;comment:角色图标" json:"icon"`
-	RoleId      uint      `gorm:"column:role_id;type:int(11);not null;comment:角色 ID" json:"role_id"`
-	Model       string    `gorm:"column:model;type:varchar(255);comment:模型名称" json:"model"`
-	Content     string    `gorm:"column:content;type:text;not null;comment:聊天内容" json:"content"`
-	Tokens      int       `gorm:"column:tokens;type:smallint;not null;comment:耗费 token 数量" json:"tokens"`
-	TotalTokens int       `gorm:"column:total_tokens;type:int;not null;comment:消耗总Token长度" json:"total_tokens"`
-	UseContext  bool      `gorm:"column:use_context;type:tinyint(1);not null;comment:是否允许作为上下文语料" json:"use_context"`
-	CreatedAt   time.Time `gorm:"column:created_at;type:datetime;not null" json:"created_at"`
-	UpdatedAt   time.Time `gorm:"column:updated_at;type:datetime;not null" json:"updated_at"`
+	Id          uint   `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+	UserId      uint   `gorm:"column:user_id;type:int(11);not null;index;comment:用户 ID" json:"user_id"`
+	ChatId      string `gorm:"column:chat_id;type:char(40);not null;index;comment:会话 ID" json:"chat_id"`
+	ParentId    uint   `gorm:"column:parent_id;type:int;not null;default:0;comment:上一条消息 ID" json:"parent_id"`
+	Type        string `gorm:"column:type;type:varchar(10);not null;comment:类型：prompt|reply" json:"type"`
+	Icon        string `gorm:"column:icon;type:varchar(255);not null;comment:角色图标" json:"icon"`
+	RoleId      uint   `gorm:"column:role_id;type:int(11);not null;comment:角色 ID" json:"role_id"`
+	Model       string `gorm:"column:model;type:varchar(255);comment:模型名称" json:"model"`
+	Content     string `gorm:"column:content;type:text;not null;comment:聊天内容" json:"content"`
+	Tokens      int    `gorm:"column:tokens;type:int;not null;comment:耗费 token 数量" json:"tokens"`
+	TotalTokens int    `gorm:"column:total_tokens;type:int;not null;comment:消耗总Token长度" json:"total_tokens"`
+	// 上游返回的 token 用量明细，只记录在回复消息上
+	PromptTokens     int       `gorm:"column:prompt_tokens;type:int;not null;default:0;comment:输入 token 数量" json:"prompt_tokens"`
+	CompletionTokens int       `gorm:"column:completion_tokens;type:int;not null;default:0;comment:输出 token 数量" json:"completion_tokens"`
+	ReasoningTokens  int       `gorm:"column:reasoning_tokens;type:int;not null;default:0;comment:推理 token 数量" json:"reasoning_tokens"`
+	CachedTokens     int       `gorm:"column:cached_tokens;type:int;not null;default:0;comment:缓存命中 token 数量" json:"cached_tokens"`
+	UsageEstimated   bool      `gorm:"column:usage_estimated;type:tinyint(1);not null;default:0;comment:用量是否为估算值" json:"usage_estimated"`
+	ToolCalls        string    `gorm:"column:tool_calls;type:text;not null;comment:工具调用记录" json:"tool_calls"`
+	Citations        string    `gorm:"column:citations;type:text;not null;comment:知识库引用" json:"citations"`
+	SearchText       string    `gorm:"column:search_text;type:text;not null;comment:全文检索的纯文本内容" json:"-"`
+	UseContext       bool      `gorm:"column:use_context;type:tinyint(1);not null;comment:是否允许作为上下文语料" json:"use_context"`
+	CompareId        uint      `gorm:"column:compare_id;type:int;not null;default:0;index;comment:多模型对比 ID" json:"compare_id"`
+	CreatedAt        time.Time `gorm:"column:created_at;type:datetime;not null" json:"created_at"`
+	UpdatedAt        time.Time `gorm:"column:updated_at;type:datetime;not null" json:"updated_at"`
 }
 
 func (m *ChatMessage) TableName() string {
@@ -5,15 +5,19 @@ import (
 )
 
 type ChatModel struct {
-	Id          uint      `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
-	Desc        string    `gorm:"column:desc;type:varchar(1024);not null;default:'';comment:模型类型描述" json:"desc"`
-	Tag         string    `gorm:"column:tag;type:varchar(1024);not null;default:'';comment:模型标签" json:"tag"`
-	Type        string    `gorm:"column:type;type:varchar(10);not null;default:chat;comment:模型类型（chat,img）" json:"type"`
-	Name        string    `gorm:"column:name;type:varchar(255);not null;comment:模型名称" json:"name"`
-	Value       string    `gorm:"column:value;type:varchar(255);not null;comment:模型值" json:"value"`
-	SortNum     int       `gorm:"column:sort_num;type:tinyint(1);not null;comment:排序数字" json:"sort_num"`
-	Enabled     bool      `gorm:"column:enabled;type:tinyint(1);not null;default:0;comment:是否启用模型" json:"enabled"`
-	Power       int       `gorm:"column:power;type:smallint;not null;comment:消耗算力点数" json:"power"`
+	Id      uint   `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+	Desc    string `gorm:"column:desc;type:varchar(1024);not null;default:'';comment:模型类型描述" json:"desc"`
+	Tag     string `gorm:"column:tag;type:varchar(1024);not null;default:'';comment:模型标签" json:"tag"`
+	Type    string `gorm:"column:type;type:varchar(10);not null;default:chat;comment:模型类型（chat,img）" json:"type"`
+	Name    string `gorm:"column:name;type:varchar(255);not null;comment:模型名称" json:"name"`
+	Value   string `gorm:"column:value;type:varchar(255);not null;comment:模型值" json:"value"`
+	SortNum int    `gorm:"column:sort_num;type:tinyint(1);not null;comment:排序数字" json:"sort_num"`
+	Enabled bool   `gorm:"column:enabled;type:tinyint(1);not null;default:0;comment:是否启用模型" json:"enabled"`
+	Power   int    `gorm:"column:power;type:smallint;not null;comment:消耗算力点数" json:"power"`
+	// 按 token 计费，设置了输入或者输出价格之后不再按照 Power 固定扣费
+	InputPower  float64   `gorm:"column:input_power;type:decimal(10,4);not null;default:0;comment:每 1K 输入 token 消耗算力" json:"input_power"`
+	OutputPower float64   `gorm:"column:output_power;type:decimal(10,4);not null;default:0;comment:每 1K 输出 token 消耗算力" json:"output_power"`
+	CachedPower float64   `gorm:"column:cached_power;type:decimal(10,4);not null;default:0;comment:每 1K 缓存命中 token 消耗算力" json:"cached_power"`
 	Temperature float32   `gorm:"column:temperature;type:float(3,1);not null;default:1.0;comment:模型创意度" json:"temperature"`
 	MaxTokens   int       `gorm:"column:max_tokens;type:int;not null;default:1024;comment:最大响应长度" json:"max_tokens"`
 	MaxContext  int       `gorm:"column:max_context;type:int;not null;default:4096;comment:最大上下文长度" json:"max_context"`
@@ -0,0 +1,28 @@
+package model
+
+import (
+	"time"
+)
+
+// ChatShare 对话分享，保存的是分享时的消息快照，之后原对话的修改和删除不影响分享的内容
+type ChatShare struct {
+	Id        uint      `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+	ShareId   string    `gorm:"column:share_id;type:varchar(32);uniqueIndex;not null;comment:分享 ID" json:"share_id"`
+	UserId    uint      `gorm:"column:user_id;type:int;not null;index;comment:用户 ID" json:"user_id"`
+	ChatId    string    `gorm:"column:chat_id;type:char(40);not null;index;comment:会话 ID" json:"chat_id"`
+	MsgId     uint      `gorm:"column:msg_id;type:int;not null;default:0;comment:分享的最后一条消息 ID" json:"msg_id"`
+	Title     string    `gorm:"column:title;type:varchar(100);not null;comment:会话标题" json:"title"`
+	RoleId    uint      `gorm:"column:role_id;type:int;not null;comment:应用 ID" json:"role_id"`
+	ModelId   uint      `gorm:"column:model_id;type:int;not null;default:0;comment:模型 ID" json:"model_id"`
+	Model     string    `gorm:"column:model;type:varchar(30);comment:模型名称" json:"model"`
+	Messages  string    `gorm:"column:messages;type:mediumtext;not null;comment:消息快照" json:"messages"`
+	MsgNum    int       `gorm:"column:msg_num;type:int;not null;default:0;comment:消息数量" json:"msg_num"`
+	Views     int       `gorm:"column:views;type:int;not null;default:0;comment:浏览次数" json:"views"`
+	ExpiredAt int64     `gorm:"column:expired_at;type:int;not null;default:0;comment:过期时间，0 为永不过期" json:"expired_at"`
+	CreatedAt time.Time `gorm:"column:created_at;type:datetime;not null" json:"created_at"`
+	UpdatedAt time.Time `gorm:"column:updated_at;type:datetime;not null" json:"updated_at"`
+}
+
+func (m *ChatShare) TableName() string {
+	return "geekai_chat_shares"
+}
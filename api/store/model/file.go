@@ -10,6 +10,7 @@ type File struct {
 	URL       string    `gorm:"column:url;type:varchar(255);not null;comment:文件地址" json:"url"`
 	Ext       string    `gorm:"column:ext;type:varchar(10);not null;comment:文件后缀" json:"ext"`
 	Size      int64     `gorm:"column:size;type:bigint;not null;default:0;comment:文件大小" json:"size"`
+	Content   string    `gorm:"column:content;type:mediumtext;comment:提取的文本内容" json:"-"`
 	CreatedAt time.Time `gorm:"column:created_at;type:datetime;not null;comment:创建时间" json:"created_at"`
 }
 
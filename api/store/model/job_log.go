@@ -0,0 +1,19 @@
+package model
+
+import "time"
+
+// JobLog 后台任务的状态变化记录，所有生成服务（MJ，SD，DALL-E，Suno，视频，即梦）的任务都记录在这里
+type JobLog struct {
+	Id         uint      `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+	Type       string    `gorm:"column:type;type:varchar(20);not null;index:idx_job;comment:任务类型" json:"type"`
+	JobId      uint      `gorm:"column:job_id;type:int;not null;index:idx_job;comment:任务 ID" json:"job_id"`
+	UserId     uint      `gorm:"column:user_id;type:int;not null;default:0;comment:用户 ID" json:"user_id"`
+	FromStatus string    `gorm:"column:from_status;type:varchar(20);not null;comment:原状态" json:"from_status"`
+	ToStatus   string    `gorm:"column:to_status;type:varchar(20);not null;comment:新状态" json:"to_status"`
+	Message    string    `gorm:"column:message;type:varchar(1024);comment:说明" json:"message"`
+	CreatedAt  time.Time `gorm:"column:created_at;type:datetime;not null" json:"created_at"`
+}
+
+func (m *JobLog) TableName() string {
+	return "geekai_job_logs"
+}
@@ -0,0 +1,61 @@
+package model
+
+import (
+	"time"
+)
+
+// KnowledgeBase 知识库，UserId 为 0 的是管理员创建的知识库，可以绑定到应用
+type KnowledgeBase struct {
+	Id           uint      `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+	UserId       uint      `gorm:"column:user_id;type:int;not null;default:0;index;comment:用户 ID" json:"user_id"`
+	Name         string    `gorm:"column:name;type:varchar(50);not null;comment:知识库名称" json:"name"`
+	Description  string    `gorm:"column:description;type:varchar(255);not null;default:'';comment:知识库描述" json:"description"`
+	ModelId      uint      `gorm:"column:model_id;type:int;not null;comment:向量模型 ID" json:"model_id"`
+	ChunkSize    int       `gorm:"column:chunk_size;type:int;not null;default:500;comment:分段长度" json:"chunk_size"`
+	ChunkOverlap int       `gorm:"column:chunk_overlap;type:int;not null;default:50;comment:分段重叠长度" json:"chunk_overlap"`
+	TopK         int       `gorm:"column:top_k;type:int;not null;default:5;comment:检索返回的分段数量" json:"top_k"`
+	DocNum       int       `gorm:"column:doc_num;type:int;not null;default:0;comment:文档数量" json:"doc_num"`
+	CreatedAt    time.Time `gorm:"column:created_at;type:datetime;not null" json:"created_at"`
+	UpdatedAt    time.Time `gorm:"column:updated_at;type:datetime;not null" json:"updated_at"`
+}
+
+func (m *KnowledgeBase) TableName() string {
+	return "geekai_knowledge_bases"
+}
+
+// KnowledgeDoc 知识库文档
+type KnowledgeDoc struct {
+	Id        uint      `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+	KbId      uint      `gorm:"column:kb_id;type:int;not null;index;comment:知识库 ID" json:"kb_id"`
+	UserId    uint      `gorm:"column:user_id;type:int;not null;default:0;comment:用户 ID" json:"user_id"`
+	Name      string    `gorm:"column:name;type:varchar(255);not null;comment:文件名" json:"name"`
+	URL       string    `gorm:"column:url;type:varchar(255);not null;comment:文件地址" json:"url"`
+	Ext       string    `gorm:"column:ext;type:varchar(10);not null;default:'';comment:文件后缀" json:"ext"`
+	Size      int64     `gorm:"column:size;type:bigint;not null;default:0;comment:文件大小" json:"size"`
+	Status    string    `gorm:"column:status;type:varchar(20);not null;comment:处理状态（pending,processing,done,failed）" json:"status"`
+	ErrMsg    string    `gorm:"column:err_msg;type:varchar(1024);not null;default:'';comment:错误信息" json:"err_msg"`
+	ChunkNum  int       `gorm:"column:chunk_num;type:int;not null;default:0;comment:分段数量" json:"chunk_num"`
+	Tokens    int       `gorm:"column:tokens;type:int;not null;default:0;comment:向量化消耗的 token 数量" json:"tokens"`
+	CreatedAt time.Time `gorm:"column:created_at;type:datetime;not null" json:"created_at"`
+	UpdatedAt time.Time `gorm:"column:updated_at;type:datetime;not null" json:"updated_at"`
+}
+
+func (m *KnowledgeDoc) TableName() string {
+	return "geekai_knowledge_docs"
+}
+
+// KnowledgeChunk 文档分段，使用本地向量存储时向量保存在 Embedding 字段
+type KnowledgeChunk struct {
+	Id        uint      `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+	KbId      uint      `gorm:"column:kb_id;type:int;not null;index;comment:知识库 ID" json:"kb_id"`
+	DocId     uint      `gorm:"column:doc_id;type:int;not null;index;comment:文档 ID" json:"doc_id"`
+	Seq       int       `gorm:"column:seq;type:int;not null;comment:分段序号" json:"seq"`
+	Content   string    `gorm:"column:content;type:text;not null;comment:分段内容" json:"content"`
+	Tokens    int       `gorm:"column:tokens;type:int;not null;default:0;comment:token 数量" json:"tokens"`
+	Embedding []byte    `gorm:"column:embedding;type:mediumblob;comment:向量（float32 小端序）" json:"-"`
+	CreatedAt time.Time `gorm:"column:created_at;type:datetime;not null" json:"created_at"`
+}
+
+func (m *KnowledgeChunk) TableName() string {
+	return "geekai_knowledge_chunks"
+}
@@ -0,0 +1,40 @@
+package model
+
+import (
+	"time"
+)
+
+// McpServer MCP 服务配置
+type McpServer struct {
+	Id        uint   `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+	Name      string `gorm:"column:name;type:varchar(50);not null;comment:服务名称" json:"name"`
+	Transport string `gorm:"column:transport;type:varchar(10);not null;comment:传输方式（stdio,http,sse）" json:"transport"`
+	Command   string `gorm:"column:command;type:varchar(255);not null;default:'';comment:启动命令" json:"command"`
+	Args      string `gorm:"column:args;type:text;comment:命令参数（JSON）" json:"args"`
+	Env       string `gorm:"column:env;type:text;comment:环境变量（JSON）" json:"env"`
+	URL       string `gorm:"column:url;type:varchar(255);not null;default:'';comment:服务地址" json:"url"`
+	Headers   string `gorm:"column:headers;type:text;comment:请求头（JSON）" json:"headers"`
+	Enabled   bool   `gorm:"column:enabled;type:tinyint(1);not null;default:0;comment:是否启用" json:"enabled"`
+	// 最近一次同步工具列表的结果
+	ToolNum      int       `gorm:"column:tool_num;type:int;not null;default:0;comment:工具数量" json:"tool_num"`
+	LastSyncedAt int64     `gorm:"column:last_synced_at;type:int;not null;default:0;comment:最后同步时间" json:"last_synced_at"`
+	ErrMsg       string    `gorm:"column:err_msg;type:varchar(1024);not null;default:'';comment:同步错误信息" json:"err_msg"`
+	CreatedAt    time.Time `gorm:"column:created_at;type:datetime;not null" json:"created_at"`
+	UpdatedAt    time.Time `gorm:"column:updated_at;type:datetime;not null" json:"updated_at"`
+}
+
+func (m *McpServer) TableName() string {
+	return "geekai_mcp_servers"
+}
+
+// UserMcpServer 用户启用的 MCP 服务
+type UserMcpServer struct {
+	Id        uint      `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+	UserId    uint      `gorm:"column:user_id;type:int;not null;uniqueIndex:idx_user_server;comment:用户 ID" json:"user_id"`
+	ServerId  uint      `gorm:"column:server_id;type:int;not null;uniqueIndex:idx_user_server;comment:MCP 服务 ID" json:"server_id"`
+	CreatedAt time.Time `gorm:"column:created_at;type:datetime;not null" json:"created_at"`
+}
+
+func (m *UserMcpServer) TableName() string {
+	return "geekai_user_mcp_servers"
+}
@@ -0,0 +1,363 @@
+package store
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"geekai/utils"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	streamGroup       = "geekai"
+	streamReadBlock   = time.Second // 优先通道没有消息的时候，等待普通通道消息的时间，等待期间到达的优先消息最多延迟这么久
+	streamClaimBatch  = 100
+	streamConsumerTTL = 24 * time.Hour // 没有待处理消息的消费者空闲多久之后删除
+	streamRangeLimit  = 1000           // 计算排队位置的时候每条通道最多读取的消息数量
+)
+
+// StreamMessage 从可靠队列取出的消息，处理完成之后需要调用 Ack
+type StreamMessage struct {
+	Id         string
+	Body       string
+	Deliveries int64  // 第几次投递
+	stream     string // 消息所在的通道
+}
+
+// DeadLetter 多次投递都没有处理完成的消息
+type DeadLetter struct {
+	Id         string `json:"id"`
+	Body       string `json:"body"`
+	Deliveries int64  `json:"deliveries"`
+	Reason     string `json:"reason"`
+	FailedAt   int64  `json:"failed_at"`
+}
+
+// RedisStreamQueue 基于 Redis Stream 消费组的可靠队列。
+// 取出的消息在 Ack 之前一直保留在待处理列表里，进程崩溃之后超过可见性超时的消息会被其他消费者重新投递，
+// 投递次数超过上限的消息转入死信队列。队列分为优先和普通两条通道，优先通道的消息先投递
+type RedisStreamQueue struct {
+	name          string
+	consumer      string
+	client        *redis.Client
+	ctx           context.Context
+	visibility    time.Duration
+	maxDeliveries int64
+	lock          sync.Mutex
+	claimed       []StreamMessage // 从其他消费者认领的消息，优先投递
+}
+
+func NewRedisStreamQueue(name string, client *redis.Client, visibility time.Duration, maxDeliveries int) *RedisStreamQueue {
+	q := &RedisStreamQueue{
+		name:          name,
+		consumer:      utils.RandomHex(8),
+		client:        client,
+		ctx:           context.Background(),
+		visibility:    visibility,
+		maxDeliveries: int64(maxDeliveries),
+	}
+	for _, stream := range q.streams() {
+		_ = q.createGroup(stream)
+	}
+	return q
+}
+
+func (q *RedisStreamQueue) createGroup(stream string) error {
+	err := q.client.XGroupCreateMkStream(q.ctx, stream, streamGroup, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	return nil
+}
+
+func (q *RedisStreamQueue) priorityName() string {
+	return q.name + ":priority"
+}
+
+func (q *RedisStreamQueue) deadName() string {
+	return q.name + ":dead"
+}
+
+// 按照投递顺序排列的通道
+func (q *RedisStreamQueue) streams() []string {
+	return []string{q.priorityName(), q.name}
+}
+
+func (q *RedisStreamQueue) Push(value any) error {
+	return q.push(q.name, value)
+}
+
+// PushPriority 加入优先通道，优先通道的消息都投递完之后才会投递普通通道的消息
+func (q *RedisStreamQueue) PushPriority(value any) error {
+	return q.push(q.priorityName(), value)
+}
+
+func (q *RedisStreamQueue) push(stream string, value any) error {
+	return q.client.XAdd(q.ctx, &redis.XAddArgs{
+		Stream: stream,
+		Values: map[string]any{"body": utils.JsonEncode(value)},
+	}).Err()
+}
+
+// Pop 阻塞取出一条消息，解析到 value
+func (q *RedisStreamQueue) Pop(value any) (StreamMessage, error) {
+	for {
+		msg, ok := q.takeClaimed()
+		if !ok {
+			var err error
+			msg, ok, err = q.read(q.priorityName(), -1)
+			if err == nil && !ok {
+				msg, ok, err = q.read(q.name, streamReadBlock)
+			}
+			if err != nil {
+				return StreamMessage{}, err
+			}
+			if !ok {
+				continue
+			}
+		}
+
+		if err := utils.JsonDecode(msg.Body, value); err != nil {
+			// 无法解析的消息重试也不会成功
+			q.bury(msg, fmt.Sprintf("decode message with error: %v", err))
+			continue
+		}
+		return msg, nil
+	}
+}
+
+// 从通道读取一条新消息，block 小于 0 的时候不等待
+func (q *RedisStreamQueue) read(stream string, block time.Duration) (StreamMessage, bool, error) {
+	streams, err := q.client.XReadGroup(q.ctx, &redis.XReadGroupArgs{
+		Group:    streamGroup,
+		Consumer: q.consumer,
+		Streams:  []string{stream, ">"},
+		Count:    1,
+		Block:    block,
+	}).Result()
+	if errors.Is(err, redis.Nil) {
+		return StreamMessage{}, false, nil
+	}
+	if err != nil {
+		// Stream 被删除之后重新创建消费组
+		if strings.HasPrefix(err.Error(), "NOGROUP") {
+			_ = q.createGroup(stream)
+		}
+		return StreamMessage{}, false, err
+	}
+	if len(streams) == 0 || len(streams[0].Messages) == 0 {
+		return StreamMessage{}, false, nil
+	}
+	return toStreamMessage(stream, streams[0].Messages[0], 1), true, nil
+}
+
+// Ack 确认消息已经处理完成
+func (q *RedisStreamQueue) Ack(msg StreamMessage) error {
+	if err := q.client.XAck(q.ctx, msg.stream, streamGroup, msg.Id).Err(); err != nil {
+		return err
+	}
+	return q.client.XDel(q.ctx, msg.stream, msg.Id).Err()
+}
+
+// Waiting 等待投递的消息，按照投递顺序排列，不包括已经取出还没有确认的消息
+func (q *RedisStreamQueue) Waiting() ([]string, error) {
+	items := make([]string, 0)
+	for _, stream := range q.streams() {
+		pending, err := q.client.XPendingExt(q.ctx, &redis.XPendingExtArgs{
+			Stream: stream,
+			Group:  streamGroup,
+			Start:  "-",
+			End:    "+",
+			Count:  streamRangeLimit,
+		}).Result()
+		if err != nil {
+			return nil, err
+		}
+		delivered := make(map[string]bool, len(pending))
+		for _, p := range pending {
+			delivered[p.ID] = true
+		}
+		messages, err := q.client.XRangeN(q.ctx, stream, "-", "+", streamRangeLimit).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range messages {
+			if !delivered[m.ID] {
+				items = append(items, fmt.Sprint(m.Values["body"]))
+			}
+		}
+	}
+	return items, nil
+}
+
+// Reclaim 认领超过可见性超时还没有确认的消息，重新投递。投递次数达到上限的消息转入死信队列，返回新增的死信
+func (q *RedisStreamQueue) Reclaim() ([]DeadLetter, error) {
+	// 上次认领的消息还没有投递完
+	q.lock.Lock()
+	busy := len(q.claimed) > 0
+	q.lock.Unlock()
+	if busy {
+		return nil, nil
+	}
+
+	deadLetters := make([]DeadLetter, 0)
+	for _, stream := range q.streams() {
+		items, err := q.reclaim(stream)
+		if err != nil {
+			return deadLetters, err
+		}
+		deadLetters = append(deadLetters, items...)
+		q.removeIdleConsumers(stream)
+	}
+	return deadLetters, nil
+}
+
+func (q *RedisStreamQueue) reclaim(stream string) ([]DeadLetter, error) {
+	pending, err := q.client.XPendingExt(q.ctx, &redis.XPendingExtArgs{
+		Stream: stream,
+		Group:  streamGroup,
+		Start:  "-",
+		End:    "+",
+		Count:  streamClaimBatch,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	deadLetters := make([]DeadLetter, 0)
+	for _, p := range pending {
+		if p.Idle < q.visibility {
+			continue
+		}
+		// 认领的时候再检查一次空闲时间，多个消费者同时认领只有一个能成功
+		messages, err := q.client.XClaim(q.ctx, &redis.XClaimArgs{
+			Stream:   stream,
+			Group:    streamGroup,
+			Consumer: q.consumer,
+			MinIdle:  q.visibility,
+			Messages: []string{p.ID},
+		}).Result()
+		if err != nil || len(messages) == 0 {
+			continue
+		}
+		msg := toStreamMessage(stream, messages[0], p.RetryCount+1)
+		if p.RetryCount >= q.maxDeliveries {
+			if dl, ok := q.bury(msg, fmt.Sprintf("投递 %d 次都没有处理完成", p.RetryCount)); ok {
+				deadLetters = append(deadLetters, dl)
+			}
+			continue
+		}
+		q.lock.Lock()
+		q.claimed = append(q.claimed, msg)
+		q.lock.Unlock()
+	}
+	return deadLetters, nil
+}
+
+// DeadLetters 死信列表，最新的在前面
+func (q *RedisStreamQueue) DeadLetters(page int, pageSize int) ([]DeadLetter, int64, error) {
+	total, err := q.client.XLen(q.ctx, q.deadName()).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	messages, err := q.client.XRevRangeN(q.ctx, q.deadName(), "+", "-", int64(page*pageSize)).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	items := make([]DeadLetter, 0, pageSize)
+	for i := (page - 1) * pageSize; i < len(messages); i++ {
+		items = append(items, toDeadLetter(messages[i]))
+	}
+	return items, total, nil
+}
+
+// DeadLetter 读取一条死信
+func (q *RedisStreamQueue) DeadLetter(id string) (DeadLetter, error) {
+	messages, err := q.client.XRange(q.ctx, q.deadName(), id, id).Result()
+	if err != nil {
+		return DeadLetter{}, err
+	}
+	if len(messages) == 0 {
+		return DeadLetter{}, errors.New("死信不存在")
+	}
+	return toDeadLetter(messages[0]), nil
+}
+
+// RemoveDeadLetter 删除死信
+func (q *RedisStreamQueue) RemoveDeadLetter(id string) error {
+	return q.client.XDel(q.ctx, q.deadName(), id).Err()
+}
+
+func (q *RedisStreamQueue) takeClaimed() (StreamMessage, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.claimed) == 0 {
+		return StreamMessage{}, false
+	}
+	msg := q.claimed[0]
+	q.claimed = q.claimed[1:]
+	return msg, true
+}
+
+// 消息转入死信队列
+func (q *RedisStreamQueue) bury(msg StreamMessage, reason string) (DeadLetter, bool) {
+	dl := DeadLetter{
+		Body:       msg.Body,
+		Deliveries: msg.Deliveries,
+		Reason:     reason,
+		FailedAt:   time.Now().Unix(),
+	}
+	id, err := q.client.XAdd(q.ctx, &redis.XAddArgs{
+		Stream: q.deadName(),
+		Values: map[string]any{
+			"body":       dl.Body,
+			"deliveries": dl.Deliveries,
+			"reason":     dl.Reason,
+			"failed_at":  dl.FailedAt,
+		},
+	}).Result()
+	if err != nil {
+		return dl, false
+	}
+	dl.Id = id
+	_ = q.Ack(msg)
+	return dl, true
+}
+
+// 进程重启之后旧的消费者不会再使用，待处理的消息都被认领之后删除
+func (q *RedisStreamQueue) removeIdleConsumers(stream string) {
+	consumers, err := q.client.XInfoConsumers(q.ctx, stream, streamGroup).Result()
+	if err != nil {
+		return
+	}
+	for _, c := range consumers {
+		if c.Name != q.consumer && c.Pending == 0 && time.Duration(c.Idle)*time.Millisecond > streamConsumerTTL {
+			q.client.XGroupDelConsumer(q.ctx, stream, streamGroup, c.Name)
+		}
+	}
+}
+
+func toStreamMessage(stream string, m redis.XMessage, deliveries int64) StreamMessage {
+	return StreamMessage{Id: m.ID, Body: fmt.Sprint(m.Values["body"]), Deliveries: deliveries, stream: stream}
+}
+
+func toDeadLetter(m redis.XMessage) DeadLetter {
+	return DeadLetter{
+		Id:         m.ID,
+		Body:       fmt.Sprint(m.Values["body"]),
+		Deliveries: int64(utils.IntValue(fmt.Sprint(m.Values["deliveries"]), 0)),
+		Reason:     fmt.Sprint(m.Values["reason"]),
+		FailedAt:   int64(utils.IntValue(fmt.Sprint(m.Values["failed_at"]), 0)),
+	}
+}
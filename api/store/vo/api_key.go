@@ -3,11 +3,16 @@ package vo
 // ApiKey OpenAI API 模型
 type ApiKey struct {
 	BaseVo
-	Name       string `json:"name"`
-	Type       string `json:"type"`
-	Value      string `json:"value"` // API Key 的值
-	ApiURL     string `json:"api_url"`
-	Enabled    bool   `json:"enabled"`
-	ProxyURL   string `json:"proxy_url"`
-	LastUsedAt int64  `json:"last_used_at"` // 最后使用时间
+	Name           string `json:"name"`
+	Type           string `json:"type"`
+	Provider       string `json:"provider"` // 服务商，为空则根据 API 地址自动识别
+	Value          string `json:"value"`    // API Key 的值
+	ApiURL         string `json:"api_url"`
+	Enabled        bool   `json:"enabled"`
+	ProxyURL       string `json:"proxy_url"`
+	Weight         int    `json:"weight"`          // 调度权重，权重越大被选中的概率越高
+	Rpm            int    `json:"rpm"`             // 每分钟请求数上限
+	Tpm            int    `json:"tpm"`             // 每分钟 token 数上限
+	DisabledReason string `json:"disabled_reason"` // 自动禁用的原因
+	LastUsedAt     int64  `json:"last_used_at"`    // 最后使用时间
 }
@@ -0,0 +1,12 @@
+package vo
+
+// ApiToken 开放接口访问令牌
+type ApiToken struct {
+	BaseVo
+	Name       string `json:"name"`
+	Token      string `json:"token"`
+	Models     []uint `json:"models"` // 允许访问的模型，为空不限制
+	Enabled    bool   `json:"enabled"`
+	ExpiredAt  int64  `json:"expired_at"`
+	LastUsedAt int64  `json:"last_used_at"`
+}
@@ -15,4 +15,19 @@ type ChatApp struct {
 	ModelId   uint            `json:"model_id"`   // 绑定模型 ID
 	ModelName string          `json:"model_name"` // 模型名称
 	TypeName  string          `json:"type_name"`  // 分类名称
+
+	ContextCompact int    `json:"context_compact"` // 上下文压缩：0 跟随模型设置，1 开启，2 关闭
+	KnowledgeIds   []uint `json:"knowledge_ids"`   // 绑定的知识库
+
+	UserId       uint                  `json:"user_id"`       // 创建者 ID，0 为系统应用
+	Temperature  float32               `json:"temperature"`   // 模型温度，0 为跟随模型设置
+	Tools        []uint                `json:"tools"`         // 默认启用的工具
+	ReviewStatus types.AppReviewStatus `json:"review_status"` // 审核状态
+	ReviewRemark string                `json:"review_remark"` // 审核意见
+
+	TopP           float32             `json:"top_p"`           // 核采样参数，0 为跟随模型设置
+	MaxTokens      int                 `json:"max_tokens"`      // 最大响应长度，0 为跟随模型设置
+	ResponseFormat string              `json:"response_format"` // 响应格式：text, json_object
+	FunctionIds    []uint              `json:"function_ids"`    // 绑定的工具，对话时总是启用
+	Variables      []types.AppVariable `json:"variables"`       // 提示词中的表单变量
 }
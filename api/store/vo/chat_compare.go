@@ -0,0 +1,12 @@
+package vo
+
+// ChatCompare 多模型对比结果
+type ChatCompare struct {
+	Id        uint          `json:"id"`
+	ChatId    string        `json:"chat_id"`
+	PromptId  uint          `json:"prompt_id"`
+	ModelIds  []uint        `json:"model_ids"`
+	WinnerId  uint          `json:"winner_id"`
+	Replies   []ChatMessage `json:"replies"`
+	CreatedAt int64         `json:"created_at"`
+}
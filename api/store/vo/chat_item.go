@@ -10,4 +10,6 @@ type ChatItem struct {
 	ModelId  uint   `json:"model_id"`
 	Model    string `json:"model"`
 	Title    string `json:"title"`
+
+	Variables map[string]string `json:"variables,omitempty"` // 用户填写的应用表单变量
 }
@@ -1,21 +1,34 @@
 package vo
 
+import "geekai/core/types"
+
 type MsgContent struct {
 	Text  string `json:"text"`
 	Files []File `json:"files"`
 }
 
 type ChatMessage struct {
-	Id         uint       `json:"id"`
-	CreatedAt  int64      `json:"created_at"`
-	UpdatedAt  int64      `json:"updated_at"`
-	ChatId     string     `json:"chat_id"`
-	UserId     uint       `json:"user_id"`
-	RoleId     uint       `json:"role_id"`
-	Model      string     `json:"model"`
-	Type       string     `json:"type"`
-	Icon       string     `json:"icon"`
-	Tokens     int        `json:"tokens"`
-	Content    MsgContent `json:"content"`
-	UseContext bool       `json:"use_context"`
+	Id               uint              `json:"id"`
+	CreatedAt        int64             `json:"created_at"`
+	UpdatedAt        int64             `json:"updated_at"`
+	ChatId           string            `json:"chat_id"`
+	ParentId         uint              `json:"parent_id"`
+	UserId           uint              `json:"user_id"`
+	RoleId           uint              `json:"role_id"`
+	Model            string            `json:"model"`
+	Type             string            `json:"type"`
+	Icon             string            `json:"icon"`
+	Tokens           int               `json:"tokens"`
+	TotalTokens      int               `json:"total_tokens"`
+	PromptTokens     int               `json:"prompt_tokens"`
+	CompletionTokens int               `json:"completion_tokens"`
+	ReasoningTokens  int               `json:"reasoning_tokens"`
+	CachedTokens     int               `json:"cached_tokens"`
+	UsageEstimated   bool              `json:"usage_estimated"` // 上游没有返回用量，token 数量为估算值
+	ToolCalls        []types.ToolTrace `json:"tool_calls"`      // 工具调用记录
+	Citations        []types.Citation  `json:"citations"`       // 知识库引用
+	Content          MsgContent        `json:"content"`
+	UseContext       bool              `json:"use_context"`
+	CompareId        uint              `json:"compare_id,omitempty"` // 多模型对比 ID
+	Branches         []uint            `json:"branches,omitempty"`   // 提问消息的所有分支，包括自己
 }
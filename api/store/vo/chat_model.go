@@ -7,6 +7,9 @@ type ChatModel struct {
 	Enabled     bool              `json:"enabled"`
 	SortNum     int               `json:"sort_num"`
 	Power       int               `json:"power"`
+	InputPower  float64           `json:"input_power"`  // 每 1K 输入 token 消耗算力
+	OutputPower float64           `json:"output_power"` // 每 1K 输出 token 消耗算力
+	CachedPower float64           `json:"cached_power"` // 每 1K 缓存命中 token 消耗算力
 	Open        bool              `json:"open"`
 	MaxTokens   int               `json:"max_tokens"`  // 最大响应长度
 	MaxContext  int               `json:"max_context"` // 最大上下文长度
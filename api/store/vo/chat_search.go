@@ -0,0 +1,15 @@
+package vo
+
+// ChatSearchItem 聊天记录搜索结果
+type ChatSearchItem struct {
+	Id        uint   `json:"id"` // 消息 ID
+	ChatId    string `json:"chat_id"`
+	Title     string `json:"title"` // 会话标题
+	UserId    uint   `json:"user_id"`
+	Username  string `json:"username,omitempty"`
+	RoleId    uint   `json:"role_id"`
+	Model     string `json:"model"`
+	Type      string `json:"type"`
+	Snippet   string `json:"snippet"` // 高亮的内容片段，已经做了 HTML 转义
+	CreatedAt int64  `json:"created_at"`
+}
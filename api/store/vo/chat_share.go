@@ -0,0 +1,19 @@
+package vo
+
+// ChatShare 对话分享
+type ChatShare struct {
+	BaseVo
+	ShareId   string        `json:"share_id"`
+	ChatId    string        `json:"chat_id,omitempty"` // 公开访问的时候不返回
+	MsgId     uint          `json:"msg_id,omitempty"`
+	Title     string        `json:"title"`
+	RoleId    uint          `json:"role_id"`
+	RoleName  string        `json:"role_name"`
+	Icon      string        `json:"icon"`
+	Model     string        `json:"model"`
+	Nickname  string        `json:"nickname,omitempty"` // 分享人的昵称
+	MsgNum    int           `json:"msg_num"`
+	Views     int           `json:"views"`
+	ExpiredAt int64         `json:"expired_at"`
+	Messages  []ChatMessage `json:"messages,omitempty"`
+}
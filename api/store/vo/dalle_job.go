@@ -11,4 +11,6 @@ type DallJob struct {
 	Progress  int    `json:"progress"`
 	ErrMsg    string `json:"err_msg"`
 	CreatedAt int64  `json:"created_at"`
+
+	QueuePosition int `json:"queue_position"` // 排队位置，从 1 开始，0 表示不在排队
 }
@@ -20,4 +20,5 @@ type Function struct {
 	Action      string     `json:"action"`
 	Token       string     `json:"token"`
 	Enabled     bool       `json:"enabled"`
+	McpServerId uint       `json:"mcp_server_id"` // 所属的 MCP 服务，为 0 表示自定义函数
 }
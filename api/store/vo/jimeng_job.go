@@ -20,4 +20,6 @@ type JimengJob struct {
 	Power     int                `json:"power"`
 	CreatedAt int64              `json:"created_at"` // 时间戳
 	UpdatedAt int64              `json:"updated_at"` // 时间戳
+
+	QueuePosition int `json:"queue_position"` // 排队位置，从 1 开始，0 表示不在排队
 }
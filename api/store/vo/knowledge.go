@@ -0,0 +1,29 @@
+package vo
+
+// KnowledgeBase 知识库
+type KnowledgeBase struct {
+	BaseVo
+	UserId       uint   `json:"user_id"`
+	Name         string `json:"name"`
+	Description  string `json:"description"`
+	ModelId      uint   `json:"model_id"` // 向量模型 ID
+	ModelName    string `json:"model_name"`
+	ChunkSize    int    `json:"chunk_size"`
+	ChunkOverlap int    `json:"chunk_overlap"`
+	TopK         int    `json:"top_k"`
+	DocNum       int    `json:"doc_num"`
+}
+
+// KnowledgeDoc 知识库文档
+type KnowledgeDoc struct {
+	BaseVo
+	KbId     uint   `json:"kb_id"`
+	Name     string `json:"name"`
+	URL      string `json:"url"`
+	Ext      string `json:"ext"`
+	Size     int64  `json:"size"`
+	Status   string `json:"status"`
+	ErrMsg   string `json:"err_msg"`
+	ChunkNum int    `json:"chunk_num"`
+	Tokens   int    `json:"tokens"`
+}
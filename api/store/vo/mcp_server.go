@@ -0,0 +1,17 @@
+package vo
+
+// McpServer MCP 服务
+type McpServer struct {
+	BaseVo
+	Name         string            `json:"name"`
+	Transport    string            `json:"transport"` // 传输方式：stdio, http, sse
+	Command      string            `json:"command"`
+	Args         []string          `json:"args"`
+	Env          map[string]string `json:"env"`
+	URL          string            `json:"url"`
+	Headers      map[string]string `json:"headers"`
+	Enabled      bool              `json:"enabled"`
+	ToolNum      int               `json:"tool_num"`
+	LastSyncedAt int64             `json:"last_synced_at"`
+	ErrMsg       string            `json:"err_msg"`
+}
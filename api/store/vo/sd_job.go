@@ -17,4 +17,6 @@ type SdJob struct {
 	ErrMsg    string             `json:"err_msg"`
 	Power     int                `json:"power"`
 	CreatedAt int64              `json:"created_at"`
+
+	QueuePosition int `json:"queue_position"` // 排队位置，从 1 开始，0 表示不在排队
 }
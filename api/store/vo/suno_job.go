@@ -27,4 +27,6 @@ type SunoJob struct {
 	User         map[string]interface{} `json:"user,omitempty"` //关联用户信息
 	PlayTimes    int                    `json:"play_times"`     // 播放次数
 	CreatedAt    int64                  `json:"created_at"`
+
+	QueuePosition int `json:"queue_position"` // 排队位置，从 1 开始，0 表示不在排队
 }
@@ -17,4 +17,6 @@ type VideoJob struct {
 	RawData   map[string]interface{} `json:"raw_data"`   // 原始数据 json
 	Power     int                    `json:"power"`      // 消耗算力
 	CreatedAt int64                  `json:"created_at"`
+
+	QueuePosition int `json:"queue_position"` // 排队位置，从 1 开始，0 表示不在排队
 }
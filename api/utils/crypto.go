@@ -12,6 +12,7 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/md5"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
@@ -96,3 +97,12 @@ func Md5(data string) string {
 	md5bs := md5.Sum([]byte(data))
 	return hex.EncodeToString(md5bs[:])
 }
+
+// RandomHex 生成密码学安全的随机字符串，用于访问令牌、分享链接等不可猜测的场景
+func RandomHex(bytesLen int) string {
+	buf := make([]byte, bytesLen)
+	if _, err := rand.Read(buf); err != nil {
+		return RandString(bytesLen * 2)
+	}
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,469 @@
+package utils
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/ledongthuc/pdf"
+)
+
+// ErrUnsupportedDocument 不支持在本地提取文本的文档格式
+var ErrUnsupportedDocument = errors.New("unsupported document format")
+
+// 压缩包里面单个文件解压之后的最大长度，防止压缩炸弹耗尽内存
+const maxZipEntrySize = 50 << 20
+
+var errZipEntryTooLarge = fmt.Errorf("document entry exceeds %d MB after decompression", maxZipEntrySize>>20)
+
+// 直接按照纯文本读取的文件格式
+var plainTextExts = []string{".txt", ".md", ".markdown", ".json", ".xml", ".yaml", ".yml", ".log", ".sql"}
+
+// ExtractText 在本地提取文档的文本内容，不依赖 Tika 服务
+// 表格统一转换成 HTML 表格，跟之前 Tika 解析 Excel 的结果保持一致
+func ExtractText(filePath string, ext string) (string, error) {
+	ext = strings.ToLower(ext)
+	switch ext {
+	case ".pdf":
+		return extractPdf(filePath)
+	case ".docx":
+		return extractDocx(filePath)
+	case ".xlsx":
+		return extractXlsx(filePath)
+	case ".pptx":
+		return extractPptx(filePath)
+	case ".csv":
+		return extractCsv(filePath)
+	case ".html", ".htm":
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			return "", err
+		}
+		return cleanHtml(string(data), true), nil
+	}
+	if slices.Contains(plainTextExts, ext) {
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			return "", err
+		}
+		return strings.ToValidUTF8(string(data), ""), nil
+	}
+	return "", ErrUnsupportedDocument
+}
+
+// 提取 PDF 文本，按行拼接。PDF 解析库遇到格式异常的文件会 panic，这里统一转换成错误
+func extractPdf(filePath string) (content string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("error with parse pdf: %v", r)
+		}
+	}()
+
+	f, reader, err := pdf.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var b strings.Builder
+	for i := 1; i <= reader.NumPage(); i++ {
+		page := reader.Page(i)
+		if page.V.IsNull() {
+			continue
+		}
+		rows, err := page.GetTextByRow()
+		if err != nil {
+			return "", err
+		}
+		for _, row := range rows {
+			line := ""
+			for _, word := range row.Content {
+				// 英文单词之间补上空格，中文直接拼接
+				if line != "" && word.S != "" && isWordRune(lastRune(line)) && isWordRune([]rune(word.S)[0]) {
+					line += " "
+				}
+				line += word.S
+			}
+			b.WriteString(line)
+			b.WriteString("\n")
+		}
+	}
+	return b.String(), nil
+}
+
+func lastRune(s string) rune {
+	runes := []rune(s)
+	return runes[len(runes)-1]
+}
+
+func isWordRune(r rune) bool {
+	return r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r))
+}
+
+// 读取压缩包里面的文件，文件头里面的长度可以伪造，所以读取的时候也要限制长度
+func readZipFile(r *zip.Reader, name string) ([]byte, error) {
+	for _, f := range r.File {
+		if f.Name != name {
+			continue
+		}
+		if f.UncompressedSize64 > maxZipEntrySize {
+			return nil, errZipEntryTooLarge
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		data, err := io.ReadAll(io.LimitReader(rc, maxZipEntrySize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > maxZipEntrySize {
+			return nil, errZipEntryTooLarge
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("%s not found", name)
+}
+
+// ooxmlText 解析 Word 和 PPT 的 XML 正文，段落换行，表格转换成 HTML 表格
+// Word 和 PPT 的标签名称不一样，但是结构相同：p 段落，t 文本，tbl/tr/tc 表格
+func ooxmlText(data []byte, b *strings.Builder) error {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	inText, inRun := false, false
+	tableDepth := 0
+	var cell strings.Builder
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// 表格里面的文本先写到单元格，最后再转义
+		out := b
+		if tableDepth > 0 {
+			out = &cell
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "r":
+				inRun = true
+			case "t":
+				inText = true
+			case "tab":
+				// 段落属性里面也有 tab 定义，只处理文本里面的制表符
+				if inRun {
+					out.WriteString("\t")
+				}
+			case "br", "cr":
+				out.WriteString("\n")
+			case "tbl":
+				if tableDepth == 0 {
+					b.WriteString("\n<table>")
+				}
+				tableDepth++
+			case "tr":
+				if tableDepth == 1 {
+					b.WriteString("<tr>")
+				}
+			case "tc":
+				if tableDepth == 1 {
+					cell.Reset()
+				}
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "r":
+				inRun = false
+			case "t":
+				inText = false
+			case "p":
+				if tableDepth > 0 {
+					cell.WriteString(" ")
+				} else {
+					b.WriteString("\n")
+				}
+			case "tc":
+				if tableDepth == 1 {
+					b.WriteString("<td>" + html.EscapeString(strings.TrimSpace(cell.String())) + "</td>")
+				}
+			case "tr":
+				if tableDepth == 1 {
+					b.WriteString("</tr>")
+				}
+			case "tbl":
+				tableDepth--
+				if tableDepth == 0 {
+					b.WriteString("</table>\n")
+				}
+			}
+		case xml.CharData:
+			if inText {
+				out.Write(t)
+			}
+		}
+	}
+}
+
+func extractDocx(filePath string) (string, error) {
+	r, err := zip.OpenReader(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	data, err := readZipFile(&r.Reader, "word/document.xml")
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err = ooxmlText(data, &b); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+var slideNameRegex = regexp.MustCompile(`^ppt/slides/slide(\d+)\.xml$`)
+
+func extractPptx(filePath string) (string, error) {
+	r, err := zip.OpenReader(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	// 按照幻灯片的序号排序，压缩包里面的文件顺序是 slide1, slide10, slide2...
+	slides := make(map[int]string)
+	nums := make([]int, 0)
+	for _, f := range r.File {
+		matches := slideNameRegex.FindStringSubmatch(f.Name)
+		if matches == nil {
+			continue
+		}
+		num, _ := strconv.Atoi(matches[1])
+		slides[num] = f.Name
+		nums = append(nums, num)
+	}
+	slices.Sort(nums)
+
+	var b strings.Builder
+	for _, num := range nums {
+		data, err := readZipFile(&r.Reader, slides[num])
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(fmt.Sprintf("第 %d 页\n", num))
+		if err = ooxmlText(data, &b); err != nil {
+			return "", err
+		}
+	}
+	return b.String(), nil
+}
+
+// Excel 的 XML 结构
+type xlsxSharedStrings struct {
+	Items []xlsxRichText `xml:"si"`
+}
+
+type xlsxRichText struct {
+	Text string         `xml:"t"`
+	Runs []xlsxRichText `xml:"r"`
+}
+
+func (t xlsxRichText) String() string {
+	s := t.Text
+	for _, r := range t.Runs {
+		s += r.Text
+	}
+	return s
+}
+
+type xlsxWorkbook struct {
+	Sheets []struct {
+		Name string `xml:"name,attr"`
+		RId  string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+type xlsxRelationships struct {
+	Items []struct {
+		Id     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+type xlsxSheet struct {
+	Rows []struct {
+		Cells []struct {
+			Ref    string       `xml:"r,attr"`
+			Type   string       `xml:"t,attr"`
+			Value  string       `xml:"v"`
+			Inline xlsxRichText `xml:"is"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+func extractXlsx(filePath string) (string, error) {
+	r, err := zip.OpenReader(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	// 共享字符串表，文件里面没有字符串的时候不存在
+	var sst xlsxSharedStrings
+	if data, err := readZipFile(&r.Reader, "xl/sharedStrings.xml"); err == nil {
+		if err = xml.Unmarshal(data, &sst); err != nil {
+			return "", err
+		}
+	} else if errors.Is(err, errZipEntryTooLarge) {
+		return "", err
+	}
+
+	var workbook xlsxWorkbook
+	var rels xlsxRelationships
+	data, err := readZipFile(&r.Reader, "xl/workbook.xml")
+	if err != nil {
+		return "", err
+	}
+	if err = xml.Unmarshal(data, &workbook); err != nil {
+		return "", err
+	}
+	data, err = readZipFile(&r.Reader, "xl/_rels/workbook.xml.rels")
+	if err != nil {
+		return "", err
+	}
+	if err = xml.Unmarshal(data, &rels); err != nil {
+		return "", err
+	}
+	targets := make(map[string]string)
+	for _, rel := range rels.Items {
+		if strings.HasPrefix(rel.Target, "/") {
+			targets[rel.Id] = strings.TrimPrefix(rel.Target, "/")
+		} else {
+			targets[rel.Id] = path.Join("xl", rel.Target)
+		}
+	}
+
+	var b strings.Builder
+	for _, s := range workbook.Sheets {
+		data, err := readZipFile(&r.Reader, targets[s.RId])
+		if err != nil {
+			return "", err
+		}
+		var sheet xlsxSheet
+		if err = xml.Unmarshal(data, &sheet); err != nil {
+			return "", err
+		}
+
+		rows := make([][]string, 0, len(sheet.Rows))
+		for _, row := range sheet.Rows {
+			cells := make([]string, 0, len(row.Cells))
+			for _, c := range row.Cells {
+				value := c.Value
+				switch c.Type {
+				case "s":
+					index, _ := strconv.Atoi(c.Value)
+					if index >= 0 && index < len(sst.Items) {
+						value = sst.Items[index].String()
+					}
+				case "inlineStr":
+					value = c.Inline.String()
+				}
+				// 空白单元格不会写入文件，按照单元格的列号补齐
+				if col := columnIndex(c.Ref); col > len(cells) {
+					cells = append(cells, make([]string, col-len(cells))...)
+				}
+				cells = append(cells, value)
+			}
+			rows = append(rows, cells)
+		}
+		if isEmptyTable(rows) {
+			continue
+		}
+		b.WriteString(s.Name + "\n")
+		writeTable(&b, rows)
+	}
+	return b.String(), nil
+}
+
+// 单元格引用的列序号，A1 => 0, AB3 => 27
+func columnIndex(ref string) int {
+	index := 0
+	for _, r := range ref {
+		if r < 'A' || r > 'Z' {
+			break
+		}
+		index = index*26 + int(r-'A'+1)
+	}
+	return index - 1
+}
+
+func extractCsv(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.LazyQuotes = true
+	reader.FieldsPerRecord = -1
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	writeTable(&b, rows)
+	return b.String(), nil
+}
+
+func isEmptyTable(rows [][]string) bool {
+	for _, row := range rows {
+		for _, cell := range row {
+			if strings.TrimSpace(cell) != "" {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// 把表格数据写成 HTML 表格，跳过空行
+func writeTable(b *strings.Builder, rows [][]string) {
+	b.WriteString("<table>")
+	for _, row := range rows {
+		if isEmptyTable([][]string{row}) {
+			continue
+		}
+		b.WriteString("<tr>")
+		for _, cell := range row {
+			b.WriteString("<td>" + html.EscapeString(strings.TrimSpace(cell)) + "</td>")
+		}
+		b.WriteString("</tr>")
+	}
+	b.WriteString("</table>\n")
+}
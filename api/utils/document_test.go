@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"archive/zip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 生成 Office 文档的测试文件，只包含提取文本需要的部分
+func writeZip(t *testing.T, name string, files map[string]string) string {
+	t.Helper()
+	filePath := filepath.Join(t.TempDir(), name)
+	f, err := os.Create(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	w := zip.NewWriter(f)
+	for entry, content := range files {
+		fw, err := w.Create(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = fw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return filePath
+}
+
+func assertContains(t *testing.T, text string, wants ...string) {
+	t.Helper()
+	for _, want := range wants {
+		if !strings.Contains(text, want) {
+			t.Errorf("extracted text %q does not contain %q", text, want)
+		}
+	}
+}
+
+func TestExtractDocx(t *testing.T) {
+	filePath := writeZip(t, "test.docx", map[string]string{
+		"word/document.xml": `<?xml version="1.0" encoding="UTF-8"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>
+<w:p><w:r><w:t>Hello</w:t></w:r><w:r><w:tab/><w:t>World</w:t></w:r></w:p>
+<w:tbl><w:tr><w:tc><w:p><w:r><w:t>A&amp;B</w:t></w:r></w:p></w:tc><w:tc><w:p><w:r><w:t>单元格</w:t></w:r></w:p></w:tc></w:tr></w:tbl>
+</w:body></w:document>`,
+	})
+
+	text, err := ExtractText(filePath, ".DOCX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertContains(t, text, "Hello\tWorld\n", "<table><tr><td>A&amp;B</td><td>单元格</td></tr></table>")
+}
+
+func TestExtractXlsx(t *testing.T) {
+	filePath := writeZip(t, "test.xlsx", map[string]string{
+		"xl/workbook.xml": `<?xml version="1.0" encoding="UTF-8"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<sheets><sheet name="Sheet1" sheetId="1" r:id="rId1"/></sheets></workbook>`,
+		"xl/_rels/workbook.xml.rels": `<?xml version="1.0" encoding="UTF-8"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`,
+		"xl/sharedStrings.xml": `<?xml version="1.0" encoding="UTF-8"?>
+<sst xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><si><t>姓名</t></si><si><r><t>张</t></r><r><t>三</t></r></si></sst>`,
+		"xl/worksheets/sheet1.xml": `<?xml version="1.0" encoding="UTF-8"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>
+<row r="1"><c r="A1" t="s"><v>0</v></c><c r="C1" t="inlineStr"><is><t>备注</t></is></c></row>
+<row r="2"><c r="A2" t="s"><v>1</v></c><c r="B2"><v>18</v></c></row>
+</sheetData></worksheet>`,
+	})
+
+	text, err := ExtractText(filePath, ".xlsx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertContains(t, text, "Sheet1\n", "<tr><td>姓名</td><td></td><td>备注</td></tr>", "<tr><td>张三</td><td>18</td></tr>")
+}
+
+func TestExtractPptx(t *testing.T) {
+	slide := func(text string) string {
+		return `<?xml version="1.0" encoding="UTF-8"?>
+<p:sld xmlns:a="http://schemas.openxmlformats.org/drawingml/2006/main" xmlns:p="http://schemas.openxmlformats.org/presentationml/2006/main">
+<p:cSld><p:spTree><p:sp><p:txBody><a:p><a:r><a:t>` + text + `</a:t></a:r></a:p></p:txBody></p:sp></p:spTree></p:cSld></p:sld>`
+	}
+	filePath := writeZip(t, "test.pptx", map[string]string{
+		"ppt/slides/slide1.xml":  slide("First"),
+		"ppt/slides/slide2.xml":  slide("Second"),
+		"ppt/slides/slide10.xml": slide("Tenth"),
+	})
+
+	text, err := ExtractText(filePath, ".pptx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 幻灯片按照序号排列，而不是文件名的字典序
+	first, second, tenth := strings.Index(text, "First"), strings.Index(text, "Second"), strings.Index(text, "Tenth")
+	if first < 0 || second < first || tenth < second {
+		t.Errorf("slides are out of order: %q", text)
+	}
+	assertContains(t, text, "第 1 页\nFirst\n", "第 10 页\nTenth\n")
+}
+
+// 解压之后超出长度限制的文件直接报错，不能全部读进内存
+func TestExtractOversizedEntry(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "bomb.docx")
+	f, err := os.Create(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := zip.NewWriter(f)
+	fw, err := w.Create("word/document.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.CopyN(fw, zeroReader{}, maxZipEntrySize+1); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	_, err = ExtractText(filePath, ".docx")
+	if !errors.Is(err, errZipEntryTooLarge) {
+		t.Fatalf("expected errZipEntryTooLarge, got %v", err)
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
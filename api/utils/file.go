@@ -2,51 +2,72 @@ package utils
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/microcosm-cc/bluemonday"
 	"io"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
 	"github.com/google/go-tika/tika"
 )
 
+// ReadFileContent 读取文件的文本内容
+// 优先在本地提取文本，本地不支持的格式或者提取失败，再使用 Tika 服务解析（如果配置了的话）
 func ReadFileContent(filePath string, tikaHost string) (string, error) {
+	ext := strings.ToLower(path.Ext(strings.SplitN(filePath, "?", 2)[0]))
 	// for remote file, download it first
 	if strings.HasPrefix(filePath, "http") {
 		file, err := downloadFile(filePath)
 		if err != nil {
 			return "", err
 		}
+		defer os.Remove(file)
 		filePath = file
 	}
+
+	content, err := ExtractText(filePath, ext)
+	if err == nil {
+		return cleanBlankLine(content), nil
+	}
+	if tikaHost == "" {
+		if errors.Is(err, ErrUnsupportedDocument) {
+			return "", fmt.Errorf("不支持的文件格式：%s", ext)
+		}
+		return "", err
+	}
+	if !errors.Is(err, ErrUnsupportedDocument) {
+		logger.Warnf("本地提取文件 %s 内容失败，使用 Tika 解析：%v", filePath, err)
+	}
+	return readWithTika(filePath, ext, tikaHost)
+}
+
+// 使用 Tika 服务解析文件
+func readWithTika(filePath string, ext string, tikaHost string) (string, error) {
 	// 创建 Tika 客户端
 	client := tika.NewClient(nil, tikaHost)
-	// 打开 PDF 文件
 	file, err := os.Open(filePath)
 	if err != nil {
 		return "", fmt.Errorf("error with open file: %v", err)
 	}
 	defer file.Close()
 
-	// 使用 Tika 提取 PDF 文件的文本内容
 	content, err := client.Parse(context.TODO(), file)
 	if err != nil {
 		return "", fmt.Errorf("error with parse file: %v", err)
 	}
 
-	ext := filepath.Ext(filePath)
 	switch ext {
-	case ".doc", ".docx", ".pdf", ".pptx", "ppt":
+	case ".doc", ".docx", ".pdf", ".pptx", ".ppt":
 		return cleanBlankLine(cleanHtml(content, false)), nil
 	case ".xls", ".xlsx":
 		return cleanBlankLine(cleanHtml(content, true)), nil
 	default:
 		return cleanBlankLine(content), nil
 	}
-
 }
 
 // 清理文本内容
@@ -84,23 +105,25 @@ func cleanBlankLine(content string) string {
 
 // 下载文件
 func downloadFile(url string) (string, error) {
-	base := filepath.Base(url)
-	dir := os.TempDir()
-	filename := filepath.Join(dir, base)
-	out, err := os.Create(filename)
+	// 获取数据
+	resp, err := http.Get(url)
 	if err != nil {
 		return "", err
 	}
-	defer out.Close()
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error with download file: %s", resp.Status)
+	}
 
-	// 获取数据
-	resp, err := http.Get(url)
+	// 使用随机的临时文件名，避免并发下载同名文件互相覆盖
+	base := filepath.Base(strings.SplitN(url, "?", 2)[0])
+	out, err := os.CreateTemp("", "*-"+base)
 	if err != nil {
 		return "", err
 	}
-	defer resp.Body.Close()
+	defer out.Close()
 
 	// 写入数据到文件
 	_, err = io.Copy(out, resp.Body)
-	return filename, err
+	return out.Name(), err
 }
@@ -8,17 +8,9 @@ package utils
 // * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
 
 import (
-	"encoding/json"
 	"fmt"
-	"geekai/core/types"
-	"geekai/store/model"
-	"io"
-	"net/url"
-	"time"
 
-	"github.com/imroc/req/v3"
 	"github.com/pkoukk/tiktoken-go"
-	"gorm.io/gorm"
 )
 
 func CalcTokens(text string, model string) (int, error) {
@@ -46,71 +38,3 @@ type OpenAIResponse struct {
 		FinishReason string `json:"finish_reason"`
 	} `json:"choices"`
 }
-
-func OpenAIRequest(db *gorm.DB, prompt string, modelId int) (string, error) {
-	messages := make([]any, 1)
-	messages[0] = types.Message{
-		Role:    "user",
-		Content: prompt,
-	}
-	return SendOpenAIMessage(db, messages, modelId)
-}
-
-func SendOpenAIMessage(db *gorm.DB, messages []any, modelId int) (string, error) {
-	var chatModel model.ChatModel
-	db.Where("id", modelId).First(&chatModel)
-	if chatModel.Value == "" {
-		chatModel.Value = "gpt-4o" // 默认使用 gpt-4o
-	}
-	var apiKey model.ApiKey
-	session := db.Session(&gorm.Session{}).Where("type", "chat").Where("enabled", true)
-	if chatModel.KeyId > 0 {
-		session = session.Where("id", chatModel.KeyId)
-	}
-	err := session.First(&apiKey).Error
-	if err != nil {
-		return "", fmt.Errorf("error with fetch OpenAI API KEY：%v", err)
-	}
-
-	var response OpenAIResponse
-	client := req.C()
-	if len(apiKey.ProxyURL) > 5 {
-		client.SetProxyURL(apiKey.ProxyURL)
-	}
-	var apiURL string
-	p, _ := url.Parse(apiKey.ApiURL)
-	// 如果设置的是 BASE_URL 没有路径，则添加 /v1/chat/completions
-	if p.Path == "" {
-		apiURL = fmt.Sprintf("%s/v1/chat/completions", apiKey.ApiURL)
-	} else {
-		apiURL = apiKey.ApiURL
-	}
-	logger.Infof("Sending %s request, API KEY:%s, PROXY: %s, Model: %s", apiURL, apiKey.ApiURL, apiKey.ProxyURL, chatModel.Name)
-	r, err := client.R().SetHeader("Body-Type", "application/json").
-		SetHeader("Authorization", "Bearer "+apiKey.Value).
-		SetBody(types.ApiRequest{
-			Model:       chatModel.Value,
-			Temperature: 0.9,
-			MaxTokens:   1024,
-			Stream:      false,
-			Messages:    messages,
-		}).Post(apiURL)
-	if err != nil {
-		return "", fmt.Errorf("请求 OpenAI API失败：%v", err)
-	}
-
-	if r.IsErrorState() {
-		return "", fmt.Errorf("请求 OpenAI API失败：%v", r.Status)
-	}
-
-	body, _ := io.ReadAll(r.Body)
-	err = json.Unmarshal(body, &response)
-	if err != nil {
-		return "", fmt.Errorf("解析API数据失败：%v, %s", err, string(body))
-	}
-
-	// 更新 API KEY 的最后使用时间
-	db.Model(&apiKey).UpdateColumn("last_used_at", time.Now().Unix())
-
-	return response.Choices[0].Message.Content, nil
-}
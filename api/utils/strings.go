@@ -128,6 +128,14 @@ func CutWords(str string, num int) string {
 	}
 }
 
+// MaskToken 只保留令牌的首尾部分，用于列表展示
+func MaskToken(token string) string {
+	if len(token) <= 11 {
+		return "****"
+	}
+	return token[:7] + "****" + token[len(token)-4:]
+}
+
 // HasChinese 判断文本是否含有中文
 func HasChinese(text string) bool {
 	for _, char := range text {
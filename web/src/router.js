@@ -74,6 +74,12 @@ const routes = [
         meta: { title: '消费日志' },
         component: () => import('@/views/PowerLog.vue'),
       },
+      {
+        name: 'apiToken',
+        path: '/apiToken',
+        meta: { title: '访问令牌' },
+        component: () => import('@/views/ApiToken.vue'),
+      },
       {
         name: 'xmind',
         path: '/xmind',
@@ -123,6 +129,12 @@ const routes = [
     meta: { title: '导出会话记录' },
     component: () => import('@/views/ChatExport.vue'),
   },
+  {
+    name: 'chat-share',
+    path: '/chat/share/:id',
+    meta: { title: '分享的对话' },
+    component: () => import('@/views/ChatShare.vue'),
+  },
 
   {
     name: 'login',
@@ -306,6 +318,18 @@ const routes = [
         meta: { title: '函数管理' },
         component: () => import('@/views/admin/Functions.vue'),
       },
+      {
+        path: '/admin/mcp',
+        name: 'admin-mcp',
+        meta: { title: 'MCP 服务' },
+        component: () => import('@/views/admin/McpServers.vue'),
+      },
+      {
+        path: '/admin/knowledge',
+        name: 'admin-knowledge',
+        meta: { title: '知识库' },
+        component: () => import('@/views/admin/Knowledge.vue'),
+      },
       {
         path: '/admin/chats',
         name: 'admin-chats',
@@ -10,6 +10,7 @@ import { JimengFunctions, JimengParams } from '@/store/data/jimeng_params'
 import { useSharedStore } from '@/store/sharedata'
 import { showMessageError, showMessageOK } from '@/utils/dialog'
 import { httpDownload, httpGet, httpPost } from '@/utils/http'
+import { onJobEvent } from '@/utils/job_events'
 import { replaceImg, substr } from '@/utils/libs'
 import { ElMessageBox } from 'element-plus'
 import { defineStore } from 'pinia'
@@ -98,8 +99,8 @@ export const useJimengStore = defineStore('jimeng', () => {
     fetchData(1)
   }
 
-  // 轮询定时器
-  let pollHandler = null
+  // 取消订阅任务事件
+  let stopJobEvents = null
   // 获取任务列表
   const fetchData = async (pageNum = 1) => {
     try {
@@ -137,42 +138,38 @@ export const useJimengStore = defineStore('jimeng', () => {
     }
   }
 
-  // 简单轮询逻辑
-  const startPolling = () => {
-    if (pollHandler) {
-      clearInterval(pollHandler)
+  // 收到任务事件之后更新列表中的任务，不在列表中的新任务重新加载第一页
+  const refreshJob = async (event) => {
+    if (event.type === 'refunded') {
+      return
     }
-    pollHandler = setInterval(async () => {
-      const response = await httpPost('/api/jimeng/jobs', {
-        page: 1,
-        page_size: 20,
-      })
-      const data = response.data
-      if (!data.items || data.items.length === 0) {
-        stopPolling()
-        return
+    if (!currentList.value.some((item) => item.id === event.job_id)) {
+      isOver.value = false
+      await fetchData(1)
+      return
+    }
+    const response = await httpPost('/api/jimeng/jobs', {
+      page: 1,
+      page_size: 20,
+    })
+    const items = response.data.items || []
+    currentList.value.forEach((item) => {
+      const index = items.findIndex((i) => i.id === item.id)
+      if (index !== -1) {
+        Object.assign(item, items[index])
       }
+    })
+  }
 
-      const todoList = data.items.filter(
-        (item) => item.status === 'in_queue' || item.status === 'generating'
-      )
-      // 更新当前列表
-      currentList.value.forEach((item) => {
-        const index = data.items.findIndex((i) => i.id === item.id)
-        if (index !== -1) {
-          Object.assign(item, data.items[index])
-        }
-      })
-      if (todoList.length === 0) {
-        stopPolling()
-      }
-    }, 3000)
+  const subscribeJobEvents = () => {
+    unsubscribeJobEvents()
+    stopJobEvents = onJobEvent(['jimeng'], refreshJob)
   }
 
-  const stopPolling = () => {
-    if (pollHandler) {
-      clearInterval(pollHandler)
-      pollHandler = null
+  const unsubscribeJobEvents = () => {
+    if (stopJobEvents) {
+      stopJobEvents()
+      stopJobEvents = null
     }
   }
 
@@ -207,7 +204,6 @@ export const useJimengStore = defineStore('jimeng', () => {
       showMessageOK('任务提交成功')
       isOver.value = false
       await fetchData(1)
-      startPolling()
     } catch (error) {
       console.error('提交任务失败:', error)
       showMessageError(error.message || '提交任务失败')
@@ -249,7 +245,6 @@ export const useJimengStore = defineStore('jimeng', () => {
         showMessageOK('重试任务已提交')
         isOver.value = false
         await fetchData(1)
-        startPolling()
       }
     } catch (error) {
       console.error('重试任务失败:', error)
@@ -313,14 +308,14 @@ export const useJimengStore = defineStore('jimeng', () => {
       isLogin.value = true
       // 获取任务列表
       await fetchData(1)
-      // 开始轮询
-      startPolling()
+      // 订阅任务事件
+      subscribeJobEvents()
     } catch (error) {
       console.error('初始化失败:', error)
     }
   }
 
-  // 页面卸载时清理轮询
+  // 页面卸载时取消订阅任务事件
   const cleanup = () => {
     page.value = 1
     pageSize.value = 10
@@ -329,7 +324,7 @@ export const useJimengStore = defineStore('jimeng', () => {
     currentList.value = []
     isOver.value = false
     loading.value = false
-    stopPolling()
+    unsubscribeJobEvents()
   }
 
   // 返回所有状态和方法
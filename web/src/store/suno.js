@@ -1,5 +1,6 @@
 import { closeLoading, showLoading, showMessageError, showMessageOK } from '@/utils/dialog'
 import { httpDownload, httpGet, httpPost } from '@/utils/http'
+import { onJobEvent } from '@/utils/job_events'
 import { replaceImg } from '@/utils/libs'
 import Compressor from 'compressorjs'
 import { ElMessage, ElMessageBox } from 'element-plus'
@@ -55,7 +56,6 @@ export const useSunoStore = defineStore('suno', () => {
   const playList = ref([])
   const showPlayer = ref(false)
   const list = ref([])
-  const taskPulling = ref(true)
   const btnText = ref('开始创作')
   const refSong = ref(null)
   const showDialog = ref(false)
@@ -71,8 +71,8 @@ export const useSunoStore = defineStore('suno', () => {
   const pageSize = ref(10)
   const total = ref(0)
 
-  // 定时器引用
-  let tastPullHandler = null
+  // 取消订阅任务事件
+  let stopJobEvents = null
 
   // 计算属性
   const hasRefSong = computed(() => refSong.value !== null)
@@ -100,21 +100,16 @@ export const useSunoStore = defineStore('suno', () => {
       })
 
       total.value = res.data.total
-      let needPull = false
       const items = []
 
       for (let v of res.data.items) {
         if (v.progress === 100) {
           v.major_model_version = v['raw_data']['major_model_version']
         }
-        if (v.progress === 0 || v.progress === 102) {
-          needPull = true
-        }
         items.push(v)
       }
 
       loading.value = false
-      taskPulling.value = needPull
 
       // 如果任务有变化，则刷新任务列表
       if (JSON.stringify(list.value) !== JSON.stringify(items)) {
@@ -159,7 +154,6 @@ export const useSunoStore = defineStore('suno', () => {
     try {
       await httpPost('/api/suno/create', data.value)
       await fetchData(1)
-      taskPulling.value = true
       showMessageOK('创建任务成功')
     } catch (e) {
       showMessageError('创建任务失败：' + e.message)
@@ -170,7 +164,6 @@ export const useSunoStore = defineStore('suno', () => {
     try {
       await httpPost('/api/suno/create', { song_id: item.song_id, type: 3 })
       await fetchData(1)
-      taskPulling.value = true
       showMessageOK('创建任务成功')
     } catch (e) {
       showMessageError('合并歌曲失败：' + e.message)
@@ -361,18 +354,20 @@ export const useSunoStore = defineStore('suno', () => {
     }
   }
 
-  const startTaskPolling = () => {
-    tastPullHandler = setInterval(() => {
-      if (taskPulling.value) {
-        fetchData(1)
+  // 订阅任务事件，任务状态变化的时候刷新当前页
+  const subscribeJobEvents = () => {
+    unsubscribeJobEvents()
+    stopJobEvents = onJobEvent(['suno'], (event) => {
+      if (event.type !== 'refunded') {
+        fetchData()
       }
-    }, 5000)
+    })
   }
 
-  const stopTaskPolling = () => {
-    if (tastPullHandler) {
-      clearInterval(tastPullHandler)
-      tastPullHandler = null
+  const unsubscribeJobEvents = () => {
+    if (stopJobEvents) {
+      stopJobEvents()
+      stopJobEvents = null
     }
   }
 
@@ -405,7 +400,6 @@ export const useSunoStore = defineStore('suno', () => {
     playList,
     showPlayer,
     list,
-    taskPulling,
     btnText,
     refSong,
     showDialog,
@@ -433,8 +427,8 @@ export const useSunoStore = defineStore('suno', () => {
     getShareURL,
     uploadCover,
     createLyric,
-    startTaskPolling,
-    stopTaskPolling,
+    subscribeJobEvents,
+    unsubscribeJobEvents,
     resetData,
   }
 })
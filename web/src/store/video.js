@@ -10,6 +10,7 @@ import { checkSession, getSystemInfo } from '@/store/cache'
 import { useSharedStore } from '@/store/sharedata'
 import { closeLoading, showLoading, showMessageError, showMessageOK } from '@/utils/dialog'
 import { httpDownload, httpGet, httpPost } from '@/utils/http'
+import { onJobEvent } from '@/utils/job_events'
 import { replaceImg, substr } from '@/utils/libs'
 import Clipboard from 'clipboard'
 import { ElMessage, ElMessageBox } from 'element-plus'
@@ -27,8 +28,7 @@ export const useVideoStore = defineStore('video', () => {
   const page = ref(1)
   const pageSize = ref(10)
   const total = ref(0)
-  const taskPulling = ref(true)
-  const pullHandler = ref(null)
+  let stopJobEvents = null // 取消订阅任务事件
   const clipboard = ref(null)
 
   // 视频预览
@@ -137,9 +137,9 @@ export const useVideoStore = defineStore('video', () => {
       keLingPowers.value = sysInfo.data.keling_powers
       updateModelPower()
 
-      // 获取数据并开始轮询
+      // 获取数据并订阅任务事件
       await fetchData(1)
-      startPolling()
+      subscribeJobEvents()
     } catch (error) {
       console.error('初始化失败:', error)
     }
@@ -150,26 +150,23 @@ export const useVideoStore = defineStore('video', () => {
     if (clipboard.value) {
       clipboard.value.destroy()
     }
-    stopPolling()
+    unsubscribeJobEvents()
   }
 
-  // 开始轮询
-  const startPolling = () => {
-    if (pullHandler.value) {
-      clearInterval(pullHandler.value)
-    }
-    pullHandler.value = setInterval(() => {
-      if (taskPulling.value) {
+  // 订阅任务事件，任务状态变化的时候刷新当前页
+  const subscribeJobEvents = () => {
+    unsubscribeJobEvents()
+    stopJobEvents = onJobEvent(['video'], (event) => {
+      if (event.type !== 'refunded') {
         fetchData(page.value)
       }
-    }, 5000)
+    })
   }
 
-  // 停止轮询
-  const stopPolling = () => {
-    if (pullHandler.value) {
-      clearInterval(pullHandler.value)
-      pullHandler.value = null
+  const unsubscribeJobEvents = () => {
+    if (stopJobEvents) {
+      stopJobEvents()
+      stopJobEvents = null
     }
   }
 
@@ -187,13 +184,9 @@ export const useVideoStore = defineStore('video', () => {
       })
 
       total.value = res.data.total
-      let needPull = false
       const items = []
 
       for (let v of res.data.items) {
-        if (v.progress === 0 || v.progress === 102) {
-          needPull = true
-        }
         items.push({
           ...v,
           downloading: false,
@@ -201,7 +194,6 @@ export const useVideoStore = defineStore('video', () => {
       }
 
       loading.value = false
-      taskPulling.value = needPull
 
       if (JSON.stringify(list.value) !== JSON.stringify(items)) {
         list.value = items
@@ -299,7 +291,6 @@ export const useVideoStore = defineStore('video', () => {
     try {
       await httpPost('/api/video/luma/create', requestData)
       await fetchData(1)
-      taskPulling.value = true
       showMessageOK('创建任务成功')
     } catch (error) {
       showMessageError('创建任务失败：' + error.message)
@@ -423,7 +414,6 @@ export const useVideoStore = defineStore('video', () => {
           mode: requestData.mode,
         },
       })
-      taskPulling.value = true
     } catch (error) {
       showMessageError('创建失败: ' + error.message)
     } finally {
@@ -538,7 +528,6 @@ export const useVideoStore = defineStore('video', () => {
     page,
     pageSize,
     total,
-    taskPulling,
     showDialog,
     currentVideoUrl,
     isLogin,
@@ -0,0 +1,76 @@
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import { getUserToken } from '@/store/session'
+import { fetchEventSource } from '@microsoft/fetch-event-source'
+
+// 任务事件推送，代替轮询任务列表。所有页面共用一个连接，
+// 断线之后自动重连，重连的时候带上 Last-Event-ID，从最后收到的事件之后继续接收
+const listeners = new Set()
+let controller = null
+
+const connect = () => {
+  controller = new AbortController()
+  const signal = controller.signal
+  fetchEventSource('/api/job/events', {
+    method: 'GET',
+    headers: {
+      Authorization: getUserToken(),
+    },
+    openWhenHidden: true,
+    signal,
+    onopen(response) {
+      if (!response.ok) {
+        throw new Error('连接任务事件失败：' + response.status)
+      }
+    },
+    onmessage(msg) {
+      if (!msg.data) {
+        return
+      }
+      const event = JSON.parse(msg.data)
+      listeners.forEach((listener) => {
+        if (listener.types.includes(event.job_type)) {
+          listener.callback(event)
+        }
+      })
+    },
+    onclose() {
+      // 服务端断开（比如重启）之后重新连接
+      throw new Error('连接已断开')
+    },
+    onerror() {
+      return 3000
+    },
+  }).catch((e) => {
+    console.error('任务事件连接中断：', e)
+    if (controller && controller.signal === signal) {
+      controller = null
+    }
+  })
+}
+
+/**
+ * 订阅任务事件，返回取消订阅的函数
+ * @param types 任务类型：mj, sd, dalle, suno, video, jimeng
+ * @param callback 回调参数为事件：{ type, job_type, job_id, status, progress, message, power }，
+ * type 为 created, progress, finished, failed, refunded
+ */
+export function onJobEvent(types, callback) {
+  const listener = { types, callback }
+  listeners.add(listener)
+  if (!controller) {
+    connect()
+  }
+  return () => {
+    listeners.delete(listener)
+    if (listeners.size === 0 && controller) {
+      controller.abort()
+      controller = null
+    }
+  }
+}